@@ -0,0 +1,65 @@
+// Package api contains the types of the REST API that are shared by the server and the client.
+package api
+
+// NodeStat represents the packet counts of a node since the last reset.
+type NodeStat struct {
+	Received  int `json:"received"`
+	Collision int `json:"collision"`
+	Sending   int `json:"sending"`
+}
+
+// StatsWindow limits the statistics to the packets whose transmission started between From and To as
+// unix timestamps in ms. A zero value leaves that side of the window open.
+type StatsWindow struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// Contains returns true if the time lies inside the window.
+func (w StatsWindow) Contains(t int64) bool {
+	return (w.From == 0 || t >= w.From) && (w.To == 0 || t <= w.To)
+}
+
+// ValueSummary represents the minimum, mean and maximum of measured values.
+type ValueSummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	Max  float64 `json:"max"`
+}
+
+// NodeStats represents the statistics of a node.
+type NodeStats struct {
+	// Sent is the number of packets the node sent.
+	Sent int `json:"sent"`
+	// Delivered is the number of sent packets that were received by at least one node.
+	Delivered int `json:"delivered"`
+	// DeliveryRatio is Delivered divided by Sent.
+	DeliveryRatio float64 `json:"deliveryRatio"`
+	// Received is the number of packets the node received.
+	Received int `json:"received"`
+	// Collisions is the number of packets the node lost because of collisions.
+	Collisions int `json:"collisions"`
+	// AirtimeMs is the time the node was sending.
+	AirtimeMs float64 `json:"airtimeMs"`
+	// RSSI and SNR of the received packets. They are nil if the node didn't receive anything.
+	RSSI *ValueSummary `json:"rssi"`
+	SNR  *ValueSummary `json:"snr"`
+}
+
+// LinkStats represents the statistics of the packets from one node to another.
+type LinkStats struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Sent is the number of packets the sender sent.
+	Sent int `json:"sent"`
+	// Received is the number of packets that arrived at the receiver. Duplicates from the fault injection
+	// are counted.
+	Received int `json:"received"`
+	// Collisions is the number of packets the receiver lost because of collisions.
+	Collisions int `json:"collisions"`
+	// DeliveryRatio is the share of the sent packets that arrived at the receiver.
+	DeliveryRatio float64 `json:"deliveryRatio"`
+	// RSSI and SNR of the received packets. They are nil if nothing was received.
+	RSSI *ValueSummary `json:"rssi"`
+	SNR  *ValueSummary `json:"snr"`
+}
@@ -0,0 +1,237 @@
+// Package client implements a Go client for the LoRa emu server. It wraps the REST API and connects
+// nodes over the /api/emu/:id websocket.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BigJk/loraemu/api"
+	"github.com/BigJk/loraemu/emu"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Client represents a connection to a LoRa emu server.
+type Client struct {
+	sync.RWMutex
+
+	baseURL        string
+	http           *http.Client
+	logger         logr.Logger
+	reconnectDelay time.Duration
+}
+
+// New creates a new client for the server at the base url (e.g. http://127.0.0.1:8291).
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		http:           &http.Client{Timeout: time.Second * 10},
+		logger:         logr.Discard(),
+		reconnectDelay: time.Second,
+	}
+}
+
+// SetLogger sets the logger of the client and the node connections created afterwards.
+func (c *Client) SetLogger(logger logr.Logger) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.logger = logger
+}
+
+// SetHTTPClient sets the http client that is used for the REST API.
+func (c *Client) SetHTTPClient(client *http.Client) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.http = client
+}
+
+// SetReconnectDelay sets the delay between reconnection attempts of node connections created afterwards.
+func (c *Client) SetReconnectDelay(delay time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.reconnectDelay = delay
+}
+
+// Nodes returns all nodes.
+func (c *Client) Nodes() ([]emu.Node, error) {
+	var nodes []emu.Node
+	return nodes, c.request(http.MethodGet, "/api/nodes", nil, &nodes)
+}
+
+// NodeIDs returns the ids of all nodes.
+func (c *Client) NodeIDs() ([]string, error) {
+	var ids []string
+	return ids, c.request(http.MethodGet, "/api/node_ids", nil, &ids)
+}
+
+// Node returns a node by id.
+func (c *Client) Node(id string) (emu.Node, error) {
+	var node emu.Node
+	return node, c.request(http.MethodGet, "/api/node/"+url.PathEscape(id), nil, &node)
+}
+
+// CreateNode creates a new node.
+func (c *Client) CreateNode(node emu.Node) error {
+	return c.request(http.MethodPost, "/api/node/create", node, nil)
+}
+
+// UpdateNode replaces the node with the same id.
+func (c *Client) UpdateNode(node emu.Node) error {
+	return c.request(http.MethodPut, "/api/node/update", node, nil)
+}
+
+// MoveNode sets the position of a node.
+func (c *Client) MoveNode(id string, x float64, y float64, z float64) error {
+	node, err := c.Node(id)
+	if err != nil {
+		return err
+	}
+
+	node.X = x
+	node.Y = y
+	node.Z = z
+
+	return c.UpdateNode(node)
+}
+
+// DeleteNode deletes a node by id.
+func (c *Client) DeleteNode(id string) error {
+	return c.request(http.MethodDelete, "/api/node/"+url.PathEscape(id), nil, nil)
+}
+
+// Queue returns the pending transmissions of a node by id.
+func (c *Client) Queue(id string) ([]emu.QueuedTx, error) {
+	var queue []emu.QueuedTx
+	return queue, c.request(http.MethodGet, "/api/node/"+url.PathEscape(id)+"/queue", nil, &queue)
+}
+
+// FlushQueue removes all pending transmissions of a node by id and returns how many were removed.
+func (c *Client) FlushQueue(id string) (int, error) {
+	var result struct {
+		Flushed int `json:"flushed"`
+	}
+	return result.Flushed, c.request(http.MethodDelete, "/api/node/"+url.PathEscape(id)+"/queue", nil, &result)
+}
+
+// CancelTx removes a pending transmission of a node.
+func (c *Client) CancelTx(id string, txID uint64) error {
+	return c.request(http.MethodDelete, fmt.Sprintf("/api/node/%s/queue/%d", url.PathEscape(id), txID), nil, nil)
+}
+
+// Pause returns if the mobility is paused.
+func (c *Client) Pause() (bool, error) {
+	var state bool
+	return state, c.request(http.MethodGet, "/api/emu/pause", nil, &state)
+}
+
+// SetPause pauses or resumes the mobility.
+func (c *Client) SetPause(state bool) error {
+	return c.request(http.MethodPost, "/api/emu/pause", map[string]interface{}{"state": state}, nil)
+}
+
+// Graph returns the connectivity graph of the online nodes.
+func (c *Client) Graph() (emu.Graph, error) {
+	var graph emu.Graph
+	return graph, c.request(http.MethodGet, "/api/graph", nil, &graph)
+}
+
+// Stats returns the packet statistics of all nodes.
+func (c *Client) Stats() (map[string]api.NodeStat, error) {
+	stats := map[string]api.NodeStat{}
+	return stats, c.request(http.MethodGet, "/api/stats", nil, &stats)
+}
+
+// NodeStats returns the statistics of all nodes in the window.
+func (c *Client) NodeStats(window api.StatsWindow) (map[string]api.NodeStats, error) {
+	stats := map[string]api.NodeStats{}
+	return stats, c.request(http.MethodGet, "/api/stats/nodes"+statsQuery(window), nil, &stats)
+}
+
+// LinkStats returns the statistics of all links in the window.
+func (c *Client) LinkStats(window api.StatsWindow) ([]api.LinkStats, error) {
+	var stats []api.LinkStats
+	return stats, c.request(http.MethodGet, "/api/stats/links"+statsQuery(window), nil, &stats)
+}
+
+// ResetStats resets the statistics of the server.
+func (c *Client) ResetStats() error {
+	return c.request(http.MethodPost, "/api/stats/reset", nil, nil)
+}
+
+func statsQuery(window api.StatsWindow) string {
+	query := url.Values{}
+	if window.From != 0 {
+		query.Set("from", strconv.FormatInt(window.From, 10))
+	}
+	if window.To != 0 {
+		query.Set("to", strconv.FormatInt(window.To, 10))
+	}
+
+	if len(query) == 0 {
+		return ""
+	}
+
+	return "?" + query.Encode()
+}
+
+func (c *Client) request(method string, path string, body interface{}, target interface{}) error {
+	c.RLock()
+	httpClient := c.http
+	c.RUnlock()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// errors are returned as json encoded string
+		var message string
+		if err := json.Unmarshal(data, &message); err != nil {
+			message = strings.TrimSpace(string(data))
+		}
+
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, message)
+	}
+
+	if target == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, target)
+}
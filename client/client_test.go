@@ -0,0 +1,217 @@
+package client
+
+import (
+	"github.com/BigJk/loraemu/api"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"github.com/BigJk/loraemu/server"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// trackingListener remembers the accepted connections so that they can be dropped.
+type trackingListener struct {
+	net.Listener
+
+	sync.Mutex
+	conns []net.Conn
+}
+
+func (t *trackingListener) Accept() (net.Conn, error) {
+	conn, err := t.Listener.Accept()
+	if err == nil {
+		t.Lock()
+		t.conns = append(t.conns, conn)
+		t.Unlock()
+	}
+	return conn, err
+}
+
+func (t *trackingListener) drop() {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.conns = nil
+}
+
+func newTestServer(t *testing.T) (*emu.Emulator, *server.Server, *httptest.Server, *trackingListener) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+
+	for i, id := range []string{"Node1", "Node2"} {
+		assert.NoError(t, testEmu.AddNode(emu.Node{
+			ID:     id,
+			Online: true,
+			X:      1 + float64(i)*0.5,
+			Y:      1,
+			TXGain: 14,
+			RXSens: -137,
+		}))
+	}
+
+	s := server.New(testEmu)
+	assert.NoError(t, s.Setup())
+
+	httpServer := httptest.NewUnstartedServer(s)
+	listener := &trackingListener{Listener: httpServer.Listener}
+	httpServer.Listener = listener
+	httpServer.Start()
+
+	return testEmu, s, httpServer, listener
+}
+
+func waitPacket(t *testing.T, node *NodeConn, data []byte) {
+	select {
+	case packet := <-node.Received():
+		assert.Equal(t, data, packet.Data)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "packet not received")
+	}
+}
+
+func TestClient_REST(t *testing.T) {
+	testEmu, _, httpServer, _ := newTestServer(t)
+	defer httpServer.Close()
+
+	c := New(httpServer.URL)
+
+	ids, err := c.NodeIDs()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Node1", "Node2"}, ids)
+
+	assert.NoError(t, c.CreateNode(emu.Node{ID: "Node3", Online: true, X: 3, Y: 3, TXGain: 14, RXSens: -137}))
+	assert.Error(t, c.CreateNode(emu.Node{ID: "Node3"}))
+
+	node, err := c.Node("Node3")
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, node.X)
+
+	node.TXGain = 20
+	assert.NoError(t, c.UpdateNode(node))
+
+	assert.NoError(t, c.MoveNode("Node3", 5, 6, 1))
+	node, err = c.Node("Node3")
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, node.X)
+	assert.Equal(t, 6.0, node.Y)
+	assert.Equal(t, 1.0, node.Z)
+	assert.Equal(t, 20.0, node.TXGain)
+
+	nodes, err := c.Nodes()
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 3)
+
+	graph, err := c.Graph()
+	assert.NoError(t, err)
+	assert.Len(t, graph.Nodes, 3)
+
+	// the first packet keeps the node busy, so the others wait in the queue
+	for _, data := range []string{"a", "b", "c"} {
+		assert.NoError(t, testEmu.SendMessage("Node3", []byte(strings.Repeat(data, 200))))
+	}
+
+	queue, err := c.Queue("Node3")
+	if assert.NoError(t, err) && assert.Len(t, queue, 2) {
+		assert.NoError(t, c.CancelTx("Node3", queue[0].ID))
+		assert.Error(t, c.CancelTx("Node3", queue[0].ID))
+	}
+
+	flushed, err := c.FlushQueue("Node3")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, flushed)
+
+	assert.NoError(t, c.DeleteNode("Node3"))
+	_, err = c.Node("Node3")
+	assert.Error(t, err)
+
+	// pausing needs an active mobility
+	assert.Error(t, c.SetPause(true))
+}
+
+func TestClient_Node(t *testing.T) {
+	testEmu, s, httpServer, listener := newTestServer(t)
+	defer httpServer.Close()
+
+	c := New(httpServer.URL)
+	c.SetReconnectDelay(time.Millisecond * 50)
+
+	_, err := c.Connect("Missing")
+	assert.Error(t, err)
+
+	node1, err := c.Connect("Node1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer node1.Close()
+
+	node2, err := c.Connect("Node2")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer node2.Close()
+
+	assert.Eventually(t, func() bool {
+		return s.ConnectedNodes() == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	t.Run("SendReceive", func(t *testing.T) {
+		assert.NoError(t, node1.Send([]byte("hello")))
+		waitPacket(t, node2, []byte("hello"))
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			stats, err := c.Stats()
+			return err == nil && stats["Node1"].Sending == 1 && stats["Node2"].Received == 1
+		}, time.Second*5, time.Millisecond*10)
+
+		links, err := c.LinkStats(api.StatsWindow{})
+		if assert.NoError(t, err) && assert.Len(t, links, 1) {
+			assert.Equal(t, "Node1", links[0].From)
+			assert.Equal(t, "Node2", links[0].To)
+			assert.Equal(t, 1.0, links[0].DeliveryRatio)
+		}
+
+		assert.NoError(t, c.ResetStats())
+
+		nodes, err := c.NodeStats(api.StatsWindow{})
+		assert.NoError(t, err)
+		assert.Empty(t, nodes)
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		listener.drop()
+
+		assert.Eventually(t, func() bool {
+			return s.ConnectedNodes() == 0 || !node1.Connected()
+		}, time.Second*5, time.Millisecond*10)
+
+		assert.Eventually(t, func() bool {
+			return s.ConnectedNodes() == 2 && node1.Connected() && node2.Connected()
+		}, time.Second*5, time.Millisecond*10)
+
+		assert.NoError(t, testEmu.SendMessage("Node2", []byte("again")))
+		waitPacket(t, node1, []byte("again"))
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		assert.NoError(t, node1.Close())
+		assert.ErrorIs(t, node1.Send([]byte("closed")), ErrClosed)
+
+		_, ok := <-node1.Received()
+		assert.False(t, ok)
+
+		assert.Eventually(t, func() bool {
+			return s.ConnectedNodes() == 1
+		}, time.Second*5, time.Millisecond*10)
+	})
+}
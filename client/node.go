@@ -0,0 +1,220 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrClosed       = errors.New("connection closed")
+)
+
+// NodeConn represents a node that is connected to the emulator. If the connection is lost it is
+// re-established until the NodeConn is closed.
+type NodeConn struct {
+	sync.Mutex
+
+	id             string
+	url            string
+	logger         logr.Logger
+	reconnectDelay time.Duration
+	conn           *websocket.Conn
+	received       chan emu.RxPacket
+	closed         bool
+	done           chan struct{}
+}
+
+// Connect connects as the node with the given id. The first connection attempt has to succeed,
+// afterwards the connection is re-established automatically.
+func (c *Client) Connect(id string) (*NodeConn, error) {
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch base.Scheme {
+	case "https":
+		base.Scheme = "wss"
+	default:
+		base.Scheme = "ws"
+	}
+
+	c.RLock()
+	node := &NodeConn{
+		id:             id,
+		url:            strings.TrimSuffix(base.String(), "/") + "/api/emu/" + url.PathEscape(id),
+		logger:         c.logger,
+		reconnectDelay: c.reconnectDelay,
+		received:       make(chan emu.RxPacket, 100),
+		done:           make(chan struct{}),
+	}
+	c.RUnlock()
+
+	conn, err := node.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	node.conn = conn
+
+	go node.run(conn)
+
+	return node, nil
+}
+
+// ID returns the id of the node.
+func (n *NodeConn) ID() string {
+	return n.id
+}
+
+// Received returns the channel of packets the node received. The channel is closed after Close.
+// If the channel is full new packets are dropped.
+func (n *NodeConn) Received() <-chan emu.RxPacket {
+	return n.received
+}
+
+// Connected checks if the websocket currently is connected.
+func (n *NodeConn) Connected() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.conn != nil
+}
+
+// Send transmits the data from the node.
+func (n *NodeConn) Send(data []byte) error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.closed {
+		return ErrClosed
+	}
+
+	if n.conn == nil {
+		return ErrNotConnected
+	}
+
+	return n.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Close closes the connection and stops reconnecting.
+func (n *NodeConn) Close() error {
+	n.Lock()
+
+	if n.closed {
+		n.Unlock()
+		return nil
+	}
+
+	n.closed = true
+
+	var err error
+	if n.conn != nil {
+		err = n.conn.Close()
+	}
+
+	n.Unlock()
+
+	<-n.done
+
+	return err
+}
+
+func (n *NodeConn) dial() (*websocket.Conn, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial(n.url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (n *NodeConn) run(conn *websocket.Conn) {
+	defer close(n.done)
+	defer close(n.received)
+
+	for {
+		n.read(conn)
+
+		n.Lock()
+		n.conn = nil
+		closed := n.closed
+		n.Unlock()
+
+		if closed {
+			return
+		}
+
+		n.logger.Info("node connection lost", "id", n.id)
+
+		conn = n.reconnect()
+		if conn == nil {
+			return
+		}
+
+		n.logger.Info("node reconnected", "id", n.id)
+	}
+}
+
+func (n *NodeConn) read(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var packet emu.RxPacket
+		if err := json.Unmarshal(data, &packet); err != nil {
+			n.logger.Error(err, "error while unmarshaling RxPacket", "id", n.id)
+			continue
+		}
+
+		select {
+		case n.received <- packet:
+		default:
+			n.logger.Info("receive channel full, dropping packet", "id", n.id)
+		}
+	}
+}
+
+// reconnect dials until the connection succeeds or the NodeConn is closed.
+func (n *NodeConn) reconnect() *websocket.Conn {
+	for {
+		time.Sleep(n.reconnectDelay)
+
+		conn, err := n.dial()
+
+		n.Lock()
+
+		if n.closed {
+			n.Unlock()
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return nil
+		}
+
+		if err == nil {
+			n.conn = conn
+			n.Unlock()
+			return conn
+		}
+
+		n.Unlock()
+
+		n.logger.Error(err, "node couldn't reconnect", "id", n.id)
+	}
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/enddevice"
+	"github.com/BigJk/loraemu/gwmp"
 	"github.com/BigJk/loraemu/lora"
 	"github.com/BigJk/loraemu/mobility"
+	"github.com/BigJk/loraemu/modem"
+	"github.com/BigJk/loraemu/netserver"
+	"github.com/BigJk/loraemu/pcap"
+	"github.com/BigJk/loraemu/script"
 	"github.com/BigJk/loraemu/server"
+	"github.com/BigJk/loraemu/trace"
+	"github.com/BigJk/loraemu/traffic"
 	"image"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -39,6 +49,23 @@ type CommandConfig struct {
 	End         []string `json:"end"`
 }
 
+// NodeConfig represents a node of the config with settings that only apply to the emu server.
+type NodeConfig struct {
+	emu.Node
+	// KISSPort is a optional TCP port on which the node can be connected to with KISS framing.
+	KISSPort int `json:"kissPort"`
+	// UDPPort is a optional UDP port on which the node can be connected to with plain datagrams.
+	UDPPort int `json:"udpPort"`
+	// Script is a optional JavaScript file that drives the node inside the emulator.
+	Script string `json:"script"`
+}
+
+// TransportConfig represents the listeners on which any node can be connected to.
+type TransportConfig struct {
+	TCP  string `json:"tcp"`
+	Unix string `json:"unix"`
+}
+
 type Config struct {
 	Freq        float64 `json:"freq"`
 	Gamma       float64 `json:"gamma"`
@@ -52,15 +79,27 @@ type Config struct {
 	IgnoreCollisions bool              `json:"ignoreCollisions"`
 	SNROffset        int               `json:"snrOffset"`
 	TimeScaling      int               `json:"timeScaling"`
-	Nodes            []emu.Node        `json:"nodes"`
+	TXQueueCapacity  *int              `json:"txQueueCapacity"`
+	LinkEvents       bool              `json:"linkEvents"`
+	StatsRetention   float64           `json:"statsRetention"`
+	Nodes            []NodeConfig      `json:"nodes"`
 	Commands         CommandConfig     `json:"commands"`
 	Mobility         struct {
 		File     string  `json:"file"`
 		Tickrate float64 `json:"tickrate"`
 		Loop     bool    `json:"loop"`
 	} `json:"mobility"`
-	BackgroundImage string `json:"backgroundImage"`
-	Web             string `json:"web"`
+	Faults           emu.FaultConfig        `json:"faults"`
+	PacketForwarders []gwmp.Config          `json:"packetForwarders"`
+	NetworkServer    *netserver.Config      `json:"networkServer"`
+	EndDevices       []enddevice.Config     `json:"endDevices"`
+	Modems           []modem.Config         `json:"modems"`
+	Traffic          []traffic.Config       `json:"traffic"`
+	Webhooks         []server.WebhookConfig `json:"webhooks"`
+	TraceSinks       []trace.Config         `json:"traceSinks"`
+	Transports       TransportConfig        `json:"transports"`
+	BackgroundImage  string                 `json:"backgroundImage"`
+	Web              string                 `json:"web"`
 }
 
 type RunningCommand struct {
@@ -102,13 +141,56 @@ func loadConfig(path string) Config {
 	return conf
 }
 
-func loadTraceLogsFile(path string) io.WriteCloser {
-	logs, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+func loadCaptureFile(path string) io.WriteCloser {
+	capture, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
-		logger.Error(err, "can't open log file")
+		logger.Error(err, "can't open capture file")
 		stopAndHelp()
 	}
-	return logs
+	return capture
+}
+
+// startCapture writes the air traffic as pcap capture to the file. The events are written by a goroutine
+// through a buffer, so a slow disk doesn't stall the emulator. The returned function writes the remaining
+// events and closes the file.
+func startCapture(e *emu.Emulator, path string, syncWord uint8) func() {
+	capture := loadCaptureFile(path)
+	buffered := bufio.NewWriter(capture)
+
+	writer, err := pcap.NewWriter(buffered, syncWord)
+	if err != nil {
+		panic(err)
+	}
+
+	subscription := e.Subscribe(emu.SubscribeOptions{
+		Events:   pcap.Events,
+		Overflow: emu.OverflowDropOldest,
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for msg := range subscription.Events() {
+			if err := writer.WriteEvent(msg); err != nil {
+				logger.Error(err, "can't write pcap record")
+			}
+		}
+	}()
+
+	return func() {
+		subscription.Unsubscribe()
+		<-done
+
+		if dropped := subscription.Dropped(); dropped > 0 {
+			logger.Error(nil, "pcap capture dropped records", "dropped", dropped)
+		}
+
+		if err := buffered.Flush(); err != nil {
+			logger.Error(err, "can't write pcap capture")
+		}
+		_ = capture.Close()
+	}
 }
 
 func evalCommand(cmd string, params map[string]interface{}) (string, []string, error) {
@@ -232,28 +314,175 @@ func waitFor(t string, s *server.Server, maxNodes int) {
 	}
 }
 
+func loadBackgroundImage(path string) image.Image {
+	imgFile, err := os.Open(path)
+	if err != nil {
+		logger.Error(err, "image not found")
+		stopAndHelp()
+	}
+
+	img, _, err := image.Decode(imgFile)
+	_ = imgFile.Close()
+
+	if err != nil {
+		logger.Error(err, "image not parsed")
+		stopAndHelp()
+	}
+
+	return img
+}
+
+// loadReplayConfig returns the scenario config from the header of the trace. If the trace has no header
+// with a config the config file is used instead.
+func loadReplayConfig(path string, configFile string) Config {
+	reader, err := trace.Open(path)
+	if err != nil {
+		logger.Error(err, "can't open replay file")
+		stopAndHelp()
+	}
+	defer reader.Close()
+
+	record, err := reader.Next()
+	if err != nil {
+		logger.Error(err, "can't read replay file")
+		stopAndHelp()
+	}
+
+	if header, ok := record.Data.(trace.Header); ok && header.Config != nil {
+		var conf Config
+
+		configBytes, err := json.Marshal(header.Config)
+		if err == nil {
+			err = json.Unmarshal(configBytes, &conf)
+		}
+		if err == nil {
+			return conf
+		}
+
+		logger.Error(err, "can't parse config of the trace header, using config file")
+	}
+
+	return loadConfig(configFile)
+}
+
+// runReplay serves the web view for a recorded trace instead of running the scenario. No nodes, commands or
+// other components are started, the events come from the trace.
+func runReplay(path string, configFile string, speed float64) {
+	configFolder := filepath.Dir(configFile)
+	config := loadReplayConfig(path, configFile)
+
+	e := emu.New(config.Freq, config.Gamma, config.RefDistance, config.KMRange, config.PacketConfig)
+	e.SetLogger(logger)
+
+	s := server.New(e)
+	s.SetLogger(logger)
+	s.SetOrigin(config.Origin.X, config.Origin.Y)
+
+	if config.StatsRetention > 0 {
+		s.SetStatsRetention(time.Duration(config.StatsRetention * float64(time.Second)))
+	}
+
+	if len(config.BackgroundImage) > 0 {
+		s.SetBackgroundImage(loadBackgroundImage(filepath.Join(configFolder, config.BackgroundImage)))
+	}
+
+	replay, err := s.LoadReplay(path)
+	if err != nil {
+		logger.Error(err, "can't load replay file")
+		stopAndHelp()
+	}
+
+	if _, err := replay.SetSpeed(speed); err != nil {
+		logger.Error(err, "invalid replay speed")
+		stopAndHelp()
+	}
+
+	go func() {
+		// the server is closed on shutdown, which isn't an error
+		if err := s.Start(config.Web); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	status := replay.Play()
+	logger.Info("replay started", "path", path, "records", status.Records, "duration", (time.Duration(status.End-status.Start) * time.Millisecond).String())
+
+	// wait for commandline interrupt
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, os.Kill)
+	<-quit
+
+	_ = s.Stop()
+}
+
 func main() {
 	configFile := flag.String("config", "./config.json", "specifies which file to load the config from.")
-	logFile := flag.String("log", "./logs.txt", "specifies where to store the trace logs. the file will be overwritten!")
+	logFile := flag.String("log", "./logs.txt", "specifies where to store the trace logs. a existing file is rotated to a timestamped backup. empty disables the log.")
+	pcapFile := flag.String("pcap", "", "specifies where to store a pcap capture of the air traffic in the LoRaTap format. the file will be overwritten!")
 	debug := flag.Bool("debug", false, "sets debug mode.")
 	timeout := flag.String("timeout", "", "specifies if the emulator should shut down after a certain amount of time (e.g. 1m, 1h20m, 50s, ...). If not specified run infinitely.")
 	waitForStr := flag.String("wait_for", "", "specifies if the emulator should wait for nodes to connect before starting the timeout. Options: first, all")
 	skipCommands := flag.Bool("skip_cmds", false, "skips all commands that would normaly executed in the scenario")
 	ignoreCollisions := flag.Bool("ignore_collisions", false, "disables the collision detection of the emulator")
 	noMobility := flag.Bool("no_mobility", false, "disables the mobility of the emulator")
+	noFaults := flag.Bool("no_faults", false, "disables the fault injection of the emulator")
+	replayFile := flag.String("replay", "", "replays a trace log in the web view instead of running the scenario. the config is taken from the header of the trace if present.")
+	replaySpeed := flag.Float64("replay_speed", 1, "sets the initial speed of the replay (e.g. 10 replays 10 seconds per second)")
 	flag.Parse()
 
-	// load config and open log file
+	if len(*replayFile) > 0 {
+		runReplay(*replayFile, *configFile, *replaySpeed)
+		return
+	}
+
+	// load config
 	configFolder := filepath.Dir(*configFile)
 	config := loadConfig(*configFile)
-	trace := loadTraceLogsFile(*logFile)
-
-	defer trace.Close()
 
 	// create emulator, set configs and add nodes
 	e := emu.New(config.Freq, config.Gamma, config.RefDistance, config.KMRange, config.PacketConfig)
-	e.SetTraceWriter(trace)
 	e.SetLogger(logger)
+
+	// open the trace log and the additional trace sinks before any event is emitted
+	var traceConfigs []trace.Config
+	if len(*logFile) > 0 {
+		traceConfigs = append(traceConfigs, trace.Config{Name: "log", Path: *logFile, Header: true})
+	}
+
+	for i, traceConfig := range config.TraceSinks {
+		if len(traceConfig.Name) == 0 {
+			traceConfig.Name = fmt.Sprintf("trace%d", i)
+		}
+
+		if len(traceConfig.Path) > 0 && !filepath.IsAbs(traceConfig.Path) {
+			traceConfig.Path = filepath.Join(configFolder, traceConfig.Path)
+		}
+
+		traceConfigs = append(traceConfigs, traceConfig)
+	}
+
+	var sinks []*trace.Sink
+	for _, traceConfig := range traceConfigs {
+		sink, err := trace.New(e, traceConfig)
+		if err != nil {
+			panic(err)
+		}
+
+		sink.SetLogger(logger)
+		sink.SetScenario(config)
+		if err := sink.Start(); err != nil {
+			logger.Error(err, "can't open trace log", "sink", traceConfig.Name)
+			stopAndHelp()
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	stopCapture := func() {}
+	if len(*pcapFile) > 0 {
+		stopCapture = startCapture(e, *pcapFile, config.PacketConfig.SyncWord)
+	}
+
 	e.SetIgnoreCollision(config.IgnoreCollisions || *ignoreCollisions)
 	e.SetSNROffset(config.SNROffset)
 	if config.TimeScaling > 0 {
@@ -261,32 +490,152 @@ func main() {
 			panic(err)
 		}
 	}
+	if config.TXQueueCapacity != nil {
+		if err := e.SetTXQueueCapacity(*config.TXQueueCapacity); err != nil {
+			panic(err)
+		}
+	}
 
 	for _, n := range config.Nodes {
-		if err := e.AddNode(n); err != nil {
+		if err := e.AddNode(n.Node); err != nil {
 			panic(err)
 		}
 	}
+	e.SetLinkEvents(config.LinkEvents)
 
-	// create frontend server based on emulator
-	s := server.New(e)
+	// create fault injector if faults are configured
+	var faults *emu.Faults
+	if config.Faults.Enabled() && !*noFaults {
+		faults = emu.NewFaults(e, config.Faults)
+		e.SetFaults(faults)
 
-	if len(config.BackgroundImage) > 0 {
-		imgFile, err := os.Open(filepath.Join(configFolder, config.BackgroundImage))
+		logger.Info("fault injection enabled", "seed", faults.Seed())
+	}
+
+	// connect gateway nodes to their network servers
+	var forwarders []*gwmp.Forwarder
+	for _, pfConfig := range config.PacketForwarders {
+		forwarder, err := gwmp.New(e, pfConfig)
 		if err != nil {
-			logger.Error(err, "image not found")
-			stopAndHelp()
+			panic(err)
 		}
 
-		img, _, err := image.Decode(imgFile)
-		_ = imgFile.Close()
+		forwarder.SetLogger(logger)
+		if err := forwarder.Start(); err != nil {
+			panic(err)
+		}
 
+		forwarders = append(forwarders, forwarder)
+	}
+
+	// attach the in-process network server to its gateway nodes
+	var ns *netserver.NetworkServer
+	if config.NetworkServer != nil {
+		ns = netserver.New(e, *config.NetworkServer)
+		ns.SetLogger(logger)
+		if err := ns.Start(); err != nil {
+			panic(err)
+		}
+	}
+
+	// create a serial modem for nodes that run serial based firmware
+	var modems []*modem.Modem
+	serialPaths := map[string]string{}
+	for _, modemConfig := range config.Modems {
+		m, err := modem.New(e, modemConfig)
 		if err != nil {
-			logger.Error(err, "image not parsed")
-			stopAndHelp()
+			panic(err)
+		}
+
+		m.SetLogger(logger)
+		if err := m.Start(); err != nil {
+			panic(err)
+		}
+
+		modems = append(modems, m)
+		serialPaths[modemConfig.Node] = m.Path()
+	}
+
+	// create the virtual end-devices, they are started together with the fault injection
+	var endDevices []*enddevice.Device
+	for _, edConfig := range config.EndDevices {
+		// the rx2 window has to match the one of the network server
+		if edConfig.RX2Freq <= 0 && config.NetworkServer != nil {
+			edConfig.RX2Freq = config.NetworkServer.RX2Freq
+		}
+
+		d, err := enddevice.New(e, edConfig)
+		if err != nil {
+			panic(err)
+		}
+
+		d.SetLogger(logger)
+		endDevices = append(endDevices, d)
+	}
+
+	// load the scripts of scripted nodes, they are started together with the fault injection
+	var scripts []*script.Script
+	for _, n := range config.Nodes {
+		if len(n.Script) == 0 {
+			continue
+		}
+
+		path := n.Script
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(configFolder, path)
+		}
+
+		sc, err := script.Load(e, n.ID, path)
+		if err != nil {
+			panic(err)
 		}
 
-		s.SetBackgroundImage(img)
+		sc.SetLogger(logger)
+		scripts = append(scripts, sc)
+	}
+
+	// create the traffic generators, they are started together with the fault injection
+	var generators []*traffic.Generator
+	for i, trafficConfig := range config.Traffic {
+		if len(trafficConfig.Name) == 0 {
+			trafficConfig.Name = fmt.Sprintf("%s%d", trafficConfig.Kind, i)
+		}
+
+		if len(trafficConfig.Schedule) > 0 && !filepath.IsAbs(trafficConfig.Schedule) {
+			trafficConfig.Schedule = filepath.Join(configFolder, trafficConfig.Schedule)
+		}
+
+		g, err := traffic.New(e, trafficConfig)
+		if err != nil {
+			panic(err)
+		}
+
+		g.SetLogger(logger)
+		generators = append(generators, g)
+	}
+
+	// create frontend server based on emulator
+	s := server.New(e)
+	s.SetNetworkServer(ns)
+	s.SetEndDevices(endDevices)
+	s.SetTrafficGenerators(generators)
+
+	if config.StatsRetention > 0 {
+		s.SetStatsRetention(time.Duration(config.StatsRetention * float64(time.Second)))
+	}
+
+	for i, webhookConfig := range config.Webhooks {
+		if len(webhookConfig.Name) == 0 {
+			webhookConfig.Name = fmt.Sprintf("webhook%d", i)
+		}
+
+		if err := s.AddWebhook(webhookConfig); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(config.BackgroundImage) > 0 {
+		s.SetBackgroundImage(loadBackgroundImage(filepath.Join(configFolder, config.BackgroundImage)))
 	}
 
 	// check if timeout is specified and start goroutine
@@ -335,11 +684,47 @@ func main() {
 	}
 
 	s.SetDebug(*debug)
+
+	// open the kiss interfaces of the nodes
+	for _, n := range config.Nodes {
+		if n.KISSPort <= 0 {
+			continue
+		}
+
+		if _, err := s.ListenKISS(n.ID, fmt.Sprintf(":%d", n.KISSPort)); err != nil {
+			panic(err)
+		}
+	}
+
+	// open the udp ports of the nodes
+	for _, n := range config.Nodes {
+		if n.UDPPort <= 0 {
+			continue
+		}
+
+		if _, err := s.ListenUDP(n.ID, fmt.Sprintf(":%d", n.UDPPort)); err != nil {
+			panic(err)
+		}
+	}
+
+	// open the transports on which all nodes can connect
+	if len(config.Transports.TCP) > 0 {
+		if _, err := s.ListenTCP(config.Transports.TCP); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(config.Transports.Unix) > 0 {
+		if _, err := s.ListenUnix(config.Transports.Unix); err != nil {
+			panic(err)
+		}
+	}
 	s.SetLogger(logger)
 	s.SetOrigin(config.Origin.X, config.Origin.Y)
 
 	go func() {
-		if err := s.Start(config.Web); err != nil {
+		// the server is closed on shutdown, which isn't an error
+		if err := s.Start(config.Web); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			panic(err)
 		}
 	}()
@@ -358,6 +743,7 @@ func main() {
 				"nodeId":    node.ID,
 				"bind":      config.Web,
 				"nodeCount": len(config.Nodes),
+				"serial":    serialPaths[node.ID],
 			}
 
 			for ci, cmd := range config.Commands.PerNode {
@@ -441,11 +827,37 @@ func main() {
 		}
 	}
 
-	// start mobility at last
+	// start mobility and node churn at last
 	if mob != nil {
 		mob.Start()
 	}
 
+	if faults != nil {
+		faults.Start()
+	}
+
+	for _, d := range endDevices {
+		if err := d.Start(); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, sc := range scripts {
+		if err := sc.Start(); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, g := range generators {
+		if g.Config().Stopped {
+			continue
+		}
+
+		if err := g.Start(); err != nil {
+			panic(err)
+		}
+	}
+
 	// wait for commandline interrupt
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, os.Kill)
@@ -475,6 +887,39 @@ func main() {
 		}
 	}
 
+	for _, g := range generators {
+		_ = g.Stop()
+		g.Done()
+	}
+
+	for _, sc := range scripts {
+		sc.Stop()
+	}
+
+	for _, d := range endDevices {
+		d.Stop()
+		d.Done()
+	}
+
+	// stop node churn so that crashed nodes are brought back online
+	if faults != nil {
+		faults.Stop()
+		faults.Done()
+	}
+
+	// disconnect gateway nodes from their network servers
+	for _, forwarder := range forwarders {
+		_ = forwarder.Stop()
+	}
+
+	if ns != nil {
+		ns.Stop()
+	}
+
+	for _, m := range modems {
+		_ = m.Stop()
+	}
+
 	// kill all running child commands
 	for _, rc := range runningCommands {
 		logger.Info("killing command", "pid", rc.cmd.Process.Pid)
@@ -486,4 +931,19 @@ func main() {
 	}
 
 	e.Wait()
+
+	// sends the remaining events of the webhooks
+	_ = s.Stop()
+
+	// writes the remaining events and closes the trace files
+	for _, sink := range sinks {
+		_ = sink.Stop()
+		sink.Done()
+
+		if status := sink.Status(); status.Errors > 0 {
+			logger.Error(errors.New(status.LastError), "trace sink had write errors", "sink", status.Name, "errors", status.Errors)
+		}
+	}
+
+	stopCapture()
 }
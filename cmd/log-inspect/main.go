@@ -1,24 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/BigJk/loraemu/emu"
-	"os"
+	"github.com/BigJk/loraemu/trace"
+	"io"
 	"strings"
 	"time"
 
 	"github.com/Knetic/govaluate"
-	"github.com/fatih/structs"
 	"github.com/nqd/flat"
 )
 
-func init() {
-	structs.DefaultTagName = "json"
-}
-
 func printHelp() {
 	fmt.Println("  _        ___      ___ __  __ _   _ \n | |   ___| _ \\__ _| __|  \\/  | | | |\n | |__/ _ \\   / _` | _|| |\\/| | |_| |\n |____\\___/_|_\\__,_|___|_|  |_|\\___/\n    - LogInspect")
 	fmt.Println("------------------------------------------")
@@ -31,6 +27,8 @@ func main() {
 	input := flag.String("input", "", "specify path to LoRaEMU trace log.")
 	exprStr := flag.String("expr", "", "the expression that should be evaluated")
 	opType := flag.String("output", "print", "the operation that should be done on the found entries (e.g. print, count, sum)")
+	fromStr := flag.String("from", "", "only inspect entries after this time since the start of the trace (e.g. 10m, 1h30m)")
+	toStr := flag.String("to", "", "only inspect entries before this time since the start of the trace (e.g. 10m, 1h30m)")
 	flag.Parse()
 
 	if len(*input) == 0 {
@@ -45,13 +43,54 @@ func main() {
 		return
 	}
 
-	// open the file
-	file, err := os.Open(*input)
-	if err != nil {
-		fmt.Printf("Error: can't open file (%s)\n\n", err)
-		printHelp()
-		return
+	var err error
+	var from, to time.Duration
+	if len(*fromStr) > 0 {
+		if from, err = time.ParseDuration(*fromStr); err != nil {
+			fmt.Printf("Error: can't parse from (%s)\n\n", err)
+			printHelp()
+			return
+		}
+	}
+
+	if len(*toStr) > 0 {
+		if to, err = time.ParseDuration(*toStr); err != nil {
+			fmt.Printf("Error: can't parse to (%s)\n\n", err)
+			printHelp()
+			return
+		}
+	}
+
+	// open the file, the index is only needed to jump to the start of the time window
+	var reader *trace.Reader
+	var end time.Time
+	if from > 0 || to > 0 {
+		index, err := trace.NewIndex(*input)
+		if err != nil {
+			fmt.Printf("Error: can't open file (%s)\n\n", err)
+			printHelp()
+			return
+		}
+
+		if to > 0 {
+			end = index.Start().Add(to)
+		}
+
+		reader, err = index.Seek(index.Start().Add(from))
+		if err != nil {
+			fmt.Printf("Error: can't open file (%s)\n\n", err)
+			printHelp()
+			return
+		}
+	} else {
+		reader, err = trace.Open(*input)
+		if err != nil {
+			fmt.Printf("Error: can't open file (%s)\n\n", err)
+			printHelp()
+			return
+		}
 	}
+	defer reader.Close()
 
 	// create the evaluator
 	expr, err := govaluate.NewEvaluableExpression(*exprStr)
@@ -65,24 +104,36 @@ func main() {
 	var sum float64
 	var concat []string
 
-	scanner := bufio.NewScanner(file)
-
-scannerFor:
-	for scanner.Scan() {
-		var entry emu.LogEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+readerFor:
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
 			panic(err)
 		}
 
-		// convert struct to map[string]interface{} so that the evaluator can work with it
-		entryMap := structs.Map(entry)
-		entryMap["event"] = string(entryMap["event"].(emu.Event)) // evaluator can't compare String to emu.Event, so we cast it to string beforehand
+		// the header describes the trace and isn't a event of the emulator
+		if record.Event == trace.EventHeader {
+			continue
+		}
 
-		// convert the time to a unix timestamp so that the evaluator can use operations on it
-		if entryTime, ok := entryMap["time"].(time.Time); ok {
-			entryMap["time"] = entryTime.Unix()
+		if !end.IsZero() && record.Time.After(end) {
+			continue
+		}
+
+		entry := record.LogEntry()
+
+		// convert the entry to map[string]interface{} with the keys of the trace log so that the evaluator can work with it
+		entryMap, err := toMap(entry)
+		if err != nil {
+			panic(err)
 		}
 
+		// convert the time to a unix timestamp so that the evaluator can use operations on it
+		entryMap["time"] = record.Time.Unix()
+
 		entryMap, err = flat.Flatten(entryMap, &flat.Options{
 			Delimiter: "_",
 		})
@@ -104,13 +155,13 @@ scannerFor:
 			}
 
 			sum += val
-			continue scannerFor
+			continue readerFor
 		case "concat":
 			str := fmt.Sprint(res)
 			if len(str) > 0 {
 				concat = append(concat, str)
 			}
-			continue scannerFor
+			continue readerFor
 		}
 
 		ok, validType := res.(bool)
@@ -142,3 +193,18 @@ scannerFor:
 		fmt.Println(strings.Join(concat, ";"))
 	}
 }
+
+// toMap converts the entry to a map with the same keys as the JSON of the trace log.
+func toMap(entry emu.LogEntry) (map[string]interface{}, error) {
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var entryMap map[string]interface{}
+	if err := json.Unmarshal(bytes, &entryMap); err != nil {
+		return nil, err
+	}
+
+	return entryMap, nil
+}
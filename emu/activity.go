@@ -0,0 +1,39 @@
+package emu
+
+import "sort"
+
+// RadioActivity represents the radio state and counters of a node that aren't part of the trace.
+type RadioActivity struct {
+	ID string `json:"id"`
+	// Transmitting is true if the node is sending at the moment.
+	Transmitting bool `json:"transmitting"`
+	// Receiving is the number of packets that are arriving at the node at the moment.
+	Receiving int `json:"receiving"`
+	// BelowSensitivity counts the packets on the channel of the node that arrived with a gain below its
+	// sensitivity, so they weren't received.
+	BelowSensitivity int `json:"belowSensitivity"`
+}
+
+// RadioActivity returns the radio state of all nodes sorted by id.
+func (emu *Emulator) RadioActivity() []RadioActivity {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	now := emu.getTime().UnixMilli()
+
+	activity := make([]RadioActivity, 0, len(emu.nodes))
+	for id, node := range emu.nodes {
+		activity = append(activity, RadioActivity{
+			ID:               id,
+			Transmitting:     now <= node.sendingUntil,
+			Receiving:        demodulatorsInUse(node, now),
+			BelowSensitivity: emu.belowSensitivity[id],
+		})
+	}
+
+	sort.Slice(activity, func(i, j int) bool {
+		return activity[i].ID < activity[j].ID
+	})
+
+	return activity
+}
@@ -0,0 +1,189 @@
+package emu
+
+import (
+	"sync"
+	"time"
+)
+
+// NodeBehavior implements the logic of a node in Go, so that it can be driven by the emulator without
+// any external process. The callbacks of a node are never called concurrently, which means a behavior
+// doesn't need to synchronize its own state.
+type NodeBehavior interface {
+	// OnStart is called once when the behavior is started.
+	OnStart(radio *Radio)
+	// OnReceive is called for every packet the node receives.
+	OnReceive(radio *Radio, packet RxPacket)
+	// OnTimer is called when a timer that was set with Radio.SetTimer fires.
+	OnTimer(radio *Radio, name string)
+}
+
+// BehaviorFuncs implements NodeBehavior with optional functions.
+type BehaviorFuncs struct {
+	Start   func(radio *Radio)
+	Receive func(radio *Radio, packet RxPacket)
+	Timer   func(radio *Radio, name string)
+}
+
+func (b BehaviorFuncs) OnStart(radio *Radio) {
+	if b.Start != nil {
+		b.Start(radio)
+	}
+}
+
+func (b BehaviorFuncs) OnReceive(radio *Radio, packet RxPacket) {
+	if b.Receive != nil {
+		b.Receive(radio, packet)
+	}
+}
+
+func (b BehaviorFuncs) OnTimer(radio *Radio, name string) {
+	if b.Timer != nil {
+		b.Timer(radio, name)
+	}
+}
+
+// Radio is the handle of a NodeBehavior to control its node. Timers run in emulator time, so they
+// follow the time scaling of the emulator.
+type Radio struct {
+	// callbackMutex serializes the callbacks of the behavior
+	callbackMutex sync.Mutex
+	timerMutex    sync.Mutex
+
+	emu      *Emulator
+	id       string
+	behavior NodeBehavior
+	timers   map[string]uint64
+	nextGen  uint64
+	stopped  bool
+}
+
+// StartBehavior attaches the behavior to the node with the given id and calls OnStart. The node can't
+// have another attached handler.
+func (emu *Emulator) StartBehavior(id string, behavior NodeBehavior) (*Radio, error) {
+	radio := &Radio{
+		emu:      emu,
+		id:       id,
+		behavior: behavior,
+		timers:   map[string]uint64{},
+	}
+
+	radio.callbackMutex.Lock()
+	defer radio.callbackMutex.Unlock()
+
+	if err := emu.AttachNode(id, radio.receive); err != nil {
+		return nil, err
+	}
+
+	behavior.OnStart(radio)
+
+	return radio, nil
+}
+
+// ID returns the id of the node.
+func (r *Radio) ID() string {
+	return r.id
+}
+
+// Node returns the current state of the node.
+func (r *Radio) Node() Node {
+	return r.emu.GetNode(r.id)
+}
+
+// Now returns the current time of the emulator.
+func (r *Radio) Now() time.Time {
+	return r.emu.Now()
+}
+
+// Send transmits the data from the node.
+func (r *Radio) Send(data []byte) error {
+	return r.SendWithParams(data, TxParams{})
+}
+
+// SendWithParams transmits the data with radio parameters that override the settings of the node.
+// OnDone is called in the same way as the callbacks of the behavior, so never concurrently to them.
+func (r *Radio) SendWithParams(data []byte, params TxParams) error {
+	if onDone := params.OnDone; onDone != nil {
+		params.OnDone = func(result TxResult, err error) {
+			r.callbackMutex.Lock()
+			defer r.callbackMutex.Unlock()
+
+			if r.stopped {
+				return
+			}
+
+			onDone(result, err)
+		}
+	}
+
+	return r.emu.SendMessageWithParams(r.id, data, params)
+}
+
+// Configure changes the settings of the node.
+func (r *Radio) Configure(updater func(node *Node) error) error {
+	return r.emu.UpdateNode(r.id, updater)
+}
+
+// SetTimer calls OnTimer with the name after the delay of emulator time has passed. Setting a timer
+// with the same name again replaces the previous one.
+func (r *Radio) SetTimer(name string, delay time.Duration) {
+	r.timerMutex.Lock()
+	r.nextGen++
+	gen := r.nextGen
+	r.timers[name] = gen
+	r.timerMutex.Unlock()
+
+	r.emu.Schedule(delay, func() {
+		r.callbackMutex.Lock()
+		defer r.callbackMutex.Unlock()
+
+		r.timerMutex.Lock()
+		active := r.timers[name] == gen
+		if active {
+			delete(r.timers, name)
+		}
+		r.timerMutex.Unlock()
+
+		if r.stopped || !active {
+			return
+		}
+
+		r.behavior.OnTimer(r, name)
+	})
+}
+
+// CancelTimer stops the timer with the name.
+func (r *Radio) CancelTimer(name string) {
+	r.timerMutex.Lock()
+	defer r.timerMutex.Unlock()
+
+	delete(r.timers, name)
+}
+
+// Stop detaches the behavior from the node. No callbacks are called afterwards. Stop can't be
+// called from inside a callback, as it waits for a running callback to finish.
+func (r *Radio) Stop() {
+	r.callbackMutex.Lock()
+	defer r.callbackMutex.Unlock()
+
+	if r.stopped {
+		return
+	}
+
+	r.stopped = true
+	r.emu.DetachNode(r.id)
+
+	r.timerMutex.Lock()
+	r.timers = map[string]uint64{}
+	r.timerMutex.Unlock()
+}
+
+func (r *Radio) receive(node Node, packet RxPacket) {
+	r.callbackMutex.Lock()
+	defer r.callbackMutex.Unlock()
+
+	if r.stopped {
+		return
+	}
+
+	r.behavior.OnReceive(r, packet)
+}
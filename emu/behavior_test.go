@@ -0,0 +1,138 @@
+package emu
+
+import (
+	"fmt"
+	"github.com/BigJk/loraemu/lora"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pingPong answers every received ping with a pong and counts the pongs it got.
+type pingPong struct {
+	pings int
+	pongs int
+}
+
+func (p *pingPong) OnStart(radio *Radio) {}
+
+func (p *pingPong) OnReceive(radio *Radio, packet RxPacket) {
+	switch string(packet.Data) {
+	case "ping":
+		p.pings++
+		_ = radio.Send([]byte("pong"))
+	case "pong":
+		p.pongs++
+	}
+}
+
+func (p *pingPong) OnTimer(radio *Radio, name string) {
+	_ = radio.Send([]byte("ping"))
+}
+
+func TestBehavior_PingPong(t *testing.T) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(100))
+
+	for i, id := range []string{"1", "2"} {
+		assert.NoError(t, e.AddNode(Node{ID: id, Online: true, X: 1 + float64(i)*0.2, Y: 1, TXGain: 14, RXSens: -137}))
+	}
+
+	pinger := &pingPong{}
+	ponger := &pingPong{}
+
+	radio, err := e.StartBehavior("1", pinger)
+	assert.NoError(t, err)
+
+	_, err = e.StartBehavior("2", ponger)
+	assert.NoError(t, err)
+
+	_, err = e.StartBehavior("2", ponger)
+	assert.Error(t, err, "node already has a behavior")
+
+	radio.SetTimer("ping", time.Second)
+
+	e.Wait()
+
+	assert.Equal(t, 1, ponger.pings)
+	assert.Equal(t, 1, pinger.pongs)
+}
+
+func TestBehavior_Timers(t *testing.T) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(100))
+	assert.NoError(t, e.AddNode(Node{ID: "1", Online: true, X: 1, Y: 1, TXGain: 14, RXSens: -137}))
+
+	var fired []string
+	radio, err := e.StartBehavior("1", BehaviorFuncs{
+		Start: func(radio *Radio) {
+			radio.SetTimer("replaced", time.Second)
+			radio.SetTimer("canceled", time.Second)
+			radio.SetTimer("periodic", time.Second)
+		},
+		Timer: func(radio *Radio, name string) {
+			fired = append(fired, name)
+
+			if name == "periodic" && len(fired) < 4 {
+				radio.SetTimer("periodic", time.Second)
+			}
+		},
+	})
+	assert.NoError(t, err)
+
+	radio.SetTimer("replaced", time.Second*2)
+	radio.CancelTimer("canceled")
+
+	e.Wait()
+
+	assert.ElementsMatch(t, []string{"periodic", "replaced", "periodic", "periodic"}, fired)
+
+	// no callbacks are called after stopping
+	radio.Stop()
+	radio.SetTimer("stopped", 0)
+	e.Wait()
+	assert.Len(t, fired, 4)
+}
+
+// TestBehavior_ManyNodes broadcasts a packet to hundreds of in-process nodes.
+func TestBehavior_ManyNodes(t *testing.T) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(100))
+	e.SetIgnoreCollision(true)
+
+	const count = 200
+
+	var reached int32
+	var sender *Radio
+	for i := 0; i < count; i++ {
+		id := fmt.Sprint(i)
+		assert.NoError(t, e.AddNode(Node{ID: id, Online: true, X: 1 + float64(i%20)*0.01, Y: 1 + float64(i/20)*0.01, TXGain: 14, RXSens: -137}))
+
+		seen := i == 0
+		radio, err := e.StartBehavior(id, BehaviorFuncs{
+			Timer: func(radio *Radio, name string) {
+				_ = radio.Send([]byte("broadcast"))
+			},
+			Receive: func(radio *Radio, packet RxPacket) {
+				if seen {
+					return
+				}
+
+				seen = true
+				atomic.AddInt32(&reached, 1)
+			},
+		})
+		assert.NoError(t, err)
+
+		if i == 0 {
+			sender = radio
+		}
+	}
+
+	sender.SetTimer("broadcast", time.Second)
+	e.Wait()
+
+	assert.Equal(t, int32(count-1), atomic.LoadInt32(&reached))
+}
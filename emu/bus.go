@@ -0,0 +1,272 @@
+package emu
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSubscriberBuffer is the size of the channel of a subscription if no buffer is set.
+const DefaultSubscriberBuffer = 256
+
+// OverflowPolicy decides what happens to events that don't fit into the buffer of a subscription.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the publisher until the subscriber has read from the channel. No event is lost,
+	// but as events are mostly published while the emulator is locked a slow subscriber stalls the emulator.
+	// It's only safe for subscribers that never call functions of the emulator while reading, otherwise they
+	// deadlock it.
+	OverflowBlock = OverflowPolicy("block")
+	// OverflowDropNewest drops the event that doesn't fit into the buffer.
+	OverflowDropNewest = OverflowPolicy("dropNewest")
+	// OverflowDropOldest drops the oldest buffered event to make room for the new one.
+	OverflowDropOldest = OverflowPolicy("dropOldest")
+)
+
+// EventMessage represents an event that is published on the event bus.
+type EventMessage struct {
+	Time  time.Time `json:"time"`
+	Event Event     `json:"event"`
+	Node  Node      `json:"node"`
+	Data  any       `json:"data"`
+}
+
+// LogEntry returns the event as it is written to the trace log.
+func (m EventMessage) LogEntry() LogEntry {
+	return LogEntry{
+		Time:   m.Time,
+		Event:  m.Event,
+		NodeID: m.Node.ID,
+		Data:   m.Data,
+	}
+}
+
+// Packet returns the received packet of a EventReceived or EventCollision.
+func (m EventMessage) Packet() (RxPacket, bool) {
+	switch data := m.Data.(type) {
+	case Reception:
+		return data.RxPacket, true
+	case RxPacket:
+		return data, true
+	}
+
+	return RxPacket{}, false
+}
+
+// SubscribeOptions represents the filter and buffer settings of a subscription.
+type SubscribeOptions struct {
+	// Events the subscriber is interested in. If empty all events are delivered.
+	Events []Event `json:"events"`
+	// Nodes the subscriber is interested in. If empty the events of all nodes are delivered.
+	Nodes []string `json:"nodes"`
+	// Buffer is the size of the channel. Defaults to DefaultSubscriberBuffer.
+	Buffer int `json:"buffer"`
+	// Overflow is the policy if the buffer is full. Defaults to OverflowDropOldest.
+	Overflow OverflowPolicy `json:"overflow"`
+}
+
+// Subscription represents a subscriber of the event bus.
+type Subscription struct {
+	mutex sync.RWMutex
+
+	bus      *EventBus
+	events   map[Event]bool
+	nodes    map[string]bool
+	overflow OverflowPolicy
+	fn       func(msg EventMessage)
+	ch       chan EventMessage
+	done     chan bool
+	once     sync.Once
+	closed   bool
+	dropped  uint64
+}
+
+// Events returns the channel the events are delivered to. It is closed on Unsubscribe. Subscriptions
+// created with SubscribeFunc have no channel.
+func (s *Subscription) Events() <-chan EventMessage {
+	return s.ch
+}
+
+// Dropped returns the number of events that were dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe removes the subscription from the bus. It's safe to call it multiple times and from
+// inside the function of a SubscribeFunc.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		// unblocks publishers that wait for space in the buffer
+		close(s.done)
+
+		s.mutex.Lock()
+		s.closed = true
+		if s.ch != nil {
+			close(s.ch)
+		}
+		s.mutex.Unlock()
+
+		s.bus.remove(s)
+	})
+}
+
+func (s *Subscription) matches(msg EventMessage) bool {
+	if len(s.events) > 0 && !s.events[msg.Event] {
+		return false
+	}
+
+	if len(s.nodes) > 0 && !s.nodes[msg.Node.ID] {
+		return false
+	}
+
+	return true
+}
+
+func (s *Subscription) deliver(msg EventMessage) {
+	if s.fn != nil {
+		select {
+		case <-s.done:
+		default:
+			s.fn(msg)
+		}
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	switch s.overflow {
+	case OverflowBlock:
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+		}
+	case OverflowDropNewest:
+		select {
+		case s.ch <- msg:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	default: // OverflowDropOldest
+		for {
+			select {
+			case s.ch <- msg:
+				return
+			default:
+			}
+
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// EventBus distributes the events of the emulator to any number of subscribers.
+type EventBus struct {
+	sync.Mutex
+
+	// replaced on every change so that publishers can iterate without holding the lock
+	subscriptions []*Subscription
+}
+
+// NewEventBus creates a new event bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe adds a subscriber that receives the events over a buffered channel.
+func (b *EventBus) Subscribe(options SubscribeOptions) *Subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultSubscriberBuffer
+	}
+
+	sub := b.newSubscription(options.Events, options.Nodes)
+	sub.overflow = options.Overflow
+	sub.ch = make(chan EventMessage, options.Buffer)
+
+	b.add(sub)
+
+	return sub
+}
+
+// SubscribeFunc adds a subscriber that is called synchronously by the publisher for the given events or for
+// all events if none are given. The function can be called concurrently and, as events are mostly published
+// while the emulator is locked, must not call functions of the emulator that lock it.
+func (b *EventBus) SubscribeFunc(fn func(msg EventMessage), events ...Event) *Subscription {
+	sub := b.newSubscription(events, nil)
+	sub.fn = fn
+
+	b.add(sub)
+
+	return sub
+}
+
+// Publish delivers the event to all matching subscribers.
+func (b *EventBus) Publish(msg EventMessage) {
+	b.Lock()
+	subscriptions := b.subscriptions
+	b.Unlock()
+
+	for _, sub := range subscriptions {
+		if sub.matches(msg) {
+			sub.deliver(msg)
+		}
+	}
+}
+
+// Subscribers returns the number of active subscriptions.
+func (b *EventBus) Subscribers() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return len(b.subscriptions)
+}
+
+func (b *EventBus) newSubscription(events []Event, nodes []string) *Subscription {
+	sub := &Subscription{
+		bus:    b,
+		events: map[Event]bool{},
+		nodes:  map[string]bool{},
+		done:   make(chan bool),
+	}
+
+	for _, event := range events {
+		sub.events[event] = true
+	}
+
+	for _, id := range nodes {
+		sub.nodes[id] = true
+	}
+
+	return sub
+}
+
+func (b *EventBus) add(sub *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	subscriptions := make([]*Subscription, len(b.subscriptions), len(b.subscriptions)+1)
+	copy(subscriptions, b.subscriptions)
+	b.subscriptions = append(subscriptions, sub)
+}
+
+func (b *EventBus) remove(sub *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	subscriptions := make([]*Subscription, 0, len(b.subscriptions))
+	for i := range b.subscriptions {
+		if b.subscriptions[i] != sub {
+			subscriptions = append(subscriptions, b.subscriptions[i])
+		}
+	}
+	b.subscriptions = subscriptions
+}
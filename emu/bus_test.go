@@ -0,0 +1,205 @@
+package emu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/BigJk/loraemu/lora"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus_Filter(t *testing.T) {
+	bus := NewEventBus()
+
+	all := bus.Subscribe(SubscribeOptions{})
+	sending := bus.Subscribe(SubscribeOptions{Events: []Event{EventSending}})
+	node2 := bus.Subscribe(SubscribeOptions{Nodes: []string{"2"}})
+
+	var called []Event
+	fn := bus.SubscribeFunc(func(msg EventMessage) {
+		called = append(called, msg.Event)
+	}, EventReceived, EventCollision)
+
+	assert.Equal(t, 4, bus.Subscribers())
+
+	bus.Publish(EventMessage{Event: EventSending, Node: Node{ID: "1"}})
+	bus.Publish(EventMessage{Event: EventReceived, Node: Node{ID: "2"}, Data: RxPacket{RSSI: -20}})
+	bus.Publish(EventMessage{Event: EventNodeUpdated, Node: Node{ID: "3"}})
+
+	assert.Len(t, all.Events(), 3)
+	assert.Len(t, sending.Events(), 1)
+	assert.Len(t, node2.Events(), 1)
+	assert.Equal(t, []Event{EventReceived}, called)
+
+	msg := <-node2.Events()
+	if packet, ok := msg.Packet(); assert.True(t, ok) {
+		assert.Equal(t, -20, packet.RSSI)
+	}
+
+	// unsubscribed channels are closed and don't receive further events
+	all.Unsubscribe()
+	all.Unsubscribe()
+	fn.Unsubscribe()
+	assert.Equal(t, 2, bus.Subscribers())
+
+	bus.Publish(EventMessage{Event: EventReceived, Node: Node{ID: "2"}})
+	assert.Len(t, called, 1)
+
+	count := 0
+	for range all.Events() {
+		count++
+	}
+	assert.Equal(t, 3, count)
+}
+
+func TestEventBus_Overflow(t *testing.T) {
+	bus := NewEventBus()
+
+	newest := bus.Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowDropNewest})
+	oldest := bus.Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowDropOldest})
+	fallback := bus.Subscribe(SubscribeOptions{Buffer: 2})
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		bus.Publish(EventMessage{Event: EventSending, Node: Node{ID: id}})
+	}
+
+	ids := func(sub *Subscription) []string {
+		var ids []string
+		for len(sub.Events()) > 0 {
+			ids = append(ids, (<-sub.Events()).Node.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"1", "2"}, ids(newest))
+	assert.Equal(t, uint64(2), newest.Dropped())
+	assert.Equal(t, []string{"3", "4"}, ids(oldest))
+	assert.Equal(t, uint64(2), oldest.Dropped())
+	assert.Equal(t, []string{"3", "4"}, ids(fallback), "default policy doesn't drop the oldest")
+}
+
+func TestEventBus_Block(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe(SubscribeOptions{Buffer: 1, Overflow: OverflowBlock})
+
+	bus.Publish(EventMessage{Event: EventSending})
+
+	published := make(chan bool)
+	go func() {
+		bus.Publish(EventMessage{Event: EventSending})
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		assert.Fail(t, "publish didn't block on full buffer")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// unsubscribing releases the blocked publisher
+	sub.Unsubscribe()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		assert.Fail(t, "publish still blocked after unsubscribe")
+	}
+}
+
+func TestEmulator_Subscribers(t *testing.T) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+
+	assert.NoError(t, e.AddNode(Node{ID: "1", Online: true, X: 1, Y: 1, TXGain: 40, RXSens: -200}))
+	assert.NoError(t, e.AddNode(Node{ID: "2", Online: true, X: 1.3, Y: 1, TXGain: 40, RXSens: -200}))
+
+	var mutex sync.Mutex
+	trace := &bytes.Buffer{}
+	e.SetTraceWriter(&lockedWriter{mutex: &mutex, writer: trace})
+
+	var legacy []string
+	e.SetOnReceived(func(node Node, packet RxPacket) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		legacy = append(legacy, string(packet.Data))
+	})
+
+	received := e.Subscribe(SubscribeOptions{Events: []Event{EventReceived}})
+
+	// self unsubscribing subscriber
+	var once []Event
+	var onceSub *Subscription
+	onceSub = e.SubscribeFunc(func(msg EventMessage) {
+		once = append(once, msg.Event)
+		onceSub.Unsubscribe()
+	}, EventSending)
+
+	// wait in between so that the order of the receptions doesn't depend on the scheduling of their goroutines
+	assert.NoError(t, e.SendMessage("1", []byte("hello")))
+	e.Wait()
+	assert.NoError(t, e.SendMessage("1", []byte("world")))
+	e.Wait()
+
+	assert.Equal(t, []Event{EventSending}, once)
+
+	for _, data := range []string{"hello", "world"} {
+		select {
+		case msg := <-received.Events():
+			assert.Equal(t, "2", msg.Node.ID)
+			packet, _ := msg.Packet()
+			assert.Equal(t, data, string(packet.Data))
+		case <-time.After(time.Second):
+			assert.Fail(t, "subscriber didn't receive packet")
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	assert.Equal(t, []string{"hello", "world"}, legacy)
+
+	lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		var entry LogEntry
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal(t, EventSending, entry.Event)
+		assert.Equal(t, "1", entry.NodeID)
+	}
+}
+
+func TestEmulator_TraceErr(t *testing.T) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	e.SetTraceWriter(failingWriter{})
+
+	assert.NoError(t, e.TraceErr())
+	assert.NoError(t, e.AddNode(Node{ID: "1", Online: true}))
+	assert.EqualError(t, e.TraceErr(), "disk full")
+
+	// a new writer resets the error
+	e.SetTraceWriter(&bytes.Buffer{})
+	assert.NoError(t, e.TraceErr())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+type lockedWriter struct {
+	mutex  *sync.Mutex
+	writer *bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.writer.Write(p)
+}
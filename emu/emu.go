@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/BigJk/loraemu/lora"
 	"io"
+	"math"
 	"sync"
 	"time"
 
@@ -21,6 +22,17 @@ const (
 	EventSending             = Event("NodeSending")
 	EventReceived            = Event("NodeReceived")
 	EventPayloadSizeExceeded = Event("NodePayloadSizeExceeded")
+	EventFaultPacketDropped  = Event("FaultPacketDropped")
+	EventFaultPacketCorrupt  = Event("FaultPacketCorrupted")
+	EventFaultPacketDuped    = Event("FaultPacketDuplicated")
+	EventFaultNodeCrashed    = Event("FaultNodeCrashed")
+	EventFaultNodeRecovered  = Event("FaultNodeRecovered")
+	EventDemodulatorsBusy    = Event("GatewayDemodulatorsBusy")
+	EventScriptError         = Event("NodeScriptError")
+	EventQueueOverflow       = Event("NodeQueueOverflow")
+	EventInterceptorDropped  = Event("InterceptorPacketDropped")
+	EventLinkUp              = Event("LinkUp")
+	EventLinkDown            = Event("LinkDown")
 )
 
 const (
@@ -43,13 +55,56 @@ type LogEntry struct {
 
 // RxPacket represents a received packet with its corresponding signal information.
 type RxPacket struct {
-	RSSI     int     `json:"rssi"`
-	SNR      int     `json:"snr"`
-	Data     []byte  `json:"data"`
-	RecvTime int64   `json:"recvTime"`
-	Airtime  float64 `json:"airtime"`
+	RSSI            int     `json:"rssi"`
+	SNR             int     `json:"snr"`
+	Data            []byte  `json:"data"`
+	RecvTime        int64   `json:"recvTime"`
+	Airtime         float64 `json:"airtime"`
+	RecvTimeMicro   int64   `json:"recvTimeMicro"`
+	CRCFailed       bool    `json:"crcFailed"`
+	Freq            float64 `json:"freq"`
+	SpreadingFactor float64 `json:"spreadingFactor"`
+	BandWidth       float64 `json:"bandWidth"`
 }
 
+// Reception is the data of EventReceived and EventCollision. It contains the packet as it arrived at the
+// receiver and the transmission it belongs to.
+type Reception struct {
+	RxPacket
+	// From is the id of the sender.
+	From string `json:"from"`
+	// Sent is the start of the transmission as unix timestamp in ms, like the start of EventSending.
+	Sent int64 `json:"sent"`
+}
+
+// TxParams overrides the radio parameters of a single transmission. Zero values fall back to the
+// node radio settings and the packet config of the emulator.
+type TxParams struct {
+	Freq            float64 `json:"freq"`
+	SpreadingFactor float64 `json:"spreadingFactor"`
+	BandWidth       float64 `json:"bandWidth"`
+	CodingRate      float64 `json:"codingRate"`
+
+	// Priority orders the transmission in the TX queue of the node. Transmissions with a higher priority
+	// are sent before the ones with a lower priority, equal priorities are sent in FIFO order.
+	Priority int `json:"priority"`
+
+	// OnDone is called when the transmission finished or was rejected. It is called outside the
+	// emulator lock, so other emulator functions can be used in it.
+	OnDone func(result TxResult, err error) `json:"-"`
+}
+
+// TxResult represents a finished transmission. Start and Stop are unix timestamps in ms of the
+// emulator time and the Airtime is in ms of emulator time.
+type TxResult struct {
+	Start   int64   `json:"start"`
+	Stop    int64   `json:"stop"`
+	Airtime float64 `json:"airtime"`
+}
+
+// ErrPayloadSizeExceeded is passed to TxParams.OnDone if the packet is too long.
+var ErrPayloadSizeExceeded = errors.New("payload size exceeded")
+
 type OnReceivedFn func(node Node, packet RxPacket)
 type OnEventFn func(event Event, node Node, data any)
 
@@ -66,32 +121,48 @@ type Emulator struct {
 	timeScaling      int
 	packetConfig     lora.PacketConfig
 	nodes            map[string]Node
-	onReceived       OnReceivedFn
-	onEvent          OnEventFn
+	bus              *EventBus
+	attached         map[string]OnReceivedFn
 	snrOffset        int
+	faults           *Faults
+	interceptors     []namedInterceptor
+	txQueues         map[string]*txQueue
+	txQueueCapacity  int
+	nextTxID         uint64
+	links            map[linkKey]bool
+	maxAirtime       float64
+
+	// counted per node id outside the nodes, so that updates of a node don't reset them
+	belowSensitivity map[string]int
 
 	startTime int64
 
-	traceMutex sync.Mutex
-	trace      io.Writer
-	logger     logr.Logger
+	traceSub      *Subscription
+	traceMutex    sync.Mutex
+	traceErr      error
+	onEventSub    *Subscription
+	onReceivedSub *Subscription
+	logger        logr.Logger
 }
 
 // New creates a new emulator with the given frequency, gamma (which is the Log-Distance Path Loss exponent)
 // and LoRa packet config.
 func New(freq float64, gamma float64, refDist float64, kmRange float64, config lora.PacketConfig) *Emulator {
 	return &Emulator{
-		freq:         freq,
-		gamma:        gamma,
-		refDist:      refDist,
-		kmRange:      kmRange,
-		timeScaling:  1,
-		packetConfig: config,
-		nodes:        map[string]Node{},
-		onReceived:   func(node Node, packet RxPacket) {},
-		onEvent:      func(event Event, node Node, data any) {},
-		startTime:    time.Now().UnixMilli(),
-		logger:       logr.Discard(),
+		freq:             freq,
+		gamma:            gamma,
+		refDist:          refDist,
+		kmRange:          kmRange,
+		timeScaling:      1,
+		packetConfig:     config,
+		nodes:            map[string]Node{},
+		bus:              NewEventBus(),
+		attached:         map[string]OnReceivedFn{},
+		txQueues:         map[string]*txQueue{},
+		txQueueCapacity:  DefaultTXQueueCapacity,
+		belowSensitivity: map[string]int{},
+		startTime:        time.Now().UnixMilli(),
+		logger:           logr.Discard(),
 	}
 }
 
@@ -115,12 +186,63 @@ func (emu *Emulator) GetStartTime() int64 {
 	return emu.startTime
 }
 
+func (emu *Emulator) GetPacketConfig() lora.PacketConfig {
+	return emu.packetConfig
+}
+
+func (emu *Emulator) GetTimeScaling() int {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	return emu.timeScaling
+}
+
 // SetTraceWriter sets the writer for the trace logs. If no writer was set no trace logs will be emitted.
+// The trace writer is a subscriber of the event bus that replaces the previously set writer. Write errors
+// are reported by TraceErr. See the trace package for rotated and filtered trace files.
 func (emu *Emulator) SetTraceWriter(writer io.Writer) {
 	emu.Lock()
 	defer emu.Unlock()
 
-	emu.trace = writer
+	if emu.traceSub != nil {
+		emu.traceSub.Unsubscribe()
+		emu.traceSub = nil
+	}
+
+	emu.traceMutex.Lock()
+	emu.traceErr = nil
+	emu.traceMutex.Unlock()
+
+	if writer == nil {
+		return
+	}
+
+	emu.traceSub = emu.bus.SubscribeFunc(func(msg EventMessage) {
+		bytes, err := json.Marshal(msg.LogEntry())
+		if err == nil {
+			bytes = append(bytes, '\n')
+		}
+
+		emu.traceMutex.Lock()
+		defer emu.traceMutex.Unlock()
+
+		if err == nil {
+			_, err = writer.Write(bytes)
+		}
+
+		// the first error is kept, following writes most likely fail for the same reason
+		if err != nil && emu.traceErr == nil {
+			emu.traceErr = err
+		}
+	})
+}
+
+// TraceErr returns the first error that occurred while writing to the trace writer or nil.
+func (emu *Emulator) TraceErr() error {
+	emu.traceMutex.Lock()
+	defer emu.traceMutex.Unlock()
+
+	return emu.traceErr
 }
 
 // SetLogger sets the logger. This will log additional information that are not relevant for the trace.
@@ -131,20 +253,92 @@ func (emu *Emulator) SetLogger(logger logr.Logger) {
 	emu.logger = logger
 }
 
-// SetOnReceived sets the callback that should be called if a simulated node receives a message.
+// Bus returns the event bus the events of the emulator are published on.
+func (emu *Emulator) Bus() *EventBus {
+	return emu.bus
+}
+
+// Subscribe adds a subscriber to the event bus of the emulator that receives the events over a buffered channel.
+func (emu *Emulator) Subscribe(options SubscribeOptions) *Subscription {
+	return emu.bus.Subscribe(options)
+}
+
+// SubscribeFunc adds a subscriber to the event bus of the emulator that is called synchronously for the given
+// events or for all events if none are given. See EventBus.SubscribeFunc.
+func (emu *Emulator) SubscribeFunc(fn func(msg EventMessage), events ...Event) *Subscription {
+	return emu.bus.SubscribeFunc(fn, events...)
+}
+
+// SetOnReceived sets the callback that should be called if a simulated node receives a message. It replaces
+// the callback that was set before, but not the other subscribers of the event bus.
+//
+// Deprecated: Use SubscribeFunc with EventReceived, which supports multiple subscribers.
 func (emu *Emulator) SetOnReceived(onReceived OnReceivedFn) {
 	emu.Lock()
 	defer emu.Unlock()
 
-	emu.onReceived = onReceived
+	if emu.onReceivedSub != nil {
+		emu.onReceivedSub.Unsubscribe()
+	}
+
+	emu.onReceivedSub = emu.bus.SubscribeFunc(func(msg EventMessage) {
+		if packet, ok := msg.Packet(); ok {
+			onReceived(msg.Node, packet)
+		}
+	}, EventReceived)
 }
 
-// SetOnEvent sets the callback that should be called if a event happens in the simulator.
+// SetOnEvent sets the callback that should be called if a event happens in the simulator. It replaces the
+// callback that was set before, but not the other subscribers of the event bus.
+//
+// Deprecated: Use SubscribeFunc, which supports multiple subscribers.
 func (emu *Emulator) SetOnEvent(onEvent OnEventFn) {
 	emu.Lock()
 	defer emu.Unlock()
 
-	emu.onEvent = onEvent
+	if emu.onEventSub != nil {
+		emu.onEventSub.Unsubscribe()
+	}
+
+	emu.onEventSub = emu.bus.SubscribeFunc(func(msg EventMessage) {
+		onEvent(msg.Event, msg.Node, msg.Data)
+	})
+}
+
+// SetFaults sets the fault injector that decides if delivered packets get dropped, corrupted or duplicated.
+// Passing nil disables the fault injection for packets.
+func (emu *Emulator) SetFaults(faults *Faults) {
+	emu.Lock()
+	defer emu.Unlock()
+
+	emu.faults = faults
+}
+
+// AttachNode attaches a in-process handler to a node that will be called with every packet the node receives.
+// This makes it possible to drive a node from inside the emulator process. Only one handler can be attached per node.
+func (emu *Emulator) AttachNode(id string, onReceived OnReceivedFn) error {
+	emu.Lock()
+	defer emu.Unlock()
+
+	if _, ok := emu.nodes[id]; !ok {
+		return errors.New("not found")
+	}
+
+	if _, ok := emu.attached[id]; ok {
+		return errors.New("already attached")
+	}
+
+	emu.attached[id] = onReceived
+
+	return nil
+}
+
+// DetachNode removes the in-process handler of a node.
+func (emu *Emulator) DetachNode(id string) {
+	emu.Lock()
+	defer emu.Unlock()
+
+	delete(emu.attached, id)
 }
 
 // SetIgnoreCollision enables or disables the collision detection.
@@ -239,7 +433,8 @@ func (emu *Emulator) AddNode(node Node) error {
 	}
 
 	emu.nodes[node.ID] = node
-	emu.emitEvent(EventNodeAdded, node, nil)
+	emu.emitEvent(EventNodeAdded, node, node)
+	emu.updateLinksLocked(node.ID)
 
 	return nil
 }
@@ -269,7 +464,8 @@ func (emu *Emulator) UpdateNode(id string, updater func(node *Node) error) error
 
 	emu.nodes[id] = selectedNode
 
-	emu.emitEvent(EventNodeUpdated, selectedNode, nil)
+	emu.emitEvent(EventNodeUpdated, selectedNode, selectedNode)
+	emu.updateLinksLocked(id)
 
 	return nil
 }
@@ -285,7 +481,11 @@ func (emu *Emulator) RemoveNode(id string) error {
 	}
 
 	delete(emu.nodes, id)
-	emu.emitEvent(EventNodeRemoved, node, nil)
+	delete(emu.attached, id)
+	delete(emu.belowSensitivity, id)
+	emu.dropQueueLocked(id)
+	emu.emitEvent(EventNodeRemoved, node, node)
+	emu.updateLinksLocked(id)
 
 	return nil
 }
@@ -295,124 +495,304 @@ func (emu *Emulator) Clear() {
 	emu.Lock()
 	defer emu.Unlock()
 
+	for id := range emu.txQueues {
+		emu.dropQueueLocked(id)
+	}
+
 	emu.nodes = map[string]Node{}
+	emu.attached = map[string]OnReceivedFn{}
+	emu.belowSensitivity = map[string]int{}
+
+	if emu.links != nil {
+		emu.links = map[linkKey]bool{}
+	}
 }
 
 func (emu *Emulator) getTime() time.Time {
-	elapsed := time.Now().UnixMilli() - emu.startTime
+	elapsed := time.Now().UnixMicro() - emu.startTime*1000
 	elapsed *= int64(emu.timeScaling)
-	return time.UnixMilli(emu.startTime + elapsed)
+	return time.UnixMicro(emu.startTime*1000 + elapsed)
+}
+
+// Now returns the current time of the emulator, which runs faster than the wall clock if a time scaling is set.
+func (emu *Emulator) Now() time.Time {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	return emu.getTime()
+}
+
+// Schedule calls fn after the given duration of emulator time has passed. Scheduled functions are
+// tracked, so Wait will also wait for them.
+func (emu *Emulator) Schedule(delay time.Duration, fn func()) {
+	emu.RLock()
+	wait := delay / time.Duration(emu.timeScaling)
+	emu.RUnlock()
+
+	emu.Add(1)
+	time.AfterFunc(wait, func() {
+		defer emu.Done()
+		fn()
+	})
 }
 
 func (emu *Emulator) emitEvent(event Event, node Node, data any) {
-	emu.onEvent(event, node, data)
-
-	// TODO: error handling
-	if emu.trace != nil {
-		bytes, _ := json.Marshal(LogEntry{
-			Time:   emu.getTime(),
-			Event:  event,
-			NodeID: node.ID,
-			Data:   data,
-		})
+	emu.bus.Publish(EventMessage{
+		Time:  emu.getTime(),
+		Event: event,
+		Node:  node,
+		Data:  data,
+	})
+}
 
-		emu.traceMutex.Lock()
-		defer emu.traceMutex.Unlock()
+// EmitEvent emits a event for the node with the given id, so that components outside the emulator can
+// report to the trace log and the web view.
+func (emu *Emulator) EmitEvent(event Event, id string, data any) error {
+	emu.RLock()
+	defer emu.RUnlock()
 
-		_, _ = emu.trace.Write(bytes)
-		_, _ = emu.trace.Write([]byte{'\n'})
+	node, ok := emu.nodes[id]
+	if !ok {
+		return errors.New("not found")
 	}
+
+	emu.emitEvent(event, node, data)
+
+	return nil
+}
+
+// afterLocked is like Schedule but can be used while the lock of the emulator is held.
+func (emu *Emulator) afterLocked(delay time.Duration, fn func()) {
+	emu.Add(1)
+	time.AfterFunc(delay/time.Duration(emu.timeScaling), func() {
+		defer emu.Done()
+		fn()
+	})
 }
 
 // SendMessage starts the data sending for a given node by id.
 func (emu *Emulator) SendMessage(id string, msg []byte) error {
+	return emu.SendMessageWithParams(id, msg, TxParams{})
+}
+
+// SendMessageWithParams starts the data sending for a given node by id with radio parameters that
+// override the settings of the node for this transmission. If the node is still sending, the
+// transmission waits in the TX queue of the node.
+func (emu *Emulator) SendMessageWithParams(id string, msg []byte, params TxParams) error {
 	emu.Lock()
 	defer emu.Unlock()
 
-	if _, ok := emu.nodes[id]; !ok {
+	sender, ok := emu.nodes[id]
+	if !ok {
 		return errors.New("not found")
 	}
 
-	sender := emu.nodes[id]
 	if !sender.Online {
-		return errors.New("sender not online")
+		return ErrSenderOffline
 	}
 
-	packet := emu.packetConfig
-	packet.PayloadLen = float64(len(msg))
-
 	// Deny packets that are too long
 	if len(msg)+int(emu.packetConfig.PreambleLen) >= MaxPacketLen {
-		emu.emitEvent(EventPayloadSizeExceeded, sender, map[string]interface{}{
-			"size":                len(msg) + int(emu.packetConfig.PreambleLen),
-			"theoretical_airtime": packet.TimeTotal(),
+		packet, _ := emu.txPacket(sender, len(msg), params)
+
+		emu.emitEvent(EventPayloadSizeExceeded, sender, PayloadSizeExceeded{
+			Size:               len(msg) + int(emu.packetConfig.PreambleLen),
+			TheoreticalAirtime: packet.TimeTotal(),
 		})
 
+		if params.OnDone != nil {
+			emu.afterLocked(0, func() {
+				params.OnDone(TxResult{Airtime: packet.TimeTotal()}, ErrPayloadSizeExceeded)
+			})
+		}
+
 		return nil
 	}
 
+	// We are already sending or older transmissions are waiting, so the packet needs to be queued.
+	if emu.getTime().UnixMilli() <= sender.sendingUntil || emu.queueLen(id) > 0 {
+		return emu.enqueueLocked(sender, msg, params)
+	}
+
+	emu.transmitLocked(sender, msg, params)
+
+	return nil
+}
+
+// txPacket returns the packet config and frequency of a transmission of the node.
+func (emu *Emulator) txPacket(sender Node, size int, params TxParams) (lora.PacketConfig, float64) {
+	packet := emu.packetConfig
+	packet.PayloadLen = float64(size)
+	packet.SpreadingFactor = emu.radioSpreadingFactor(sender)
+	freq := emu.radioFreq(sender)
+
+	if params.Freq > 0 {
+		freq = params.Freq
+	}
+
+	if params.SpreadingFactor > 0 {
+		packet.SpreadingFactor = params.SpreadingFactor
+	}
+
+	if params.BandWidth > 0 {
+		packet.BandWidth = params.BandWidth
+	}
+
+	if params.CodingRate > 0 {
+		packet.CodingRate = params.CodingRate
+	}
+
+	return packet, freq
+}
+
+// ReachedGain returns the signal strength in dBm of a packet from the sender at the position of the
+// receiver after the path loss.
+func (emu *Emulator) ReachedGain(sender Node, receiver Node) float64 {
+	return sender.TXGain - sender.PathLoss(receiver, emu.refDist, emu.gamma, emu.freq)
+}
+
+// pruneReceiving returns the receptions that ended after the horizon. The collision checks read the slice without
+// holding the lock, so a new slice is allocated instead of changing the old one.
+func pruneReceiving(receiving []received, horizon int64) []received {
+	expired := 0
+	for i := range receiving {
+		if receiving[i].Stop < horizon {
+			expired++
+		}
+	}
+
+	if expired == 0 {
+		return receiving
+	}
+
+	pruned := make([]received, 0, len(receiving)-expired+1)
+	for i := range receiving {
+		if receiving[i].Stop >= horizon {
+			pruned = append(pruned, receiving[i])
+		}
+	}
+
+	return pruned
+}
+
+// transmitLocked sends the packet of a node that isn't sending at the moment. The lock of the
+// emulator needs to be held.
+func (emu *Emulator) transmitLocked(sender Node, msg []byte, params TxParams) {
+	id := sender.ID
+	packet, freq := emu.txPacket(sender, len(msg), params)
+
 	start := emu.getTime().UnixMilli()
 	stop := start + int64(packet.TimeTotal())
 
-	// We are already sending and need to wait for the sent to finish.
-	if start <= sender.sendingUntil {
-		emu.Add(1)
-		go func() {
-			wait := (1000 * float64(sender.sendingUntil-start+1)) / float64(emu.timeScaling)
-			time.Sleep(time.Microsecond * time.Duration(wait))
-			_ = emu.SendMessage(id, msg)
-			emu.Done()
-		}()
-
-		return nil
+	// receptions that ended more than the longest airtime ago can't overlap with a packet that is still in flight
+	if packet.TimeTotal() > emu.maxAirtime {
+		emu.maxAirtime = packet.TimeTotal()
 	}
+	horizon := start - int64(math.Ceil(emu.maxAirtime))
 
 	// Set the sending until
 	sender.sendingUntil = stop
 	emu.nodes[id] = sender
 
-	emu.emitEvent(EventSending, sender, map[string]interface{}{
-		"start":   start,
-		"stop":    stop,
-		"airtime": packet.TimeTotal(),
-		"x":       sender.X,
-		"y":       sender.Y,
-		"z":       sender.Z,
+	if params.OnDone != nil {
+		result := TxResult{Start: start, Stop: stop, Airtime: packet.TimeTotal()}
+		emu.afterLocked(time.Duration(packet.TimeTotal()*float64(time.Millisecond)), func() {
+			params.OnDone(result, nil)
+		})
+	}
+
+	emu.emitEvent(EventSending, sender, Transmission{
+		Start:           start,
+		Stop:            stop,
+		Airtime:         packet.TimeTotal(),
+		Freq:            freq,
+		SpreadingFactor: packet.SpreadingFactor,
+		BandWidth:       packet.BandWidth,
+		Data:            msg,
+		X:               sender.X,
+		Y:               sender.Y,
+		Z:               sender.Z,
 	})
 
 	for k, receiver := range emu.nodes {
-		if k == id || !receiver.Online {
+		if k == id || !receiver.Online || !emu.canDemodulate(receiver, freq, packet.SpreadingFactor) {
 			continue
 		}
 
-		reachedGain := sender.TXGain - sender.PathLoss(receiver, emu.refDist, emu.gamma, emu.freq)
+		data := msg
+		delay := time.Duration(0)
+		reachedGain := emu.ReachedGain(sender, receiver)
+
+		if len(emu.interceptors) > 0 {
+			intercepted := InterceptedPacket{
+				Sender:          sender,
+				Receiver:        receiver,
+				Data:            append([]byte{}, msg...),
+				Gain:            reachedGain,
+				Freq:            freq,
+				SpreadingFactor: packet.SpreadingFactor,
+				Start:           start,
+				Stop:            stop,
+			}
+
+			if name, ok := emu.interceptLocked(&intercepted); !ok {
+				emu.emitEvent(EventInterceptorDropped, receiver, InterceptorDropped{
+					From:        id,
+					Interceptor: name,
+					Size:        len(msg),
+				})
+				continue
+			}
+
+			data = intercepted.Data
+			reachedGain = intercepted.Gain
+			delay = intercepted.Delay
+		}
+
 		if reachedGain > receiver.RXSens {
+			// a gateway can only receive as many packets at once as it has demodulators
+			if receiver.IsGateway() && demodulatorsInUse(receiver, start) >= emu.gatewayConfig(receiver).Demodulators {
+				receiver.demodulatorsBusy++
+				emu.nodes[k] = receiver
+
+				emu.emitEvent(EventDemodulatorsBusy, receiver, DemodulatorsBusy{
+					From:            id,
+					Freq:            freq,
+					SpreadingFactor: packet.SpreadingFactor,
+				})
+
+				continue
+			}
+
 			emu.logger.Info("sending", "from", id, "to", k, "gain", reachedGain, "margin", reachedGain-receiver.RXSens, "dist", sender.DistanceTo(receiver))
 
 			r := received{
-				Start: start,
-				Stop:  stop,
-				Gain:  reachedGain,
+				Start:           start,
+				Stop:            stop,
+				Gain:            reachedGain,
+				Freq:            freq,
+				SpreadingFactor: packet.SpreadingFactor,
 			}
 
-			receiver.receiving = append(receiver.receiving, r)
+			receiver.receiving = append(pruneReceiving(receiver.receiving, horizon), r)
 			emu.nodes[k] = receiver
 
 			emu.Add(1)
-			go func(id string, sleep float64, gain float64, timeFrame received, msg []byte) {
+			go func(id string, sleep float64, delay time.Duration, gain float64, bandWidth float64, timeFrame received, msg []byte) {
 				defer emu.Done()
 
 				time.Sleep(time.Microsecond * time.Duration(1000*sleep))
 
 				emu.RLock()
-
 				node, ok := emu.nodes[id]
+				faults := emu.faults
+				attached := emu.attached[id]
+				emu.RUnlock()
+
 				if !ok {
 					return
 				}
 
-				emu.RUnlock()
-
 				collisions := 0
 
 				// node is sending itself and can't receive at the same time
@@ -420,29 +800,80 @@ func (emu *Emulator) SendMessage(id string, msg []byte) error {
 					collisions++
 				}
 
-				// check if multiple packets arrive
+				// check if multiple packets arrive on the same channel and spreading factor
 				for i := range node.receiving {
-					if timeFrame.Start >= node.receiving[i].Start && timeFrame.Start <= node.receiving[i].Stop && gain-node.receiving[i].Gain < CollisionDecodeableLevel {
+					if !sameFreq(timeFrame.Freq, node.receiving[i].Freq) || timeFrame.SpreadingFactor != node.receiving[i].SpreadingFactor {
+						continue
+					}
+
+					if timeFrame.Start <= node.receiving[i].Stop && node.receiving[i].Start <= timeFrame.Stop && gain-node.receiving[i].Gain < CollisionDecodeableLevel {
 						collisions += 1
 					}
 				}
 
+				now := emu.getTime()
+				packet := RxPacket{
+					RSSI:            int(gain),
+					SNR:             int(gain) + node.SNR + emu.snrOffset,
+					Data:            msg,
+					RecvTime:        now.Unix(),
+					RecvTimeMicro:   now.UnixMicro(),
+					Airtime:         sleep,
+					Freq:            timeFrame.Freq,
+					SpreadingFactor: timeFrame.SpreadingFactor,
+					BandWidth:       bandWidth,
+				}
+
 				if emu.ignoreCollisions || collisions <= 1 {
-					packet := RxPacket{
-						RSSI:     int(gain),
-						SNR:      int(gain) + node.SNR + emu.snrOffset,
-						Data:     msg,
-						RecvTime: emu.getTime().Unix(),
-						Airtime:  sleep,
+					if delay > 0 {
+						time.Sleep(delay)
+
+						now = emu.getTime()
+						packet.RecvTime = now.Unix()
+						packet.RecvTimeMicro = now.UnixMicro()
+					}
+
+					deliveries := 1
+					if faults != nil {
+						if faults.drop(node.ID) {
+							emu.emitEvent(EventFaultPacketDropped, node, FaultPacket{
+								From: sender.ID,
+								Size: len(msg),
+							})
+							return
+						}
+
+						if corrupted, flipped := faults.corrupt(msg); len(flipped) > 0 {
+							packet.Data = corrupted
+							packet.CRCFailed = emu.packetConfig.CRC
+							emu.emitEvent(EventFaultPacketCorrupt, node, FaultPacketCorrupted{
+								From:      sender.ID,
+								Bits:      flipped,
+								CRCFailed: packet.CRCFailed,
+							})
+						}
+
+						if faults.duplicate() {
+							deliveries++
+							emu.emitEvent(EventFaultPacketDuped, node, FaultPacket{
+								From: sender.ID,
+								Size: len(msg),
+							})
+						}
+					}
+
+					for i := 0; i < deliveries; i++ {
+						if attached != nil {
+							attached(node, packet)
+						}
+						emu.emitEvent(EventReceived, node, Reception{RxPacket: packet, From: sender.ID, Sent: timeFrame.Start})
 					}
-					emu.onReceived(node, packet)
-					emu.emitEvent(EventReceived, node, packet)
 				} else {
-					emu.emitEvent(EventCollision, node, packet)
+					emu.emitEvent(EventCollision, node, Reception{RxPacket: packet, From: sender.ID, Sent: timeFrame.Start})
 				}
-			}(k, packet.TimeTotal()/float64(emu.timeScaling), reachedGain, r, msg)
+			}(k, packet.TimeTotal()/float64(emu.timeScaling), delay/time.Duration(emu.timeScaling), reachedGain, packet.BandWidth, r, data)
+		} else {
+			emu.belowSensitivity[k]++
 		}
 	}
-
-	return nil
 }
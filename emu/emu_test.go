@@ -2,8 +2,11 @@ package emu
 
 import (
 	"fmt"
+	"github.com/BigJk/loraemu/lora"
 	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,7 +21,7 @@ var timeScaling = []int{1, 10, 20, 50, 100}
 func TestEmulator_Collision(t *testing.T) {
 	for _, scale := range timeScaling {
 		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
-			e := New(868, 10, 1, 10, lora.PacketConfigDefault)
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
 			assert.NoError(t, e.SetTimeScaling(scale))
 
 			assert.NoError(t, e.AddNode(Node{
@@ -54,11 +57,11 @@ func TestEmulator_Collision(t *testing.T) {
 				SNR:    0,
 			}))
 
-			gotCollision := 0
+			var gotCollision int32
 
 			e.SetOnEvent(func(event Event, node Node, data any) {
 				if event == EventCollision {
-					gotCollision++
+					atomic.AddInt32(&gotCollision, 1)
 				}
 
 				if event == EventReceived {
@@ -71,7 +74,7 @@ func TestEmulator_Collision(t *testing.T) {
 
 			e.Wait()
 
-			assert.Equal(t, 4, gotCollision, "collisions not detected")
+			assert.Equal(t, int32(4), atomic.LoadInt32(&gotCollision), "collisions not detected")
 		})
 	}
 }
@@ -81,7 +84,7 @@ func TestEmulator_Collision(t *testing.T) {
 func TestEmulator_CollisionPowerLevel(t *testing.T) {
 	for _, scale := range timeScaling {
 		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
-			e := New(868, 10, 1, 10, lora.PacketConfigDefault)
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
 			assert.NoError(t, e.SetTimeScaling(scale))
 
 			assert.NoError(t, e.AddNode(Node{
@@ -117,11 +120,11 @@ func TestEmulator_CollisionPowerLevel(t *testing.T) {
 				SNR:    0,
 			}))
 
-			gotCollision := 0
+			var gotCollision int32
 
 			e.SetOnEvent(func(event Event, node Node, data any) {
 				if event == EventCollision {
-					gotCollision++
+					atomic.AddInt32(&gotCollision, 1)
 				}
 			})
 
@@ -130,7 +133,56 @@ func TestEmulator_CollisionPowerLevel(t *testing.T) {
 
 			e.Wait()
 
-			assert.Equal(t, 3, gotCollision, "collisions not detected")
+			assert.Equal(t, int32(3), atomic.LoadInt32(&gotCollision), "collisions not detected")
+		})
+	}
+}
+
+// TestEmulator_CollisionOverlap tests if a packet that is already being received collides with a packet
+// that starts later but overlaps the end of it. Only the lower time scalings are used, as the second send
+// has to start within the airtime of the first one.
+func TestEmulator_CollisionOverlap(t *testing.T) {
+	for _, scale := range timeScaling[:3] {
+		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+			assert.NoError(t, e.SetTimeScaling(scale))
+
+			for i, x := range []float64{1, 1.2, 1.4} {
+				assert.NoError(t, e.AddNode(Node{
+					ID:     fmt.Sprint(i + 1),
+					Online: true,
+					X:      x,
+					Y:      1,
+					Z:      0,
+					TXGain: 40,
+					RXSens: -200,
+					SNR:    0,
+				}))
+			}
+
+			var gotCollision int32
+			e.SetOnEvent(func(event Event, node Node, data any) {
+				if node.ID != "2" {
+					return
+				}
+
+				switch event {
+				case EventCollision:
+					atomic.AddInt32(&gotCollision, 1)
+				case EventReceived:
+					assert.Fail(t, "node received message that overlapped another one")
+				}
+			})
+
+			assert.NoError(t, e.SendMessage("1", []byte(strings.Repeat("HELLO WORLD", 10))))
+
+			time.Sleep(time.Millisecond * time.Duration(60/scale))
+
+			assert.NoError(t, e.SendMessage("3", []byte("HELLO")))
+
+			e.Wait()
+
+			assert.Equal(t, int32(2), atomic.LoadInt32(&gotCollision), "collisions not detected")
 		})
 	}
 }
@@ -139,7 +191,7 @@ func TestEmulator_CollisionPowerLevel(t *testing.T) {
 func TestEmulator_NoCollision(t *testing.T) {
 	for _, scale := range timeScaling {
 		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
-			e := New(868, 10, 1, 10, lora.PacketConfigDefault)
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
 			assert.NoError(t, e.SetTimeScaling(scale))
 
 			assert.NoError(t, e.AddNode(Node{
@@ -175,11 +227,11 @@ func TestEmulator_NoCollision(t *testing.T) {
 				SNR:    0,
 			}))
 
-			gotCollision := false
+			var gotCollision atomic.Bool
 
 			e.SetOnEvent(func(event Event, node Node, data any) {
 				if node.ID == "2" && event == EventCollision {
-					gotCollision = true
+					gotCollision.Store(true)
 				}
 			})
 
@@ -191,7 +243,7 @@ func TestEmulator_NoCollision(t *testing.T) {
 
 			e.Wait()
 
-			assert.False(t, gotCollision, "collision detected")
+			assert.False(t, gotCollision.Load(), "collision detected")
 		})
 	}
 }
@@ -199,7 +251,7 @@ func TestEmulator_NoCollision(t *testing.T) {
 func TestEmulator_PayloadSizeExceeded(t *testing.T) {
 	for _, scale := range timeScaling {
 		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
-			e := New(868, 10, 1, 10, lora.PacketConfigDefault)
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
 			assert.NoError(t, e.SetTimeScaling(scale))
 
 			assert.NoError(t, e.AddNode(Node{
@@ -213,11 +265,11 @@ func TestEmulator_PayloadSizeExceeded(t *testing.T) {
 				SNR:    0,
 			}))
 
-			gotExceeded := false
+			var gotExceeded atomic.Bool
 
 			e.SetOnEvent(func(event Event, node Node, data any) {
 				if node.ID == "1" && event == EventPayloadSizeExceeded {
-					gotExceeded = true
+					gotExceeded.Store(true)
 				}
 			})
 
@@ -225,7 +277,7 @@ func TestEmulator_PayloadSizeExceeded(t *testing.T) {
 
 			e.Wait()
 
-			assert.True(t, gotExceeded, "exceeding not detected")
+			assert.True(t, gotExceeded.Load(), "exceeding not detected")
 		})
 	}
 }
@@ -233,7 +285,7 @@ func TestEmulator_PayloadSizeExceeded(t *testing.T) {
 func TestEmulator_MultipleSends(t *testing.T) {
 	for _, scale := range timeScaling {
 		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
-			e := New(868, 10, 1, 10, lora.PacketConfigDefault)
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
 			assert.NoError(t, e.SetTimeScaling(scale))
 
 			assert.NoError(t, e.AddNode(Node{
@@ -258,11 +310,11 @@ func TestEmulator_MultipleSends(t *testing.T) {
 				SNR:    0,
 			}))
 
-			gotPacket := 0
+			var gotPacket int32
 
 			e.SetOnEvent(func(event Event, node Node, data any) {
 				if node.ID == "2" && event == EventReceived {
-					gotPacket++
+					atomic.AddInt32(&gotPacket, 1)
 				}
 			})
 
@@ -272,13 +324,59 @@ func TestEmulator_MultipleSends(t *testing.T) {
 
 			e.Wait()
 
-			assert.Equal(t, 20, gotPacket, "didn't get all packages")
+			assert.Equal(t, int32(20), atomic.LoadInt32(&gotPacket), "didn't get all packages")
+		})
+	}
+}
+
+func TestEmulator_TxDone(t *testing.T) {
+	for _, scale := range timeScaling {
+		t.Run(fmt.Sprintf("TimeScaling%d", scale), func(t *testing.T) {
+			e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+			assert.NoError(t, e.SetTimeScaling(scale))
+
+			assert.NoError(t, e.AddNode(Node{
+				ID:     "1",
+				Online: true,
+				X:      1,
+				Y:      1,
+				Z:      0,
+				TXGain: 40,
+				RXSens: -200,
+				SNR:    0,
+			}))
+
+			var results []TxResult
+			var errs []error
+			var mutex sync.Mutex
+
+			onDone := func(result TxResult, err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				results = append(results, result)
+				errs = append(errs, err)
+			}
+
+			assert.NoError(t, e.SendMessageWithParams("1", []byte("HELLO WORLD"), TxParams{OnDone: onDone}))
+			assert.NoError(t, e.SendMessageWithParams("1", []byte(strings.Repeat("HELLO WORLD", 100)), TxParams{OnDone: onDone}))
+
+			e.Wait()
+
+			if assert.Len(t, results, 2) {
+				// the exceeded packet is rejected right away
+				assert.Equal(t, ErrPayloadSizeExceeded, errs[0])
+
+				assert.NoError(t, errs[1])
+				assert.Greater(t, results[1].Airtime, 0.0)
+				assert.Equal(t, results[1].Start+int64(results[1].Airtime), results[1].Stop)
+			}
 		})
 	}
 }
 
 func BenchmarkEmulator_UpdateNode(b *testing.B) {
-	e := New(868, 10, 1, 10, lora.PacketConfigDefault)
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
 	assert.NoError(b, e.AddNode(Node{
 		ID:     "1",
 		Online: true,
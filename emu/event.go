@@ -0,0 +1,86 @@
+package emu
+
+// The types in this file are the data of the events. Node events (EventNodeAdded, EventNodeUpdated and
+// EventNodeRemoved) have the Node as data, EventReceived and EventCollision a Reception. The JSON encoding
+// of the types is the schema of the trace log, so fields are only added but never renamed or removed.
+
+// Transmission is the data of EventSending.
+type Transmission struct {
+	// Start and Stop are unix timestamps in ms of the emulator time.
+	Start   int64   `json:"start"`
+	Stop    int64   `json:"stop"`
+	Airtime float64 `json:"airtime"`
+	// Freq in MHz.
+	Freq            float64 `json:"freq"`
+	SpreadingFactor float64 `json:"spreadingFactor"`
+	// BandWidth in kHz.
+	BandWidth float64 `json:"bandWidth"`
+	Data      []byte  `json:"data"`
+	// X, Y and Z is the position of the sender when the transmission started.
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// PayloadSizeExceeded is the data of EventPayloadSizeExceeded.
+type PayloadSizeExceeded struct {
+	// Size of the packet including the preamble.
+	Size               int     `json:"size"`
+	TheoreticalAirtime float64 `json:"theoretical_airtime"`
+}
+
+// InterceptorDropped is the data of EventInterceptorDropped.
+type InterceptorDropped struct {
+	From        string `json:"from"`
+	Interceptor string `json:"interceptor"`
+	Size        int    `json:"size"`
+}
+
+// DemodulatorsBusy is the data of EventDemodulatorsBusy.
+type DemodulatorsBusy struct {
+	From            string  `json:"from"`
+	Freq            float64 `json:"freq"`
+	SpreadingFactor float64 `json:"spreadingFactor"`
+}
+
+// FaultPacket is the data of EventFaultPacketDropped and EventFaultPacketDuped.
+type FaultPacket struct {
+	From string `json:"from"`
+	Size int    `json:"size"`
+}
+
+// FaultPacketCorrupted is the data of EventFaultPacketCorrupt.
+type FaultPacketCorrupted struct {
+	From string `json:"from"`
+	// Bits are the positions of the flipped bits.
+	Bits      []int `json:"bits"`
+	CRCFailed bool  `json:"crcFailed"`
+}
+
+// FaultNode is the data of EventFaultNodeCrashed and EventFaultNodeRecovered.
+type FaultNode struct {
+	// Downtime in seconds of emulator time the node is or was offline.
+	Downtime float64 `json:"downtime"`
+}
+
+// QueueOverflow is the data of EventQueueOverflow.
+type QueueOverflow struct {
+	Size     int `json:"size"`
+	Priority int `json:"priority"`
+	Capacity int `json:"capacity"`
+}
+
+// LinkChange is the data of EventLinkUp and EventLinkDown.
+type LinkChange struct {
+	From string `json:"from"`
+	// Gain and Margin in dB are only set for EventLinkUp.
+	Gain   float64 `json:"gain,omitempty"`
+	Margin float64 `json:"margin,omitempty"`
+}
+
+// ScriptError is the data of EventScriptError.
+type ScriptError struct {
+	Script   string `json:"script"`
+	Callback string `json:"callback"`
+	Error    string `json:"error"`
+}
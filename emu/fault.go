@@ -0,0 +1,288 @@
+package emu
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChurnConfig describes the random crashing and recovering of nodes.
+type ChurnConfig struct {
+	// MTBF is the mean time between failures of a node in seconds. A value of 0 disables the churn.
+	MTBF float64 `json:"mtbf"`
+	// MTTR is the mean time to repair of a node in seconds.
+	MTTR float64 `json:"mttr"`
+	// Nodes limits the churn to the given node ids. If empty all nodes are affected.
+	Nodes []string `json:"nodes"`
+}
+
+// FaultConfig describes which faults should be injected into a emulation.
+type FaultConfig struct {
+	// Seed for the random source. If 0 a time based seed will be used.
+	Seed int64 `json:"seed"`
+	// DropProbability is the probability (0 - 1) that a packet that would be received is dropped.
+	DropProbability float64 `json:"dropProbability"`
+	// NodeDropProbability overrides the DropProbability for specific receiving nodes.
+	NodeDropProbability map[string]float64 `json:"nodeDropProbability"`
+	// BitFlipProbability is the probability (0 - 1) that a received packet gets corrupted.
+	BitFlipProbability float64 `json:"bitFlipProbability"`
+	// BitFlips is the amount of bits that will be flipped in a corrupted packet. Defaults to 1.
+	BitFlips int `json:"bitFlips"`
+	// DuplicateProbability is the probability (0 - 1) that a received packet is delivered twice.
+	DuplicateProbability float64 `json:"duplicateProbability"`
+	// Churn describes the random crashing and recovering of nodes.
+	Churn ChurnConfig `json:"churn"`
+}
+
+// Enabled checks if any fault is configured.
+func (fc FaultConfig) Enabled() bool {
+	return fc.DropProbability > 0 || len(fc.NodeDropProbability) > 0 || fc.BitFlipProbability > 0 || fc.DuplicateProbability > 0 || fc.Churn.MTBF > 0
+}
+
+// Faults represents a fault injector that drops, corrupts and duplicates packets and lets
+// nodes randomly crash and recover.
+type Faults struct {
+	emu       *Emulator
+	config    FaultConfig
+	seed      int64
+	randMutex sync.Mutex
+	rand      *rand.Rand
+	wg        sync.WaitGroup
+	done      chan bool
+	stopOnce  sync.Once
+	sub       *Subscription
+
+	// crashed contains the nodes the churn took offline and that weren't changed via the API since. The
+	// node is stored with its last position so that moves by the mobility can be told apart from updates.
+	// updating is the id of the node the injector is currently updating itself.
+	crashedMutex sync.Mutex
+	crashed      map[string]Node
+	updating     string
+}
+
+// NewFaults creates a new fault injector for the given emu. To enable the packet faults the injector needs
+// to be set via Emulator.SetFaults and to start the churn Start needs to be called.
+func NewFaults(emu *Emulator, config FaultConfig) *Faults {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	if config.BitFlips <= 0 {
+		config.BitFlips = 1
+	}
+
+	return &Faults{
+		emu:     emu,
+		config:  config,
+		seed:    seed,
+		rand:    rand.New(rand.NewSource(seed)),
+		done:    make(chan bool),
+		crashed: map[string]Node{},
+	}
+}
+
+// Seed returns the seed that is used for the random source.
+func (f *Faults) Seed() int64 {
+	return f.seed
+}
+
+func (f *Faults) float64() float64 {
+	f.randMutex.Lock()
+	defer f.randMutex.Unlock()
+
+	return f.rand.Float64()
+}
+
+func (f *Faults) expDuration(mean float64) time.Duration {
+	f.randMutex.Lock()
+	val := f.rand.ExpFloat64() * mean
+	f.randMutex.Unlock()
+
+	return time.Duration(val * float64(time.Second) / float64(f.emu.GetTimeScaling()))
+}
+
+func (f *Faults) drop(id string) bool {
+	prob := f.config.DropProbability
+	if nodeProb, ok := f.config.NodeDropProbability[id]; ok {
+		prob = nodeProb
+	}
+
+	return prob > 0 && f.float64() < prob
+}
+
+// corrupt returns a corrupted copy of the data and the flipped bit positions. If the packet
+// shouldn't be corrupted no bits are returned.
+func (f *Faults) corrupt(data []byte) ([]byte, []int) {
+	if len(data) == 0 || f.config.BitFlipProbability <= 0 || f.float64() >= f.config.BitFlipProbability {
+		return data, nil
+	}
+
+	corrupted := make([]byte, len(data))
+	copy(corrupted, data)
+
+	f.randMutex.Lock()
+	defer f.randMutex.Unlock()
+
+	var flipped []int
+	for i := 0; i < f.config.BitFlips; i++ {
+		bit := f.rand.Intn(len(data) * 8)
+		corrupted[bit/8] ^= 1 << (bit % 8)
+		flipped = append(flipped, bit)
+	}
+
+	return corrupted, flipped
+}
+
+func (f *Faults) duplicate() bool {
+	return f.config.DuplicateProbability > 0 && f.float64() < f.config.DuplicateProbability
+}
+
+// crash takes the node offline. Nodes that are already offline, e.g. because they were switched off via the
+// API, are left alone and false is returned.
+func (f *Faults) crash(id string, dur time.Duration) bool {
+	f.emu.Lock()
+	defer f.emu.Unlock()
+
+	node, ok := f.emu.nodes[id]
+	if !ok || !node.Online {
+		return false
+	}
+
+	f.setOnlineLocked(node, false, EventFaultNodeCrashed, dur)
+
+	f.crashedMutex.Lock()
+	f.crashed[id] = node
+	f.crashedMutex.Unlock()
+
+	return true
+}
+
+// recover brings the node back online if it was crashed by the churn and is still offline.
+func (f *Faults) recover(id string, dur time.Duration) {
+	f.emu.Lock()
+	defer f.emu.Unlock()
+
+	f.crashedMutex.Lock()
+	_, crashed := f.crashed[id]
+	delete(f.crashed, id)
+	f.crashedMutex.Unlock()
+
+	node, ok := f.emu.nodes[id]
+	if !crashed || !ok || node.Online {
+		return
+	}
+
+	f.setOnlineLocked(node, true, EventFaultNodeRecovered, dur)
+}
+
+// observe forgets crashed nodes that were updated or removed by someone else, so that a node that is
+// switched on or off via the API while it's down isn't brought back by the recovery. Updates that only
+// move a node that is still offline, like the ones of the mobility, keep it crashed.
+func (f *Faults) observe(msg EventMessage) {
+	f.crashedMutex.Lock()
+	defer f.crashedMutex.Unlock()
+
+	if msg.Node.ID == f.updating {
+		return
+	}
+
+	crashed, ok := f.crashed[msg.Node.ID]
+	if !ok {
+		return
+	}
+
+	moved := crashed.X != msg.Node.X || crashed.Y != msg.Node.Y || crashed.Z != msg.Node.Z
+	if msg.Event == EventNodeUpdated && !msg.Node.Online && moved {
+		f.crashed[msg.Node.ID] = msg.Node
+		return
+	}
+
+	delete(f.crashed, msg.Node.ID)
+}
+
+func (f *Faults) setOnlineLocked(node Node, online bool, event Event, dur time.Duration) {
+	node.Online = online
+	f.emu.nodes[node.ID] = node
+
+	f.crashedMutex.Lock()
+	f.updating = node.ID
+	f.crashedMutex.Unlock()
+
+	f.emu.emitEvent(EventNodeUpdated, node, node)
+
+	f.crashedMutex.Lock()
+	f.updating = ""
+	f.crashedMutex.Unlock()
+
+	f.emu.updateLinksLocked(node.ID)
+	f.emu.emitEvent(event, node, FaultNode{
+		Downtime: dur.Seconds() * float64(f.emu.timeScaling),
+	})
+}
+
+func (f *Faults) churn(id string) {
+	defer f.wg.Done()
+
+	for {
+		down := f.expDuration(f.config.Churn.MTBF)
+		select {
+		case <-time.After(down):
+		case <-f.done:
+			return
+		}
+
+		up := f.expDuration(f.config.Churn.MTTR)
+		if !f.crash(id, up) {
+			continue
+		}
+
+		select {
+		case <-time.After(up):
+		case <-f.done:
+			f.recover(id, up)
+			return
+		}
+
+		f.recover(id, up)
+	}
+}
+
+// Start starts the churn of nodes. Only nodes that are online at the start are affected.
+func (f *Faults) Start() {
+	if f.config.Churn.MTBF <= 0 {
+		return
+	}
+
+	f.sub = f.emu.SubscribeFunc(f.observe, EventNodeUpdated, EventNodeRemoved)
+
+	ids := f.config.Churn.Nodes
+	if len(ids) == 0 {
+		ids = f.emu.NodeIDs()
+	}
+
+	for _, id := range ids {
+		if node := f.emu.GetNode(id); node.ID == "" || !node.Online {
+			continue
+		}
+
+		f.wg.Add(1)
+		go f.churn(id)
+	}
+}
+
+// Stop requests the stop of the churn. Crashed nodes will be brought back online. You need to .Done() after this to ensure graceful shutdown.
+// It's safe to call Stop multiple times.
+func (f *Faults) Stop() {
+	f.stopOnce.Do(func() {
+		if f.sub != nil {
+			f.sub.Unsubscribe()
+		}
+		close(f.done)
+	})
+}
+
+// Done waits for the churn to finish.
+func (f *Faults) Done() {
+	f.wg.Wait()
+}
@@ -0,0 +1,175 @@
+package emu
+
+import (
+	"bytes"
+	"github.com/BigJk/loraemu/lora"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFaultTestEmu(t *testing.T, config FaultConfig) (*Emulator, *Faults) {
+	packetConfig := lora.PacketConfigDefault
+	packetConfig.CRC = true
+
+	e := New(868, 2, 1, 10, packetConfig)
+	assert.NoError(t, e.SetTimeScaling(100))
+
+	assert.NoError(t, e.AddNode(Node{
+		ID:     "1",
+		Online: true,
+		X:      1,
+		Y:      1,
+		TXGain: 40,
+		RXSens: -200,
+	}))
+
+	assert.NoError(t, e.AddNode(Node{
+		ID:     "2",
+		Online: true,
+		X:      1.2,
+		Y:      1,
+		TXGain: 40,
+		RXSens: -200,
+	}))
+
+	faults := NewFaults(e, config)
+	e.SetFaults(faults)
+
+	return e, faults
+}
+
+func TestFaults_Drop(t *testing.T) {
+	e, _ := newFaultTestEmu(t, FaultConfig{Seed: 1, NodeDropProbability: map[string]float64{"2": 1}})
+
+	dropped := 0
+	e.SetOnEvent(func(event Event, node Node, data any) {
+		switch event {
+		case EventFaultPacketDropped:
+			dropped++
+		case EventReceived:
+			assert.Fail(t, "node received message that should be dropped")
+		}
+	})
+
+	assert.NoError(t, e.SendMessage("1", []byte("HELLO WORLD")))
+	e.Wait()
+
+	assert.Equal(t, 1, dropped)
+}
+
+func TestFaults_Corrupt(t *testing.T) {
+	e, _ := newFaultTestEmu(t, FaultConfig{Seed: 1, BitFlipProbability: 1, BitFlips: 3})
+
+	msg := []byte("HELLO WORLD")
+
+	var received []RxPacket
+	e.SetOnReceived(func(node Node, packet RxPacket) {
+		received = append(received, packet)
+	})
+
+	assert.NoError(t, e.SendMessage("1", msg))
+	e.Wait()
+
+	if assert.Len(t, received, 1) {
+		assert.True(t, received[0].CRCFailed)
+		assert.False(t, bytes.Equal(msg, received[0].Data))
+		assert.Equal(t, []byte("HELLO WORLD"), msg, "original payload was modified")
+	}
+}
+
+func TestFaults_Duplicate(t *testing.T) {
+	e, _ := newFaultTestEmu(t, FaultConfig{Seed: 1, DuplicateProbability: 1})
+
+	received := 0
+	e.SetOnReceived(func(node Node, packet RxPacket) {
+		received++
+	})
+
+	assert.NoError(t, e.SendMessage("1", []byte("HELLO WORLD")))
+	e.Wait()
+
+	assert.Equal(t, 2, received)
+}
+
+func TestFaults_Seed(t *testing.T) {
+	config := FaultConfig{Seed: 42, DropProbability: 0.5}
+
+	a := NewFaults(nil, config)
+	b := NewFaults(nil, config)
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, a.drop("1"), b.drop("1"))
+	}
+}
+
+func TestFaults_Churn(t *testing.T) {
+	e, faults := newFaultTestEmu(t, FaultConfig{Seed: 1, Churn: ChurnConfig{MTBF: 1, MTTR: 1, Nodes: []string{"1"}}})
+
+	crashed := make(chan bool, 100)
+	e.SetOnEvent(func(event Event, node Node, data any) {
+		if event == EventFaultNodeCrashed {
+			assert.Equal(t, "1", node.ID)
+			crashed <- true
+		}
+	})
+
+	faults.Start()
+
+	select {
+	case <-crashed:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "node didn't crash")
+	}
+
+	faults.Stop()
+	faults.Done()
+
+	assert.True(t, e.GetNode("1").Online, "node not recovered after stop")
+	assert.True(t, e.GetNode("2").Online, "node without churn went offline")
+}
+
+func TestFaults_ChurnSwitchedOff(t *testing.T) {
+	// the mtbf is high enough that the churn never crashes a node by itself, the crashes and recoveries are
+	// triggered explicitly
+	e, faults := newFaultTestEmu(t, FaultConfig{Seed: 1, Churn: ChurnConfig{MTBF: 1e9, MTTR: 1, Nodes: []string{"1", "2"}}})
+	faults.Start()
+
+	setOnline := func(id string, online bool) {
+		assert.NoError(t, e.UpdateNode(id, func(node *Node) error {
+			node.Online = online
+			return nil
+		}))
+	}
+
+	// node 1 is switched off while it's down, node 2 is switched on and off again
+	assert.True(t, faults.crash("1", time.Second))
+	assert.True(t, faults.crash("2", time.Second))
+	assert.False(t, faults.crash("2", time.Second), "offline node crashed again")
+
+	setOnline("1", false)
+	setOnline("2", true)
+	setOnline("2", false)
+
+	faults.recover("1", time.Second)
+	faults.recover("2", time.Second)
+
+	assert.False(t, e.GetNode("1").Online, "node switched off while crashed was brought back")
+	assert.False(t, e.GetNode("2").Online, "node switched on and off while crashed was brought back")
+
+	// a node that is only moved while it's down is still recovered
+	setOnline("1", true)
+	assert.True(t, faults.crash("1", time.Second))
+	assert.NoError(t, e.UpdateNode("1", func(node *Node) error {
+		node.X += 0.1
+		return nil
+	}))
+
+	faults.recover("1", time.Second)
+	assert.True(t, e.GetNode("1").Online, "moved node wasn't recovered")
+
+	faults.Stop()
+	faults.Stop()
+	faults.Done()
+}
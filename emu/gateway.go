@@ -0,0 +1,135 @@
+package emu
+
+import (
+	"errors"
+	"math"
+)
+
+// DefaultGatewayDemodulators is the amount of demodulators a gateway has if none are configured.
+// This matches the 8 multi-SF demodulation paths of the SX1302.
+const DefaultGatewayDemodulators = 8
+
+// GatewayConfig represents the radio configuration of a gateway node.
+type GatewayConfig struct {
+	// Demodulators is the amount of packets that can be received at the same time.
+	Demodulators int `json:"demodulators"`
+	// Channels are the frequencies in MHz the gateway listens to. If empty the emulator frequency is used.
+	Channels []float64 `json:"channels"`
+	// SpreadingFactors are the spreading factors the gateway can demodulate. If empty all are accepted.
+	SpreadingFactors []float64 `json:"spreadingFactors"`
+}
+
+// GatewayUsage represents the current demodulator usage of a gateway.
+type GatewayUsage struct {
+	Demodulators     int       `json:"demodulators"`
+	InUse            int       `json:"inUse"`
+	Dropped          int       `json:"dropped"`
+	Channels         []float64 `json:"channels"`
+	SpreadingFactors []float64 `json:"spreadingFactors"`
+}
+
+func sameFreq(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+// radioFreq returns the frequency the node listens and transmits on.
+func (emu *Emulator) radioFreq(node Node) float64 {
+	if node.Freq > 0 {
+		return node.Freq
+	}
+	return emu.freq
+}
+
+// radioSpreadingFactor returns the spreading factor the node listens and transmits with.
+func (emu *Emulator) radioSpreadingFactor(node Node) float64 {
+	if node.SpreadingFactor > 0 {
+		return node.SpreadingFactor
+	}
+	return emu.packetConfig.SpreadingFactor
+}
+
+func (emu *Emulator) gatewayConfig(node Node) GatewayConfig {
+	var config GatewayConfig
+	if node.Gateway != nil {
+		config = *node.Gateway
+	}
+
+	if config.Demodulators == 0 {
+		config.Demodulators = DefaultGatewayDemodulators
+	}
+
+	if len(config.Channels) == 0 {
+		config.Channels = []float64{emu.radioFreq(node)}
+	}
+
+	return config
+}
+
+// canDemodulate checks if the receiver is tuned to the frequency and spreading factor of a packet.
+func (emu *Emulator) canDemodulate(receiver Node, freq float64, sf float64) bool {
+	if !receiver.IsGateway() {
+		return sameFreq(emu.radioFreq(receiver), freq) && emu.radioSpreadingFactor(receiver) == sf
+	}
+
+	config := emu.gatewayConfig(receiver)
+
+	channelOk := false
+	for _, c := range config.Channels {
+		if sameFreq(c, freq) {
+			channelOk = true
+			break
+		}
+	}
+
+	if !channelOk {
+		return false
+	}
+
+	if len(config.SpreadingFactors) == 0 {
+		return true
+	}
+
+	for _, s := range config.SpreadingFactors {
+		if s == sf {
+			return true
+		}
+	}
+
+	return false
+}
+
+// demodulatorsInUse counts the receptions that are still ongoing at the given time.
+func demodulatorsInUse(node Node, at int64) int {
+	inUse := 0
+	for i := range node.receiving {
+		if node.receiving[i].Start <= at && node.receiving[i].Stop >= at {
+			inUse++
+		}
+	}
+	return inUse
+}
+
+// GatewayUsage returns the demodulator configuration and usage of a gateway node.
+func (emu *Emulator) GatewayUsage(id string) (GatewayUsage, error) {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	node, ok := emu.nodes[id]
+	if !ok {
+		return GatewayUsage{}, errors.New("not found")
+	}
+
+	if !node.IsGateway() {
+		return GatewayUsage{}, errors.New("not a gateway")
+	}
+
+	config := emu.gatewayConfig(node)
+
+	return GatewayUsage{
+		Demodulators:     config.Demodulators,
+		InUse:            demodulatorsInUse(node, emu.getTime().UnixMilli()),
+		Dropped:          node.demodulatorsBusy,
+		Channels:         config.Channels,
+		SpreadingFactors: config.SpreadingFactors,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package emu
+
+import (
+	"github.com/BigJk/loraemu/lora"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGatewayTestEmu(t *testing.T, demodulators int) *Emulator {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+
+	assert.NoError(t, e.AddNode(Node{
+		ID:     "1",
+		Online: true,
+		X:      1,
+		Y:      1,
+		TXGain: 40,
+		RXSens: -200,
+		Freq:   868.1,
+	}))
+
+	assert.NoError(t, e.AddNode(Node{
+		ID:              "2",
+		Online:          true,
+		X:               1.4,
+		Y:               1,
+		TXGain:          40,
+		RXSens:          -200,
+		Freq:            868.3,
+		SpreadingFactor: 9,
+	}))
+
+	assert.NoError(t, e.AddNode(Node{
+		ID:     "GW",
+		Online: true,
+		X:      1.2,
+		Y:      1,
+		TXGain: 40,
+		RXSens: -200,
+		Kind:   NodeKindGateway,
+		Gateway: &GatewayConfig{
+			Demodulators: demodulators,
+			Channels:     []float64{868.1, 868.3},
+		},
+	}))
+
+	return e
+}
+
+// TestGateway_Concurrent tests if a gateway can receive packets on different channels and spreading factors
+// at the same time without collisions, while single channel nodes on other channels don't hear them.
+func TestGateway_Concurrent(t *testing.T) {
+	e := newGatewayTestEmu(t, 0)
+
+	mtx := sync.Mutex{}
+	received := map[string]int{}
+	e.SetOnEvent(func(event Event, node Node, data any) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		switch event {
+		case EventCollision:
+			assert.Fail(t, "collision on different channels")
+		case EventReceived:
+			received[node.ID]++
+		}
+	})
+
+	assert.NoError(t, e.SendMessage("1", []byte(strings.Repeat("HELLO WORLD", 10))))
+	assert.NoError(t, e.SendMessage("2", []byte(strings.Repeat("HELLO WORLD", 10))))
+
+	e.Wait()
+
+	assert.Equal(t, map[string]int{"GW": 2}, received)
+}
+
+// TestGateway_DemodulatorsBusy tests if packets get dropped if all demodulators are in use.
+func TestGateway_DemodulatorsBusy(t *testing.T) {
+	e := newGatewayTestEmu(t, 1)
+
+	mtx := sync.Mutex{}
+	received := 0
+	busy := 0
+	e.SetOnEvent(func(event Event, node Node, data any) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		switch event {
+		case EventReceived:
+			received++
+		case EventDemodulatorsBusy:
+			busy++
+		}
+	})
+
+	assert.NoError(t, e.SendMessage("1", []byte(strings.Repeat("HELLO WORLD", 10))))
+	assert.NoError(t, e.SendMessage("2", []byte(strings.Repeat("HELLO WORLD", 10))))
+
+	usage, err := e.GatewayUsage("GW")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, usage.Demodulators)
+		assert.Equal(t, 1, usage.InUse)
+		assert.Equal(t, 1, usage.Dropped)
+	}
+
+	e.Wait()
+
+	assert.Equal(t, 1, received)
+	assert.Equal(t, 1, busy)
+
+	_, err = e.GatewayUsage("1")
+	assert.Error(t, err)
+}
+
+// TestGateway_PruneReceiving tests if receptions that can't collide anymore are forgotten.
+func TestGateway_PruneReceiving(t *testing.T) {
+	e := newGatewayTestEmu(t, 0)
+	assert.NoError(t, e.SetTimeScaling(1000))
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, e.SendMessage("1", []byte("HELLO WORLD")))
+		e.Wait()
+	}
+
+	e.RLock()
+	receiving := len(e.nodes["GW"].receiving)
+	e.RUnlock()
+
+	assert.LessOrEqual(t, receiving, 2)
+
+	usage, err := e.GatewayUsage("GW")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, usage.InUse)
+	}
+}
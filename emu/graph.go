@@ -0,0 +1,479 @@
+package emu
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// GraphEdge represents a directed link on which the receiver can hear the sender.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Gain is the signal strength in dBm at the receiver after the path loss.
+	Gain float64 `json:"gain"`
+	// Margin is the gain above the sensitivity of the receiver in dB.
+	Margin   float64 `json:"margin"`
+	Distance float64 `json:"distance"`
+}
+
+// GraphNode represents a node of the connectivity graph.
+type GraphNode struct {
+	ID string  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	Z  float64 `json:"z"`
+	// Partition is the index of the partition the node belongs to.
+	Partition int `json:"partition"`
+	// InDegree is the number of nodes the node can hear.
+	InDegree int `json:"inDegree"`
+	// OutDegree is the number of nodes that can hear the node.
+	OutDegree int `json:"outDegree"`
+	// Degree is the number of neighbours in either direction.
+	Degree int `json:"degree"`
+	// Articulation is true if removing the node splits its partition.
+	Articulation bool `json:"articulation"`
+}
+
+// Graph represents the directed "can hear" graph of the online nodes that results from the current
+// positions, gains, sensitivities and radio settings. Interceptors and faults aren't part of the graph.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	// Partitions are the ids of the connected nodes, largest first. Links count in either direction.
+	Partitions [][]string `json:"partitions"`
+	// Diameter is the longest shortest path in hops between nodes that can reach each other.
+	Diameter int `json:"diameter"`
+	// ArticulationPoints are the nodes that split their partition if they are removed.
+	ArticulationPoints []string `json:"articulationPoints"`
+}
+
+type linkKey struct {
+	from string
+	to   string
+}
+
+// linkLocked returns the edge from the sender to the receiver if the receiver can hear the sender.
+func (emu *Emulator) linkLocked(sender Node, receiver Node) (GraphEdge, bool) {
+	if sender.ID == receiver.ID || !sender.Online || !receiver.Online {
+		return GraphEdge{}, false
+	}
+
+	if !emu.canDemodulate(receiver, emu.radioFreq(sender), emu.radioSpreadingFactor(sender)) {
+		return GraphEdge{}, false
+	}
+
+	gain := emu.ReachedGain(sender, receiver)
+	if gain <= receiver.RXSens {
+		return GraphEdge{}, false
+	}
+
+	return GraphEdge{
+		From:     sender.ID,
+		To:       receiver.ID,
+		Gain:     gain,
+		Margin:   gain - receiver.RXSens,
+		Distance: sender.DistanceTo(receiver),
+	}, true
+}
+
+// Graph computes the connectivity graph of the online nodes.
+func (emu *Emulator) Graph() Graph {
+	emu.RLock()
+
+	var nodes []Node
+	for _, node := range emu.nodes {
+		if node.Online {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	var edges []GraphEdge
+	for _, sender := range nodes {
+		for _, receiver := range nodes {
+			if edge, ok := emu.linkLocked(sender, receiver); ok {
+				edges = append(edges, edge)
+			}
+		}
+	}
+
+	emu.RUnlock()
+
+	return newGraph(nodes, edges)
+}
+
+func newGraph(nodes []Node, edges []GraphEdge) Graph {
+	graph := Graph{
+		Nodes:              make([]GraphNode, len(nodes)),
+		Edges:              edges,
+		Partitions:         [][]string{},
+		ArticulationPoints: []string{},
+	}
+
+	if graph.Edges == nil {
+		graph.Edges = []GraphEdge{}
+	}
+
+	index := map[string]int{}
+	for i, node := range nodes {
+		index[node.ID] = i
+		graph.Nodes[i] = GraphNode{ID: node.ID, X: node.X, Y: node.Y, Z: node.Z}
+	}
+
+	out := make([][]int, len(nodes))
+	neighbours := make([]map[int]bool, len(nodes))
+	for i := range neighbours {
+		neighbours[i] = map[int]bool{}
+	}
+
+	for _, edge := range edges {
+		from, to := index[edge.From], index[edge.To]
+
+		out[from] = append(out[from], to)
+		neighbours[from][to] = true
+		neighbours[to][from] = true
+		graph.Nodes[from].OutDegree++
+		graph.Nodes[to].InDegree++
+	}
+
+	undirected := make([][]int, len(nodes))
+	for i := range neighbours {
+		for j := range neighbours[i] {
+			undirected[i] = append(undirected[i], j)
+		}
+		sort.Ints(undirected[i])
+		graph.Nodes[i].Degree = len(undirected[i])
+	}
+
+	// partitions
+	partition := make([]int, len(nodes))
+	for i := range partition {
+		partition[i] = -1
+	}
+
+	var partitions [][]int
+	for i := range nodes {
+		if partition[i] >= 0 {
+			continue
+		}
+
+		members := []int{i}
+		partition[i] = len(partitions)
+		for queue := []int{i}; len(queue) > 0; queue = queue[1:] {
+			for _, j := range undirected[queue[0]] {
+				if partition[j] < 0 {
+					partition[j] = len(partitions)
+					members = append(members, j)
+					queue = append(queue, j)
+				}
+			}
+		}
+
+		partitions = append(partitions, members)
+	}
+
+	// the nodes are sorted by id, so partitions of the same size are ordered by their first id
+	sort.SliceStable(partitions, func(i, j int) bool {
+		return len(partitions[i]) > len(partitions[j])
+	})
+
+	for p, members := range partitions {
+		ids := make([]string, 0, len(members))
+		for _, i := range members {
+			ids = append(ids, nodes[i].ID)
+			graph.Nodes[i].Partition = p
+		}
+		sort.Strings(ids)
+		graph.Partitions = append(graph.Partitions, ids)
+	}
+
+	// diameter
+	for i := range nodes {
+		dist := map[int]int{i: 0}
+		for queue := []int{i}; len(queue) > 0; queue = queue[1:] {
+			for _, j := range out[queue[0]] {
+				if _, ok := dist[j]; !ok {
+					dist[j] = dist[queue[0]] + 1
+					queue = append(queue, j)
+
+					if dist[j] > graph.Diameter {
+						graph.Diameter = dist[j]
+					}
+				}
+			}
+		}
+	}
+
+	// articulation points
+	for _, i := range articulationPoints(undirected) {
+		graph.Nodes[i].Articulation = true
+		graph.ArticulationPoints = append(graph.ArticulationPoints, nodes[i].ID)
+	}
+
+	return graph
+}
+
+// articulationPoints returns the indices of the articulation points of a undirected graph in ascending order.
+func articulationPoints(adjacency [][]int) []int {
+	discovered := make([]int, len(adjacency))
+	low := make([]int, len(adjacency))
+	isPoint := make([]bool, len(adjacency))
+	counter := 0
+
+	var visit func(i int, parent int)
+	visit = func(i int, parent int) {
+		counter++
+		discovered[i] = counter
+		low[i] = counter
+
+		children := 0
+		for _, j := range adjacency[i] {
+			if j == parent {
+				continue
+			}
+
+			if discovered[j] > 0 {
+				low[i] = minInt(low[i], discovered[j])
+				continue
+			}
+
+			children++
+			visit(j, i)
+			low[i] = minInt(low[i], low[j])
+
+			if parent >= 0 && low[j] >= discovered[i] {
+				isPoint[i] = true
+			}
+		}
+
+		if parent < 0 && children > 1 {
+			isPoint[i] = true
+		}
+	}
+
+	for i := range adjacency {
+		if discovered[i] == 0 {
+			visit(i, -1)
+		}
+	}
+
+	var points []int
+	for i := range isPoint {
+		if isPoint[i] {
+			points = append(points, i)
+		}
+	}
+
+	return points
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format. The nodes are placed at their position and the
+// edges are labeled with the link margin.
+func (g Graph) WriteDOT(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph loraemu {"); err != nil {
+		return err
+	}
+
+	for _, node := range g.Nodes {
+		if _, err := fmt.Fprintf(w, "  %s [pos=\"%g,%g!\"];\n", strconv.Quote(node.ID), node.X, node.Y); err != nil {
+			return err
+		}
+	}
+
+	for _, edge := range g.Edges {
+		if _, err := fmt.Fprintf(w, "  %s -> %s [label=\"%.1f dB\"];\n", strconv.Quote(edge.From), strconv.Quote(edge.To), edge.Margin); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// WriteGraphML writes the graph in the GraphML format with the positions, partitions and link margins as data.
+func (g Graph) WriteGraphML(w io.Writer) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "x", For: "node", AttrName: "x", AttrType: "double"},
+			{ID: "y", For: "node", AttrName: "y", AttrType: "double"},
+			{ID: "z", For: "node", AttrName: "z", AttrType: "double"},
+			{ID: "partition", For: "node", AttrName: "partition", AttrType: "int"},
+			{ID: "articulation", For: "node", AttrName: "articulation", AttrType: "boolean"},
+			{ID: "gain", For: "edge", AttrName: "gain", AttrType: "double"},
+			{ID: "margin", For: "edge", AttrName: "margin", AttrType: "double"},
+			{ID: "distance", For: "edge", AttrName: "distance", AttrType: "double"},
+		},
+	}
+	doc.Graph.ID = "loraemu"
+	doc.Graph.EdgeDefault = "directed"
+
+	for _, node := range g.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			ID: node.ID,
+			Data: []graphMLData{
+				{Key: "x", Value: formatFloat(node.X)},
+				{Key: "y", Value: formatFloat(node.Y)},
+				{Key: "z", Value: formatFloat(node.Z)},
+				{Key: "partition", Value: strconv.Itoa(node.Partition)},
+				{Key: "articulation", Value: strconv.FormatBool(node.Articulation)},
+			},
+		})
+	}
+
+	for _, edge := range g.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: edge.From,
+			Target: edge.To,
+			Data: []graphMLData{
+				{Key: "gain", Value: formatFloat(edge.Gain)},
+				{Key: "margin", Value: formatFloat(edge.Margin)},
+				{Key: "distance", Value: formatFloat(edge.Distance)},
+			},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// SetLinkEvents enables EventLinkUp and EventLinkDown, which are emitted for the receiver if a link appears
+// or disappears because nodes were added, removed, moved or changed.
+func (emu *Emulator) SetLinkEvents(state bool) {
+	emu.Lock()
+	defer emu.Unlock()
+
+	if !state {
+		emu.links = nil
+		return
+	}
+
+	if emu.links != nil {
+		return
+	}
+
+	// the links that already exist don't emit events
+	emu.links = map[linkKey]bool{}
+	for _, sender := range emu.nodes {
+		for _, receiver := range emu.nodes {
+			if _, ok := emu.linkLocked(sender, receiver); ok {
+				emu.links[linkKey{from: sender.ID, to: receiver.ID}] = true
+			}
+		}
+	}
+}
+
+// updateLinksLocked checks the links from and to the node with the given id and emits the link events
+// for the changes. The lock of the emulator needs to be held.
+func (emu *Emulator) updateLinksLocked(id string) {
+	if emu.links == nil {
+		return
+	}
+
+	node, exists := emu.nodes[id]
+
+	if !exists {
+		for key := range emu.links {
+			if key.from == id || key.to == id {
+				delete(emu.links, key)
+				emu.emitLinkLocked(EventLinkDown, key, GraphEdge{From: key.from, To: key.to})
+			}
+		}
+		return
+	}
+
+	for _, other := range emu.nodes {
+		for _, pair := range [][2]Node{{node, other}, {other, node}} {
+			key := linkKey{from: pair[0].ID, to: pair[1].ID}
+			edge, up := emu.linkLocked(pair[0], pair[1])
+
+			if up && !emu.links[key] {
+				emu.links[key] = true
+				emu.emitLinkLocked(EventLinkUp, key, edge)
+			} else if !up && emu.links[key] {
+				delete(emu.links, key)
+				emu.emitLinkLocked(EventLinkDown, key, edge)
+			}
+		}
+	}
+}
+
+func (emu *Emulator) emitLinkLocked(event Event, key linkKey, edge GraphEdge) {
+	receiver, ok := emu.nodes[key.to]
+	if !ok {
+		receiver = Node{ID: key.to}
+	}
+
+	data := LinkChange{
+		From: key.from,
+	}
+
+	if event == EventLinkUp {
+		data.Gain = edge.Gain
+		data.Margin = edge.Margin
+	}
+
+	emu.emitEvent(event, receiver, data)
+}
@@ -0,0 +1,128 @@
+package emu
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/BigJk/loraemu/lora"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newGraphTestEmu creates a line of nodes A - B - C with 1km between them, so that only neighbours can
+// hear each other, a isolated node D and a offline node E.
+func newGraphTestEmu(t *testing.T) *Emulator {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+
+	for _, node := range []Node{
+		{ID: "A", Online: true, X: 0},
+		{ID: "B", Online: true, X: 1},
+		{ID: "C", Online: true, X: 2},
+		{ID: "D", Online: true, X: 10},
+		{ID: "E", Online: false, X: 1.5},
+	} {
+		node.RXSens = -155
+		assert.NoError(t, e.AddNode(node))
+	}
+
+	return e
+}
+
+func TestEmulator_Graph(t *testing.T) {
+	e := newGraphTestEmu(t)
+
+	graph := e.Graph()
+
+	if assert.Len(t, graph.Edges, 4) {
+		assert.Equal(t, "A", graph.Edges[0].From)
+		assert.Equal(t, "B", graph.Edges[0].To)
+		assert.InDelta(t, 3.8, graph.Edges[0].Margin, 0.1)
+		assert.InDelta(t, 1, graph.Edges[0].Distance, 0.001)
+	}
+
+	assert.Equal(t, [][]string{{"A", "B", "C"}, {"D"}}, graph.Partitions)
+	assert.Equal(t, 2, graph.Diameter)
+	assert.Equal(t, []string{"B"}, graph.ArticulationPoints)
+
+	if assert.Len(t, graph.Nodes, 4) {
+		assert.Equal(t, GraphNode{ID: "B", X: 1, InDegree: 2, OutDegree: 2, Degree: 2, Articulation: true}, graph.Nodes[1])
+		assert.Equal(t, 1, graph.Nodes[3].Partition)
+		assert.Equal(t, 0, graph.Nodes[3].Degree)
+	}
+
+	// a node on another spreading factor can't hear the others
+	assert.NoError(t, e.UpdateNode("C", func(node *Node) error {
+		node.SpreadingFactor = 12
+		return nil
+	}))
+
+	graph = e.Graph()
+	assert.Len(t, graph.Edges, 2)
+	assert.Equal(t, [][]string{{"A", "B"}, {"C"}, {"D"}}, graph.Partitions)
+	assert.Empty(t, graph.ArticulationPoints)
+}
+
+func TestEmulator_GraphExport(t *testing.T) {
+	graph := newGraphTestEmu(t).Graph()
+
+	var dot bytes.Buffer
+	assert.NoError(t, graph.WriteDOT(&dot))
+	assert.Contains(t, dot.String(), "digraph loraemu {")
+	assert.Contains(t, dot.String(), `"B" [pos="1,0!"];`)
+	assert.Contains(t, dot.String(), `"A" -> "B" [label="3.8 dB"];`)
+
+	var buf bytes.Buffer
+	assert.NoError(t, graph.WriteGraphML(&buf))
+
+	var doc graphML
+	if assert.NoError(t, xml.Unmarshal(buf.Bytes(), &doc)) {
+		assert.Equal(t, "directed", doc.Graph.EdgeDefault)
+		assert.Len(t, doc.Graph.Nodes, 4)
+		if assert.Len(t, doc.Graph.Edges, 4) {
+			assert.Equal(t, "A", doc.Graph.Edges[0].Source)
+			assert.Equal(t, "B", doc.Graph.Edges[0].Target)
+		}
+	}
+}
+
+func TestEmulator_LinkEvents(t *testing.T) {
+	e := newGraphTestEmu(t)
+
+	var events []string
+	e.SubscribeFunc(func(msg EventMessage) {
+		events = append(events, string(msg.Event)+":"+msg.Data.(LinkChange).From+"->"+msg.Node.ID)
+	}, EventLinkUp, EventLinkDown)
+
+	// nothing is emitted without link events
+	assert.NoError(t, e.UpdateNode("D", func(node *Node) error {
+		node.X = 3
+		return nil
+	}))
+	assert.Empty(t, events)
+
+	// the existing links don't emit events
+	e.SetLinkEvents(true)
+	assert.Empty(t, events)
+
+	assert.NoError(t, e.UpdateNode("D", func(node *Node) error {
+		node.X = 10
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"LinkDown:C->D", "LinkDown:D->C"}, events)
+
+	events = nil
+	assert.NoError(t, e.UpdateNode("E", func(node *Node) error {
+		node.Online = true
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"LinkUp:E->A", "LinkUp:A->E", "LinkUp:E->B", "LinkUp:B->E", "LinkUp:E->C", "LinkUp:C->E"}, events)
+
+	events = nil
+	assert.NoError(t, e.RemoveNode("B"))
+	assert.ElementsMatch(t, []string{"LinkDown:A->B", "LinkDown:B->A", "LinkDown:C->B", "LinkDown:B->C", "LinkDown:E->B", "LinkDown:B->E"}, events)
+
+	events = nil
+	e.SetLinkEvents(false)
+	assert.NoError(t, e.RemoveNode("E"))
+	assert.Empty(t, events)
+}
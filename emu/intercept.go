@@ -0,0 +1,118 @@
+package emu
+
+import (
+	"errors"
+	"time"
+)
+
+// InterceptedPacket represents a packet on its way from a sender to a single receiver. Interceptors can
+// change the Gain, Data and Delay.
+type InterceptedPacket struct {
+	Sender   Node
+	Receiver Node
+	// Data is a copy of the payload for this receiver.
+	Data []byte
+	// Gain is the signal strength in dBm at the receiver after the path loss.
+	Gain            float64
+	Freq            float64
+	SpreadingFactor float64
+	// Start and Stop of the transmission as unix timestamp in ms of the emulator time.
+	Start int64
+	Stop  int64
+	// Delay is additional emulator time after the end of the transmission before the packet is delivered.
+	Delay time.Duration
+}
+
+// PacketInterceptor processes packets between transmission and reception.
+//
+// Interceptors are called in the order they were added, for every receiver that is online and listens on the
+// channel of the transmission, while the transmission is started:
+//
+//  1. The gain at the receiver is calculated with the path loss.
+//  2. The interceptors are called one after another. If one drops the packet, the following ones aren't
+//     called and a EventInterceptorDropped with the name of the interceptor is emitted for the receiver.
+//  3. The (changed) gain is checked against the sensitivity of the receiver and the gateway demodulators.
+//  4. At the end of the airtime the collision detection uses the (changed) gain. Dropped packets don't
+//     occupy the receiver, so they can't collide with other packets.
+//  5. The delivery waits for the Delay, then the fault injection is applied and the packet is delivered.
+//
+// The airtime isn't changed if the payload is changed. Interceptors are called while the emulator is locked,
+// so they must not call functions of the emulator.
+type PacketInterceptor interface {
+	// Intercept processes the packet. If false is returned the packet is dropped.
+	Intercept(packet *InterceptedPacket) bool
+}
+
+// InterceptorFunc is a adapter to use a function as PacketInterceptor.
+type InterceptorFunc func(packet *InterceptedPacket) bool
+
+// Intercept implements PacketInterceptor.
+func (fn InterceptorFunc) Intercept(packet *InterceptedPacket) bool {
+	return fn(packet)
+}
+
+type namedInterceptor struct {
+	name        string
+	interceptor PacketInterceptor
+}
+
+// AddInterceptor adds a packet interceptor at the end of the chain. The name identifies the interceptor in
+// the trace if it dropped a packet.
+func (emu *Emulator) AddInterceptor(name string, interceptor PacketInterceptor) error {
+	if len(name) == 0 {
+		return errors.New("name missing")
+	}
+
+	emu.Lock()
+	defer emu.Unlock()
+
+	for i := range emu.interceptors {
+		if emu.interceptors[i].name == name {
+			return errors.New("interceptor with this name already exists")
+		}
+	}
+
+	emu.interceptors = append(emu.interceptors, namedInterceptor{name: name, interceptor: interceptor})
+
+	return nil
+}
+
+// RemoveInterceptor removes a packet interceptor by name.
+func (emu *Emulator) RemoveInterceptor(name string) error {
+	emu.Lock()
+	defer emu.Unlock()
+
+	for i := range emu.interceptors {
+		if emu.interceptors[i].name == name {
+			emu.interceptors = append(emu.interceptors[:i:i], emu.interceptors[i+1:]...)
+			return nil
+		}
+	}
+
+	return errors.New("not found")
+}
+
+// Interceptors returns the names of the packet interceptors in the order they are called.
+func (emu *Emulator) Interceptors() []string {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	names := make([]string, len(emu.interceptors))
+	for i := range emu.interceptors {
+		names[i] = emu.interceptors[i].name
+	}
+
+	return names
+}
+
+// interceptLocked runs the packet through all interceptors. If the packet is dropped the name of the
+// interceptor that dropped it is returned.
+func (emu *Emulator) interceptLocked(packet *InterceptedPacket) (string, bool) {
+	for i := range emu.interceptors {
+		if !emu.interceptors[i].interceptor.Intercept(packet) {
+			return emu.interceptors[i].name, false
+		}
+	}
+
+	return "", true
+}
@@ -0,0 +1,110 @@
+package emu
+
+import (
+	"bytes"
+	"github.com/BigJk/loraemu/lora"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newInterceptTestEmu(t *testing.T) (*Emulator, func() map[string][]RxPacket) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+
+	var mutex sync.Mutex
+	received := map[string][]RxPacket{}
+
+	for i, id := range []string{"1", "2", "3"} {
+		assert.NoError(t, e.AddNode(Node{ID: id, Online: true, X: 1 + float64(i)*0.3, Y: 1, TXGain: 40, RXSens: -200}))
+		assert.NoError(t, e.AttachNode(id, func(node Node, packet RxPacket) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			received[node.ID] = append(received[node.ID], packet)
+		}))
+	}
+
+	return e, func() map[string][]RxPacket {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return received
+	}
+}
+
+func TestEmulator_InterceptorChain(t *testing.T) {
+	e, received := newInterceptTestEmu(t)
+
+	var calls []string
+	assert.NoError(t, e.AddInterceptor("mitm", InterceptorFunc(func(packet *InterceptedPacket) bool {
+		calls = append(calls, "mitm:"+packet.Receiver.ID)
+		packet.Data = bytes.ToUpper(packet.Data)
+		return true
+	})))
+	assert.NoError(t, e.AddInterceptor("loss", InterceptorFunc(func(packet *InterceptedPacket) bool {
+		calls = append(calls, "loss:"+packet.Receiver.ID)
+		if packet.Receiver.ID == "3" {
+			return false
+		}
+
+		packet.Gain = -50
+		return true
+	})))
+	assert.Error(t, e.AddInterceptor("loss", InterceptorFunc(func(packet *InterceptedPacket) bool { return true })))
+	assert.Equal(t, []string{"mitm", "loss"}, e.Interceptors())
+
+	var dropped []string
+	e.SubscribeFunc(func(msg EventMessage) {
+		assert.Equal(t, "3", msg.Node.ID)
+		dropped = append(dropped, msg.Data.(InterceptorDropped).Interceptor)
+	}, EventInterceptorDropped)
+
+	msg := []byte("hello")
+	assert.NoError(t, e.SendMessage("1", msg))
+	e.Wait()
+
+	assert.ElementsMatch(t, []string{"mitm:2", "loss:2", "mitm:3", "loss:3"}, calls)
+	assert.Equal(t, []string{"loss"}, dropped)
+	assert.Equal(t, []byte("hello"), msg, "original payload was changed")
+
+	packets := received()
+	assert.Empty(t, packets["3"])
+	if assert.Len(t, packets["2"], 1) {
+		assert.Equal(t, []byte("HELLO"), packets["2"][0].Data)
+		assert.Equal(t, -50, packets["2"][0].RSSI)
+	}
+
+	assert.NoError(t, e.RemoveInterceptor("loss"))
+	assert.Error(t, e.RemoveInterceptor("loss"))
+	assert.Equal(t, []string{"mitm"}, e.Interceptors())
+}
+
+func TestEmulator_InterceptorGainAndDelay(t *testing.T) {
+	e, received := newInterceptTestEmu(t)
+
+	var stop int64
+	assert.NoError(t, e.AddInterceptor("latency", InterceptorFunc(func(packet *InterceptedPacket) bool {
+		stop = packet.Stop
+
+		// node 3 is moved below its sensitivity, node 2 gets a delayed packet
+		if packet.Receiver.ID == "3" {
+			packet.Gain = -250
+		} else {
+			packet.Delay = time.Second * 2
+		}
+
+		return true
+	})))
+
+	assert.NoError(t, e.SendMessage("1", []byte("hello")))
+	e.Wait()
+
+	packets := received()
+	assert.Empty(t, packets["3"])
+	if assert.Len(t, packets["2"], 1) {
+		assert.GreaterOrEqual(t, packets["2"][0].RecvTimeMicro/1000-stop, int64(2000))
+	}
+}
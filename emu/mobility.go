@@ -22,6 +22,7 @@ type Mobility struct {
 	wg          sync.WaitGroup
 	done        chan bool
 	pause       atomic.Value
+	tickLag     int64
 }
 
 // NewMobility creates a new mobility manager linked to an emu with the given commands.
@@ -112,6 +113,12 @@ func (m *Mobility) GetPause() bool {
 	return m.pause.Load().(bool)
 }
 
+// TickLag returns how late the last tick was handled in wall time. It grows if the updates of the nodes
+// take longer than the tick interval.
+func (m *Mobility) TickLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.tickLag))
+}
+
 // Start starts the simulation.
 func (m *Mobility) Start() {
 	m.wg.Add(1)
@@ -128,14 +135,18 @@ func (m *Mobility) Start() {
 			}
 
 			active := map[string]*mobility.SetDestCommand{}
-			ticker := time.NewTicker(time.Millisecond * time.Duration(1000.0/float64(m.timeScaling)/m.tickrate))
+			interval := time.Millisecond * time.Duration(1000.0/float64(m.timeScaling)/m.tickrate)
+			ticker := time.NewTicker(interval)
 			elapsed := 0.0
 
 		commandExec:
 			for {
 				select {
-				case <-ticker.C:
+				case tick := <-ticker.C:
 					{
+						// the ticker drops ticks of a slow receiver, so the lag is measured per tick
+						atomic.StoreInt64(&m.tickLag, int64(time.Since(tick)))
+
 						if m.pause.Load().(bool) {
 							continue
 						}
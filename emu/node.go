@@ -7,26 +7,44 @@ import (
 )
 
 type received struct {
-	Start int64   `json:"start"`
-	Stop  int64   `json:"stop"`
-	Gain  float64 `json:"gain"`
+	Start           int64   `json:"start"`
+	Stop            int64   `json:"stop"`
+	Gain            float64 `json:"gain"`
+	Freq            float64 `json:"freq"`
+	SpreadingFactor float64 `json:"spreadingFactor"`
 }
 
+// NodeKind represents the kind of radio a node has.
+type NodeKind string
+
+const (
+	// NodeKindDefault is a single-channel half-duplex radio.
+	NodeKindDefault = NodeKind("")
+	// NodeKindGateway is a multi-channel gateway radio that can demodulate multiple packets at once.
+	NodeKindGateway = NodeKind("gateway")
+)
+
 // Node represents a LoRa device in the emulator.
 type Node struct {
-	ID     string                 `json:"id"`
-	Online bool                   `json:"online"`
-	X      float64                `json:"x"`
-	Y      float64                `json:"y"`
-	Z      float64                `json:"z"`
-	TXGain float64                `json:"txGain"`
-	RXSens float64                `json:"rxSens"`
-	SNR    int                    `json:"snr"`
-	Icon   string                 `json:"icon"`
-	Meta   map[string]interface{} `json:"meta"`
+	ID              string                 `json:"id"`
+	Online          bool                   `json:"online"`
+	X               float64                `json:"x"`
+	Y               float64                `json:"y"`
+	Z               float64                `json:"z"`
+	TXGain          float64                `json:"txGain"`
+	RXSens          float64                `json:"rxSens"`
+	SNR             int                    `json:"snr"`
+	Freq            float64                `json:"freq"`
+	SpreadingFactor float64                `json:"spreadingFactor"`
+	Kind            NodeKind               `json:"kind"`
+	Gateway         *GatewayConfig         `json:"gateway"`
+	Icon            string                 `json:"icon"`
+	Tags            []string               `json:"tags"`
+	Meta            map[string]interface{} `json:"meta"`
 
-	receiving    []received
-	sendingUntil int64
+	receiving        []received
+	sendingUntil     int64
+	demodulatorsBusy int
 }
 
 func (n Node) DistanceTo(other Node) float64 {
@@ -48,9 +66,35 @@ func (n Node) LatLng() (float64, float64) {
 	return lat, lng
 }
 
+// HasTag checks if the node has the given tag.
+func (n Node) HasTag(tag string) bool {
+	for i := range n.Tags {
+		if n.Tags[i] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsGateway checks if the node is a multi-channel gateway.
+func (n Node) IsGateway() bool {
+	return n.Kind == NodeKindGateway
+}
+
 func (n Node) Valid() error {
 	if len(n.ID) == 0 {
 		return errors.New("no id")
 	}
+
+	switch n.Kind {
+	case NodeKindDefault:
+	case NodeKindGateway:
+		if n.Gateway != nil && n.Gateway.Demodulators < 0 {
+			return errors.New("demodulators can't be negative")
+		}
+	default:
+		return errors.New("unknown node kind")
+	}
+
 	return nil
 }
@@ -0,0 +1,260 @@
+package emu
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultTXQueueCapacity is the number of transmissions that can wait per node if no capacity is set.
+const DefaultTXQueueCapacity = 64
+
+var (
+	// ErrSenderOffline is returned if a node that is offline tries to send. It is also passed to
+	// TxParams.OnDone of queued transmissions if the node went offline while they were waiting.
+	ErrSenderOffline = errors.New("sender not online")
+	// ErrQueueFull is returned and passed to TxParams.OnDone if the TX queue of the node is full.
+	ErrQueueFull = errors.New("tx queue full")
+	// ErrTxCanceled is passed to TxParams.OnDone if a queued transmission is canceled or flushed.
+	ErrTxCanceled = errors.New("transmission canceled")
+	// ErrTxNotFound is returned if a transmission to cancel isn't in the queue.
+	ErrTxNotFound = errors.New("transmission not found")
+)
+
+// QueuedTx represents a transmission that waits until the node finished its current transmission.
+type QueuedTx struct {
+	ID       uint64 `json:"id"`
+	Data     []byte `json:"data"`
+	Priority int    `json:"priority"`
+	// Queued is the unix timestamp in ms of the emulator time at which the transmission was queued.
+	Queued int64 `json:"queued"`
+
+	params TxParams
+}
+
+// txQueue holds the pending transmissions of a node. Scheduled is true if the next dequeue is already
+// scheduled, so that only one dequeue per node is pending at once.
+type txQueue struct {
+	items     []QueuedTx
+	scheduled bool
+}
+
+// SetTXQueueCapacity sets the maximum number of transmissions that can wait per node. Transmissions
+// that don't fit into the queue are rejected with ErrQueueFull. A capacity of 0 means that nodes
+// can't send while they are still sending.
+func (emu *Emulator) SetTXQueueCapacity(capacity int) error {
+	if capacity < 0 {
+		return errors.New("capacity can't be negative")
+	}
+
+	emu.Lock()
+	defer emu.Unlock()
+
+	emu.txQueueCapacity = capacity
+
+	return nil
+}
+
+// GetTXQueueCapacity returns the maximum number of transmissions that can wait per node.
+func (emu *Emulator) GetTXQueueCapacity() int {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	return emu.txQueueCapacity
+}
+
+// Queue returns the pending transmissions of a node in the order they will be sent.
+func (emu *Emulator) Queue(id string) ([]QueuedTx, error) {
+	emu.RLock()
+	defer emu.RUnlock()
+
+	if _, ok := emu.nodes[id]; !ok {
+		return nil, errors.New("not found")
+	}
+
+	queue := emu.txQueues[id]
+	if queue == nil {
+		return []QueuedTx{}, nil
+	}
+
+	return append([]QueuedTx{}, queue.items...), nil
+}
+
+// CancelTx removes a pending transmission from the queue of a node.
+func (emu *Emulator) CancelTx(id string, txID uint64) error {
+	emu.Lock()
+	defer emu.Unlock()
+
+	if _, ok := emu.nodes[id]; !ok {
+		return errors.New("not found")
+	}
+
+	queue := emu.txQueues[id]
+	if queue == nil {
+		return ErrTxNotFound
+	}
+
+	for i := range queue.items {
+		if queue.items[i].ID != txID {
+			continue
+		}
+
+		tx := queue.items[i]
+		queue.items = append(queue.items[:i], queue.items[i+1:]...)
+		emu.rejectLocked(tx.params, ErrTxCanceled)
+
+		return nil
+	}
+
+	return ErrTxNotFound
+}
+
+// FlushQueue removes all pending transmissions of a node and returns how many were removed.
+func (emu *Emulator) FlushQueue(id string) (int, error) {
+	emu.Lock()
+	defer emu.Unlock()
+
+	if _, ok := emu.nodes[id]; !ok {
+		return 0, errors.New("not found")
+	}
+
+	queue := emu.txQueues[id]
+	if queue == nil {
+		return 0, nil
+	}
+
+	flushed := len(queue.items)
+	for i := range queue.items {
+		emu.rejectLocked(queue.items[i].params, ErrTxCanceled)
+	}
+	queue.items = nil
+
+	return flushed, nil
+}
+
+func (emu *Emulator) queueLen(id string) int {
+	if queue := emu.txQueues[id]; queue != nil {
+		return len(queue.items)
+	}
+
+	return 0
+}
+
+// rejectLocked passes the error to the OnDone callback of a transmission that will never be sent.
+func (emu *Emulator) rejectLocked(params TxParams, err error) {
+	if params.OnDone != nil {
+		emu.afterLocked(0, func() {
+			params.OnDone(TxResult{}, err)
+		})
+	}
+}
+
+// dropQueueLocked rejects all pending transmissions of a node and deletes its queue.
+func (emu *Emulator) dropQueueLocked(id string) {
+	queue := emu.txQueues[id]
+	if queue == nil {
+		return
+	}
+
+	for i := range queue.items {
+		emu.rejectLocked(queue.items[i].params, ErrTxCanceled)
+	}
+
+	delete(emu.txQueues, id)
+}
+
+// enqueueLocked adds a transmission to the queue of the node. Transmissions are sorted by priority
+// and keep their order within the same priority.
+func (emu *Emulator) enqueueLocked(sender Node, msg []byte, params TxParams) error {
+	queue := emu.txQueues[sender.ID]
+	if queue == nil {
+		queue = &txQueue{}
+		emu.txQueues[sender.ID] = queue
+	}
+
+	if len(queue.items) >= emu.txQueueCapacity {
+		emu.emitEvent(EventQueueOverflow, sender, QueueOverflow{
+			Size:     len(msg),
+			Priority: params.Priority,
+			Capacity: emu.txQueueCapacity,
+		})
+
+		emu.rejectLocked(params, ErrQueueFull)
+
+		return ErrQueueFull
+	}
+
+	emu.nextTxID++
+	tx := QueuedTx{
+		ID:       emu.nextTxID,
+		Data:     msg,
+		Priority: params.Priority,
+		Queued:   emu.getTime().UnixMilli(),
+		params:   params,
+	}
+
+	pos := len(queue.items)
+	for pos > 0 && queue.items[pos-1].Priority < tx.Priority {
+		pos--
+	}
+
+	queue.items = append(queue.items, QueuedTx{})
+	copy(queue.items[pos+1:], queue.items[pos:])
+	queue.items[pos] = tx
+
+	emu.scheduleDequeueLocked(sender)
+
+	return nil
+}
+
+// scheduleDequeueLocked schedules the next transmission of the queue for the time the node has
+// finished sending.
+func (emu *Emulator) scheduleDequeueLocked(sender Node) {
+	queue := emu.txQueues[sender.ID]
+	if queue == nil || queue.scheduled || len(queue.items) == 0 {
+		return
+	}
+
+	wait := sender.sendingUntil - emu.getTime().UnixMilli() + 1
+	if wait < 0 {
+		wait = 0
+	}
+
+	queue.scheduled = true
+	emu.afterLocked(time.Duration(wait)*time.Millisecond, func() {
+		emu.dequeue(sender.ID)
+	})
+}
+
+// dequeue sends the next transmission of the queue of the node.
+func (emu *Emulator) dequeue(id string) {
+	emu.Lock()
+	defer emu.Unlock()
+
+	queue := emu.txQueues[id]
+	if queue == nil {
+		return
+	}
+	queue.scheduled = false
+
+	sender, ok := emu.nodes[id]
+	if !ok || len(queue.items) == 0 {
+		return
+	}
+
+	// the timer can fire a bit early, so wait until the node is really finished
+	if emu.getTime().UnixMilli() <= sender.sendingUntil {
+		emu.scheduleDequeueLocked(sender)
+		return
+	}
+
+	tx := queue.items[0]
+	queue.items = queue.items[1:]
+
+	if sender.Online {
+		emu.transmitLocked(sender, tx.Data, tx.params)
+	} else {
+		emu.rejectLocked(tx.params, ErrSenderOffline)
+	}
+
+	emu.scheduleDequeueLocked(emu.nodes[id])
+}
@@ -0,0 +1,123 @@
+package emu
+
+import (
+	"github.com/BigJk/loraemu/lora"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newQueueTestEmu(t *testing.T) (*Emulator, func() []string) {
+	e := New(868, 2, 1, 10, lora.PacketConfigDefault)
+
+	assert.NoError(t, e.AddNode(Node{ID: "1", Online: true, X: 1, Y: 1, TXGain: 40, RXSens: -200}))
+	assert.NoError(t, e.AddNode(Node{ID: "2", Online: true, X: 1.3, Y: 1, TXGain: 40, RXSens: -200}))
+
+	var mutex sync.Mutex
+	var received []string
+
+	assert.NoError(t, e.AttachNode("2", func(node Node, packet RxPacket) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		received = append(received, string(packet.Data[:1]))
+	}))
+
+	return e, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return append([]string{}, received...)
+	}
+}
+
+// payload returns a packet starting with the given prefix that is long enough to keep the node busy while
+// the test queues further packets.
+func payload(prefix string) []byte {
+	return []byte(prefix + strings.Repeat("-", 60))
+}
+
+func TestEmulator_QueuePriority(t *testing.T) {
+	e, received := newQueueTestEmu(t)
+	assert.NoError(t, e.SetTXQueueCapacity(4))
+	assert.Error(t, e.SetTXQueueCapacity(-1))
+
+	var overflows int
+	e.SubscribeFunc(func(msg EventMessage) {
+		overflows++
+	}, EventQueueOverflow)
+
+	var mutex sync.Mutex
+	var errs []error
+	onDone := func(result TxResult, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		errs = append(errs, err)
+	}
+
+	assert.NoError(t, e.SendMessage("1", payload("a")))
+	assert.NoError(t, e.SendMessage("1", payload("b")))
+	assert.NoError(t, e.SendMessage("1", payload("c")))
+	assert.NoError(t, e.SendMessageWithParams("1", payload("d"), TxParams{Priority: 1}))
+	assert.NoError(t, e.SendMessageWithParams("1", payload("e"), TxParams{OnDone: onDone}))
+	assert.ErrorIs(t, e.SendMessageWithParams("1", payload("f"), TxParams{OnDone: onDone}), ErrQueueFull)
+	assert.Equal(t, 1, overflows)
+
+	queue, err := e.Queue("1")
+	if assert.NoError(t, err) && assert.Len(t, queue, 4) {
+		var order []string
+		for _, tx := range queue {
+			order = append(order, string(tx.Data[:1]))
+		}
+		assert.Equal(t, []string{"d", "b", "c", "e"}, order)
+
+		assert.NoError(t, e.CancelTx("1", queue[3].ID))
+		assert.ErrorIs(t, e.CancelTx("1", queue[3].ID), ErrTxNotFound)
+	}
+
+	_, err = e.Queue("3")
+	assert.Error(t, err)
+
+	e.Wait()
+
+	assert.Equal(t, []string{"a", "d", "b", "c"}, received())
+	assert.ElementsMatch(t, []error{ErrQueueFull, ErrTxCanceled}, errs)
+
+	queue, err = e.Queue("1")
+	assert.NoError(t, err)
+	assert.Empty(t, queue)
+}
+
+func TestEmulator_QueueFlush(t *testing.T) {
+	e, received := newQueueTestEmu(t)
+
+	assert.NoError(t, e.SendMessage("1", payload("a")))
+	assert.NoError(t, e.SendMessage("1", payload("b")))
+	assert.NoError(t, e.SendMessage("1", payload("c")))
+
+	flushed, err := e.FlushQueue("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, flushed)
+
+	// packets sent after the flush are queued again
+	assert.NoError(t, e.SendMessage("1", payload("d")))
+
+	e.Wait()
+
+	assert.Equal(t, []string{"a", "d"}, received())
+}
+
+func TestEmulator_QueueDisabled(t *testing.T) {
+	e, received := newQueueTestEmu(t)
+	assert.NoError(t, e.SetTXQueueCapacity(0))
+
+	assert.NoError(t, e.SendMessage("1", payload("a")))
+	assert.ErrorIs(t, e.SendMessage("1", payload("b")), ErrQueueFull)
+
+	e.Wait()
+
+	assert.Equal(t, []string{"a"}, received())
+}
@@ -0,0 +1,550 @@
+// Package enddevice implements virtual LoRaWAN 1.0.x class A end-devices that use emulator nodes as
+// their radio. They join via OTAA, send uplinks on a schedule, open the RX1 and RX2 windows and follow
+// the ADR commands of the network server.
+package enddevice
+
+import (
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lorawan"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// ReceiveWindowTolerance is the time around the opening of a receive window in which the start of a
+// downlink is accepted.
+const ReceiveWindowTolerance = time.Millisecond * 500
+
+// After ADRAckLimit uplinks without downlink the device requests a answer and after further ADRAckDelay
+// uplinks it lowers the data rate.
+const (
+	ADRAckLimit = 64
+	ADRAckDelay = 32
+)
+
+// Config represents the configuration of a virtual end-device.
+type Config struct {
+	// Node is the id of the node that is used as radio.
+	Node    string            `json:"node"`
+	DevEUI  lorawan.EUI64     `json:"devEui"`
+	JoinEUI lorawan.EUI64     `json:"joinEui"`
+	AppKey  lorawan.AES128Key `json:"appKey"`
+	// Interval is the time between uplinks in seconds. Defaults to 60.
+	Interval float64 `json:"interval"`
+	// Jitter is the maximum random delay in seconds that is added to the interval.
+	Jitter float64 `json:"jitter"`
+	// JoinRetry is the time between join-requests in seconds if the join failed. Defaults to 10.
+	JoinRetry float64 `json:"joinRetry"`
+	// FPort is the port of the uplinks. Defaults to 1.
+	FPort uint8 `json:"fPort"`
+	// Payload is sent in every uplink. If empty PayloadSize random bytes are sent.
+	Payload []byte `json:"payload"`
+	// PayloadSize is the size of the random payload. Defaults to 8.
+	PayloadSize int `json:"payloadSize"`
+	// Confirmed sends confirmed uplinks.
+	Confirmed bool `json:"confirmed"`
+	// ADR enables the adaptive data rate.
+	ADR bool `json:"adr"`
+	// DataRate is the data rate of the join-requests and the first uplinks.
+	DataRate int `json:"dataRate"`
+	// Channels are the uplink channels. Defaults to the EU868 default channels.
+	Channels []float64 `json:"channels"`
+	// RX2Freq is the frequency of the RX2 window in MHz. It has to match the network server. Defaults to 869.525.
+	RX2Freq float64 `json:"rx2Freq"`
+}
+
+// State represents the MAC state of a end-device.
+type State struct {
+	Node          string                `json:"node"`
+	DevEUI        lorawan.EUI64         `json:"devEui"`
+	Joined        bool                  `json:"joined"`
+	DevAddr       lorawan.DevAddr       `json:"devAddr"`
+	DevNonce      uint16                `json:"devNonce"`
+	FCntUp        uint32                `json:"fCntUp"`
+	FCntDown      uint32                `json:"fCntDown"`
+	DataRate      int                   `json:"dataRate"`
+	TXPower       int                   `json:"txPower"`
+	ADR           bool                  `json:"adr"`
+	ADRAckCnt     int                   `json:"adrAckCnt"`
+	RX1DROffset   uint8                 `json:"rx1DrOffset"`
+	RX2DataRate   uint8                 `json:"rx2DataRate"`
+	RxDelay       uint8                 `json:"rxDelay"`
+	JoinRequests  int                   `json:"joinRequests"`
+	Uplinks       int                   `json:"uplinks"`
+	Downlinks     int                   `json:"downlinks"`
+	Acked         int                   `json:"acked"`
+	LastLinkCheck *lorawan.LinkCheckAns `json:"lastLinkCheck"`
+}
+
+// rxWindow represents a opened receive window.
+type rxWindow struct {
+	Open     time.Time
+	Freq     float64
+	DataRate int
+}
+
+// Device represents a virtual end-device.
+type Device struct {
+	sync.Mutex
+
+	emu      *emu.Emulator
+	config   Config
+	logger   logr.Logger
+	rand     *rand.Rand
+	state    State
+	nwkSKey  lorawan.AES128Key
+	appSKey  lorawan.AES128Key
+	windows  []rxWindow
+	answers  []lorawan.MACCommand
+	ack      bool
+	done     chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a new virtual end-device.
+func New(emulator *emu.Emulator, config Config) (*Device, error) {
+	if len(config.Node) == 0 {
+		return nil, errors.New("node missing")
+	}
+
+	if _, err := lorawan.EU868DataRate(config.DataRate); err != nil {
+		return nil, err
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = 60
+	}
+
+	if config.JoinRetry <= 0 {
+		config.JoinRetry = 10
+	}
+
+	if config.FPort == 0 {
+		config.FPort = 1
+	}
+
+	if config.PayloadSize <= 0 {
+		config.PayloadSize = 8
+	}
+
+	if len(config.Channels) == 0 {
+		config.Channels = lorawan.EU868DefaultChannels
+	}
+
+	if config.RX2Freq <= 0 {
+		config.RX2Freq = lorawan.EU868RX2Freq
+	}
+
+	return &Device{
+		emu:    emulator,
+		config: config,
+		logger: logr.Discard(),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		state: State{
+			Node:     config.Node,
+			DevEUI:   config.DevEUI,
+			DataRate: config.DataRate,
+			ADR:      config.ADR,
+		},
+		done: make(chan bool),
+	}, nil
+}
+
+// SetLogger sets the logger of the end-device.
+func (d *Device) SetLogger(logger logr.Logger) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.logger = logger
+}
+
+// DevEUI returns the DevEUI of the end-device.
+func (d *Device) DevEUI() lorawan.EUI64 {
+	return d.config.DevEUI
+}
+
+// State returns a copy of the MAC state of the end-device.
+func (d *Device) State() State {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.state
+}
+
+// scaled converts a duration of emulator time to wall clock time.
+func (d *Device) scaled(dur time.Duration) time.Duration {
+	return dur / time.Duration(d.emu.GetTimeScaling())
+}
+
+// transmit sends the frame on a random channel and opens the receive windows after the uplink. The lock
+// of the device needs to be held.
+func (d *Device) transmit(phy []byte, rx1Delay time.Duration) error {
+	dr, err := lorawan.EU868DataRate(d.state.DataRate)
+	if err != nil {
+		return err
+	}
+
+	freq := d.config.Channels[d.rand.Intn(len(d.config.Channels))]
+	rx1DataRate := int(math.Max(0, float64(d.state.DataRate-int(d.state.RX1DROffset))))
+	rx2DataRate := int(d.state.RX2DataRate)
+
+	return d.emu.SendMessageWithParams(d.config.Node, phy, emu.TxParams{
+		Freq:            freq,
+		SpreadingFactor: dr.SpreadingFactor,
+		BandWidth:       dr.BandWidth,
+		OnDone: func(result emu.TxResult, err error) {
+			if err != nil {
+				return
+			}
+
+			// the uplink might have waited in the tx queue, so the windows follow the actual end of it
+			end := time.UnixMilli(result.Start).Add(time.Duration(result.Airtime * float64(time.Millisecond)))
+			d.openWindows(end,
+				rxWindow{Open: end.Add(rx1Delay), Freq: freq, DataRate: rx1DataRate},
+				rxWindow{Open: end.Add(rx1Delay + time.Second), Freq: d.config.RX2Freq, DataRate: rx2DataRate},
+			)
+		},
+	})
+}
+
+// openWindows sets the receive windows of a finished uplink. The radio listens on the rx1 parameters right
+// after the uplink and switches to rx2 if nothing was received.
+func (d *Device) openWindows(end time.Time, rx1 rxWindow, rx2 rxWindow) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.windows = []rxWindow{rx1, rx2}
+	d.tune(rx1)
+
+	d.emu.Schedule(rx1.Open.Add(ReceiveWindowTolerance).Sub(end), func() {
+		d.Lock()
+		defer d.Unlock()
+
+		// only switch if nothing was received in rx1 and no newer uplink was sent
+		if len(d.windows) == 2 && d.windows[1] == rx2 {
+			d.tune(rx2)
+		}
+	})
+}
+
+// tune sets the receive parameters of the radio node.
+func (d *Device) tune(window rxWindow) {
+	dr, err := lorawan.EU868DataRate(window.DataRate)
+	if err != nil {
+		return
+	}
+
+	_ = d.emu.UpdateNode(d.config.Node, func(node *emu.Node) error {
+		node.Freq = window.Freq
+		node.SpreadingFactor = dr.SpreadingFactor
+		return nil
+	})
+}
+
+// Join sends a join-request.
+func (d *Device) Join() error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.state.DevNonce++
+	d.state.JoinRequests++
+
+	jr := lorawan.JoinRequestPayload{
+		JoinEUI:  d.config.JoinEUI,
+		DevEUI:   d.config.DevEUI,
+		DevNonce: d.state.DevNonce,
+	}
+
+	return d.transmit(jr.Marshal(d.config.AppKey), lorawan.JoinAcceptDelay1)
+}
+
+// SendUplink sends a data uplink with the given port and payload. Pending MAC command answers are
+// sent in the FOpts.
+func (d *Device) SendUplink(fPort uint8, payload []byte, confirmed bool) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.state.Joined {
+		return errors.New("not joined")
+	}
+
+	if fPort == 0 {
+		return errors.New("fport 0 is reserved for mac commands")
+	}
+
+	// without downlinks for a long time the device requests a answer and lowers the data rate
+	adrAckReq := false
+	if d.state.ADR {
+		adrAckReq = d.state.ADRAckCnt >= ADRAckLimit
+		if d.state.ADRAckCnt >= ADRAckLimit+ADRAckDelay && (d.state.ADRAckCnt-ADRAckLimit)%ADRAckDelay == 0 {
+			if d.state.TXPower > 0 {
+				d.state.TXPower = 0
+				d.setTXPower(0)
+			} else if d.state.DataRate > 0 {
+				d.state.DataRate--
+			}
+		}
+	}
+
+	mType := lorawan.UnconfirmedDataUp
+	if confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
+
+	frame := lorawan.DataFrame{
+		MType:   mType,
+		DevAddr: d.state.DevAddr,
+		FCtrl: lorawan.FCtrl{
+			ADR:       d.state.ADR,
+			ADRACKReq: adrAckReq,
+			ACK:       d.ack,
+		},
+		FCnt:       d.state.FCntUp,
+		FOpts:      lorawan.MarshalMACCommands(d.answers),
+		FPort:      &fPort,
+		FRMPayload: payload,
+	}
+
+	phy, err := frame.Marshal(d.nwkSKey, d.appSKey)
+	if err != nil {
+		return err
+	}
+
+	rxDelay := time.Duration(d.state.RxDelay) * time.Second
+	if rxDelay == 0 {
+		rxDelay = lorawan.ReceiveDelay1
+	}
+
+	if err := d.transmit(phy, rxDelay); err != nil {
+		return err
+	}
+
+	d.answers = nil
+	d.ack = false
+	d.state.FCntUp++
+	d.state.Uplinks++
+	d.state.ADRAckCnt++
+
+	return nil
+}
+
+func (d *Device) setTXPower(index int) {
+	_ = d.emu.UpdateNode(d.config.Node, func(node *emu.Node) error {
+		node.TXGain = lorawan.EU868TXPower(index)
+		return nil
+	})
+}
+
+func (d *Device) payload() []byte {
+	if len(d.config.Payload) > 0 {
+		return d.config.Payload
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	payload := make([]byte, d.config.PayloadSize)
+	d.rand.Read(payload)
+	return payload
+}
+
+func (d *Device) handleReceived(node emu.Node, packet emu.RxPacket) {
+	if packet.CRCFailed {
+		return
+	}
+
+	// the airtime of the packet is in wall clock time
+	airtime := time.Duration(packet.Airtime * float64(d.emu.GetTimeScaling()) * float64(time.Millisecond))
+	start := time.UnixMicro(packet.RecvTimeMicro).Add(-airtime)
+
+	d.Lock()
+	defer d.Unlock()
+
+	opened := false
+	for _, window := range d.windows {
+		dr, err := lorawan.EU868DataRate(window.DataRate)
+		if err != nil || math.Abs(window.Freq-packet.Freq) > 1e-6 || dr.SpreadingFactor != packet.SpreadingFactor {
+			continue
+		}
+
+		if start.After(window.Open.Add(-ReceiveWindowTolerance)) && start.Before(window.Open.Add(ReceiveWindowTolerance)) {
+			opened = true
+			break
+		}
+	}
+
+	if !opened {
+		return
+	}
+
+	mType, err := lorawan.ParseMType(packet.Data)
+	if err != nil {
+		return
+	}
+
+	switch mType {
+	case lorawan.JoinAccept:
+		d.handleJoinAccept(packet.Data)
+	case lorawan.UnconfirmedDataDown, lorawan.ConfirmedDataDown:
+		d.handleDataDown(packet.Data)
+	}
+}
+
+// handleJoinAccept processes a join-accept. The lock of the device needs to be held.
+func (d *Device) handleJoinAccept(phy []byte) {
+	ja, err := lorawan.DecryptJoinAccept(d.config.AppKey, phy)
+	if err != nil {
+		return
+	}
+
+	d.windows = nil
+	d.nwkSKey, d.appSKey = lorawan.DeriveSessionKeys(d.config.AppKey, ja.JoinNonce, ja.NetID, d.state.DevNonce)
+	d.answers = nil
+	d.ack = false
+
+	d.state.Joined = true
+	d.state.DevAddr = ja.DevAddr
+	d.state.FCntUp = 0
+	d.state.FCntDown = 0
+	d.state.RX1DROffset = ja.RX1DROffset
+	d.state.RX2DataRate = ja.RX2DataRate
+	d.state.RxDelay = ja.RxDelay
+	d.state.ADRAckCnt = 0
+
+	d.logger.Info("end-device joined", "devEui", d.config.DevEUI.String(), "devAddr", ja.DevAddr.String())
+}
+
+// handleDataDown processes a data downlink. The lock of the device needs to be held.
+func (d *Device) handleDataDown(phy []byte) {
+	if !d.state.Joined {
+		return
+	}
+
+	frame, err := lorawan.ParseDataFrame(phy)
+	if err != nil || frame.DevAddr != d.state.DevAddr {
+		return
+	}
+
+	fCnt := lorawan.FullFCnt(d.state.FCntDown, uint16(frame.FCnt))
+	if !lorawan.ValidateDataMIC(d.nwkSKey, phy, fCnt) {
+		return
+	}
+
+	frame.Decrypt(d.nwkSKey, d.appSKey, fCnt)
+
+	d.windows = nil
+	d.state.FCntDown = fCnt + 1
+	d.state.Downlinks++
+	d.state.ADRAckCnt = 0
+
+	if frame.FCtrl.ACK {
+		d.state.Acked++
+	}
+
+	d.ack = frame.MType == lorawan.ConfirmedDataDown
+
+	macPayload := frame.FOpts
+	if frame.FPort != nil && *frame.FPort == 0 {
+		macPayload = frame.FRMPayload
+	}
+
+	commands, _ := lorawan.ParseMACCommands(macPayload, false)
+	for _, cmd := range commands {
+		switch cmd.CID {
+		case lorawan.CIDLinkADR:
+			req := lorawan.ParseLinkADRReq(cmd)
+			ans := lorawan.LinkADRAns{
+				PowerACK:       req.TXPower <= lorawan.EU868MaxTXPowerIndex,
+				DataRateACK:    req.DataRate <= lorawan.EU868MaxADRDataRate,
+				ChannelMaskACK: req.ChMask != 0,
+			}
+
+			if ans.Accepted() {
+				d.state.DataRate = int(req.DataRate)
+				if d.state.TXPower != int(req.TXPower) {
+					d.state.TXPower = int(req.TXPower)
+					d.setTXPower(d.state.TXPower)
+				}
+			}
+
+			d.answers = append(d.answers, ans.Command())
+		case lorawan.CIDLinkCheck:
+			ans := lorawan.ParseLinkCheckAns(cmd)
+			d.state.LastLinkCheck = &ans
+		}
+	}
+}
+
+func (d *Device) wait(seconds float64) bool {
+	d.Lock()
+	jitter := d.config.Jitter * d.rand.Float64()
+	d.Unlock()
+
+	select {
+	case <-time.After(d.scaled(time.Duration((seconds + jitter) * float64(time.Second)))):
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+func (d *Device) run() {
+	defer d.wg.Done()
+
+	if !d.wait(0) {
+		return
+	}
+
+	for {
+		if !d.State().Joined {
+			if err := d.Join(); err != nil {
+				d.logger.Error(err, "can't send join-request", "devEui", d.config.DevEUI.String())
+			}
+
+			if !d.wait(d.config.JoinRetry) {
+				return
+			}
+
+			continue
+		}
+
+		if err := d.SendUplink(d.config.FPort, d.payload(), d.config.Confirmed); err != nil {
+			d.logger.Error(err, "can't send uplink", "devEui", d.config.DevEUI.String())
+		}
+
+		if !d.wait(d.config.Interval) {
+			return
+		}
+	}
+}
+
+// Start attaches the end-device to its node and starts the join and uplink schedule.
+func (d *Device) Start() error {
+	if err := d.emu.AttachNode(d.config.Node, d.handleReceived); err != nil {
+		return err
+	}
+
+	d.wg.Add(1)
+	go d.run()
+
+	return nil
+}
+
+// Stop requests the stop of the end-device. You need to .Done() after this to ensure graceful shutdown.
+// It's safe to call Stop multiple times.
+func (d *Device) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.done)
+		d.emu.DetachNode(d.config.Node)
+	})
+}
+
+// Done waits for the end-device to stop.
+func (d *Device) Done() {
+	d.wg.Wait()
+}
@@ -0,0 +1,220 @@
+package enddevice
+
+import (
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"github.com/BigJk/loraemu/lorawan"
+	"github.com/BigJk/loraemu/netserver"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitUntil(t *testing.T, cond func() bool, msg string) bool {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return assert.Fail(t, msg)
+}
+
+func newDeviceTestEmu(t *testing.T) *emu.Emulator {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(20))
+
+	assert.NoError(t, e.AddNode(emu.Node{
+		ID:     "Device",
+		Online: true,
+		X:      1.45,
+		Y:      1,
+		TXGain: 14,
+		RXSens: -137,
+	}))
+
+	assert.NoError(t, e.AddNode(emu.Node{
+		ID:      "GW",
+		Online:  true,
+		X:       1.5,
+		Y:       1,
+		TXGain:  27,
+		RXSens:  -141,
+		SNR:     117, // noise floor of a 125 kHz channel
+		Kind:    emu.NodeKindGateway,
+		Gateway: &emu.GatewayConfig{Channels: lorawan.EU868DefaultChannels},
+	}))
+
+	return e
+}
+
+func TestDevice(t *testing.T) {
+	e := newDeviceTestEmu(t)
+
+	config := Config{
+		Node:      "Device",
+		DevEUI:    lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+		JoinEUI:   lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+		AppKey:    lorawan.AES128Key{3, 3, 3},
+		Interval:  5,
+		JoinRetry: 10,
+		Confirmed: true,
+		ADR:       true,
+		DataRate:  0,
+	}
+
+	ns := netserver.New(e, netserver.Config{
+		Gateways:   []string{"GW"},
+		Devices:    []netserver.DeviceConfig{{DevEUI: config.DevEUI, JoinEUI: config.JoinEUI, AppKey: config.AppKey}},
+		ADR:        true,
+		ADRHistory: 1,
+	})
+	if !assert.NoError(t, ns.Start()) {
+		return
+	}
+	defer ns.Stop()
+
+	d, err := New(e, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, d.Start()) {
+		return
+	}
+	defer d.Done()
+	defer d.Stop()
+
+	t.Run("Join", func(t *testing.T) {
+		if !waitUntil(t, func() bool { return d.State().Joined }, "device not joined") {
+			t.FailNow()
+		}
+
+		session, _ := ns.Session(config.DevEUI)
+		assert.Equal(t, session.DevAddr, d.State().DevAddr)
+	})
+
+	t.Run("ConfirmedUplink", func(t *testing.T) {
+		waitUntil(t, func() bool { return d.State().Acked >= 1 }, "uplink not acknowledged")
+
+		session, _ := ns.Session(config.DevEUI)
+		assert.GreaterOrEqual(t, session.Uplinks, 1)
+		assert.Equal(t, session.FCntDown, d.State().FCntDown)
+	})
+
+	t.Run("ADR", func(t *testing.T) {
+		// the device is close to the gateway so the data rate is raised to the maximum
+		waitUntil(t, func() bool { return d.State().DataRate == lorawan.EU868MaxADRDataRate }, "data rate not raised")
+		waitUntil(t, func() bool {
+			session, _ := ns.Session(config.DevEUI)
+			return session.DataRate == lorawan.EU868MaxADRDataRate
+		}, "link adr not answered")
+	})
+}
+
+func TestDeviceConfig(t *testing.T) {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+
+	_, err := New(e, Config{})
+	assert.Error(t, err)
+
+	_, err = New(e, Config{Node: "Device", DataRate: 10})
+	assert.Error(t, err)
+
+	d, err := New(e, Config{Node: "Device"})
+	if assert.NoError(t, err) {
+		assert.Error(t, d.Start())
+		assert.Error(t, d.SendUplink(1, []byte{1}, false))
+
+		d.Stop()
+		d.Stop()
+		d.Done()
+	}
+}
+
+// TestDevice_RX2 tests if the device listens on the rx2 frequency of the network server.
+func TestDevice_RX2(t *testing.T) {
+	e := newDeviceTestEmu(t)
+
+	config := Config{
+		Node:      "Device",
+		DevEUI:    lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+		JoinEUI:   lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+		AppKey:    lorawan.AES128Key{3, 3, 3},
+		Interval:  5,
+		Confirmed: true,
+		RX2Freq:   869.1,
+	}
+
+	ns := netserver.New(e, netserver.Config{
+		Gateways: []string{"GW"},
+		Devices:  []netserver.DeviceConfig{{DevEUI: config.DevEUI, JoinEUI: config.JoinEUI, AppKey: config.AppKey}},
+		RX2Freq:  869.1,
+		RXWindow: 2,
+	})
+	if !assert.NoError(t, ns.Start()) {
+		return
+	}
+	defer ns.Stop()
+
+	d, err := New(e, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, d.Start()) {
+		return
+	}
+	defer d.Done()
+	defer d.Stop()
+
+	waitUntil(t, func() bool { return d.State().Acked >= 1 }, "uplink not acknowledged in rx2")
+}
+
+// TestDevice_QueuedUplink tests if the receive windows follow the end of a join-request that had to wait
+// in the tx queue behind an earlier transmission of the node.
+func TestDevice_QueuedUplink(t *testing.T) {
+	e := newDeviceTestEmu(t)
+
+	config := Config{
+		Node:      "Device",
+		DevEUI:    lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+		JoinEUI:   lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+		AppKey:    lorawan.AES128Key{3, 3, 3},
+		Interval:  60,
+		JoinRetry: 60,
+	}
+
+	ns := netserver.New(e, netserver.Config{
+		Gateways: []string{"GW"},
+		Devices:  []netserver.DeviceConfig{{DevEUI: config.DevEUI, JoinEUI: config.JoinEUI, AppKey: config.AppKey}},
+	})
+	if !assert.NoError(t, ns.Start()) {
+		return
+	}
+	defer ns.Stop()
+
+	d, err := New(e, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// a few seconds of airtime on a frequency the gateway doesn't listen on
+	assert.NoError(t, e.SendMessageWithParams("Device", make([]byte, 100), emu.TxParams{
+		Freq:            867.0,
+		SpreadingFactor: 12,
+		BandWidth:       125,
+	}))
+
+	if !assert.NoError(t, d.Start()) {
+		return
+	}
+	defer d.Done()
+	defer d.Stop()
+
+	if waitUntil(t, func() bool { return d.State().Joined }, "device not joined after queued join-request") {
+		assert.Equal(t, 1, d.State().JoinRequests, "join-accept of the first join-request missed")
+	}
+}
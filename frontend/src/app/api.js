@@ -56,3 +56,32 @@ export function setEmuPause(val) {
 		}),
 	});
 }
+
+export function getReplay() {
+	return fetch('/api/replay', {
+		method: 'get',
+		headers: {
+			'Content-Type': 'application/json',
+		},
+	});
+}
+
+// postReplay sends a control of the replay, e.g. 'play', 'pause', 'seek', 'step' or 'speed'.
+export function postReplay(control, body) {
+	return fetch('/api/replay/' + control, {
+		method: 'post',
+		headers: {
+			'Content-Type': 'application/json',
+		},
+		body: JSON.stringify(body || {}),
+	});
+}
+
+// coverageUrl returns the url of the coverage heatmap of the nodes, or of all gateways if no ids are given.
+// The time is added so that the browser doesn't show a cached heatmap after nodes were moved.
+export function coverageUrl(nodeIds) {
+	let params = new URLSearchParams();
+	nodeIds.forEach((id) => params.append('node', id));
+	params.append('t', Date.now().toString());
+	return '/api/coverage?' + params.toString();
+}
@@ -131,6 +131,9 @@ let app = createApp({
 				},
 			},
 			showCreateMultiple: false,
+
+			// url of the coverage heatmap that is shown over the background
+			coverage: null,
 		};
 	},
 	mounted() {
@@ -193,6 +196,9 @@ let app = createApp({
 					this.$refs.editNodeWindow.winbox.setTitle('Update Node: ' + item.id);
 					this.$refs.editNodeWindow.winbox.show();
 					break;
+				case 'Coverage':
+					this.coverage = API.coverageUrl([item.id]);
+					break;
 				case 'Delete':
 					API.deleteNode(item.id)
 						.then(() => {
@@ -229,6 +235,12 @@ let app = createApp({
 					this.$refs.createMultipleWindow.winbox.setTitle('Create Multiple Nodes');
 					this.$refs.createMultipleWindow.winbox.show();
 					break;
+				case 'Gateway Coverage':
+					this.coverage = API.coverageUrl([]);
+					break;
+				case 'Hide Coverage':
+					this.coverage = null;
+					break;
 			}
 		},
 		createMultipleNodes() {
@@ -310,6 +322,11 @@ let app = createApp({
 			if (this.selectedId === null) return null;
 			return getters.nodeById(this.selectedId);
 		},
+		simBackground() {
+			// the heatmap covers the same area as the background image, so it's drawn as the upper layer
+			if (this.coverage === null) return 'url("/api/background")';
+			return `url("${this.coverage}"), url("/api/background")`;
+		},
 		...getters,
 	},
 })
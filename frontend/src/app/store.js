@@ -21,12 +21,17 @@ export let store = reactive({
 	nodes: [],
 	nodeState: {},
 	nodeStats: {},
+	scriptErrors: {},
 	reachLines: [],
 	events: [],
 	mobility: {
 		available: false,
 		paused: false,
 	},
+	replay: {
+		available: false,
+		status: null,
+	},
 });
 
 // Helper Functions
@@ -79,6 +84,24 @@ function checkMobility() {
 		});
 }
 
+function checkReplay() {
+	API.getReplay()
+		.then((res) => {
+			if (!res.ok) {
+				throw res;
+			}
+
+			res.json().then((val) => {
+				store.replay.available = true;
+				store.replay.status = val;
+			});
+		})
+		.catch(() => {
+			store.replay.available = false;
+			console.log('[Store] No replay!');
+		});
+}
+
 function checkBackground() {
 	let img = new Image();
 	img.onload = () => (store.backgroundPresent = true);
@@ -100,8 +123,10 @@ export const getters = {
 		return store.nodeState[id][type];
 	},
 	reachLines: () => store.reachLines,
+	scriptErrorsById: (id) => store.scriptErrors[id] || [],
 	events: () => store.events,
 	mobility: () => store.mobility,
+	replay: () => store.replay,
 	backgroundPresent: () => store.backgroundPresent,
 };
 
@@ -160,8 +185,10 @@ export const mutations = {
 		store.nodeStats = store.config.curNodeStats;
 		Object.keys(store.nodeStats).forEach((id) => addNodeStats({ id }));
 
-		// Run checks if mobility and background are present
+		// Run checks if mobility, replay and background are present. The replay sends the config
+		// again after seeking, so the stats are reset to the new position.
 		checkMobility();
+		checkReplay();
 		checkBackground();
 	},
 	addLog: (data, type) => {
@@ -186,9 +213,25 @@ export const mutations = {
 		store.nodeStats[id][state] += 1;
 		store.nodeStats[id].timeline[state].push(time);
 	},
+	addScriptError: (id, data) => {
+		if (!store.scriptErrors[id]) {
+			store.scriptErrors[id] = [];
+		}
+
+		// Only keep the latest errors of a node
+		store.scriptErrors[id].unshift({
+			time: new Date().toLocaleString(),
+			callback: data.callback,
+			error: data.error,
+		});
+		store.scriptErrors[id].splice(10);
+	},
 	setMobilityPaused: (state) => {
 		store.mobility.paused = state;
 	},
+	setReplayStatus: (status) => {
+		store.replay.status = status;
+	},
 	updateReachLines: () => {
 		store.reachLines = reachLines(store.config, store.nodes);
 	},
@@ -236,9 +279,16 @@ PubSub.subscribe('WebSocket', (topic, packet) => {
 				mutations.triggerNodeState(packet.node.id, 'collision', Math.ceil(/*packet.data.airtime*/ 500), packet.time);
 			}
 			break;
+		case 'NodeScriptError':
+			{
+				mutations.addLog(packet, packet.event);
+				mutations.addScriptError(packet.node.id, packet.data);
+			}
+			break;
 		case 'NodeRemoved':
 			{
 				mutations.addLog(packet, packet.event);
+				delete store.scriptErrors[packet.node.id];
 				mutations.removeNode(packet.node.id);
 				mutations.updateReachLines();
 			}
@@ -4,3 +4,4 @@ export { default as WindowMobility } from './mobility.vue';
 export { default as WindowConfig } from './config.vue';
 export { default as WindowStats } from './stats.vue';
 export { default as WindowMobilityCreator } from './mobility-creator.vue';
+export { default as WindowReplay } from './replay.vue';
@@ -0,0 +1,306 @@
+package gwmp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// MaxScheduleAhead is the maximum time a downlink can be scheduled in advance.
+const MaxScheduleAhead = time.Second * 30
+
+// Config represents the configuration of a packet forwarder for a gateway node.
+type Config struct {
+	// Node is the id of the gateway node.
+	Node string `json:"node"`
+	// Server is the UDP address of the network server (e.g. 127.0.0.1:1700).
+	Server string `json:"server"`
+	// GatewayEUI is the hex encoded 8 byte EUI of the gateway.
+	GatewayEUI string `json:"gatewayEui"`
+	// KeepAlive is the interval in seconds in which PULL_DATA is sent. Defaults to 10.
+	KeepAlive float64 `json:"keepAlive"`
+}
+
+// Forwarder represents a emulated Semtech UDP packet-forwarder that is attached to a gateway node.
+type Forwarder struct {
+	emu      *emu.Emulator
+	config   Config
+	eui      [8]byte
+	logger   logr.Logger
+	conn     *net.UDPConn
+	wg       sync.WaitGroup
+	done     chan bool
+	stopOnce sync.Once
+}
+
+// New creates a new packet forwarder for a gateway node of the emulator.
+func New(emulator *emu.Emulator, config Config) (*Forwarder, error) {
+	eui, err := hex.DecodeString(config.GatewayEUI)
+	if err != nil || len(eui) != 8 {
+		return nil, errors.New("gateway eui needs to be 8 hex encoded bytes")
+	}
+
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = 10
+	}
+
+	f := &Forwarder{
+		emu:    emulator,
+		config: config,
+		logger: logr.Discard(),
+		done:   make(chan bool),
+	}
+	copy(f.eui[:], eui)
+
+	return f, nil
+}
+
+// SetLogger sets the logger of the forwarder.
+func (f *Forwarder) SetLogger(logger logr.Logger) {
+	f.logger = logger
+}
+
+// counter returns the value of the emulated concentrator counter in µs for the given emulator time.
+func (f *Forwarder) counter(t time.Time) uint32 {
+	return uint32(t.UnixMicro() - f.emu.GetStartTime()*1000)
+}
+
+func (f *Forwarder) send(t PacketType, payload []byte) {
+	bytes, _ := Packet{
+		Version:    ProtocolVersion,
+		Token:      uint16(rand.Intn(0xFFFF)),
+		Type:       t,
+		GatewayEUI: f.eui,
+		Payload:    payload,
+	}.MarshalBinary()
+
+	if _, err := f.conn.Write(bytes); err != nil {
+		f.logger.Error(err, "can't send to network server", "node", f.config.Node)
+	}
+}
+
+func (f *Forwarder) sendTxAck(token uint16, errStr string) {
+	payload, _ := json.Marshal(TxAckPayload{TXPKAck: TXPKAck{Error: errStr}})
+	bytes, _ := Packet{
+		Version:    ProtocolVersion,
+		Token:      token,
+		Type:       TxAck,
+		GatewayEUI: f.eui,
+		Payload:    payload,
+	}.MarshalBinary()
+
+	if _, err := f.conn.Write(bytes); err != nil {
+		f.logger.Error(err, "can't send tx ack to network server", "node", f.config.Node)
+	}
+}
+
+func (f *Forwarder) handleReceived(node emu.Node, packet emu.RxPacket) {
+	recvTime := time.UnixMicro(packet.RecvTimeMicro)
+
+	channel := 0
+	if usage, err := f.emu.GatewayUsage(node.ID); err == nil {
+		for i := range usage.Channels {
+			if math.Abs(usage.Channels[i]-packet.Freq) < 1e-6 {
+				channel = i
+			}
+		}
+	}
+
+	stat := 1
+	if packet.CRCFailed {
+		stat = -1
+	}
+
+	codingRate := f.emu.GetPacketConfig().CodingRate
+
+	payload, err := json.Marshal(PushDataPayload{RXPK: []RXPK{{
+		Time: recvTime.UTC().Format(time.RFC3339Nano),
+		Tmst: f.counter(recvTime),
+		Chan: channel,
+		Freq: packet.Freq,
+		Stat: stat,
+		Modu: "LORA",
+		DatR: DataRate(packet.SpreadingFactor, packet.BandWidth),
+		CodR: CodingRate(codingRate),
+		RSSI: packet.RSSI,
+		LSNR: float64(packet.SNR),
+		Size: len(packet.Data),
+		Data: base64.StdEncoding.EncodeToString(packet.Data),
+	}}})
+	if err != nil {
+		f.logger.Error(err, "can't marshal rxpk", "node", f.config.Node)
+		return
+	}
+
+	f.send(PushData, payload)
+}
+
+func (f *Forwarder) handleDownlink(token uint16, data []byte) {
+	var resp PullRespPayload
+	if err := json.Unmarshal(data, &resp); err != nil {
+		f.logger.Error(err, "can't parse pull resp", "node", f.config.Node)
+		return
+	}
+
+	txpk := resp.TXPK
+
+	payload, err := base64.StdEncoding.DecodeString(txpk.Data)
+	if err != nil {
+		f.sendTxAck(token, TxAckTxFailed)
+		return
+	}
+
+	sf, bw, err := ParseDataRate(txpk.DatR)
+	if err != nil {
+		f.sendTxAck(token, TxAckTxFailed)
+		return
+	}
+
+	var cr float64
+	if len(txpk.CodR) > 0 {
+		if cr, err = ParseCodingRate(txpk.CodR); err != nil {
+			f.sendTxAck(token, TxAckTxFailed)
+			return
+		}
+	}
+
+	if txpk.Freq <= 0 {
+		f.sendTxAck(token, TxAckTxFreq)
+		return
+	}
+
+	transmit := func() {
+		if err := f.emu.SendMessageWithParams(f.config.Node, payload, emu.TxParams{
+			Freq:            txpk.Freq,
+			SpreadingFactor: sf,
+			BandWidth:       bw,
+			CodingRate:      cr,
+		}); err != nil {
+			f.logger.Error(err, "can't transmit downlink", "node", f.config.Node)
+		}
+	}
+
+	if txpk.Imme {
+		transmit()
+		f.sendTxAck(token, TxAckNone)
+		return
+	}
+
+	// the difference is interpreted as signed value so that the wrap-around of the counter is handled
+	delay := time.Duration(int32(txpk.Tmst-f.counter(f.emu.Now()))) * time.Microsecond
+	if delay < 0 {
+		f.sendTxAck(token, TxAckTooLate)
+		return
+	}
+
+	if delay > MaxScheduleAhead {
+		f.sendTxAck(token, TxAckTooEarly)
+		return
+	}
+
+	f.emu.Schedule(delay, transmit)
+	f.sendTxAck(token, TxAckNone)
+}
+
+func (f *Forwarder) readLoop() {
+	defer f.wg.Done()
+
+	buf := make([]byte, 65507)
+	for {
+		n, err := f.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-f.done:
+				return
+			default:
+			}
+
+			f.logger.Error(err, "can't read from network server", "node", f.config.Node)
+			continue
+		}
+
+		var packet Packet
+		if err := packet.UnmarshalBinary(buf[:n]); err != nil {
+			f.logger.Error(err, "invalid packet from network server", "node", f.config.Node)
+			continue
+		}
+
+		switch packet.Type {
+		case PushAck, PullAck:
+		case PullResp:
+			f.handleDownlink(packet.Token, packet.Payload)
+		default:
+			f.logger.Info("unexpected packet from network server", "node", f.config.Node, "type", packet.Type)
+		}
+	}
+}
+
+func (f *Forwarder) keepAlive() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(f.config.KeepAlive * float64(time.Second)))
+	defer ticker.Stop()
+
+	f.send(PullData, nil)
+
+	for {
+		select {
+		case <-ticker.C:
+			f.send(PullData, nil)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Start connects to the network server and starts forwarding the packets of the gateway node.
+func (f *Forwarder) Start() error {
+	if _, err := f.emu.GatewayUsage(f.config.Node); err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", f.config.Server)
+	if err != nil {
+		return err
+	}
+
+	f.conn, err = net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	if err := f.emu.AttachNode(f.config.Node, f.handleReceived); err != nil {
+		_ = f.conn.Close()
+		return err
+	}
+
+	f.wg.Add(2)
+	go f.readLoop()
+	go f.keepAlive()
+
+	return nil
+}
+
+// Stop detaches the forwarder from the gateway node and closes the connection.
+// It's safe to call Stop multiple times, only the first call returns the error of closing the connection.
+func (f *Forwarder) Stop() error {
+	var err error
+	f.stopOnce.Do(func() {
+		close(f.done)
+		f.emu.DetachNode(f.config.Node)
+		if f.conn != nil {
+			err = f.conn.Close()
+		}
+		f.wg.Wait()
+	})
+	return err
+}
@@ -0,0 +1,234 @@
+package gwmp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNetworkServer is a minimal network server that records the packets of a forwarder.
+type fakeNetworkServer struct {
+	conn    *net.UDPConn
+	packets chan Packet
+	addr    chan *net.UDPAddr
+}
+
+func newFakeNetworkServer(t *testing.T) *fakeNetworkServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	ns := &fakeNetworkServer{
+		conn:    conn,
+		packets: make(chan Packet, 100),
+		addr:    make(chan *net.UDPAddr, 100),
+	}
+
+	go func() {
+		buf := make([]byte, 65507)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			var packet Packet
+			if err := packet.UnmarshalBinary(append([]byte{}, buf[:n]...)); err != nil {
+				continue
+			}
+
+			// acknowledge like a real network server would
+			switch packet.Type {
+			case PushData:
+				ack, _ := Packet{Version: ProtocolVersion, Token: packet.Token, Type: PushAck}.MarshalBinary()
+				_, _ = conn.WriteToUDP(ack, addr)
+			case PullData:
+				ack, _ := Packet{Version: ProtocolVersion, Token: packet.Token, Type: PullAck}.MarshalBinary()
+				_, _ = conn.WriteToUDP(ack, addr)
+				ns.addr <- addr
+			}
+
+			ns.packets <- packet
+		}
+	}()
+
+	return ns
+}
+
+func (ns *fakeNetworkServer) expect(t *testing.T, packetType PacketType) Packet {
+	for {
+		select {
+		case p := <-ns.packets:
+			if p.Type == packetType {
+				return p
+			}
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "packet not received", "type", packetType)
+			t.FailNow()
+		}
+	}
+}
+
+func (ns *fakeNetworkServer) pullResp(t *testing.T, addr *net.UDPAddr, txpk TXPK) {
+	payload, _ := json.Marshal(PullRespPayload{TXPK: txpk})
+	bytes, _ := Packet{Version: ProtocolVersion, Token: 42, Type: PullResp, Payload: payload}.MarshalBinary()
+	_, err := ns.conn.WriteToUDP(bytes, addr)
+	assert.NoError(t, err)
+}
+
+func TestForwarder(t *testing.T) {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+
+	assert.NoError(t, e.AddNode(emu.Node{
+		ID:     "Device",
+		Online: true,
+		X:      1,
+		Y:      1,
+		TXGain: 14,
+		RXSens: -137,
+		Freq:   868.3,
+	}))
+
+	assert.NoError(t, e.AddNode(emu.Node{
+		ID:      "GW",
+		Online:  true,
+		X:       1.5,
+		Y:       1,
+		TXGain:  27,
+		RXSens:  -141,
+		Kind:    emu.NodeKindGateway,
+		Gateway: &emu.GatewayConfig{Channels: []float64{868.1, 868.3, 868.5}},
+	}))
+
+	ns := newFakeNetworkServer(t)
+	defer ns.conn.Close()
+
+	f, err := New(e, Config{
+		Node:       "GW",
+		Server:     ns.conn.LocalAddr().String(),
+		GatewayEUI: "0102030405060708",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, f.Start()) {
+		return
+	}
+	defer f.Stop()
+
+	pull := ns.expect(t, PullData)
+	assert.Equal(t, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, pull.GatewayEUI)
+	gatewayAddr := <-ns.addr
+
+	downlinks := make(chan emu.RxPacket, 10)
+	assert.NoError(t, e.AttachNode("Device", func(node emu.Node, packet emu.RxPacket) {
+		downlinks <- packet
+	}))
+
+	var rxpk RXPK
+
+	t.Run("Uplink", func(t *testing.T) {
+		assert.NoError(t, e.SendMessage("Device", []byte("uplink")))
+
+		push := ns.expect(t, PushData)
+
+		var payload PushDataPayload
+		if assert.NoError(t, json.Unmarshal(push.Payload, &payload)) && assert.Len(t, payload.RXPK, 1) {
+			rxpk = payload.RXPK[0]
+
+			assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("uplink")), rxpk.Data)
+			assert.Equal(t, 868.3, rxpk.Freq)
+			assert.Equal(t, 1, rxpk.Chan)
+			assert.Equal(t, 1, rxpk.Stat)
+			assert.Equal(t, "SF7BW125", rxpk.DatR)
+			assert.Equal(t, 6, rxpk.Size)
+			assert.Less(t, rxpk.RSSI, 0)
+		}
+	})
+
+	t.Run("Downlink", func(t *testing.T) {
+		ns.pullResp(t, gatewayAddr, TXPK{
+			Tmst: rxpk.Tmst + 1000000,
+			Freq: 868.3,
+			Modu: "LORA",
+			DatR: "SF7BW125",
+			CodR: "4/5",
+			Data: base64.StdEncoding.EncodeToString([]byte("downlink")),
+		})
+
+		ack := ns.expect(t, TxAck)
+		assert.Equal(t, uint16(42), ack.Token)
+
+		var payload TxAckPayload
+		if assert.NoError(t, json.Unmarshal(ack.Payload, &payload)) {
+			assert.Equal(t, TxAckNone, payload.TXPKAck.Error)
+		}
+
+		select {
+		case packet := <-downlinks:
+			assert.Equal(t, []byte("downlink"), packet.Data)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "downlink not received")
+		}
+	})
+
+	t.Run("DownlinkTooLate", func(t *testing.T) {
+		ns.pullResp(t, gatewayAddr, TXPK{
+			Tmst: rxpk.Tmst,
+			Freq: 868.3,
+			Modu: "LORA",
+			DatR: "SF7BW125",
+			Data: base64.StdEncoding.EncodeToString([]byte("late")),
+		})
+
+		ack := ns.expect(t, TxAck)
+
+		var payload TxAckPayload
+		if assert.NoError(t, json.Unmarshal(ack.Payload, &payload)) {
+			assert.Equal(t, TxAckTooLate, payload.TXPKAck.Error)
+		}
+	})
+
+	e.Wait()
+
+	assert.NoError(t, f.Stop())
+	assert.NoError(t, f.Stop())
+}
+
+func TestPacket(t *testing.T) {
+	packet := Packet{
+		Version:    ProtocolVersion,
+		Token:      0xABCD,
+		Type:       PushData,
+		GatewayEUI: [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload:    []byte(`{"rxpk":[]}`),
+	}
+
+	bytes, err := packet.MarshalBinary()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{2, 0xAB, 0xCD, 0, 1, 2, 3, 4, 5, 6, 7, 8}, bytes[:12])
+
+		var decoded Packet
+		if assert.NoError(t, decoded.UnmarshalBinary(bytes)) {
+			assert.Equal(t, packet, decoded)
+		}
+	}
+
+	sf, bw, err := ParseDataRate("SF12BW125")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 12.0, sf)
+		assert.Equal(t, 125.0, bw)
+	}
+
+	_, _, err = ParseDataRate("FSK")
+	assert.Error(t, err)
+}
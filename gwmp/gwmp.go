@@ -0,0 +1,176 @@
+// Package gwmp implements the gateway side of the Semtech UDP packet-forwarder protocol (GWMP) so that
+// gateway nodes of the emulator can be connected to a LoRaWAN network server.
+//
+// https://github.com/Lora-net/packet_forwarder/blob/master/PROTOCOL.TXT
+package gwmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the protocol version that is used by the forwarder.
+const ProtocolVersion = 2
+
+// PacketType represents the identifier of a GWMP packet.
+type PacketType = byte
+
+const (
+	PushData = PacketType(0x00)
+	PushAck  = PacketType(0x01)
+	PullData = PacketType(0x02)
+	PullResp = PacketType(0x03)
+	PullAck  = PacketType(0x04)
+	TxAck    = PacketType(0x05)
+)
+
+// Error values of the TX_ACK packet.
+const (
+	TxAckNone      = "NONE"
+	TxAckTooLate   = "TOO_LATE"
+	TxAckTooEarly  = "TOO_EARLY"
+	TxAckTxFreq    = "TX_FREQ"
+	TxAckTxFailed  = "TX_FAILED"
+	TxAckCollision = "COLLISION_PACKET"
+)
+
+// RXPK represents a received packet that is forwarded to the network server.
+type RXPK struct {
+	Time string  `json:"time"`
+	Tmst uint32  `json:"tmst"`
+	Chan int     `json:"chan"`
+	RFCh int     `json:"rfch"`
+	Freq float64 `json:"freq"`
+	Stat int     `json:"stat"`
+	Modu string  `json:"modu"`
+	DatR string  `json:"datr"`
+	CodR string  `json:"codr"`
+	RSSI int     `json:"rssi"`
+	LSNR float64 `json:"lsnr"`
+	Size int     `json:"size"`
+	Data string  `json:"data"`
+}
+
+// TXPK represents a packet the network server requests to be transmitted by the gateway.
+type TXPK struct {
+	Imme bool    `json:"imme"`
+	Tmst uint32  `json:"tmst"`
+	Freq float64 `json:"freq"`
+	RFCh int     `json:"rfch"`
+	Powe int     `json:"powe"`
+	Modu string  `json:"modu"`
+	DatR string  `json:"datr"`
+	CodR string  `json:"codr"`
+	IPol bool    `json:"ipol"`
+	Size int     `json:"size"`
+	Data string  `json:"data"`
+	NCRC bool    `json:"ncrc"`
+}
+
+// TXPKAck represents the result of a downlink request.
+type TXPKAck struct {
+	Error string `json:"error"`
+}
+
+// PushDataPayload is the JSON payload of a PUSH_DATA packet.
+type PushDataPayload struct {
+	RXPK []RXPK `json:"rxpk"`
+}
+
+// PullRespPayload is the JSON payload of a PULL_RESP packet.
+type PullRespPayload struct {
+	TXPK TXPK `json:"txpk"`
+}
+
+// TxAckPayload is the JSON payload of a TX_ACK packet.
+type TxAckPayload struct {
+	TXPKAck TXPKAck `json:"txpk_ack"`
+}
+
+// Packet represents a raw GWMP packet.
+type Packet struct {
+	Version    byte
+	Token      uint16
+	Type       PacketType
+	GatewayEUI [8]byte
+	Payload    []byte
+}
+
+// hasEUI checks if packets of the type contain the gateway eui.
+func hasEUI(t PacketType) bool {
+	return t == PushData || t == PullData || t == TxAck
+}
+
+// MarshalBinary encodes the packet into the wire format.
+func (p Packet) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 4, 12+len(p.Payload))
+	buf[0] = p.Version
+	binary.BigEndian.PutUint16(buf[1:3], p.Token)
+	buf[3] = p.Type
+
+	if hasEUI(p.Type) {
+		buf = append(buf, p.GatewayEUI[:]...)
+	}
+
+	return append(buf, p.Payload...), nil
+}
+
+// UnmarshalBinary decodes the packet from the wire format.
+func (p *Packet) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("packet too short")
+	}
+
+	p.Version = data[0]
+	p.Token = binary.BigEndian.Uint16(data[1:3])
+	p.Type = data[3]
+	data = data[4:]
+
+	if p.Type > TxAck {
+		return fmt.Errorf("unknown packet type %d", p.Type)
+	}
+
+	if hasEUI(p.Type) {
+		if len(data) < 8 {
+			return errors.New("packet too short")
+		}
+
+		copy(p.GatewayEUI[:], data[:8])
+		data = data[8:]
+	}
+
+	p.Payload = data
+
+	return nil
+}
+
+// DataRate formats spreading factor and bandwidth as the datr string (e.g. SF7BW125).
+func DataRate(sf float64, bw float64) string {
+	return fmt.Sprintf("SF%dBW%d", int(sf), int(bw))
+}
+
+// ParseDataRate parses a datr string (e.g. SF7BW125) into spreading factor and bandwidth.
+func ParseDataRate(datr string) (float64, float64, error) {
+	var sf, bw int
+	if _, err := fmt.Sscanf(datr, "SF%dBW%d", &sf, &bw); err != nil {
+		return 0, 0, fmt.Errorf("invalid data rate %s", datr)
+	}
+
+	return float64(sf), float64(bw), nil
+}
+
+// CodingRate formats the coding rate denominator (5 - 8) as the codr string (e.g. 4/5).
+func CodingRate(cr float64) string {
+	return fmt.Sprintf("4/%d", int(cr))
+}
+
+// ParseCodingRate parses a codr string (e.g. 4/5) into the coding rate denominator.
+func ParseCodingRate(codr string) (float64, error) {
+	var cr int
+	if _, err := fmt.Sscanf(codr, "4/%d", &cr); err != nil {
+		return 0, fmt.Errorf("invalid coding rate %s", codr)
+	}
+
+	return float64(cr), nil
+}
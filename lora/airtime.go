@@ -12,6 +12,8 @@ type PacketConfig struct {
 	CRC                     bool    `json:"crc"`
 	ExplicitHeader          bool    `json:"explicitHeader"`
 	LowDataRateOptimization bool    `json:"lowDataRateOptimization"`
+	// SyncWord is only used to label captures, e.g. 0x12 for private networks and 0x34 for LoRaWAN.
+	SyncWord uint8 `json:"syncWord"`
 }
 
 // PacketConfigDefault represents a default packet config.
@@ -24,6 +26,7 @@ var PacketConfigDefault = PacketConfig{
 	CRC:                     false,
 	ExplicitHeader:          false,
 	LowDataRateOptimization: false,
+	SyncWord:                0x12,
 }
 
 func (pc PacketConfig) PayloadValid() bool {
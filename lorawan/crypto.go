@@ -0,0 +1,153 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+)
+
+// Direction of a data frame as used in the MIC and encryption blocks.
+const (
+	DirUplink   = byte(0)
+	DirDownlink = byte(1)
+)
+
+func shiftLeft(in [16]byte) [16]byte {
+	var out [16]byte
+	for i := 0; i < 16; i++ {
+		out[i] = in[i] << 1
+		if i < 15 {
+			out[i] |= in[i+1] >> 7
+		}
+	}
+	return out
+}
+
+func subKey(in [16]byte) [16]byte {
+	out := shiftLeft(in)
+	if in[0]&0x80 != 0 {
+		out[15] ^= 0x87
+	}
+	return out
+}
+
+// CMAC calculates the AES-CMAC of the message.
+//
+// https://www.rfc-editor.org/rfc/rfc4493
+func CMAC(key AES128Key, msg []byte) [16]byte {
+	block, _ := aes.NewCipher(key[:])
+
+	var l [16]byte
+	block.Encrypt(l[:], l[:])
+
+	k1 := subKey(l)
+	k2 := subKey(k1)
+
+	n := (len(msg) + 15) / 16
+	complete := n > 0 && len(msg)%16 == 0
+	if n == 0 {
+		n = 1
+	}
+
+	var last [16]byte
+	if complete {
+		copy(last[:], msg[(n-1)*16:])
+		for i := range last {
+			last[i] ^= k1[i]
+		}
+	} else {
+		rest := msg[(n-1)*16:]
+		copy(last[:], rest)
+		last[len(rest)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+
+	var x [16]byte
+	for b := 0; b < n-1; b++ {
+		for i := 0; i < 16; i++ {
+			x[i] ^= msg[b*16+i]
+		}
+		block.Encrypt(x[:], x[:])
+	}
+
+	for i := range x {
+		x[i] ^= last[i]
+	}
+	block.Encrypt(x[:], x[:])
+
+	return x
+}
+
+func mic(key AES128Key, msg []byte) [4]byte {
+	var out [4]byte
+	full := CMAC(key, msg)
+	copy(out[:], full[:4])
+	return out
+}
+
+// DeriveSessionKeys derives the network and application session keys after a join.
+func DeriveSessionKeys(appKey AES128Key, joinNonce uint32, netID uint32, devNonce uint16) (AES128Key, AES128Key) {
+	block, _ := aes.NewCipher(appKey[:])
+
+	derive := func(prefix byte) AES128Key {
+		var in, out AES128Key
+		in[0] = prefix
+		putUint24(in[1:4], joinNonce)
+		putUint24(in[4:7], netID)
+		binary.LittleEndian.PutUint16(in[7:9], devNonce)
+		block.Encrypt(out[:], in[:])
+		return out
+	}
+
+	return derive(0x01), derive(0x02)
+}
+
+// dataBlock creates the B0 or A_i block that is used for the MIC and encryption of data frames.
+func dataBlock(prefix byte, dir byte, devAddr DevAddr, fCnt uint32, last byte) []byte {
+	b := make([]byte, 16)
+	b[0] = prefix
+	b[5] = dir
+	copy(b[6:10], reverse(devAddr[:]))
+	binary.LittleEndian.PutUint32(b[10:14], fCnt)
+	b[15] = last
+	return b
+}
+
+func dataMIC(nwkSKey AES128Key, dir byte, devAddr DevAddr, fCnt uint32, msg []byte) [4]byte {
+	return mic(nwkSKey, append(dataBlock(0x49, dir, devAddr, fCnt, byte(len(msg))), msg...))
+}
+
+// EncryptFRMPayload encrypts or decrypts (the operation is symmetric) the FRMPayload of a data frame.
+func EncryptFRMPayload(key AES128Key, dir byte, devAddr DevAddr, fCnt uint32, payload []byte) []byte {
+	block, _ := aes.NewCipher(key[:])
+
+	out := make([]byte, len(payload))
+	s := make([]byte, 16)
+	for i := 0; i < len(payload); i += 16 {
+		block.Encrypt(s, dataBlock(0x01, dir, devAddr, fCnt, byte(i/16+1)))
+		for j := 0; j < 16 && i+j < len(payload); j++ {
+			out[i+j] = payload[i+j] ^ s[j]
+		}
+	}
+
+	return out
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
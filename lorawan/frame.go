@@ -0,0 +1,281 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// JoinRequestPayload represents the content of a OTAA join-request.
+type JoinRequestPayload struct {
+	JoinEUI  EUI64  `json:"joinEui"`
+	DevEUI   EUI64  `json:"devEui"`
+	DevNonce uint16 `json:"devNonce"`
+}
+
+// Marshal encodes the join-request and signs it with the AppKey.
+func (jr JoinRequestPayload) Marshal(appKey AES128Key) []byte {
+	b := make([]byte, 0, 23)
+	b = append(b, JoinRequest.MHDR())
+	b = append(b, reverse(jr.JoinEUI[:])...)
+	b = append(b, reverse(jr.DevEUI[:])...)
+	b = append(b, byte(jr.DevNonce), byte(jr.DevNonce>>8))
+
+	m := mic(appKey, b)
+	return append(b, m[:]...)
+}
+
+// ParseJoinRequest decodes a join-request without validating the MIC.
+func ParseJoinRequest(phy []byte) (JoinRequestPayload, error) {
+	if len(phy) != 23 {
+		return JoinRequestPayload{}, errors.New("invalid join-request length")
+	}
+
+	if mType, err := ParseMType(phy); err != nil || mType != JoinRequest {
+		return JoinRequestPayload{}, errors.New("not a join-request")
+	}
+
+	var jr JoinRequestPayload
+	copy(jr.JoinEUI[:], reverse(phy[1:9]))
+	copy(jr.DevEUI[:], reverse(phy[9:17]))
+	jr.DevNonce = binary.LittleEndian.Uint16(phy[17:19])
+
+	return jr, nil
+}
+
+// ValidateJoinRequestMIC checks the MIC of a join-request against the AppKey.
+func ValidateJoinRequestMIC(appKey AES128Key, phy []byte) bool {
+	if len(phy) != 23 {
+		return false
+	}
+
+	m := mic(appKey, phy[:19])
+	return string(m[:]) == string(phy[19:])
+}
+
+// JoinAcceptPayload represents the content of a join-accept.
+type JoinAcceptPayload struct {
+	JoinNonce   uint32  `json:"joinNonce"`
+	NetID       uint32  `json:"netId"`
+	DevAddr     DevAddr `json:"devAddr"`
+	RX1DROffset uint8   `json:"rx1DrOffset"`
+	RX2DataRate uint8   `json:"rx2DataRate"`
+	RxDelay     uint8   `json:"rxDelay"`
+	CFList      []byte  `json:"cfList"`
+}
+
+// Marshal encodes, signs and encrypts the join-accept with the AppKey.
+func (ja JoinAcceptPayload) Marshal(appKey AES128Key) ([]byte, error) {
+	if len(ja.CFList) != 0 && len(ja.CFList) != 16 {
+		return nil, errors.New("cflist needs to be 16 bytes")
+	}
+
+	b := make([]byte, 0, 33)
+	b = append(b, JoinAccept.MHDR(), 0, 0, 0, 0, 0, 0)
+	putUint24(b[1:4], ja.JoinNonce)
+	putUint24(b[4:7], ja.NetID)
+	b = append(b, reverse(ja.DevAddr[:])...)
+	b = append(b, (ja.RX1DROffset&0x07)<<4|ja.RX2DataRate&0x0F, ja.RxDelay)
+	b = append(b, ja.CFList...)
+
+	m := mic(appKey, b)
+	b = append(b, m[:]...)
+
+	// the network server uses the aes decrypt operation so that the device only needs to implement encrypt
+	block, _ := aes.NewCipher(appKey[:])
+	for i := 1; i < len(b); i += 16 {
+		block.Decrypt(b[i:i+16], b[i:i+16])
+	}
+
+	return b, nil
+}
+
+// DecryptJoinAccept decrypts and decodes a join-accept and validates its MIC.
+func DecryptJoinAccept(appKey AES128Key, phy []byte) (JoinAcceptPayload, error) {
+	if len(phy) != 17 && len(phy) != 33 {
+		return JoinAcceptPayload{}, errors.New("invalid join-accept length")
+	}
+
+	if mType, err := ParseMType(phy); err != nil || mType != JoinAccept {
+		return JoinAcceptPayload{}, errors.New("not a join-accept")
+	}
+
+	b := make([]byte, len(phy))
+	copy(b, phy)
+
+	block, _ := aes.NewCipher(appKey[:])
+	for i := 1; i < len(b); i += 16 {
+		block.Encrypt(b[i:i+16], b[i:i+16])
+	}
+
+	m := mic(appKey, b[:len(b)-4])
+	if string(m[:]) != string(b[len(b)-4:]) {
+		return JoinAcceptPayload{}, errors.New("invalid mic")
+	}
+
+	ja := JoinAcceptPayload{
+		JoinNonce:   uint24(b[1:4]),
+		NetID:       uint24(b[4:7]),
+		RX1DROffset: (b[11] >> 4) & 0x07,
+		RX2DataRate: b[11] & 0x0F,
+		RxDelay:     b[12],
+	}
+	copy(ja.DevAddr[:], reverse(b[7:11]))
+
+	if len(b) == 33 {
+		ja.CFList = b[13:29]
+	}
+
+	return ja, nil
+}
+
+// FCtrl represents the frame control field of a data frame.
+type FCtrl struct {
+	ADR       bool `json:"adr"`
+	ADRACKReq bool `json:"adrAckReq"`
+	ACK       bool `json:"ack"`
+	FPending  bool `json:"fPending"`
+}
+
+// DataFrame represents a uplink or downlink data frame with a plaintext FRMPayload.
+type DataFrame struct {
+	MType      MType   `json:"mType"`
+	DevAddr    DevAddr `json:"devAddr"`
+	FCtrl      FCtrl   `json:"fCtrl"`
+	FCnt       uint32  `json:"fCnt"`
+	FOpts      []byte  `json:"fOpts"`
+	FPort      *uint8  `json:"fPort"`
+	FRMPayload []byte  `json:"frmPayload"`
+}
+
+func (f DataFrame) dir() byte {
+	if f.MType.IsUplink() {
+		return DirUplink
+	}
+	return DirDownlink
+}
+
+func (f DataFrame) payloadKey(nwkSKey AES128Key, appSKey AES128Key) AES128Key {
+	if f.FPort != nil && *f.FPort == 0 {
+		return nwkSKey
+	}
+	return appSKey
+}
+
+// Marshal encodes the data frame, encrypts the FRMPayload and signs it with the session keys.
+func (f DataFrame) Marshal(nwkSKey AES128Key, appSKey AES128Key) ([]byte, error) {
+	if !f.MType.IsData() {
+		return nil, errors.New("not a data frame")
+	}
+
+	if len(f.FOpts) > 15 {
+		return nil, errors.New("fopts too long")
+	}
+
+	if f.FPort == nil && len(f.FRMPayload) > 0 {
+		return nil, errors.New("payload without fport")
+	}
+
+	fCtrl := byte(len(f.FOpts))
+	if f.FCtrl.ADR {
+		fCtrl |= 0x80
+	}
+	if f.FCtrl.ADRACKReq {
+		fCtrl |= 0x40
+	}
+	if f.FCtrl.ACK {
+		fCtrl |= 0x20
+	}
+	if f.FCtrl.FPending {
+		fCtrl |= 0x10
+	}
+
+	b := []byte{f.MType.MHDR()}
+	b = append(b, reverse(f.DevAddr[:])...)
+	b = append(b, fCtrl)
+	b = append(b, byte(f.FCnt), byte(f.FCnt>>8))
+	b = append(b, f.FOpts...)
+
+	if f.FPort != nil {
+		b = append(b, *f.FPort)
+		b = append(b, EncryptFRMPayload(f.payloadKey(nwkSKey, appSKey), f.dir(), f.DevAddr, f.FCnt, f.FRMPayload)...)
+	}
+
+	m := dataMIC(nwkSKey, f.dir(), f.DevAddr, f.FCnt, b)
+	return append(b, m[:]...), nil
+}
+
+// ParseDataFrame decodes a data frame without validating the MIC. The FCnt only contains the 16 transmitted
+// bits and the FRMPayload stays encrypted until Decrypt is called.
+func ParseDataFrame(phy []byte) (DataFrame, error) {
+	if len(phy) < 12 {
+		return DataFrame{}, errors.New("data frame too short")
+	}
+
+	mType, err := ParseMType(phy)
+	if err != nil {
+		return DataFrame{}, err
+	}
+
+	if !mType.IsData() {
+		return DataFrame{}, errors.New("not a data frame")
+	}
+
+	f := DataFrame{MType: mType}
+	copy(f.DevAddr[:], reverse(phy[1:5]))
+
+	fCtrl := phy[5]
+	f.FCtrl = FCtrl{
+		ADR:       fCtrl&0x80 != 0,
+		ADRACKReq: fCtrl&0x40 != 0,
+		ACK:       fCtrl&0x20 != 0,
+		FPending:  fCtrl&0x10 != 0,
+	}
+	f.FCnt = uint32(binary.LittleEndian.Uint16(phy[6:8]))
+
+	fOptsLen := int(fCtrl & 0x0F)
+	rest := phy[8 : len(phy)-4]
+	if len(rest) < fOptsLen {
+		return DataFrame{}, fmt.Errorf("fopts length %d exceeds frame", fOptsLen)
+	}
+
+	f.FOpts = rest[:fOptsLen]
+	rest = rest[fOptsLen:]
+
+	if len(rest) > 0 {
+		fPort := rest[0]
+		f.FPort = &fPort
+		f.FRMPayload = rest[1:]
+	}
+
+	return f, nil
+}
+
+// Decrypt sets the full frame counter and decrypts the FRMPayload.
+func (f *DataFrame) Decrypt(nwkSKey AES128Key, appSKey AES128Key, fCnt uint32) {
+	f.FCnt = fCnt
+	if f.FPort != nil {
+		f.FRMPayload = EncryptFRMPayload(f.payloadKey(nwkSKey, appSKey), f.dir(), f.DevAddr, fCnt, f.FRMPayload)
+	}
+}
+
+// ValidateDataMIC checks the MIC of a data frame against the network session key and the full frame counter.
+func ValidateDataMIC(nwkSKey AES128Key, phy []byte, fCnt uint32) bool {
+	f, err := ParseDataFrame(phy)
+	if err != nil {
+		return false
+	}
+
+	m := dataMIC(nwkSKey, f.dir(), f.DevAddr, fCnt, phy[:len(phy)-4])
+	return string(m[:]) == string(phy[len(phy)-4:])
+}
+
+// FullFCnt reconstructs the 32-bit frame counter from the 16 transmitted bits and the last known counter.
+func FullFCnt(last uint32, fCnt uint16) uint32 {
+	full := last&0xFFFF0000 | uint32(fCnt)
+	if full < last {
+		full += 0x10000
+	}
+	return full
+}
@@ -0,0 +1,141 @@
+package lorawan
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// TestCMAC tests the AES-CMAC against the test vectors of RFC 4493.
+func TestCMAC(t *testing.T) {
+	var key AES128Key
+	copy(key[:], mustHex("2b7e151628aed2a6abf7158809cf4f3c"))
+
+	msg := mustHex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+
+	tests := []struct {
+		len int
+		mac string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+
+	for _, test := range tests {
+		mac := CMAC(key, msg[:test.len])
+		assert.Equal(t, test.mac, hex.EncodeToString(mac[:]))
+	}
+}
+
+func TestJoin(t *testing.T) {
+	var appKey AES128Key
+	copy(appKey[:], mustHex("000102030405060708090a0b0c0d0e0f"))
+
+	jr := JoinRequestPayload{
+		JoinEUI:  EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:   EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+		DevNonce: 0x1234,
+	}
+
+	phy := jr.Marshal(appKey)
+	assert.Len(t, phy, 23)
+	assert.True(t, ValidateJoinRequestMIC(appKey, phy))
+	assert.False(t, ValidateJoinRequestMIC(AES128Key{}, phy))
+
+	decoded, err := ParseJoinRequest(phy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, jr, decoded)
+	}
+
+	ja := JoinAcceptPayload{
+		JoinNonce:   1,
+		NetID:       0x000013,
+		DevAddr:     DevAddr{0x26, 0x01, 0x02, 0x03},
+		RX1DROffset: 1,
+		RX2DataRate: 3,
+		RxDelay:     1,
+	}
+
+	phy, err = ja.Marshal(appKey)
+	if assert.NoError(t, err) {
+		assert.Len(t, phy, 17)
+
+		decodedAccept, err := DecryptJoinAccept(appKey, phy)
+		if assert.NoError(t, err) {
+			assert.Equal(t, ja, decodedAccept)
+		}
+
+		_, err = DecryptJoinAccept(AES128Key{1}, phy)
+		assert.Error(t, err)
+	}
+
+	nwkSKey, appSKey := DeriveSessionKeys(appKey, ja.JoinNonce, ja.NetID, jr.DevNonce)
+	assert.NotEqual(t, nwkSKey, appSKey)
+}
+
+func TestDataFrame(t *testing.T) {
+	nwkSKey := AES128Key{1, 2, 3}
+	appSKey := AES128Key{4, 5, 6}
+	fPort := uint8(10)
+
+	frame := DataFrame{
+		MType:      ConfirmedDataUp,
+		DevAddr:    DevAddr{0x26, 0x01, 0x02, 0x03},
+		FCtrl:      FCtrl{ADR: true},
+		FCnt:       0x10005,
+		FOpts:      MarshalMACCommands([]MACCommand{LinkADRAns{PowerACK: true, DataRateACK: true, ChannelMaskACK: true}.Command()}),
+		FPort:      &fPort,
+		FRMPayload: []byte("hello world"),
+	}
+
+	phy, err := frame.Marshal(nwkSKey, appSKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, ValidateDataMIC(nwkSKey, phy, 0x10005))
+	assert.False(t, ValidateDataMIC(nwkSKey, phy, 0x5))
+
+	decoded, err := ParseDataFrame(phy)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, uint32(5), decoded.FCnt)
+	assert.NotEqual(t, frame.FRMPayload, decoded.FRMPayload)
+
+	decoded.Decrypt(nwkSKey, appSKey, FullFCnt(0x10000, uint16(decoded.FCnt)))
+	assert.Equal(t, frame, decoded)
+
+	commands, err := ParseMACCommands(decoded.FOpts, true)
+	if assert.NoError(t, err) && assert.Len(t, commands, 1) {
+		assert.True(t, ParseLinkADRAns(commands[0]).Accepted())
+	}
+}
+
+func TestFullFCnt(t *testing.T) {
+	assert.Equal(t, uint32(5), FullFCnt(0, 5))
+	assert.Equal(t, uint32(0x10001), FullFCnt(0xFFFF, 1))
+	assert.Equal(t, uint32(0x1FFFF), FullFCnt(0x10005, 0xFFFF))
+}
+
+func TestLinkADRReq(t *testing.T) {
+	req := LinkADRReq{DataRate: 5, TXPower: 2, ChMask: 0x0007, NbTrans: 1}
+	cmd := req.Command()
+
+	commands, err := ParseMACCommands(MarshalMACCommands([]MACCommand{cmd}), false)
+	if assert.NoError(t, err) && assert.Len(t, commands, 1) {
+		assert.Equal(t, req, ParseLinkADRReq(commands[0]))
+	}
+}
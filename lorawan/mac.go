@@ -0,0 +1,141 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// CID represents the identifier of a MAC command.
+type CID = byte
+
+const (
+	CIDLinkCheck    = CID(0x02)
+	CIDLinkADR      = CID(0x03)
+	CIDDutyCycle    = CID(0x04)
+	CIDRXParamSetup = CID(0x05)
+	CIDDevStatus    = CID(0x06)
+	CIDNewChannel   = CID(0x07)
+	CIDRXTimingSet  = CID(0x08)
+)
+
+// payload lengths of the MAC commands in uplink (answers and LinkCheckReq) and downlink direction.
+var (
+	uplinkCommandLen   = map[CID]int{CIDLinkCheck: 0, CIDLinkADR: 1, CIDDutyCycle: 0, CIDRXParamSetup: 1, CIDDevStatus: 2, CIDNewChannel: 1, CIDRXTimingSet: 0}
+	downlinkCommandLen = map[CID]int{CIDLinkCheck: 2, CIDLinkADR: 4, CIDDutyCycle: 1, CIDRXParamSetup: 4, CIDDevStatus: 0, CIDNewChannel: 5, CIDRXTimingSet: 1}
+)
+
+// MACCommand represents a single MAC command.
+type MACCommand struct {
+	CID     CID    `json:"cid"`
+	Payload []byte `json:"payload"`
+}
+
+// ParseMACCommands splits the FOpts or port 0 payload into MAC commands.
+func ParseMACCommands(b []byte, uplink bool) ([]MACCommand, error) {
+	lengths := downlinkCommandLen
+	if uplink {
+		lengths = uplinkCommandLen
+	}
+
+	var commands []MACCommand
+	for len(b) > 0 {
+		l, ok := lengths[b[0]]
+		if !ok {
+			return commands, fmt.Errorf("unknown mac command 0x%02x", b[0])
+		}
+
+		if len(b) < l+1 {
+			return commands, fmt.Errorf("mac command 0x%02x too short", b[0])
+		}
+
+		commands = append(commands, MACCommand{CID: b[0], Payload: b[1 : l+1]})
+		b = b[l+1:]
+	}
+
+	return commands, nil
+}
+
+// MarshalMACCommands concatenates MAC commands.
+func MarshalMACCommands(commands []MACCommand) []byte {
+	var b []byte
+	for i := range commands {
+		b = append(b, commands[i].CID)
+		b = append(b, commands[i].Payload...)
+	}
+	return b
+}
+
+// LinkADRReq requests a end-device to change data rate, transmit power and channels.
+type LinkADRReq struct {
+	DataRate   uint8  `json:"dataRate"`
+	TXPower    uint8  `json:"txPower"`
+	ChMask     uint16 `json:"chMask"`
+	ChMaskCntl uint8  `json:"chMaskCntl"`
+	NbTrans    uint8  `json:"nbTrans"`
+}
+
+func (r LinkADRReq) Command() MACCommand {
+	payload := make([]byte, 4)
+	payload[0] = r.DataRate<<4 | r.TXPower&0x0F
+	binary.LittleEndian.PutUint16(payload[1:3], r.ChMask)
+	payload[3] = (r.ChMaskCntl&0x07)<<4 | r.NbTrans&0x0F
+	return MACCommand{CID: CIDLinkADR, Payload: payload}
+}
+
+func ParseLinkADRReq(cmd MACCommand) LinkADRReq {
+	return LinkADRReq{
+		DataRate:   cmd.Payload[0] >> 4,
+		TXPower:    cmd.Payload[0] & 0x0F,
+		ChMask:     binary.LittleEndian.Uint16(cmd.Payload[1:3]),
+		ChMaskCntl: (cmd.Payload[3] >> 4) & 0x07,
+		NbTrans:    cmd.Payload[3] & 0x0F,
+	}
+}
+
+// LinkADRAns is the answer of a end-device to a LinkADRReq.
+type LinkADRAns struct {
+	PowerACK       bool `json:"powerAck"`
+	DataRateACK    bool `json:"dataRateAck"`
+	ChannelMaskACK bool `json:"channelMaskAck"`
+}
+
+// Accepted checks if all changes of the request were accepted.
+func (a LinkADRAns) Accepted() bool {
+	return a.PowerACK && a.DataRateACK && a.ChannelMaskACK
+}
+
+func (a LinkADRAns) Command() MACCommand {
+	var status byte
+	if a.PowerACK {
+		status |= 0x04
+	}
+	if a.DataRateACK {
+		status |= 0x02
+	}
+	if a.ChannelMaskACK {
+		status |= 0x01
+	}
+	return MACCommand{CID: CIDLinkADR, Payload: []byte{status}}
+}
+
+func ParseLinkADRAns(cmd MACCommand) LinkADRAns {
+	return LinkADRAns{
+		PowerACK:       cmd.Payload[0]&0x04 != 0,
+		DataRateACK:    cmd.Payload[0]&0x02 != 0,
+		ChannelMaskACK: cmd.Payload[0]&0x01 != 0,
+	}
+}
+
+// LinkCheckAns is the answer of the network server to a LinkCheckReq.
+type LinkCheckAns struct {
+	Margin uint8 `json:"margin"`
+	GwCnt  uint8 `json:"gwCnt"`
+}
+
+func (a LinkCheckAns) Command() MACCommand {
+	return MACCommand{CID: CIDLinkCheck, Payload: []byte{a.Margin, a.GwCnt}}
+}
+
+func ParseLinkCheckAns(cmd MACCommand) LinkCheckAns {
+	return LinkCheckAns{Margin: cmd.Payload[0], GwCnt: cmd.Payload[1]}
+}
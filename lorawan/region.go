@@ -0,0 +1,71 @@
+package lorawan
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timings of the class A receive windows.
+const (
+	ReceiveDelay1    = time.Second
+	ReceiveDelay2    = time.Second * 2
+	JoinAcceptDelay1 = time.Second * 5
+	JoinAcceptDelay2 = time.Second * 6
+)
+
+// EU868 regional parameters.
+const (
+	EU868RX2Freq         = 869.525
+	EU868RX2DataRate     = 0
+	EU868MaxEIRP         = 16
+	EU868MaxADRDataRate  = 5
+	EU868MaxTXPowerIndex = 7
+)
+
+// EU868DefaultChannels are the three join channels every EU868 device supports.
+var EU868DefaultChannels = []float64{868.1, 868.3, 868.5}
+
+// DataRate represents the modulation of a data rate index.
+type DataRate struct {
+	SpreadingFactor float64 `json:"spreadingFactor"`
+	BandWidth       float64 `json:"bandWidth"`
+}
+
+// EU868DataRates maps the data rate indices to their LoRa modulation.
+var EU868DataRates = []DataRate{
+	{SpreadingFactor: 12, BandWidth: 125},
+	{SpreadingFactor: 11, BandWidth: 125},
+	{SpreadingFactor: 10, BandWidth: 125},
+	{SpreadingFactor: 9, BandWidth: 125},
+	{SpreadingFactor: 8, BandWidth: 125},
+	{SpreadingFactor: 7, BandWidth: 125},
+	{SpreadingFactor: 7, BandWidth: 250},
+}
+
+// EU868DataRate returns the modulation of a data rate index.
+func EU868DataRate(index int) (DataRate, error) {
+	if index < 0 || index >= len(EU868DataRates) {
+		return DataRate{}, fmt.Errorf("unknown data rate %d", index)
+	}
+	return EU868DataRates[index], nil
+}
+
+// EU868DataRateIndex returns the data rate index of a LoRa modulation.
+func EU868DataRateIndex(sf float64, bw float64) (int, error) {
+	for i := range EU868DataRates {
+		if EU868DataRates[i].SpreadingFactor == sf && EU868DataRates[i].BandWidth == bw {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no data rate for SF%d BW%d", int(sf), int(bw))
+}
+
+// EU868TXPower returns the EIRP in dBm of a TX power index.
+func EU868TXPower(index int) float64 {
+	return float64(EU868MaxEIRP - 2*index)
+}
+
+// RequiredSNR returns the minimal SNR in dB that is needed to demodulate a spreading factor.
+func RequiredSNR(sf float64) float64 {
+	return -5 - (sf-6)*2.5
+}
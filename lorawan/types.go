@@ -0,0 +1,114 @@
+// Package lorawan implements the LoRaWAN 1.0.x frame format, cryptography and the EU868 regional
+// parameters that are needed to emulate network servers and end-devices.
+package lorawan
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// EUI64 represents a 64-bit extended unique identifier (DevEUI, JoinEUI, ...).
+type EUI64 [8]byte
+
+// DevAddr represents a 32-bit device address.
+type DevAddr [4]byte
+
+// AES128Key represents a 128-bit AES key.
+type AES128Key [16]byte
+
+func unmarshalHex(dst []byte, text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	if len(b) != len(dst) {
+		return fmt.Errorf("expected %d bytes but got %d", len(dst), len(b))
+	}
+
+	copy(dst, b)
+	return nil
+}
+
+func (e EUI64) String() string {
+	return hex.EncodeToString(e[:])
+}
+
+func (e EUI64) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *EUI64) UnmarshalText(text []byte) error {
+	return unmarshalHex(e[:], text)
+}
+
+func (a DevAddr) String() string {
+	return hex.EncodeToString(a[:])
+}
+
+func (a DevAddr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *DevAddr) UnmarshalText(text []byte) error {
+	return unmarshalHex(a[:], text)
+}
+
+func (k AES128Key) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+func (k AES128Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *AES128Key) UnmarshalText(text []byte) error {
+	return unmarshalHex(k[:], text)
+}
+
+// MType represents the message type of a LoRaWAN frame.
+type MType byte
+
+const (
+	JoinRequest         = MType(0)
+	JoinAccept          = MType(1)
+	UnconfirmedDataUp   = MType(2)
+	UnconfirmedDataDown = MType(3)
+	ConfirmedDataUp     = MType(4)
+	ConfirmedDataDown   = MType(5)
+	RejoinRequest       = MType(6)
+	Proprietary         = MType(7)
+)
+
+// IsUplink checks if the message type is sent by end-devices.
+func (m MType) IsUplink() bool {
+	return m == JoinRequest || m == UnconfirmedDataUp || m == ConfirmedDataUp || m == RejoinRequest
+}
+
+// IsData checks if the message type is a data frame.
+func (m MType) IsData() bool {
+	return m >= UnconfirmedDataUp && m <= ConfirmedDataDown
+}
+
+// IsConfirmed checks if the message type is a confirmed data frame.
+func (m MType) IsConfirmed() bool {
+	return m == ConfirmedDataUp || m == ConfirmedDataDown
+}
+
+// MHDR returns the MAC header byte for the message type with LoRaWAN R1 as major version.
+func (m MType) MHDR() byte {
+	return byte(m) << 5
+}
+
+// ParseMType extracts the message type of a raw LoRaWAN frame.
+func ParseMType(phy []byte) (MType, error) {
+	if len(phy) == 0 {
+		return 0, fmt.Errorf("empty frame")
+	}
+
+	if phy[0]&0x03 != 0 {
+		return 0, fmt.Errorf("unsupported major version %d", phy[0]&0x03)
+	}
+
+	return MType(phy[0] >> 5), nil
+}
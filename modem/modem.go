@@ -0,0 +1,462 @@
+// Package modem emulates a RN2483 style LoRa modem on a pseudo-terminal per node, so that firmware that talks
+// to its LoRa module over UART can run unmodified against the emulator.
+package modem
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Version is the answer to "sys get ver".
+const Version = "RN2483 1.0.5 LoRaEMU"
+
+// Answers of the modem.
+const (
+	AnswerOk           = "ok"
+	AnswerInvalidParam = "invalid_param"
+	AnswerBusy         = "busy"
+	AnswerRadioErr     = "radio_err"
+	AnswerRadioTxOk    = "radio_tx_ok"
+	AnswerRadioRx      = "radio_rx"
+	AnswerMacPause     = "4294967245"
+)
+
+// Config represents the configuration of a modem for a node.
+type Config struct {
+	// Node is the id of the node.
+	Node string `json:"node"`
+	// Link is a optional path at which a symlink to the pseudo-terminal is created (e.g. /tmp/loraemu/Node1).
+	Link string `json:"link"`
+}
+
+// Modem represents a emulated LoRa modem that is attached to a node.
+type Modem struct {
+	sync.Mutex
+
+	emu    *emu.Emulator
+	config Config
+	logger logr.Logger
+	port   io.Writer
+	master *os.File
+	slave  *os.File
+
+	freq    int
+	sf      int
+	pwr     int
+	bw      int
+	cr      int
+	wdt     int
+	rx      bool
+	rxGen   int
+	txUntil time.Time
+	snr     int
+	rssi    int
+}
+
+// New creates a new modem for a node.
+func New(emulator *emu.Emulator, config Config) (*Modem, error) {
+	if len(config.Node) == 0 {
+		return nil, errors.New("node missing")
+	}
+
+	return &Modem{
+		emu:    emulator,
+		config: config,
+		logger: logr.Discard(),
+		wdt:    15000,
+	}, nil
+}
+
+// SetLogger sets the logger of the modem.
+func (m *Modem) SetLogger(logger logr.Logger) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.logger = logger
+}
+
+// Path returns the path of the pseudo-terminal the firmware should open.
+func (m *Modem) Path() string {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.slave == nil {
+		return ""
+	}
+
+	return m.slave.Name()
+}
+
+// writeLine writes a answer to the serial port. The lock of the modem needs to be held.
+func (m *Modem) writeLine(line string) {
+	if m.port == nil {
+		return
+	}
+
+	if _, err := io.WriteString(m.port, line+"\r\n"); err != nil {
+		m.logger.Error(err, "can't write to serial port", "node", m.config.Node)
+	}
+}
+
+// tune applies the radio settings to the node, so that the emulator uses them.
+func (m *Modem) tune() error {
+	return m.emu.UpdateNode(m.config.Node, func(node *emu.Node) error {
+		node.Freq = float64(m.freq) / 1e6
+		node.SpreadingFactor = float64(m.sf)
+		node.TXGain = float64(m.pwr)
+		return nil
+	})
+}
+
+func (m *Modem) hwEUI() string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(m.config.Node))
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+}
+
+// handleCommand executes a command and returns the direct answer. Asynchronous answers like radio_tx_ok are
+// written later. The lock of the modem needs to be held.
+func (m *Modem) handleCommand(line string) string {
+	args := strings.Fields(line)
+	if len(args) < 2 {
+		return AnswerInvalidParam
+	}
+
+	switch args[0] + " " + args[1] {
+	case "sys reset":
+		return Version
+	case "sys get":
+		if len(args) != 3 {
+			return AnswerInvalidParam
+		}
+
+		switch args[2] {
+		case "ver":
+			return Version
+		case "hweui":
+			return m.hwEUI()
+		}
+	case "mac pause":
+		return AnswerMacPause
+	case "mac resume":
+		return AnswerOk
+	case "radio set":
+		if len(args) != 4 {
+			return AnswerInvalidParam
+		}
+		return m.handleSet(args[2], args[3])
+	case "radio get":
+		if len(args) != 3 {
+			return AnswerInvalidParam
+		}
+		return m.handleGet(args[2])
+	case "radio tx":
+		if len(args) != 3 {
+			return AnswerInvalidParam
+		}
+		return m.handleTx(args[2])
+	case "radio rx":
+		if len(args) != 3 {
+			return AnswerInvalidParam
+		}
+		return m.handleRx(args[2])
+	case "radio rxstop":
+		m.rx = false
+		m.rxGen++
+		return AnswerOk
+	}
+
+	return AnswerInvalidParam
+}
+
+func (m *Modem) handleSet(key string, value string) string {
+	switch key {
+	case "mod":
+		if value != "lora" {
+			return AnswerInvalidParam
+		}
+		return AnswerOk
+	case "cr":
+		var cr int
+		if _, err := fmt.Sscanf(value, "4/%d", &cr); err != nil || cr < 5 || cr > 8 {
+			return AnswerInvalidParam
+		}
+		m.cr = cr
+		return AnswerOk
+	case "sf":
+		sf, err := strconv.Atoi(strings.TrimPrefix(value, "sf"))
+		if err != nil || !strings.HasPrefix(value, "sf") || sf < 7 || sf > 12 {
+			return AnswerInvalidParam
+		}
+		m.sf = sf
+	case "freq":
+		freq, err := strconv.Atoi(value)
+		if err != nil || !((freq >= 433050000 && freq <= 434790000) || (freq >= 863000000 && freq <= 870000000)) {
+			return AnswerInvalidParam
+		}
+		m.freq = freq
+	case "pwr":
+		pwr, err := strconv.Atoi(value)
+		if err != nil || pwr < -3 || pwr > 15 {
+			return AnswerInvalidParam
+		}
+		m.pwr = pwr
+	case "bw":
+		bw, err := strconv.Atoi(value)
+		if err != nil || (bw != 125 && bw != 250 && bw != 500) {
+			return AnswerInvalidParam
+		}
+		m.bw = bw
+		return AnswerOk
+	case "wdt":
+		wdt, err := strconv.Atoi(value)
+		if err != nil || wdt < 0 {
+			return AnswerInvalidParam
+		}
+		m.wdt = wdt
+		return AnswerOk
+	default:
+		return AnswerInvalidParam
+	}
+
+	if err := m.tune(); err != nil {
+		m.logger.Error(err, "can't update node", "node", m.config.Node)
+		return AnswerInvalidParam
+	}
+
+	return AnswerOk
+}
+
+func (m *Modem) handleGet(key string) string {
+	switch key {
+	case "mod":
+		return "lora"
+	case "freq":
+		return strconv.Itoa(m.freq)
+	case "sf":
+		return fmt.Sprintf("sf%d", m.sf)
+	case "pwr":
+		return strconv.Itoa(m.pwr)
+	case "bw":
+		return strconv.Itoa(m.bw)
+	case "cr":
+		return fmt.Sprintf("4/%d", m.cr)
+	case "wdt":
+		return strconv.Itoa(m.wdt)
+	case "snr":
+		return strconv.Itoa(m.snr)
+	case "rssi":
+		return strconv.Itoa(m.rssi)
+	}
+
+	return AnswerInvalidParam
+}
+
+func (m *Modem) handleTx(data string) string {
+	msg, err := hex.DecodeString(data)
+	if err != nil || len(msg) == 0 {
+		return AnswerInvalidParam
+	}
+
+	now := m.emu.Now()
+	if m.rx || now.Before(m.txUntil) {
+		return AnswerBusy
+	}
+
+	packet := m.emu.GetPacketConfig()
+	packet.PayloadLen = float64(len(msg))
+	packet.SpreadingFactor = float64(m.sf)
+	packet.BandWidth = float64(m.bw)
+	packet.CodingRate = float64(m.cr)
+
+	airtime := time.Duration(packet.TimeTotal() * float64(time.Millisecond))
+
+	if err := m.emu.SendMessageWithParams(m.config.Node, msg, emu.TxParams{
+		Freq:            float64(m.freq) / 1e6,
+		SpreadingFactor: packet.SpreadingFactor,
+		BandWidth:       packet.BandWidth,
+		CodingRate:      packet.CodingRate,
+	}); err != nil {
+		m.logger.Error(err, "can't transmit", "node", m.config.Node)
+
+		// the command itself is valid, the failure is reported like a failed transmission
+		m.emu.Schedule(0, func() {
+			m.Lock()
+			defer m.Unlock()
+
+			m.writeLine(AnswerRadioErr)
+		})
+
+		return AnswerOk
+	}
+
+	m.txUntil = now.Add(airtime)
+	m.emu.Schedule(airtime, func() {
+		m.Lock()
+		defer m.Unlock()
+
+		m.writeLine(AnswerRadioTxOk)
+	})
+
+	return AnswerOk
+}
+
+func (m *Modem) handleRx(size string) string {
+	if _, err := strconv.Atoi(size); err != nil {
+		return AnswerInvalidParam
+	}
+
+	if m.rx || m.emu.Now().Before(m.txUntil) {
+		return AnswerBusy
+	}
+
+	m.rx = true
+	m.rxGen++
+
+	// the watchdog ends the reception if nothing was received in time
+	if m.wdt > 0 {
+		gen := m.rxGen
+		m.emu.Schedule(time.Duration(m.wdt)*time.Millisecond, func() {
+			m.Lock()
+			defer m.Unlock()
+
+			if m.rx && m.rxGen == gen {
+				m.rx = false
+				m.writeLine(AnswerRadioErr)
+			}
+		})
+	}
+
+	return AnswerOk
+}
+
+func (m *Modem) handleReceived(node emu.Node, packet emu.RxPacket) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.rx || packet.CRCFailed {
+		return
+	}
+
+	m.rx = false
+	m.rxGen++
+	m.snr = packet.SNR
+	m.rssi = packet.RSSI
+
+	m.writeLine(AnswerRadioRx + "  " + strings.ToUpper(hex.EncodeToString(packet.Data)))
+}
+
+// serve reads commands from the reader until it is closed.
+func (m *Modem) serve(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		m.Lock()
+		m.writeLine(m.handleCommand(line))
+		m.Unlock()
+	}
+}
+
+// init sets the radio settings from the node and attaches the modem to it.
+func (m *Modem) init(port io.Writer) error {
+	node := m.emu.GetNode(m.config.Node)
+	if node.ID == "" {
+		return errors.New("node not found")
+	}
+
+	packet := m.emu.GetPacketConfig()
+
+	m.Lock()
+	m.port = port
+	m.freq = int(math.Round(m.emu.GetFreq() * 1e6))
+	if node.Freq > 0 {
+		m.freq = int(math.Round(node.Freq * 1e6))
+	}
+	m.sf = int(packet.SpreadingFactor)
+	if node.SpreadingFactor > 0 {
+		m.sf = int(node.SpreadingFactor)
+	}
+	m.pwr = int(node.TXGain)
+	m.bw = int(packet.BandWidth)
+	m.cr = int(packet.CodingRate)
+	m.Unlock()
+
+	return m.emu.AttachNode(m.config.Node, m.handleReceived)
+}
+
+// Start creates the pseudo-terminal and attaches the modem to its node.
+func (m *Modem) Start() error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+
+	if err := m.init(master); err != nil {
+		_ = master.Close()
+		_ = slave.Close()
+		return err
+	}
+
+	m.Lock()
+	m.master = master
+	m.slave = slave
+	m.Unlock()
+
+	if len(m.config.Link) > 0 {
+		// only replace old symlinks and never a real file
+		if info, err := os.Lstat(m.config.Link); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			_ = os.Remove(m.config.Link)
+		}
+
+		if err := os.Symlink(slave.Name(), m.config.Link); err != nil {
+			m.logger.Error(err, "can't create symlink", "node", m.config.Node, "link", m.config.Link)
+		}
+	}
+
+	m.logger.Info("modem started", "node", m.config.Node, "path", slave.Name())
+
+	go m.serve(master)
+
+	return nil
+}
+
+// Stop detaches the modem from its node and closes the pseudo-terminal.
+func (m *Modem) Stop() error {
+	m.emu.DetachNode(m.config.Node)
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.port = nil
+
+	if len(m.config.Link) > 0 {
+		_ = os.Remove(m.config.Link)
+	}
+
+	if m.slave != nil {
+		_ = m.slave.Close()
+	}
+
+	if m.master != nil {
+		return m.master.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package modem
+
+import (
+	"bufio"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// firmware is the other side of the pseudo-terminal.
+type firmware struct {
+	t     *testing.T
+	port  *os.File
+	lines chan string
+}
+
+func newFirmware(t *testing.T, path string) *firmware {
+	port, err := os.OpenFile(path, os.O_RDWR, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	f := &firmware{t: t, port: port, lines: make(chan string, 10)}
+
+	go func() {
+		reader := bufio.NewReader(port)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f.lines <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+
+	return f
+}
+
+func (f *firmware) expect(answer string) {
+	select {
+	case line := <-f.lines:
+		assert.Equal(f.t, answer, line)
+	case <-time.After(time.Second * 5):
+		assert.Fail(f.t, "no answer", "expected", answer)
+	}
+}
+
+func (f *firmware) command(cmd string, answer string) {
+	_, err := f.port.WriteString(cmd + "\r\n")
+	assert.NoError(f.t, err)
+	f.expect(answer)
+}
+
+func TestModem(t *testing.T) {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+
+	for i, id := range []string{"Modem", "Other"} {
+		assert.NoError(t, e.AddNode(emu.Node{
+			ID:     id,
+			Online: true,
+			X:      1 + float64(i)*0.5,
+			Y:      1,
+			TXGain: 14,
+			RXSens: -137,
+		}))
+	}
+
+	m, err := New(e, Config{Node: "Modem"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if err := m.Start(); err != nil {
+		t.Skip("pseudo-terminals not available:", err)
+	}
+	defer m.Stop()
+
+	f := newFirmware(t, m.Path())
+	defer f.port.Close()
+
+	received := make(chan emu.RxPacket, 10)
+	assert.NoError(t, e.AttachNode("Other", func(node emu.Node, packet emu.RxPacket) {
+		received <- packet
+	}))
+
+	t.Run("Settings", func(t *testing.T) {
+		f.command("sys get ver", Version)
+		f.command("mac pause", AnswerMacPause)
+		f.command("radio set sf sf9", AnswerOk)
+		f.command("radio set sf sf13", AnswerInvalidParam)
+		f.command("radio set freq 868100000", AnswerOk)
+		f.command("radio set pwr 10", AnswerOk)
+		f.command("radio get sf", "sf9")
+		f.command("radio get freq", "868100000")
+		f.command("unknown command", AnswerInvalidParam)
+
+		node := e.GetNode("Modem")
+		assert.Equal(t, 868.1, node.Freq)
+		assert.Equal(t, 9.0, node.SpreadingFactor)
+		assert.Equal(t, 10.0, node.TXGain)
+	})
+
+	t.Run("Tx", func(t *testing.T) {
+		assert.NoError(t, e.UpdateNode("Other", func(node *emu.Node) error {
+			node.Freq = 868.1
+			node.SpreadingFactor = 9
+			return nil
+		}))
+
+		f.command("radio tx 0102ab", AnswerOk)
+		f.expect(AnswerRadioTxOk)
+
+		select {
+		case packet := <-received:
+			assert.Equal(t, []byte{0x01, 0x02, 0xab}, packet.Data)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "packet not received")
+		}
+
+		f.command("radio tx zz", AnswerInvalidParam)
+	})
+
+	t.Run("Rx", func(t *testing.T) {
+		f.command("radio rx 0", AnswerOk)
+		assert.NoError(t, e.SendMessage("Other", []byte{0xca, 0xfe}))
+		f.expect(AnswerRadioRx + "  CAFE")
+
+		f.command("radio get rssi", "-131")
+	})
+
+	t.Run("RxTimeout", func(t *testing.T) {
+		f.command("radio set wdt 1000", AnswerOk)
+		f.command("radio rx 0", AnswerOk)
+		f.expect(AnswerRadioErr)
+	})
+}
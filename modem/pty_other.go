@@ -0,0 +1,13 @@
+//go:build !linux
+
+package modem
+
+import (
+	"errors"
+	"os"
+)
+
+// openPTY is only supported on linux.
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pseudo-terminals are only supported on linux")
+}
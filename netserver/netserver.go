@@ -0,0 +1,648 @@
+// Package netserver implements a minimal in-process LoRaWAN 1.0.x network server that is attached to
+// gateway nodes of the emulator. It supports OTAA joins, deduplication of uplinks across gateways,
+// class A downlinks in RX1 / RX2 and ADR for the EU868 region.
+package netserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lorawan"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// DeviceConfig represents a end-device that is allowed to join the network.
+type DeviceConfig struct {
+	DevEUI  lorawan.EUI64     `json:"devEui"`
+	JoinEUI lorawan.EUI64     `json:"joinEui"`
+	AppKey  lorawan.AES128Key `json:"appKey"`
+}
+
+// Config represents the configuration of the network server.
+type Config struct {
+	// Gateways are the ids of the gateway nodes the network server is attached to.
+	Gateways []string `json:"gateways"`
+	// Devices are the end-devices that are allowed to join.
+	Devices []DeviceConfig `json:"devices"`
+	// NetID is the 24-bit network identifier.
+	NetID uint32 `json:"netId"`
+	// RX1DROffset is the data rate offset of the RX1 window.
+	RX1DROffset uint8 `json:"rx1DrOffset"`
+	// RX2Freq is the frequency of the RX2 window in MHz. Defaults to 869.525.
+	RX2Freq float64 `json:"rx2Freq"`
+	// RX2DataRate is the data rate of the RX2 window.
+	RX2DataRate uint8 `json:"rx2DataRate"`
+	// RXWindow selects the receive window of downlinks. 0 uses RX1 and falls back to RX2, 1 only uses RX1 and 2 only uses RX2.
+	RXWindow int `json:"rxWindow"`
+	// Deduplication is the time in ms that is waited for the same uplink from other gateways. Defaults to 200.
+	Deduplication float64 `json:"deduplication"`
+	// ADR enables the adaptive data rate.
+	ADR bool `json:"adr"`
+	// ADRMargin is the installation margin in dB of the ADR algorithm. Defaults to 10.
+	ADRMargin float64 `json:"adrMargin"`
+	// ADRHistory is the amount of uplinks the ADR algorithm considers. Defaults to 20.
+	ADRHistory int `json:"adrHistory"`
+}
+
+// GatewayReception represents the reception of a uplink by a single gateway.
+type GatewayReception struct {
+	Gateway         string  `json:"gateway"`
+	RSSI            int     `json:"rssi"`
+	SNR             int     `json:"snr"`
+	Freq            float64 `json:"freq"`
+	SpreadingFactor float64 `json:"spreadingFactor"`
+	BandWidth       float64 `json:"bandWidth"`
+	RecvTimeMicro   int64   `json:"recvTimeMicro"`
+}
+
+// Uplink represents a deduplicated and decrypted data uplink of a end-device.
+type Uplink struct {
+	DevEUI     lorawan.EUI64      `json:"devEui"`
+	DevAddr    lorawan.DevAddr    `json:"devAddr"`
+	Confirmed  bool               `json:"confirmed"`
+	FCnt       uint32             `json:"fCnt"`
+	FPort      *uint8             `json:"fPort"`
+	Payload    []byte             `json:"payload"`
+	DataRate   int                `json:"dataRate"`
+	Receptions []GatewayReception `json:"receptions"`
+}
+
+// Downlink represents a application payload that is queued for a end-device.
+type Downlink struct {
+	FPort     uint8  `json:"fPort"`
+	Payload   []byte `json:"payload"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// DeviceSession represents the state of a end-device in the network server.
+type DeviceSession struct {
+	DevEUI    lorawan.EUI64     `json:"devEui"`
+	JoinEUI   lorawan.EUI64     `json:"joinEui"`
+	Joined    bool              `json:"joined"`
+	DevAddr   lorawan.DevAddr   `json:"devAddr"`
+	NwkSKey   lorawan.AES128Key `json:"nwkSKey"`
+	AppSKey   lorawan.AES128Key `json:"appSKey"`
+	FCntUp    uint32            `json:"fCntUp"`
+	FCntDown  uint32            `json:"fCntDown"`
+	DataRate  int               `json:"dataRate"`
+	TXPower   int               `json:"txPower"`
+	ADR       bool              `json:"adr"`
+	Joins     int               `json:"joins"`
+	Uplinks   int               `json:"uplinks"`
+	Downlinks int               `json:"downlinks"`
+	Queued    int               `json:"queued"`
+	LastRSSI  int               `json:"lastRssi"`
+	LastSNR   int               `json:"lastSnr"`
+	LastSeen  time.Time         `json:"lastSeen"`
+
+	appKey     lorawan.AES128Key
+	joinNonce  uint32
+	devNonces  map[uint16]bool
+	snrHistory []float64
+	pendingADR *lorawan.LinkADRReq
+	linkCheck  *lorawan.LinkCheckAns
+	queue      []Downlink
+}
+
+type dedupEntry struct {
+	receptions []GatewayReception
+}
+
+// NetworkServer represents a in-process LoRaWAN network server.
+type NetworkServer struct {
+	sync.Mutex
+
+	emu      *emu.Emulator
+	config   Config
+	logger   logr.Logger
+	sessions map[lorawan.EUI64]*DeviceSession
+	dedup    map[string]*dedupEntry
+	onUplink func(uplink Uplink)
+}
+
+// New creates a new network server for the emulator.
+func New(emulator *emu.Emulator, config Config) *NetworkServer {
+	if config.RX2Freq <= 0 {
+		config.RX2Freq = lorawan.EU868RX2Freq
+	}
+
+	if config.Deduplication <= 0 {
+		config.Deduplication = 200
+	}
+
+	if config.ADRMargin <= 0 {
+		config.ADRMargin = 10
+	}
+
+	if config.ADRHistory <= 0 {
+		config.ADRHistory = 20
+	}
+
+	ns := &NetworkServer{
+		emu:      emulator,
+		config:   config,
+		logger:   logr.Discard(),
+		sessions: map[lorawan.EUI64]*DeviceSession{},
+		dedup:    map[string]*dedupEntry{},
+		onUplink: func(uplink Uplink) {},
+	}
+
+	for _, dev := range config.Devices {
+		ns.sessions[dev.DevEUI] = &DeviceSession{
+			DevEUI:    dev.DevEUI,
+			JoinEUI:   dev.JoinEUI,
+			appKey:    dev.AppKey,
+			devNonces: map[uint16]bool{},
+		}
+	}
+
+	return ns
+}
+
+// SetLogger sets the logger of the network server.
+func (ns *NetworkServer) SetLogger(logger logr.Logger) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	ns.logger = logger
+}
+
+// SetOnUplink sets the callback that should be called for every deduplicated data uplink.
+func (ns *NetworkServer) SetOnUplink(onUplink func(uplink Uplink)) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	ns.onUplink = onUplink
+}
+
+// Sessions returns a copy of all device sessions sorted by DevEUI.
+func (ns *NetworkServer) Sessions() []DeviceSession {
+	ns.Lock()
+	defer ns.Unlock()
+
+	sessions := make([]DeviceSession, 0, len(ns.sessions))
+	for _, s := range ns.sessions {
+		sessions = append(sessions, s.copy())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].DevEUI.String() < sessions[j].DevEUI.String()
+	})
+
+	return sessions
+}
+
+// Session returns a copy of the session of a end-device.
+func (ns *NetworkServer) Session(devEUI lorawan.EUI64) (DeviceSession, bool) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	s, ok := ns.sessions[devEUI]
+	if !ok {
+		return DeviceSession{}, false
+	}
+
+	return s.copy(), true
+}
+
+// EnqueueDownlink queues a application payload that will be sent in the next receive window of the end-device.
+func (ns *NetworkServer) EnqueueDownlink(devEUI lorawan.EUI64, downlink Downlink) error {
+	ns.Lock()
+	defer ns.Unlock()
+
+	s, ok := ns.sessions[devEUI]
+	if !ok {
+		return errors.New("device not found")
+	}
+
+	if downlink.FPort == 0 {
+		return errors.New("fport 0 is reserved for mac commands")
+	}
+
+	s.queue = append(s.queue, downlink)
+
+	return nil
+}
+
+func (s *DeviceSession) copy() DeviceSession {
+	c := *s
+	c.Queued = len(s.queue)
+	return c
+}
+
+func (ns *NetworkServer) sessionByDevAddr(devAddr lorawan.DevAddr) *DeviceSession {
+	for _, s := range ns.sessions {
+		if s.Joined && s.DevAddr == devAddr {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ns *NetworkServer) newDevAddr() lorawan.DevAddr {
+	for {
+		var devAddr lorawan.DevAddr
+		_, _ = rand.Read(devAddr[:])
+
+		// the 7 msb of the address are the NwkID which are the 7 lsb of the NetID
+		devAddr[0] = byte(ns.config.NetID&0x7F)<<1 | devAddr[0]&0x01
+
+		if ns.sessionByDevAddr(devAddr) == nil {
+			return devAddr
+		}
+	}
+}
+
+func (ns *NetworkServer) handleReceived(node emu.Node, packet emu.RxPacket) {
+	if packet.CRCFailed {
+		return
+	}
+
+	reception := GatewayReception{
+		Gateway:         node.ID,
+		RSSI:            packet.RSSI,
+		SNR:             packet.SNR,
+		Freq:            packet.Freq,
+		SpreadingFactor: packet.SpreadingFactor,
+		BandWidth:       packet.BandWidth,
+		RecvTimeMicro:   packet.RecvTimeMicro,
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	key := string(packet.Data)
+	if entry, ok := ns.dedup[key]; ok {
+		entry.receptions = append(entry.receptions, reception)
+		return
+	}
+
+	ns.dedup[key] = &dedupEntry{receptions: []GatewayReception{reception}}
+
+	data := packet.Data
+	ns.emu.Schedule(time.Duration(ns.config.Deduplication*float64(time.Millisecond)), func() {
+		ns.Lock()
+		entry := ns.dedup[key]
+		delete(ns.dedup, key)
+		ns.Unlock()
+
+		ns.handleUplink(data, entry.receptions)
+	})
+}
+
+// bestReception returns the reception with the best SNR, which is used to send the downlink.
+func bestReception(receptions []GatewayReception) GatewayReception {
+	best := receptions[0]
+	for _, r := range receptions[1:] {
+		if r.SNR > best.SNR || (r.SNR == best.SNR && r.RSSI > best.RSSI) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (ns *NetworkServer) handleUplink(phy []byte, receptions []GatewayReception) {
+	mType, err := lorawan.ParseMType(phy)
+	if err != nil || !mType.IsUplink() {
+		return
+	}
+
+	switch mType {
+	case lorawan.JoinRequest:
+		ns.handleJoinRequest(phy, receptions)
+	case lorawan.UnconfirmedDataUp, lorawan.ConfirmedDataUp:
+		ns.handleDataUp(phy, receptions)
+	}
+}
+
+func (ns *NetworkServer) handleJoinRequest(phy []byte, receptions []GatewayReception) {
+	jr, err := lorawan.ParseJoinRequest(phy)
+	if err != nil {
+		ns.logger.Error(err, "invalid join-request")
+		return
+	}
+
+	best := bestReception(receptions)
+	dataRate, err := lorawan.EU868DataRateIndex(best.SpreadingFactor, best.BandWidth)
+	if err != nil {
+		ns.logger.Error(err, "join-request with unknown data rate", "devEui", jr.DevEUI.String())
+		return
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	s, ok := ns.sessions[jr.DevEUI]
+	if !ok || s.JoinEUI != jr.JoinEUI {
+		ns.logger.Info("join-request of unknown device", "devEui", jr.DevEUI.String())
+		return
+	}
+
+	if !lorawan.ValidateJoinRequestMIC(s.appKey, phy) {
+		ns.logger.Info("join-request with invalid mic", "devEui", jr.DevEUI.String())
+		return
+	}
+
+	if s.devNonces[jr.DevNonce] {
+		ns.logger.Info("join-request with reused dev nonce", "devEui", jr.DevEUI.String(), "devNonce", jr.DevNonce)
+		return
+	}
+
+	s.devNonces[jr.DevNonce] = true
+	s.joinNonce++
+
+	ja := lorawan.JoinAcceptPayload{
+		JoinNonce:   s.joinNonce,
+		NetID:       ns.config.NetID,
+		DevAddr:     ns.newDevAddr(),
+		RX1DROffset: ns.config.RX1DROffset,
+		RX2DataRate: ns.config.RX2DataRate,
+		RxDelay:     uint8(lorawan.ReceiveDelay1 / time.Second),
+	}
+
+	joinAccept, err := ja.Marshal(s.appKey)
+	if err != nil {
+		ns.logger.Error(err, "can't create join-accept", "devEui", jr.DevEUI.String())
+		return
+	}
+
+	s.Joined = true
+	s.DevAddr = ja.DevAddr
+	s.NwkSKey, s.AppSKey = lorawan.DeriveSessionKeys(s.appKey, ja.JoinNonce, ja.NetID, jr.DevNonce)
+	s.FCntUp = 0
+	s.FCntDown = 0
+	s.DataRate = dataRate
+	s.TXPower = 0
+	s.Joins++
+	s.Uplinks = 0
+	s.LastRSSI = best.RSSI
+	s.LastSNR = best.SNR
+	s.LastSeen = time.UnixMicro(best.RecvTimeMicro)
+	s.snrHistory = nil
+	s.pendingADR = nil
+	s.linkCheck = nil
+
+	ns.logger.Info("device joined", "devEui", jr.DevEUI.String(), "devAddr", ja.DevAddr.String())
+
+	ns.scheduleDownlink(best, dataRate, joinAccept, lorawan.JoinAcceptDelay1)
+}
+
+func (ns *NetworkServer) handleDataUp(phy []byte, receptions []GatewayReception) {
+	frame, err := lorawan.ParseDataFrame(phy)
+	if err != nil {
+		ns.logger.Error(err, "invalid data frame")
+		return
+	}
+
+	best := bestReception(receptions)
+	dataRate, err := lorawan.EU868DataRateIndex(best.SpreadingFactor, best.BandWidth)
+	if err != nil {
+		ns.logger.Error(err, "uplink with unknown data rate", "devAddr", frame.DevAddr.String())
+		return
+	}
+
+	ns.Lock()
+
+	s := ns.sessionByDevAddr(frame.DevAddr)
+	if s == nil {
+		ns.Unlock()
+		ns.logger.Info("uplink of unknown device", "devAddr", frame.DevAddr.String())
+		return
+	}
+
+	fCnt := lorawan.FullFCnt(s.FCntUp, uint16(frame.FCnt))
+	if s.Uplinks > 0 && fCnt <= s.FCntUp {
+		ns.Unlock()
+		ns.logger.Info("uplink with old frame counter", "devEui", s.DevEUI.String(), "fCnt", fCnt)
+		return
+	}
+
+	if !lorawan.ValidateDataMIC(s.NwkSKey, phy, fCnt) {
+		ns.Unlock()
+		ns.logger.Info("uplink with invalid mic", "devEui", s.DevEUI.String(), "fCnt", fCnt)
+		return
+	}
+
+	frame.Decrypt(s.NwkSKey, s.AppSKey, fCnt)
+
+	s.FCntUp = fCnt
+	s.Uplinks++
+	s.DataRate = dataRate
+	s.LastRSSI = best.RSSI
+	s.LastSNR = best.SNR
+	s.LastSeen = time.UnixMicro(best.RecvTimeMicro)
+
+	// mac commands are either in the fopts or the payload on port 0
+	macPayload := frame.FOpts
+	if frame.FPort != nil && *frame.FPort == 0 {
+		macPayload = frame.FRMPayload
+	}
+
+	commands, err := lorawan.ParseMACCommands(macPayload, true)
+	if err != nil {
+		ns.logger.Error(err, "invalid mac commands", "devEui", s.DevEUI.String())
+	}
+
+	for _, cmd := range commands {
+		switch cmd.CID {
+		case lorawan.CIDLinkCheck:
+			s.linkCheck = &lorawan.LinkCheckAns{
+				Margin: uint8(math.Max(0, float64(best.SNR)-lorawan.RequiredSNR(best.SpreadingFactor))),
+				GwCnt:  uint8(len(receptions)),
+			}
+		case lorawan.CIDLinkADR:
+			if s.pendingADR != nil && lorawan.ParseLinkADRAns(cmd).Accepted() {
+				s.DataRate = int(s.pendingADR.DataRate)
+				s.TXPower = int(s.pendingADR.TXPower)
+				s.snrHistory = nil
+			}
+			s.pendingADR = nil
+		}
+	}
+
+	// collect the snr history and run the adr
+	s.ADR = ns.config.ADR && frame.FCtrl.ADR
+	if s.ADR {
+		s.snrHistory = append(s.snrHistory, float64(best.SNR))
+		if len(s.snrHistory) > ns.config.ADRHistory {
+			s.snrHistory = s.snrHistory[1:]
+		}
+
+		if s.pendingADR == nil && len(s.snrHistory) >= ns.config.ADRHistory {
+			maxSNR := s.snrHistory[0]
+			for _, snr := range s.snrHistory {
+				maxSNR = math.Max(maxSNR, snr)
+			}
+
+			dr, txPower := ADR(s.DataRate, s.TXPower, maxSNR, ns.config.ADRMargin)
+			if dr != s.DataRate || txPower != s.TXPower {
+				s.pendingADR = &lorawan.LinkADRReq{
+					DataRate: uint8(dr),
+					TXPower:  uint8(txPower),
+					ChMask:   uint16(1<<len(lorawan.EU868DefaultChannels) - 1),
+					NbTrans:  1,
+				}
+			}
+		}
+	}
+
+	confirmed := frame.MType == lorawan.ConfirmedDataUp
+	if confirmed || frame.FCtrl.ADRACKReq || s.pendingADR != nil || s.linkCheck != nil || len(s.queue) > 0 {
+		ns.sendDataDown(s, best, dataRate, confirmed)
+	}
+
+	uplink := Uplink{
+		DevEUI:     s.DevEUI,
+		DevAddr:    s.DevAddr,
+		Confirmed:  confirmed,
+		FCnt:       fCnt,
+		FPort:      frame.FPort,
+		Payload:    frame.FRMPayload,
+		DataRate:   dataRate,
+		Receptions: receptions,
+	}
+	onUplink := ns.onUplink
+
+	ns.Unlock()
+
+	if frame.FPort != nil && *frame.FPort != 0 {
+		onUplink(uplink)
+	}
+}
+
+// sendDataDown builds the next downlink of the device session. The lock of the network server needs to be held.
+func (ns *NetworkServer) sendDataDown(s *DeviceSession, best GatewayReception, dataRate int, ack bool) {
+	frame := lorawan.DataFrame{
+		MType:   lorawan.UnconfirmedDataDown,
+		DevAddr: s.DevAddr,
+		FCtrl: lorawan.FCtrl{
+			ADR: ns.config.ADR,
+			ACK: ack,
+		},
+		FCnt: s.FCntDown,
+	}
+
+	var commands []lorawan.MACCommand
+	if s.linkCheck != nil {
+		commands = append(commands, s.linkCheck.Command())
+		s.linkCheck = nil
+	}
+
+	if s.pendingADR != nil {
+		commands = append(commands, s.pendingADR.Command())
+	}
+
+	frame.FOpts = lorawan.MarshalMACCommands(commands)
+
+	if len(s.queue) > 0 {
+		downlink := s.queue[0]
+		s.queue = s.queue[1:]
+
+		if downlink.Confirmed {
+			frame.MType = lorawan.ConfirmedDataDown
+		}
+
+		frame.FPort = &downlink.FPort
+		frame.FRMPayload = downlink.Payload
+		frame.FCtrl.FPending = len(s.queue) > 0
+	}
+
+	phy, err := frame.Marshal(s.NwkSKey, s.AppSKey)
+	if err != nil {
+		ns.logger.Error(err, "can't create downlink", "devEui", s.DevEUI.String())
+		return
+	}
+
+	s.FCntDown++
+	s.Downlinks++
+
+	ns.scheduleDownlink(best, dataRate, phy, lorawan.ReceiveDelay1)
+}
+
+// scheduleDownlink schedules the transmission of the downlink in RX1 or RX2 relative to the end of the uplink.
+func (ns *NetworkServer) scheduleDownlink(best GatewayReception, uplinkDataRate int, phy []byte, rx1Delay time.Duration) {
+	recvTime := time.UnixMicro(best.RecvTimeMicro)
+	now := ns.emu.Now()
+
+	var at time.Time
+	var params emu.TxParams
+
+	if rx1 := recvTime.Add(rx1Delay); ns.config.RXWindow != 2 && rx1.After(now) {
+		dr, _ := lorawan.EU868DataRate(int(math.Max(0, float64(uplinkDataRate-int(ns.config.RX1DROffset)))))
+
+		at = rx1
+		params = emu.TxParams{Freq: best.Freq, SpreadingFactor: dr.SpreadingFactor, BandWidth: dr.BandWidth}
+	} else if rx2 := recvTime.Add(rx1Delay + time.Second); ns.config.RXWindow != 1 && rx2.After(now) {
+		dr, err := lorawan.EU868DataRate(int(ns.config.RX2DataRate))
+		if err != nil {
+			ns.logger.Error(err, "invalid rx2 data rate")
+			return
+		}
+
+		at = rx2
+		params = emu.TxParams{Freq: ns.config.RX2Freq, SpreadingFactor: dr.SpreadingFactor, BandWidth: dr.BandWidth}
+	} else {
+		ns.logger.Info("downlink missed the receive windows", "gateway", best.Gateway)
+		return
+	}
+
+	ns.emu.Schedule(at.Sub(now), func() {
+		if err := ns.emu.SendMessageWithParams(best.Gateway, phy, params); err != nil {
+			ns.logger.Error(err, "can't transmit downlink", "gateway", best.Gateway)
+		}
+	})
+}
+
+// ADR calculates the new data rate and TX power index of a device based on the maximum SNR of the
+// last uplinks, following the ADR algorithm recommended by Semtech.
+func ADR(dataRate int, txPower int, maxSNR float64, margin float64) (int, int) {
+	dr, err := lorawan.EU868DataRate(dataRate)
+	if err != nil {
+		return dataRate, txPower
+	}
+
+	nStep := int(math.Floor((maxSNR - lorawan.RequiredSNR(dr.SpreadingFactor) - margin) / 3))
+
+	for nStep > 0 && dataRate < lorawan.EU868MaxADRDataRate {
+		dataRate++
+		nStep--
+	}
+
+	for nStep > 0 && txPower < lorawan.EU868MaxTXPowerIndex {
+		txPower++
+		nStep--
+	}
+
+	for nStep < 0 && txPower > 0 {
+		txPower--
+		nStep++
+	}
+
+	return dataRate, txPower
+}
+
+// Start attaches the network server to its gateway nodes.
+func (ns *NetworkServer) Start() error {
+	for i, gw := range ns.config.Gateways {
+		if err := ns.emu.AttachNode(gw, ns.handleReceived); err != nil {
+			for _, attached := range ns.config.Gateways[:i] {
+				ns.emu.DetachNode(attached)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop detaches the network server from its gateway nodes.
+func (ns *NetworkServer) Stop() {
+	for _, gw := range ns.config.Gateways {
+		ns.emu.DetachNode(gw)
+	}
+}
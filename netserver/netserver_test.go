@@ -0,0 +1,214 @@
+package netserver
+
+import (
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"github.com/BigJk/loraemu/lorawan"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func expectDownlink(t *testing.T, downlinks chan emu.RxPacket) emu.RxPacket {
+	select {
+	case packet := <-downlinks:
+		return packet
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "downlink not received")
+		t.FailNow()
+	}
+	return emu.RxPacket{}
+}
+
+func TestNetworkServer(t *testing.T) {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+
+	assert.NoError(t, e.AddNode(emu.Node{
+		ID:     "Device",
+		Online: true,
+		X:      1,
+		Y:      1,
+		TXGain: 14,
+		RXSens: -137,
+		Freq:   868.1,
+	}))
+
+	for i, id := range []string{"GW-1", "GW-2"} {
+		assert.NoError(t, e.AddNode(emu.Node{
+			ID:      id,
+			Online:  true,
+			X:       1.5 + float64(i),
+			Y:       1,
+			TXGain:  27,
+			RXSens:  -141,
+			Kind:    emu.NodeKindGateway,
+			Gateway: &emu.GatewayConfig{Channels: lorawan.EU868DefaultChannels},
+		}))
+	}
+
+	dev := DeviceConfig{
+		DevEUI:  lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+		JoinEUI: lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+		AppKey:  lorawan.AES128Key{3, 3, 3},
+	}
+
+	ns := New(e, Config{
+		Gateways: []string{"GW-1", "GW-2"},
+		Devices:  []DeviceConfig{dev},
+		NetID:    0x13,
+		ADR:      true,
+	})
+
+	uplinks := make(chan Uplink, 10)
+	ns.SetOnUplink(func(uplink Uplink) {
+		uplinks <- uplink
+	})
+
+	if !assert.NoError(t, ns.Start()) {
+		return
+	}
+	defer ns.Stop()
+
+	downlinks := make(chan emu.RxPacket, 10)
+	assert.NoError(t, e.AttachNode("Device", func(node emu.Node, packet emu.RxPacket) {
+		downlinks <- packet
+	}))
+
+	var nwkSKey, appSKey lorawan.AES128Key
+	var devAddr lorawan.DevAddr
+
+	t.Run("Join", func(t *testing.T) {
+		jr := lorawan.JoinRequestPayload{JoinEUI: dev.JoinEUI, DevEUI: dev.DevEUI, DevNonce: 1}
+		assert.NoError(t, e.SendMessage("Device", jr.Marshal(dev.AppKey)))
+
+		packet := expectDownlink(t, downlinks)
+
+		ja, err := lorawan.DecryptJoinAccept(dev.AppKey, packet.Data)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		assert.Equal(t, uint32(0x13), ja.NetID)
+		assert.Equal(t, byte(0x13<<1), ja.DevAddr[0]&0xFE)
+		assert.Equal(t, 868.1, packet.Freq)
+
+		devAddr = ja.DevAddr
+		nwkSKey, appSKey = lorawan.DeriveSessionKeys(dev.AppKey, ja.JoinNonce, ja.NetID, jr.DevNonce)
+
+		s, ok := ns.Session(dev.DevEUI)
+		if assert.True(t, ok) {
+			assert.True(t, s.Joined)
+			assert.Equal(t, devAddr, s.DevAddr)
+			assert.Equal(t, nwkSKey, s.NwkSKey)
+			assert.Equal(t, 5, s.DataRate)
+		}
+	})
+
+	t.Run("JoinDevNonceReused", func(t *testing.T) {
+		jr := lorawan.JoinRequestPayload{JoinEUI: dev.JoinEUI, DevEUI: dev.DevEUI, DevNonce: 1}
+		assert.NoError(t, e.SendMessage("Device", jr.Marshal(dev.AppKey)))
+
+		select {
+		case <-downlinks:
+			assert.Fail(t, "join-accept for reused dev nonce")
+		case <-time.After(time.Second):
+		}
+
+		s, _ := ns.Session(dev.DevEUI)
+		assert.Equal(t, 1, s.Joins)
+	})
+
+	t.Run("ConfirmedUplink", func(t *testing.T) {
+		fPort := uint8(1)
+		phy, err := lorawan.DataFrame{
+			MType:      lorawan.ConfirmedDataUp,
+			DevAddr:    devAddr,
+			FCtrl:      lorawan.FCtrl{ADR: true},
+			FCnt:       0,
+			FPort:      &fPort,
+			FRMPayload: []byte("hello"),
+		}.Marshal(nwkSKey, appSKey)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.NoError(t, e.SendMessage("Device", phy))
+
+		select {
+		case uplink := <-uplinks:
+			assert.Equal(t, []byte("hello"), uplink.Payload)
+			assert.Equal(t, dev.DevEUI, uplink.DevEUI)
+			assert.True(t, uplink.Confirmed)
+			assert.Len(t, uplink.Receptions, 2)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "uplink not received")
+		}
+
+		packet := expectDownlink(t, downlinks)
+		assert.True(t, lorawan.ValidateDataMIC(nwkSKey, packet.Data, 0))
+
+		frame, err := lorawan.ParseDataFrame(packet.Data)
+		if assert.NoError(t, err) {
+			assert.Equal(t, lorawan.UnconfirmedDataDown, frame.MType)
+			assert.True(t, frame.FCtrl.ACK)
+		}
+
+		s, _ := ns.Session(dev.DevEUI)
+		assert.Equal(t, uint32(0), s.FCntUp)
+		assert.Equal(t, uint32(1), s.FCntDown)
+		assert.Equal(t, 1, s.Uplinks)
+		assert.Equal(t, 1, s.Downlinks)
+
+		// replaying the same frame counter is rejected
+		assert.NoError(t, e.SendMessage("Device", phy))
+
+		select {
+		case <-uplinks:
+			assert.Fail(t, "replayed uplink accepted")
+		case <-time.After(time.Second):
+		}
+	})
+
+	t.Run("QueuedDownlink", func(t *testing.T) {
+		assert.NoError(t, ns.EnqueueDownlink(dev.DevEUI, Downlink{FPort: 2, Payload: []byte("config")}))
+		assert.Error(t, ns.EnqueueDownlink(lorawan.EUI64{}, Downlink{FPort: 2}))
+
+		fPort := uint8(1)
+		phy, _ := lorawan.DataFrame{
+			MType:      lorawan.UnconfirmedDataUp,
+			DevAddr:    devAddr,
+			FCnt:       1,
+			FPort:      &fPort,
+			FRMPayload: []byte("status"),
+		}.Marshal(nwkSKey, appSKey)
+
+		assert.NoError(t, e.SendMessage("Device", phy))
+
+		packet := expectDownlink(t, downlinks)
+		frame, err := lorawan.ParseDataFrame(packet.Data)
+		if assert.NoError(t, err) && assert.NotNil(t, frame.FPort) {
+			frame.Decrypt(nwkSKey, appSKey, 1)
+			assert.Equal(t, uint8(2), *frame.FPort)
+			assert.Equal(t, []byte("config"), frame.FRMPayload)
+		}
+	})
+}
+
+func TestADR(t *testing.T) {
+	// SF12 needs -20 dB, with a SNR of 10 dB and a margin of 10 there are 20 dB to spare
+	dr, txPower := ADR(0, 0, 10, 10)
+	assert.Equal(t, 5, dr)
+	assert.Equal(t, 1, txPower)
+
+	// not enough margin keeps the data rate
+	dr, txPower = ADR(0, 0, -12, 10)
+	assert.Equal(t, 0, dr)
+	assert.Equal(t, 0, txPower)
+
+	// negative margin increases the power again
+	dr, txPower = ADR(5, 3, -10, 10)
+	assert.Equal(t, 5, dr)
+	assert.Equal(t, 0, txPower)
+}
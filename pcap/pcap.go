@@ -0,0 +1,161 @@
+// Package pcap writes the air traffic of the emulator as pcap capture with the LoRaTap link-layer header,
+// so that emulated runs can be analysed in Wireshark like real captures.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// LinkTypeLoRaTap is the pcap link-layer type of LoRaTap.
+	LinkTypeLoRaTap = 270
+	// DefaultSyncWord is used if the packet config has no sync word.
+	DefaultSyncWord = 0x12
+	// SnapLen is the maximum length of a record.
+	SnapLen = 65535
+	// HeaderLen is the length of the LoRaTap version 0 header.
+	HeaderLen = 15
+)
+
+// Events are the events that are written to a capture.
+var Events = []emu.Event{emu.EventSending, emu.EventReceived}
+
+// Header represents the LoRaTap header of a packet.
+type Header struct {
+	// Freq in MHz.
+	Freq float64
+	// BandWidth in kHz.
+	BandWidth       float64
+	SpreadingFactor float64
+	RSSI            int
+	SNR             int
+	SyncWord        uint8
+	// Transmission is true for sent packets. They don't have a RSSI and SNR, so these fields are written as 0.
+	Transmission bool
+}
+
+func clamp(val float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, val))
+}
+
+// MarshalBinary encodes the header as LoRaTap version 0.
+func (h Header) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, HeaderLen)
+
+	// version and padding stay 0
+	binary.BigEndian.PutUint16(buf[2:], HeaderLen)
+	binary.BigEndian.PutUint32(buf[4:], uint32(math.Round(h.Freq*1e6)))
+	buf[8] = uint8(clamp(math.Round(h.BandWidth/125), 0, 255))
+	buf[9] = uint8(clamp(h.SpreadingFactor, 0, 255))
+
+	if !h.Transmission {
+		// the rssi is encoded with a offset of -139 dBm and the snr in steps of 0.25 dB
+		rssi := uint8(clamp(float64(h.RSSI+139), 0, 255))
+		buf[10] = rssi
+		buf[11] = rssi
+		buf[12] = rssi
+		buf[13] = byte(int8(clamp(float64(h.SNR*4), math.MinInt8, math.MaxInt8)))
+	}
+
+	buf[14] = h.SyncWord
+
+	return buf, nil
+}
+
+// Writer writes a pcap capture with LoRaTap records. It's safe for concurrent use.
+type Writer struct {
+	sync.Mutex
+
+	w        io.Writer
+	syncWord uint8
+}
+
+// NewWriter writes the pcap file header and returns a writer for the records. If the sync word is 0
+// DefaultSyncWord is used.
+func NewWriter(w io.Writer, syncWord uint8) (*Writer, error) {
+	if syncWord == 0 {
+		syncWord = DefaultSyncWord
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], SnapLen)
+	binary.LittleEndian.PutUint32(header[20:], LinkTypeLoRaTap)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, syncWord: syncWord}, nil
+}
+
+// WritePacket writes a record with the LoRaTap header and payload.
+func (w *Writer) WritePacket(t time.Time, header Header, data []byte) error {
+	lora, err := header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	length := len(lora) + len(data)
+	if length > SnapLen {
+		return errors.New("packet too long")
+	}
+
+	record := make([]byte, 16, 16+length)
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(length))
+	binary.LittleEndian.PutUint32(record[12:], uint32(length))
+	record = append(record, lora...)
+	record = append(record, data...)
+
+	w.Lock()
+	defer w.Unlock()
+
+	_, err = w.w.Write(record)
+	return err
+}
+
+// WriteEvent writes the transmission of a EventSending or the packet of a EventReceived. Other events
+// are ignored. The timestamp is the emulator time of the event.
+func (w *Writer) WriteEvent(msg emu.EventMessage) error {
+	switch msg.Event {
+	case emu.EventSending:
+		data, ok := msg.Data.(emu.Transmission)
+		if !ok {
+			return nil
+		}
+
+		return w.WritePacket(msg.Time, Header{
+			Freq:            data.Freq,
+			BandWidth:       data.BandWidth,
+			SpreadingFactor: data.SpreadingFactor,
+			SyncWord:        w.syncWord,
+			Transmission:    true,
+		}, data.Data)
+	case emu.EventReceived:
+		packet, ok := msg.Packet()
+		if !ok {
+			return nil
+		}
+
+		return w.WritePacket(msg.Time, Header{
+			Freq:            packet.Freq,
+			BandWidth:       packet.BandWidth,
+			SpreadingFactor: packet.SpreadingFactor,
+			RSSI:            packet.RSSI,
+			SNR:             packet.SNR,
+			SyncWord:        w.syncWord,
+		}, packet.Data)
+	}
+
+	return nil
+}
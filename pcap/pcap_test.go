@@ -0,0 +1,91 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type record struct {
+	time   time.Time
+	header []byte
+	data   []byte
+}
+
+func readCapture(t *testing.T, capture []byte) []record {
+	if !assert.GreaterOrEqual(t, len(capture), 24) {
+		return nil
+	}
+
+	assert.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(capture[0:]))
+	assert.Equal(t, uint32(LinkTypeLoRaTap), binary.LittleEndian.Uint32(capture[20:]))
+
+	var records []record
+	for rest := capture[24:]; len(rest) >= 16; {
+		length := int(binary.LittleEndian.Uint32(rest[8:]))
+		sec := int64(binary.LittleEndian.Uint32(rest[0:]))
+		usec := int64(binary.LittleEndian.Uint32(rest[4:]))
+
+		records = append(records, record{
+			time:   time.Unix(sec, usec*1000),
+			header: rest[16 : 16+HeaderLen],
+			data:   rest[16+HeaderLen : 16+length],
+		})
+		rest = rest[16+length:]
+	}
+
+	return records
+}
+
+func TestHeader(t *testing.T) {
+	header, err := Header{Freq: 868.1, BandWidth: 250, SpreadingFactor: 9, RSSI: -100, SNR: -5, SyncWord: 0x34}.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 15, 0x33, 0xbe, 0x27, 0xa0, 2, 9, 39, 39, 39, 0xec, 0x34}, header)
+
+	header, err = Header{Freq: 868, BandWidth: 125, SpreadingFactor: 7, RSSI: -100, Transmission: true}.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0}, header[10:14])
+}
+
+func TestWriter(t *testing.T) {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+	assert.NoError(t, e.AddNode(emu.Node{ID: "1", Online: true, X: 1, Y: 1, TXGain: 14, RXSens: -137}))
+	assert.NoError(t, e.AddNode(emu.Node{ID: "2", Online: true, X: 1.5, Y: 1, TXGain: 14, RXSens: -137}))
+
+	buf := &bytes.Buffer{}
+	writer, err := NewWriter(buf, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	e.SubscribeFunc(func(msg emu.EventMessage) {
+		assert.NoError(t, writer.WriteEvent(msg))
+	}, Events...)
+
+	assert.NoError(t, e.SendMessage("1", []byte("hello")))
+	e.Wait()
+
+	records := readCapture(t, buf.Bytes())
+	if !assert.Len(t, records, 2) {
+		return
+	}
+
+	// transmission
+	assert.Equal(t, []byte("hello"), records[0].data)
+	assert.Equal(t, uint32(868000000), binary.BigEndian.Uint32(records[0].header[4:]))
+	assert.Equal(t, []byte{1, 7, 0, 0, 0, 0, DefaultSyncWord}, records[0].header[8:])
+
+	// reception
+	assert.Equal(t, []byte("hello"), records[1].data)
+	assert.NotZero(t, records[1].header[10])
+	assert.False(t, records[1].time.Before(records[0].time))
+
+	// the timestamps are in emulator time, which runs faster than the wall clock
+	assert.InDelta(t, e.Now().UnixMilli(), records[1].time.UnixMilli(), 1000)
+}
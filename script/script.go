@@ -0,0 +1,411 @@
+// Package script runs virtual nodes whose logic is written in JavaScript. The scripts are executed by an
+// embedded pure Go engine inside the emulator process and have no access to the file system or network.
+//
+// A script can define the functions onStart() and onReceive(packet) and use the following globals:
+//
+//   - node: the current state of the node (id, x, y, z, online, txGain, freq, spreadingFactor, tags, meta)
+//   - send(data): transmits a string, array of bytes, Uint8Array or ArrayBuffer
+//   - setTimeout(fn, ms), setInterval(fn, ms), clearTimeout(id), clearInterval(id): timers in emulator time
+//   - now(): current emulator time as unix timestamp in ms
+//   - move(x, y, z): changes the position of the node
+//   - setMeta(key, value): changes a meta value of the node
+//   - log(...args) and console.log(...args): writes to the log
+package script
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/go-logr/logr"
+)
+
+// DefaultTimeout is the maximum time a single callback of a script can run before it is interrupted.
+const DefaultTimeout = time.Second
+
+// timer represents a pending setTimeout or setInterval of a script.
+type timer struct {
+	fn       goja.Callable
+	interval time.Duration
+}
+
+// Script represents a node that is driven by a JavaScript file.
+type Script struct {
+	sync.Mutex
+
+	emu     *emu.Emulator
+	id      string
+	name    string
+	program *goja.Program
+	timeout time.Duration
+	logger  logr.Logger
+	radio   *emu.Radio
+
+	// only accessed inside the callbacks of the behavior, which are never called concurrently
+	vm      *goja.Runtime
+	timers  map[int]timer
+	timerID int
+}
+
+// New compiles the source of a script for the node with the given id. The name is used in error messages.
+func New(emulator *emu.Emulator, id string, name string, source string) (*Script, error) {
+	if len(id) == 0 {
+		return nil, errors.New("node missing")
+	}
+
+	program, err := goja.Compile(name, source, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Script{
+		emu:     emulator,
+		id:      id,
+		name:    name,
+		program: program,
+		timeout: DefaultTimeout,
+		logger:  logr.Discard(),
+		timers:  map[int]timer{},
+	}, nil
+}
+
+// Load reads and compiles a script file for the node with the given id.
+func Load(emulator *emu.Emulator, id string, path string) (*Script, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(emulator, id, path, string(source))
+}
+
+// SetLogger sets the logger that is also used by log() in the script.
+func (s *Script) SetLogger(logger logr.Logger) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.logger = logger
+}
+
+// SetTimeout sets the maximum time a single callback of the script can run.
+func (s *Script) SetTimeout(timeout time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.timeout = timeout
+}
+
+// Start runs the script and attaches it to its node.
+func (s *Script) Start() error {
+	radio, err := s.emu.StartBehavior(s.id, s)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.radio = radio
+	s.Unlock()
+
+	return nil
+}
+
+// Stop detaches the script from its node. Pending timers are dropped.
+func (s *Script) Stop() {
+	s.Lock()
+	radio := s.radio
+	s.radio = nil
+	s.Unlock()
+
+	if radio != nil {
+		radio.Stop()
+	}
+}
+
+func (s *Script) getLogger() logr.Logger {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.logger
+}
+
+// run executes fn with the timeout and reports errors of the script.
+func (s *Script) run(callback string, fn func() error) {
+	s.Lock()
+	timeout := s.timeout
+	s.Unlock()
+
+	interrupt := time.AfterFunc(timeout, func() {
+		s.vm.Interrupt(fmt.Sprintf("callback exceeded the timeout of %s", timeout))
+	})
+
+	err := fn()
+
+	interrupt.Stop()
+	s.vm.ClearInterrupt()
+
+	if err == nil {
+		return
+	}
+
+	s.getLogger().Error(err, "script error", "id", s.id, "script", s.name, "callback", callback)
+
+	_ = s.emu.EmitEvent(emu.EventScriptError, s.id, emu.ScriptError{
+		Script:   s.name,
+		Callback: callback,
+		Error:    err.Error(),
+	})
+}
+
+// call calls a global function of the script if it is defined.
+func (s *Script) call(name string, args ...goja.Value) error {
+	fn, ok := goja.AssertFunction(s.vm.Get(name))
+	if !ok {
+		return nil
+	}
+
+	_, err := fn(goja.Undefined(), args...)
+	return err
+}
+
+// updateNode exposes the current state of the node to the script.
+func (s *Script) updateNode(radio *emu.Radio) {
+	node := radio.Node()
+
+	meta := map[string]interface{}{}
+	for k, v := range node.Meta {
+		meta[k] = v
+	}
+
+	tags := make([]interface{}, len(node.Tags))
+	for i := range node.Tags {
+		tags[i] = node.Tags[i]
+	}
+
+	_ = s.vm.Set("node", map[string]interface{}{
+		"id":              node.ID,
+		"x":               node.X,
+		"y":               node.Y,
+		"z":               node.Z,
+		"online":          node.Online,
+		"txGain":          node.TXGain,
+		"rxSens":          node.RXSens,
+		"freq":            node.Freq,
+		"spreadingFactor": node.SpreadingFactor,
+		"tags":            tags,
+		"meta":            meta,
+	})
+}
+
+// toBytes converts a JavaScript value to bytes.
+func (s *Script) toBytes(value goja.Value) ([]byte, error) {
+	switch exported := value.Export().(type) {
+	case string:
+		return []byte(exported), nil
+	case []byte:
+		return exported, nil
+	case goja.ArrayBuffer:
+		return exported.Bytes(), nil
+	}
+
+	var data []byte
+	if err := s.vm.ExportTo(value, &data); err != nil {
+		return nil, fmt.Errorf("can't convert %s to bytes", value.String())
+	}
+
+	return data, nil
+}
+
+func (s *Script) throw(err error) {
+	panic(s.vm.NewGoError(err))
+}
+
+func (s *Script) setTimer(radio *emu.Radio, call goja.FunctionCall, repeat bool) goja.Value {
+	fn, ok := goja.AssertFunction(call.Argument(0))
+	if !ok {
+		s.throw(errors.New("first argument is not a function"))
+	}
+
+	delay := time.Duration(call.Argument(1).ToFloat() * float64(time.Millisecond))
+	if delay < 0 {
+		delay = 0
+	}
+
+	t := timer{fn: fn}
+	if repeat {
+		// an interval of 0 would starve the emulator
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		t.interval = delay
+	}
+
+	s.timerID++
+	s.timers[s.timerID] = t
+	radio.SetTimer(strconv.Itoa(s.timerID), delay)
+
+	return s.vm.ToValue(s.timerID)
+}
+
+func (s *Script) clearTimer(radio *emu.Radio, call goja.FunctionCall) goja.Value {
+	id := int(call.Argument(0).ToInteger())
+
+	delete(s.timers, id)
+	radio.CancelTimer(strconv.Itoa(id))
+
+	return goja.Undefined()
+}
+
+func (s *Script) log(call goja.FunctionCall) goja.Value {
+	args := make([]string, len(call.Arguments))
+	for i := range call.Arguments {
+		args[i] = call.Arguments[i].String()
+	}
+
+	s.getLogger().Info("script log", "id", s.id, "message", strings.Join(args, " "))
+
+	return goja.Undefined()
+}
+
+// setup creates the runtime and registers the globals of the script.
+func (s *Script) setup(radio *emu.Radio) error {
+	s.vm = goja.New()
+
+	clearTimer := func(call goja.FunctionCall) goja.Value {
+		return s.clearTimer(radio, call)
+	}
+
+	globals := map[string]interface{}{
+		"send": func(call goja.FunctionCall) goja.Value {
+			data, err := s.toBytes(call.Argument(0))
+			if err != nil {
+				s.throw(err)
+			}
+
+			if err := radio.Send(data); err != nil {
+				s.throw(err)
+			}
+
+			return goja.Undefined()
+		},
+		"setTimeout": func(call goja.FunctionCall) goja.Value {
+			return s.setTimer(radio, call, false)
+		},
+		"setInterval": func(call goja.FunctionCall) goja.Value {
+			return s.setTimer(radio, call, true)
+		},
+		"clearTimeout":  clearTimer,
+		"clearInterval": clearTimer,
+		"now": func(call goja.FunctionCall) goja.Value {
+			return s.vm.ToValue(radio.Now().UnixMilli())
+		},
+		"move": func(x float64, y float64, z float64) {
+			if err := radio.Configure(func(node *emu.Node) error {
+				node.X = x
+				node.Y = y
+				node.Z = z
+				return nil
+			}); err != nil {
+				s.throw(err)
+			}
+		},
+		"setMeta": func(key string, value interface{}) {
+			if err := radio.Configure(func(node *emu.Node) error {
+				if node.Meta == nil {
+					node.Meta = map[string]interface{}{}
+				}
+				node.Meta[key] = value
+				return nil
+			}); err != nil {
+				s.throw(err)
+			}
+		},
+		"log": s.log,
+	}
+
+	for name, value := range globals {
+		if err := s.vm.Set(name, value); err != nil {
+			return err
+		}
+	}
+
+	console := s.vm.NewObject()
+	if err := console.Set("log", s.log); err != nil {
+		return err
+	}
+
+	return s.vm.Set("console", console)
+}
+
+// OnStart implements emu.NodeBehavior.
+func (s *Script) OnStart(radio *emu.Radio) {
+	if err := s.setup(radio); err != nil {
+		s.getLogger().Error(err, "can't setup script", "id", s.id)
+		return
+	}
+
+	s.updateNode(radio)
+	s.run("main", func() error {
+		_, err := s.vm.RunProgram(s.program)
+		return err
+	})
+
+	s.updateNode(radio)
+	s.run("onStart", func() error {
+		return s.call("onStart")
+	})
+}
+
+// OnReceive implements emu.NodeBehavior.
+func (s *Script) OnReceive(radio *emu.Radio, packet emu.RxPacket) {
+	data := make([]interface{}, len(packet.Data))
+	for i := range packet.Data {
+		data[i] = packet.Data[i]
+	}
+
+	s.updateNode(radio)
+	s.run("onReceive", func() error {
+		return s.call("onReceive", s.vm.ToValue(map[string]interface{}{
+			"data":            s.vm.NewArray(data...),
+			"text":            string(packet.Data),
+			"rssi":            packet.RSSI,
+			"snr":             packet.SNR,
+			"freq":            packet.Freq,
+			"spreadingFactor": packet.SpreadingFactor,
+			"bandWidth":       packet.BandWidth,
+			"airtime":         packet.Airtime,
+			"recvTime":        packet.RecvTimeMicro / 1000,
+			"crcFailed":       packet.CRCFailed,
+		}))
+	})
+}
+
+// OnTimer implements emu.NodeBehavior.
+func (s *Script) OnTimer(radio *emu.Radio, name string) {
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return
+	}
+
+	t, ok := s.timers[id]
+	if !ok {
+		return
+	}
+
+	if t.interval > 0 {
+		radio.SetTimer(name, t.interval)
+	} else {
+		delete(s.timers, id)
+	}
+
+	s.updateNode(radio)
+	s.run("timer", func() error {
+		_, err := t.fn(goja.Undefined())
+		return err
+	})
+}
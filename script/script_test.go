@@ -0,0 +1,159 @@
+package script
+
+import (
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEmu(t *testing.T, ids ...string) *emu.Emulator {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(100))
+
+	for i, id := range ids {
+		assert.NoError(t, e.AddNode(emu.Node{ID: id, Online: true, X: 1 + float64(i)*0.2, Y: 1, TXGain: 14, RXSens: -137}))
+	}
+
+	return e
+}
+
+// collectErrors records the script errors that are emitted as events.
+func collectErrors(e *emu.Emulator) func() []string {
+	var mutex sync.Mutex
+	var errors []string
+
+	e.SubscribeFunc(func(msg emu.EventMessage) {
+		mutex.Lock()
+		errors = append(errors, msg.Data.(emu.ScriptError).Error)
+		mutex.Unlock()
+	}, emu.EventScriptError)
+
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return append([]string{}, errors...)
+	}
+}
+
+func TestScript_PingPong(t *testing.T) {
+	e := newTestEmu(t, "Node1", "Node2")
+	errors := collectErrors(e)
+
+	pinger, err := New(e, "Node1", "ping.js", `
+		function onStart() {
+			setMeta("started", node.id);
+			setTimeout(function() { send("ping"); }, 1000);
+		}
+
+		function onReceive(packet) {
+			setMeta("answer", packet.text);
+			move(node.x, node.y + 1, 0);
+		}
+	`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ponger, err := New(e, "Node2", "pong.js", `
+		function onReceive(packet) {
+			if (packet.text === "ping" && packet.rssi < 0) {
+				send([0x70, 0x6f, 0x6e, 0x67]);
+			}
+		}
+	`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, ponger.Start())
+	assert.NoError(t, pinger.Start())
+	assert.Error(t, pinger.Start(), "node already has a script")
+
+	e.Wait()
+
+	node := e.GetNode("Node1")
+	assert.Equal(t, "Node1", node.Meta["started"])
+	assert.Equal(t, "pong", node.Meta["answer"])
+	assert.Equal(t, 2.0, node.Y)
+	assert.Empty(t, errors())
+
+	pinger.Stop()
+	ponger.Stop()
+}
+
+func TestScript_Timers(t *testing.T) {
+	e := newTestEmu(t, "Node1", "Node2")
+	errors := collectErrors(e)
+
+	received := make(chan []byte, 10)
+	assert.NoError(t, e.AttachNode("Node2", func(node emu.Node, packet emu.RxPacket) {
+		received <- packet.Data
+	}))
+
+	s, err := New(e, "Node1", "timers.js", `
+		var count = 0;
+		var start = now();
+		var canceled = setTimeout(function() { send("canceled"); }, 500);
+		clearTimeout(canceled);
+
+		var interval = setInterval(function() {
+			count++;
+			send(new Uint8Array([count]));
+			if (count === 3) {
+				clearInterval(interval);
+				log("done after", now() - start, "ms");
+			}
+		}, 2000);
+	`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, s.Start())
+	e.Wait()
+	s.Stop()
+
+	close(received)
+
+	var packets [][]byte
+	for data := range received {
+		packets = append(packets, data)
+	}
+
+	assert.Equal(t, [][]byte{{1}, {2}, {3}}, packets)
+	assert.Empty(t, errors())
+}
+
+func TestScript_Errors(t *testing.T) {
+	e := newTestEmu(t, "Node1")
+	errors := collectErrors(e)
+
+	_, err := New(e, "Node1", "syntax.js", "function {")
+	assert.Error(t, err)
+
+	s, err := New(e, "Node1", "errors.js", `
+		function onStart() {
+			setTimeout(function() { while (true) {} }, 0);
+			throw new Error("start failed");
+		}
+	`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s.SetTimeout(time.Millisecond * 50)
+	assert.NoError(t, s.Start())
+	e.Wait()
+	s.Stop()
+
+	if assert.Len(t, errors(), 2) {
+		assert.True(t, strings.Contains(errors()[0], "start failed"))
+		assert.True(t, strings.Contains(errors()[1], "timeout"))
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"image"
+	"image/color"
+	"math"
+)
+
+// MaxCoverageResolution is the maximum width and height of a coverage heatmap.
+const MaxCoverageResolution = 2048
+
+// CoverageScales are the colour scales of the coverage heatmap from the lowest to the highest gain.
+var CoverageScales = map[string][]color.NRGBA{
+	"viridis": {{0x44, 0x01, 0x54, 0xff}, {0x3b, 0x52, 0x8b, 0xff}, {0x21, 0x91, 0x8c, 0xff}, {0x5e, 0xc9, 0x62, 0xff}, {0xfd, 0xe7, 0x25, 0xff}},
+	"jet":     {{0x00, 0x00, 0x7f, 0xff}, {0x00, 0x00, 0xff, 0xff}, {0x00, 0xff, 0xff, 0xff}, {0xff, 0xff, 0x00, 0xff}, {0xff, 0x00, 0x00, 0xff}, {0x7f, 0x00, 0x00, 0xff}},
+	"heat":    {{0xff, 0xff, 0xb2, 0xff}, {0xfe, 0xcc, 0x5c, 0xff}, {0xfd, 0x8d, 0x3c, 0xff}, {0xf0, 0x3b, 0x20, 0xff}, {0xbd, 0x00, 0x26, 0xff}},
+	"gray":    {{0x00, 0x00, 0x00, 0xff}, {0xff, 0xff, 0xff, 0xff}},
+}
+
+// CoverageOptions represents the settings of a coverage heatmap.
+type CoverageOptions struct {
+	// Nodes whose coverage is shown. If empty all gateways are used.
+	Nodes []string `json:"nodes"`
+	// Resolution is the width and height of the heatmap in pixels. Defaults to 256.
+	Resolution int `json:"resolution"`
+	// Z is the height of the receiver in km.
+	Z float64 `json:"z"`
+	// Min and Max are the gains in dBm at the ends of the colour scale. Areas below Min are transparent.
+	// They default to -140 and -60 if both are zero.
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	// Scale is the name of the colour scale in CoverageScales. Defaults to "viridis".
+	Scale string `json:"scale"`
+	// Opacity of the heatmap between 0 and 1. Defaults to 0.6.
+	Opacity float64 `json:"opacity"`
+}
+
+// Coverage renders a heatmap of the best gain of the nodes over the area of the web view. The image covers
+// kmRange with the origin in the top left corner, like the background image.
+func (s *Server) Coverage(options CoverageOptions) (*image.NRGBA, error) {
+	if options.Resolution == 0 {
+		options.Resolution = 256
+	}
+
+	if options.Resolution < 0 || options.Resolution > MaxCoverageResolution {
+		return nil, fmt.Errorf("resolution needs to be between 1 and %d", MaxCoverageResolution)
+	}
+
+	if options.Min == 0 && options.Max == 0 {
+		options.Min = -140
+		options.Max = -60
+	}
+
+	if options.Min >= options.Max {
+		return nil, errors.New("min needs to be lower than max")
+	}
+
+	if len(options.Scale) == 0 {
+		options.Scale = "viridis"
+	}
+
+	scale, ok := CoverageScales[options.Scale]
+	if !ok {
+		return nil, fmt.Errorf("unknown scale '%s'", options.Scale)
+	}
+
+	if options.Opacity == 0 {
+		options.Opacity = 0.6
+	}
+
+	if options.Opacity < 0 || options.Opacity > 1 {
+		return nil, errors.New("opacity needs to be between 0 and 1")
+	}
+
+	var nodes []emu.Node
+	if len(options.Nodes) == 0 {
+		for _, node := range s.emu.Nodes() {
+			if node.IsGateway() {
+				nodes = append(nodes, node)
+			}
+		}
+
+		if len(nodes) == 0 {
+			return nil, errors.New("no gateways")
+		}
+	} else {
+		for _, id := range options.Nodes {
+			if !s.emu.HasNode(id) {
+				return nil, fmt.Errorf("node '%s' not found", id)
+			}
+			nodes = append(nodes, s.emu.GetNode(id))
+		}
+	}
+
+	s.RLock()
+	originX, originY := s.originX, s.originY
+	s.RUnlock()
+
+	kmRange := s.emu.GetKMRange()
+	cell := kmRange / float64(options.Resolution)
+
+	img := image.NewNRGBA(image.Rect(0, 0, options.Resolution, options.Resolution))
+	for py := 0; py < options.Resolution; py++ {
+		for px := 0; px < options.Resolution; px++ {
+			receiver := emu.Node{
+				X: (float64(px)+0.5)*cell - originX,
+				Y: (float64(py)+0.5)*cell - originY,
+				Z: options.Z,
+			}
+
+			gain := math.Inf(-1)
+			for i := range nodes {
+				gain = math.Max(gain, s.emu.ReachedGain(nodes[i], receiver))
+			}
+
+			if gain < options.Min {
+				continue
+			}
+
+			c := scaleColor(scale, (gain-options.Min)/(options.Max-options.Min))
+			c.A = uint8(float64(c.A) * options.Opacity)
+			img.SetNRGBA(px, py, c)
+		}
+	}
+
+	return img, nil
+}
+
+// scaleColor interpolates the colour at the position between 0 and 1 of the scale.
+func scaleColor(scale []color.NRGBA, pos float64) color.NRGBA {
+	pos = math.Max(0, math.Min(1, pos)) * float64(len(scale)-1)
+
+	i := int(pos)
+	if i >= len(scale)-1 {
+		return scale[len(scale)-1]
+	}
+
+	t := pos - float64(i)
+	lerp := func(a uint8, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t))
+	}
+
+	a, b := scale[i], scale[i+1]
+	return color.NRGBA{R: lerp(a.R, b.R), G: lerp(a.G, b.G), B: lerp(a.B, b.B), A: lerp(a.A, b.A)}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoverage(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.AddNode(emu.Node{ID: "Node1", Online: true, X: 0, Y: 0, TXGain: 14}))
+
+	s := New(testEmu)
+	s.SetOrigin(5, 5)
+
+	_, err := s.Coverage(CoverageOptions{})
+	assert.Error(t, err, "no gateways")
+
+	_, err = s.Coverage(CoverageOptions{Nodes: []string{"Missing"}})
+	assert.Error(t, err)
+
+	_, err = s.Coverage(CoverageOptions{Nodes: []string{"Node1"}, Scale: "rainbow"})
+	assert.Error(t, err)
+
+	_, err = s.Coverage(CoverageOptions{Nodes: []string{"Node1"}, Min: -60, Max: -100})
+	assert.Error(t, err)
+
+	// the node is in the center of the 10km range, only the area around it is above -140 dBm
+	img, err := s.Coverage(CoverageOptions{Nodes: []string{"Node1"}, Resolution: 20, Min: -140, Max: -130, Opacity: 1})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 20, img.Bounds().Dx())
+		assert.Equal(t, color.NRGBA{0xfd, 0xe7, 0x25, 0xff}, img.NRGBAAt(10, 10))
+		assert.Equal(t, uint8(0), img.NRGBAAt(0, 0).A)
+	}
+
+	assert.NoError(t, testEmu.UpdateNode("Node1", func(node *emu.Node) error {
+		node.Kind = emu.NodeKindGateway
+		return nil
+	}))
+
+	rec := httptest.NewRecorder()
+	if assert.NoError(t, s.routeGetCoverage(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/coverage?resolution=32&scale=gray&opacity=0.5", nil), rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+
+		decoded, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if assert.NoError(t, err) {
+			assert.Equal(t, 32, decoded.Bounds().Dx())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	if assert.NoError(t, s.routeGetCoverage(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/coverage?resolution=100000", nil), rec))) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"net"
+	"sync"
+	"time"
+)
+
+// Special bytes of the KISS framing.
+const (
+	kissFEND  = 0xC0
+	kissFESC  = 0xDB
+	kissTFEND = 0xDC
+	kissTFESC = 0xDD
+
+	kissCmdData   = 0x00
+	kissCmdReturn = 0xFF
+)
+
+// kissEncode wraps the data in a KISS data frame for port 0.
+func kissEncode(data []byte) []byte {
+	frame := make([]byte, 0, len(data)+3)
+	frame = append(frame, kissFEND, kissCmdData)
+
+	for _, b := range data {
+		switch b {
+		case kissFEND:
+			frame = append(frame, kissFESC, kissTFEND)
+		case kissFESC:
+			frame = append(frame, kissFESC, kissTFESC)
+		default:
+			frame = append(frame, b)
+		}
+	}
+
+	return append(frame, kissFEND)
+}
+
+// kissDecoder splits a byte stream into KISS frames. Frames that grow larger than MaxFrameSize are discarded
+// up to the next FEND.
+type kissDecoder struct {
+	frame     []byte
+	escaped   bool
+	discarded bool
+}
+
+// decode consumes the bytes and returns all completed frames including their command byte.
+func (d *kissDecoder) decode(data []byte) [][]byte {
+	var frames [][]byte
+
+	for _, b := range data {
+		switch {
+		case b == kissFEND:
+			if len(d.frame) > 0 && !d.discarded {
+				frames = append(frames, d.frame)
+			}
+			d.frame = nil
+			d.escaped = false
+			d.discarded = false
+		case d.discarded:
+			continue
+		case len(d.frame) >= MaxFrameSize:
+			d.frame = nil
+			d.escaped = false
+			d.discarded = true
+		case b == kissFESC:
+			d.escaped = true
+		case d.escaped:
+			switch b {
+			case kissTFEND:
+				d.frame = append(d.frame, kissFEND)
+			case kissTFESC:
+				d.frame = append(d.frame, kissFESC)
+			}
+			d.escaped = false
+		default:
+			d.frame = append(d.frame, b)
+		}
+	}
+
+	return frames
+}
+
+// kissSession is a node connected via its KISS TCP interface.
+type kissSession struct {
+	sync.Mutex
+
+	conn net.Conn
+}
+
+func (k *kissSession) Transport() string {
+	return "kiss"
+}
+
+func (k *kissSession) Deliver(packet emu.RxPacket) error {
+	k.Lock()
+	defer k.Unlock()
+
+	if err := k.conn.SetWriteDeadline(time.Now().Add(SessionWriteTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := k.conn.Write(kissEncode(packet.Data)); err != nil {
+		// the read loop of the session ends with the closed connection and unregisters it
+		_ = k.conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (k *kissSession) Close() error {
+	return k.conn.Close()
+}
+
+// ListenKISS starts a TCP listener for a node that speaks KISS framing. Data frames are transmitted
+// by the node and received packets are sent back as data frames.
+func (s *Server) ListenKISS(id string, bind string) (net.Addr, error) {
+	if !s.emu.HasNode(id) {
+		return nil, ErrNodeNotFound
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.kissListeners[id]; ok {
+		return nil, errors.New("already listening")
+	}
+
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	s.kissListeners[id] = listener
+
+	go s.acceptKISS(id, listener)
+
+	s.logger.Info("kiss interface listening", "id", id, "addr", listener.Addr().String())
+
+	return listener.Addr(), nil
+}
+
+func (s *Server) acceptKISS(id string, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		// check if the node already is connected to, if so close the new connection
+		session := &kissSession{conn: conn}
+		if err := s.registerSession(id, session); err != nil {
+			_ = conn.Close()
+			continue
+		}
+
+		go s.handleKISSConn(id, session)
+	}
+}
+
+func (s *Server) handleKISSConn(id string, session *kissSession) {
+	defer func() {
+		s.unregisterSession(id, session)
+		_ = session.Close()
+	}()
+
+	var decoder kissDecoder
+	buf := make([]byte, 1024)
+
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, frame := range decoder.decode(buf[:n]) {
+			// only data frames are transmitted, radio parameters like TXDELAY are ignored
+			if frame[0] == kissCmdReturn || frame[0]&0x0F != kissCmdData || len(frame) < 2 {
+				continue
+			}
+
+			if err := s.emu.SendMessage(id, frame[1:]); err != nil {
+				s.logger.Error(err, "node couldn't send kiss frame", "id", id)
+			}
+		}
+	}
+}
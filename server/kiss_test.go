@@ -0,0 +1,137 @@
+package server
+
+import (
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKISSFraming(t *testing.T) {
+	data := []byte{0x01, kissFEND, 0x02, kissFESC, 0x03}
+	frame := kissEncode(data)
+
+	assert.Equal(t, []byte{kissFEND, kissCmdData, 0x01, kissFESC, kissTFEND, 0x02, kissFESC, kissTFESC, 0x03, kissFEND}, frame)
+
+	// frames can be split over multiple reads
+	var decoder kissDecoder
+	assert.Len(t, decoder.decode(frame[:4]), 0)
+
+	frames := decoder.decode(append(frame[4:], kissEncode([]byte{0x04})...))
+	if assert.Len(t, frames, 2) {
+		assert.Equal(t, append([]byte{kissCmdData}, data...), frames[0])
+		assert.Equal(t, []byte{kissCmdData, 0x04}, frames[1])
+	}
+
+	// frames without a FEND are discarded once they exceed the maximum size
+	frames = decoder.decode(append([]byte{kissFEND}, make([]byte, MaxFrameSize+10)...))
+	assert.Len(t, frames, 0)
+	assert.LessOrEqual(t, len(decoder.frame), MaxFrameSize)
+
+	frames = decoder.decode(append([]byte{0x01, kissFEND}, kissEncode([]byte{0x05})...))
+	if assert.Len(t, frames, 1) {
+		assert.Equal(t, []byte{kissCmdData, 0x05}, frames[0])
+	}
+}
+
+func TestKISS(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+
+	for i, id := range []string{"Node1", "Node2"} {
+		assert.NoError(t, testEmu.AddNode(emu.Node{
+			ID:     id,
+			Online: true,
+			X:      1 + float64(i)*0.5,
+			Y:      1,
+			TXGain: 14,
+			RXSens: -137,
+		}))
+	}
+
+	s := New(testEmu)
+	s.subscribe()
+
+	_, err := s.ListenKISS("Missing", "127.0.0.1:0")
+	assert.Error(t, err)
+
+	addr, err := s.ListenKISS("Node1", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.closeListeners()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// the second connection for the same node is closed
+	second, err := net.Dial("tcp", addr.String())
+	if assert.NoError(t, err) {
+		_ = second.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = second.Read(make([]byte, 1))
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, 1, s.ConnectedNodes())
+
+	received := make(chan emu.RxPacket, 10)
+	assert.NoError(t, testEmu.AttachNode("Node2", func(node emu.Node, packet emu.RxPacket) {
+		received <- packet
+	}))
+
+	t.Run("Transmit", func(t *testing.T) {
+		_, err := conn.Write(kissEncode([]byte{0xc0, 0xff, 0xee}))
+		assert.NoError(t, err)
+
+		select {
+		case packet := <-received:
+			assert.Equal(t, []byte{0xc0, 0xff, 0xee}, packet.Data)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "packet not received")
+		}
+	})
+
+	t.Run("Receive", func(t *testing.T) {
+		assert.NoError(t, testEmu.SendMessage("Node2", []byte("hello")))
+
+		var decoder kissDecoder
+		buf := make([]byte, 1024)
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		for {
+			n, err := conn.Read(buf)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			if frames := decoder.decode(buf[:n]); len(frames) > 0 {
+				assert.Equal(t, append([]byte{kissCmdData}, []byte("hello")...), frames[0])
+				return
+			}
+		}
+	})
+}
+
+func TestKISS_WriteTimeout(t *testing.T) {
+	timeout := SessionWriteTimeout
+	SessionWriteTimeout = time.Millisecond * 50
+	defer func() { SessionWriteTimeout = timeout }()
+
+	// the other side of the pipe never reads
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	session := &kissSession{conn: conn}
+	assert.Error(t, session.Deliver(emu.RxPacket{Data: []byte("hello")}))
+
+	// the session is closed, so the read loop ends
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"github.com/BigJk/loraemu/emu"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// utilisationWindowMs is the emulator time over which the channel utilisation is calculated.
+const utilisationWindowMs = 60 * 1000
+
+// transmission represents the on-air time of a packet on a channel.
+type transmission struct {
+	start int64
+	stop  int64
+}
+
+// metrics collects the Prometheus metrics of the emulator and server.
+type metrics struct {
+	sync.Mutex
+
+	server   *Server
+	registry *prometheus.Registry
+
+	sent           *prometheus.CounterVec
+	received       *prometheus.CounterVec
+	collisions     *prometheus.CounterVec
+	airtime        *prometheus.HistogramVec
+	channelAirtime *prometheus.CounterVec
+
+	belowSensitivity *prometheus.Desc
+	utilisation      *prometheus.Desc
+	inFlight         *prometheus.Desc
+	receiving        *prometheus.Desc
+	sessions         *prometheus.Desc
+	frontendSessions *prometheus.Desc
+	tickLag          *prometheus.Desc
+
+	// recent transmissions per channel for the utilisation
+	channels map[string][]transmission
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		server:   s,
+		registry: prometheus.NewRegistry(),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loraemu_node_sent_total",
+			Help: "Number of packets a node started to send.",
+		}, []string{"node"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loraemu_node_received_total",
+			Help: "Number of packets a node received.",
+		}, []string{"node"}),
+		collisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loraemu_node_collisions_total",
+			Help: "Number of packets a node lost because of collisions.",
+		}, []string{"node"}),
+		airtime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "loraemu_airtime_seconds",
+			Help:    "Airtime of the sent packets in seconds of emulator time.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"spreading_factor"}),
+		channelAirtime: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loraemu_channel_airtime_seconds_total",
+			Help: "Airtime of all packets sent on a channel in seconds of emulator time.",
+		}, []string{"freq"}),
+		belowSensitivity: prometheus.NewDesc(
+			"loraemu_node_below_sensitivity_total",
+			"Number of packets on the channel of a node that arrived below its sensitivity.",
+			[]string{"node"}, nil,
+		),
+		utilisation: prometheus.NewDesc(
+			"loraemu_channel_utilisation_ratio",
+			"Share of the last minute of emulator time a channel was used. Overlapping packets add up.",
+			[]string{"freq"}, nil,
+		),
+		inFlight: prometheus.NewDesc(
+			"loraemu_packets_in_flight",
+			"Number of packets that are on air at the moment.",
+			nil, nil,
+		),
+		receiving: prometheus.NewDesc(
+			"loraemu_receptions_in_progress",
+			"Number of packets that are arriving at nodes at the moment.",
+			nil, nil,
+		),
+		sessions: prometheus.NewDesc(
+			"loraemu_node_sessions",
+			"Number of connected nodes by transport.",
+			[]string{"transport"}, nil,
+		),
+		frontendSessions: prometheus.NewDesc(
+			"loraemu_frontend_sessions",
+			"Number of connected frontend websocket sessions.",
+			nil, nil,
+		),
+		tickLag: prometheus.NewDesc(
+			"loraemu_mobility_tick_lag_seconds",
+			"How late the last mobility tick was handled in wall time.",
+			nil, nil,
+		),
+		channels: map[string][]transmission{},
+	}
+
+	m.registry.MustRegister(
+		m.sent, m.received, m.collisions, m.airtime, m.channelAirtime, m,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// observe counts the events. It's subscribed synchronously, so the counters are exact. The transmissions
+// that left the utilisation window are forgotten here as well, so they don't pile up without scrapes.
+func (m *metrics) observe(msg emu.EventMessage) {
+	switch msg.Event {
+	case emu.EventSending:
+		m.sent.WithLabelValues(msg.Node.ID).Inc()
+
+		data, ok := msg.Data.(emu.Transmission)
+		if !ok {
+			return
+		}
+
+		channel := strconv.FormatFloat(data.Freq, 'f', -1, 64)
+		m.airtime.WithLabelValues(strconv.FormatFloat(data.SpreadingFactor, 'f', -1, 64)).Observe(data.Airtime / 1000)
+		m.channelAirtime.WithLabelValues(channel).Add(data.Airtime / 1000)
+
+		m.Lock()
+		recent := recentTransmissions(m.channels[channel], data.Start-utilisationWindowMs)
+		m.channels[channel] = append(recent, transmission{start: data.Start, stop: data.Stop})
+		m.Unlock()
+	case emu.EventReceived:
+		m.received.WithLabelValues(msg.Node.ID).Inc()
+	case emu.EventCollision:
+		m.collisions.WithLabelValues(msg.Node.ID).Inc()
+	}
+}
+
+// channelUtilisation returns the utilisation of the channels in the window before now and forgets
+// the transmissions that are outside the window.
+func (m *metrics) channelUtilisation(now int64) map[string]float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	from := now - utilisationWindowMs
+
+	utilisation := map[string]float64{}
+	for channel, transmissions := range m.channels {
+		used := int64(0)
+		recent := recentTransmissions(transmissions, from)
+		for _, t := range recent {
+			start, stop := t.start, t.stop
+			if start < from {
+				start = from
+			}
+			if stop > now {
+				stop = now
+			}
+			if stop > start {
+				used += stop - start
+			}
+		}
+
+		m.channels[channel] = recent
+		utilisation[channel] = float64(used) / utilisationWindowMs
+	}
+
+	return utilisation
+}
+
+// recentTransmissions removes the transmissions that ended before from in place.
+func recentTransmissions(transmissions []transmission, from int64) []transmission {
+	recent := transmissions[:0]
+	for _, t := range transmissions {
+		if t.stop >= from {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// Describe implements prometheus.Collector for the metrics that are read on scrape.
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.belowSensitivity
+	ch <- m.utilisation
+	ch <- m.inFlight
+	ch <- m.receiving
+	ch <- m.sessions
+	ch <- m.frontendSessions
+	ch <- m.tickLag
+}
+
+// Collect implements prometheus.Collector for the metrics that are read on scrape.
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	s := m.server
+
+	inFlight, receiving := 0, 0
+	for _, activity := range s.emu.RadioActivity() {
+		if activity.Transmitting {
+			inFlight++
+		}
+		receiving += activity.Receiving
+
+		ch <- prometheus.MustNewConstMetric(m.belowSensitivity, prometheus.CounterValue, float64(activity.BelowSensitivity), activity.ID)
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.inFlight, prometheus.GaugeValue, float64(inFlight))
+	ch <- prometheus.MustNewConstMetric(m.receiving, prometheus.GaugeValue, float64(receiving))
+
+	for channel, utilisation := range m.channelUtilisation(s.emu.Now().UnixMilli()) {
+		ch <- prometheus.MustNewConstMetric(m.utilisation, prometheus.GaugeValue, utilisation, channel)
+	}
+
+	s.RLock()
+	transports := map[string]int{}
+	websocketNodes := 0
+	for _, session := range s.nodeSessions {
+		transports[session.Transport()]++
+		if _, ok := session.(*websocketSession); ok {
+			websocketNodes++
+		}
+	}
+	mobility := s.mobility
+	s.RUnlock()
+
+	for transport, count := range transports {
+		ch <- prometheus.MustNewConstMetric(m.sessions, prometheus.GaugeValue, float64(count), transport)
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.frontendSessions, prometheus.GaugeValue, float64(s.websocket.Len()-websocketNodes))
+
+	if mobility != nil {
+		ch <- prometheus.MustNewConstMetric(m.tickLag, prometheus.GaugeValue, mobility.TickLag().Seconds())
+	}
+}
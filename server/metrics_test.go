@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+
+	nodes := []emu.Node{
+		{ID: "Node1", X: 1},
+		{ID: "Node2", X: 1.5},
+		// too far away to receive anything
+		{ID: "Node3", X: 90},
+	}
+
+	for _, node := range nodes {
+		node.Online = true
+		node.Y = 1
+		node.TXGain = 14
+		node.RXSens = -137
+		assert.NoError(t, testEmu.AddNode(node))
+	}
+
+	s := New(testEmu)
+	assert.NoError(t, s.Setup())
+	defer s.Stop()
+
+	httpServer := httptest.NewServer(s)
+	defer httpServer.Close()
+
+	assert.NoError(t, testEmu.SendMessage("Node1", []byte("hello")))
+	testEmu.Wait()
+
+	// updating a node via the api doesn't reset its counters
+	updated, _ := json.Marshal(testEmu.GetNode("Node3"))
+	req, _ := http.NewRequest(http.MethodPut, httpServer.URL+"/api/node/update", bytes.NewReader(updated))
+	req.Header.Set("Content-Type", "application/json")
+	if put, err := http.DefaultClient.Do(req); assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, put.StatusCode)
+		put.Body.Close()
+	}
+
+	res, err := http.Get(httpServer.URL + "/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	metrics := string(body)
+
+	for _, line := range []string{
+		`loraemu_node_sent_total{node="Node1"} 1`,
+		`loraemu_node_received_total{node="Node2"} 1`,
+		`loraemu_node_below_sensitivity_total{node="Node3"} 1`,
+		`loraemu_node_below_sensitivity_total{node="Node2"} 0`,
+		`loraemu_airtime_seconds_count{spreading_factor="7"} 1`,
+		`loraemu_packets_in_flight 0`,
+		`loraemu_frontend_sessions 0`,
+		`loraemu_channel_utilisation_ratio{freq="868"}`,
+		`loraemu_channel_airtime_seconds_total{freq="868"}`,
+	} {
+		assert.True(t, strings.Contains(metrics, line), "missing metric %s", line)
+	}
+
+	// without mobility the tick lag isn't reported
+	assert.False(t, strings.Contains(metrics, "loraemu_mobility_tick_lag_seconds "))
+}
+
+func TestMetrics_ChannelPruning(t *testing.T) {
+	m := newMetrics(nil)
+
+	send := func(start int64) {
+		m.observe(emu.EventMessage{
+			Event: emu.EventSending,
+			Node:  emu.Node{ID: "Node1"},
+			Data:  emu.Transmission{Start: start, Stop: start + 100, Airtime: 100, Freq: 868, SpreadingFactor: 7},
+		})
+	}
+
+	// without scrapes only the transmissions of the utilisation window are kept
+	for i := int64(0); i < 100; i++ {
+		send(i * utilisationWindowMs / 10)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	assert.LessOrEqual(t, len(m.channels["868"]), 11)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"net/http"
+	"strings"
+
+	"github.com/olahol/melody"
+)
+
+// Versions of the node websocket protocol. In v1 every binary message is transmitted and received
+// packets are sent as JSON encoded RxPacket. In v2 all messages are typed JSON messages.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	// SubprotocolV2 is the websocket subprotocol to negotiate v2. Alternatively the query parameter
+	// ?protocol=2 can be used.
+	SubprotocolV2 = "loraemu.v2"
+)
+
+// MessageType represents the type of v2 message.
+type MessageType string
+
+const (
+	// MessageHello is sent by the server after the connection is established.
+	MessageHello = MessageType("hello")
+	// MessageTx transmits data with optional radio parameters.
+	MessageTx = MessageType("tx")
+	// MessageTxDone is sent by the server when the transmission finished.
+	MessageTxDone = MessageType("txDone")
+	// MessageTxError is sent by the server if the transmission was rejected.
+	MessageTxError = MessageType("txError")
+	// MessageRx is sent by the server for every received packet.
+	MessageRx = MessageType("rx")
+	// MessageGetNode requests the state of the node.
+	MessageGetNode = MessageType("getNode")
+	// MessageConfigure changes the radio settings of the node.
+	MessageConfigure = MessageType("configure")
+	// MessageNode is the answer to MessageGetNode and MessageConfigure.
+	MessageNode = MessageType("node")
+	// MessageTime requests the emulator time and is also the answer to it.
+	MessageTime = MessageType("time")
+	// MessageError is sent by the server if a message couldn't be handled.
+	MessageError = MessageType("error")
+)
+
+// Message represents a v2 message. Only the fields relevant to the type are set.
+type Message struct {
+	Type MessageType `json:"type"`
+	// Ref is a client chosen reference that is copied to the answers of a request.
+	Ref string `json:"ref,omitempty"`
+
+	// Data and radio parameters of tx. Radio parameters of configure.
+	Data            []byte   `json:"data,omitempty"`
+	Freq            float64  `json:"freq,omitempty"`
+	SpreadingFactor float64  `json:"spreadingFactor,omitempty"`
+	BandWidth       float64  `json:"bandWidth,omitempty"`
+	CodingRate      float64  `json:"codingRate,omitempty"`
+	Priority        int      `json:"priority,omitempty"`
+	TXGain          *float64 `json:"txGain,omitempty"`
+
+	// Result of a transmission.
+	Result *emu.TxResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+
+	Packet *emu.RxPacket `json:"packet,omitempty"`
+	Node   *emu.Node     `json:"node,omitempty"`
+
+	// Emulator time sync. Time is the current emulator time in µs, StartTime is in ms.
+	Version     int   `json:"version,omitempty"`
+	Time        int64 `json:"time,omitempty"`
+	StartTime   int64 `json:"startTime,omitempty"`
+	TimeScaling int   `json:"timeScaling,omitempty"`
+}
+
+// requestedProtocol returns the protocol version the client requested.
+func requestedProtocol(r *http.Request) int {
+	if r.URL.Query().Get("protocol") == "2" {
+		return ProtocolV2
+	}
+
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if strings.TrimSpace(protocol) == SubprotocolV2 {
+			return ProtocolV2
+		}
+	}
+
+	return ProtocolV1
+}
+
+func sessionProtocol(session *melody.Session) int {
+	if protocol, ok := session.Get("protocol"); ok {
+		return protocol.(int)
+	}
+	return ProtocolV1
+}
+
+func (s *Server) writeMessage(session *melody.Session, msg Message) {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Error(err, "error while marshaling message")
+		return
+	}
+
+	_ = session.Write(bytes)
+}
+
+func (s *Server) timeMessage(msgType MessageType, ref string) Message {
+	return Message{
+		Type:        msgType,
+		Ref:         ref,
+		Version:     ProtocolV2,
+		Time:        s.emu.Now().UnixMicro(),
+		StartTime:   s.emu.GetStartTime(),
+		TimeScaling: s.emu.GetTimeScaling(),
+	}
+}
+
+func (s *Server) handleConnectV2(session *melody.Session, id string) {
+	hello := s.timeMessage(MessageHello, "")
+	node := s.emu.GetNode(id)
+	hello.Node = &node
+
+	s.writeMessage(session, hello)
+}
+
+func (s *Server) handleMessageV2(session *melody.Session, id string, bytes []byte) {
+	var msg Message
+	if err := json.Unmarshal(bytes, &msg); err != nil {
+		s.writeMessage(session, Message{Type: MessageError, Error: err.Error()})
+		return
+	}
+
+	switch msg.Type {
+	case MessageTx:
+		ref := msg.Ref
+		err := s.emu.SendMessageWithParams(id, msg.Data, emu.TxParams{
+			Freq:            msg.Freq,
+			SpreadingFactor: msg.SpreadingFactor,
+			BandWidth:       msg.BandWidth,
+			CodingRate:      msg.CodingRate,
+			Priority:        msg.Priority,
+			OnDone: func(result emu.TxResult, err error) {
+				if err != nil {
+					s.writeMessage(session, Message{Type: MessageTxError, Ref: ref, Result: &result, Error: err.Error()})
+					return
+				}
+
+				s.writeMessage(session, Message{Type: MessageTxDone, Ref: ref, Result: &result})
+			},
+		})
+		if err != nil {
+			s.writeMessage(session, Message{Type: MessageTxError, Ref: ref, Error: err.Error()})
+		}
+	case MessageGetNode:
+		node := s.emu.GetNode(id)
+		s.writeMessage(session, Message{Type: MessageNode, Ref: msg.Ref, Node: &node})
+	case MessageConfigure:
+		if err := s.emu.UpdateNode(id, func(node *emu.Node) error {
+			if msg.Freq > 0 {
+				node.Freq = msg.Freq
+			}
+
+			if msg.SpreadingFactor > 0 {
+				node.SpreadingFactor = msg.SpreadingFactor
+			}
+
+			if msg.TXGain != nil {
+				node.TXGain = *msg.TXGain
+			}
+
+			return nil
+		}); err != nil {
+			s.writeMessage(session, Message{Type: MessageError, Ref: msg.Ref, Error: err.Error()})
+			return
+		}
+
+		node := s.emu.GetNode(id)
+		s.writeMessage(session, Message{Type: MessageNode, Ref: msg.Ref, Node: &node})
+	case MessageTime:
+		s.writeMessage(session, s.timeMessage(MessageTime, msg.Ref))
+	default:
+		s.writeMessage(session, Message{Type: MessageError, Ref: msg.Ref, Error: "unknown message type"})
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func readMessage(t *testing.T, conn *websocket.Conn, msgType MessageType) Message {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	for {
+		_, bytes, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		var msg Message
+		if assert.NoError(t, json.Unmarshal(bytes, &msg)) && msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestProtocolV2(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+
+	for i, id := range []string{"Node1", "Node2"} {
+		assert.NoError(t, testEmu.AddNode(emu.Node{
+			ID:     id,
+			Online: true,
+			X:      1 + float64(i)*0.5,
+			Y:      1,
+			TXGain: 14,
+			RXSens: -137,
+		}))
+	}
+
+	s := New(testEmu)
+	if !assert.NoError(t, s.Setup()) {
+		return
+	}
+
+	httpServer := httptest.NewServer(s)
+	defer httpServer.Close()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/api/emu/"
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"Node1", map[string][]string{"Sec-WebSocket-Protocol": {SubprotocolV2}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.Equal(t, SubprotocolV2, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	hello := readMessage(t, conn, MessageHello)
+	assert.Equal(t, ProtocolV2, hello.Version)
+	assert.Equal(t, 10, hello.TimeScaling)
+	if assert.NotNil(t, hello.Node) {
+		assert.Equal(t, "Node1", hello.Node.ID)
+	}
+
+	// the query parameter negotiates v2 as well
+	other, _, err := websocket.DefaultDialer.Dial(url+"Node2?protocol=2", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer other.Close()
+	readMessage(t, other, MessageHello)
+
+	t.Run("TxDone", func(t *testing.T) {
+		assert.NoError(t, conn.WriteJSON(Message{Type: MessageTx, Ref: "1", Data: []byte("hello"), SpreadingFactor: 7}))
+
+		done := readMessage(t, conn, MessageTxDone)
+		assert.Equal(t, "1", done.Ref)
+		if assert.NotNil(t, done.Result) {
+			assert.Greater(t, done.Result.Airtime, 0.0)
+		}
+
+		rx := readMessage(t, other, MessageRx)
+		if assert.NotNil(t, rx.Packet) {
+			assert.Equal(t, []byte("hello"), rx.Packet.Data)
+		}
+	})
+
+	t.Run("TxError", func(t *testing.T) {
+		assert.NoError(t, conn.WriteJSON(Message{Type: MessageTx, Ref: "2", Data: make([]byte, 300)}))
+
+		txErr := readMessage(t, conn, MessageTxError)
+		assert.Equal(t, "2", txErr.Ref)
+		assert.Equal(t, emu.ErrPayloadSizeExceeded.Error(), txErr.Error)
+	})
+
+	t.Run("Configure", func(t *testing.T) {
+		txGain := 10.0
+		assert.NoError(t, conn.WriteJSON(Message{Type: MessageConfigure, Freq: 868.3, TXGain: &txGain}))
+
+		node := readMessage(t, conn, MessageNode)
+		if assert.NotNil(t, node.Node) {
+			assert.Equal(t, 868.3, node.Node.Freq)
+			assert.Equal(t, 10.0, node.Node.TXGain)
+		}
+	})
+
+	t.Run("Time", func(t *testing.T) {
+		assert.NoError(t, conn.WriteJSON(Message{Type: MessageTime, Ref: "t"}))
+
+		msg := readMessage(t, conn, MessageTime)
+		assert.Equal(t, "t", msg.Ref)
+		assert.InDelta(t, testEmu.Now().UnixMicro(), msg.Time, float64(time.Second.Microseconds()))
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		assert.NoError(t, conn.WriteJSON(Message{Type: "unknown"}))
+		readMessage(t, conn, MessageError)
+	})
+}
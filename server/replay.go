@@ -0,0 +1,598 @@
+package server
+
+import (
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/trace"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReplayTick is the interval in which a playing replay emits the due events.
+const ReplayTick = 50 * time.Millisecond
+
+// ReplayCheckpointInterval is the number of records between two snapshots of the replayed nodes and stats.
+// Seeking restores the closest snapshot and only applies the records after it. It should be a multiple of
+// trace.IndexInterval, so that the log can be opened at a snapshot without decoding any records.
+var ReplayCheckpointInterval = 10 * trace.IndexInterval
+
+// ReplayStatus represents the state of a replay. All times are unix timestamps in ms of the trace.
+type ReplayStatus struct {
+	Path     string  `json:"path"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Position int64   `json:"position"`
+	Speed    float64 `json:"speed"`
+	Playing  bool    `json:"playing"`
+	Records  int     `json:"records"`
+	Played   int     `json:"played"`
+}
+
+// replayCheckpoint is the replayed state before the record at read.
+type replayCheckpoint struct {
+	read    int
+	played  int
+	maxTime time.Time
+	nodes   map[string]emu.Node
+	stats   statsSnapshot
+}
+
+// Replay re-emits the events of a trace log to the frontend sessions. The nodes of the trace are added to
+// the emulator of the server, so that the web view and the REST API show the state at the current position
+// without any live nodes. The log is streamed through a trace.Index in the order it was written, only the
+// checkpoints of the replayed state are kept in memory.
+type Replay struct {
+	sync.Mutex
+
+	// emitting serializes the emitting of the events. The events are emitted after the lock is released,
+	// so that the node changes can be published on the bus while the replay is used.
+	emitting sync.Mutex
+
+	server      *Server
+	path        string
+	index       *trace.Index
+	reader      *trace.Reader
+	read        int
+	pending     *trace.Record
+	ended       bool
+	checkpoints []replayCheckpoint
+	nodes       map[string]emu.Node
+	played      int
+	maxTime     time.Time
+	position    time.Time
+	speed       float64
+	playing     bool
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// LoadReplay indexes the trace log and replaces the nodes of the emulator with the nodes at the start of
+// the trace. The replay is paused until Play is called.
+func (s *Server) LoadReplay(path string) (*Replay, error) {
+	index, err := trace.NewIndex(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if index.Events() == 0 {
+		return nil, errors.New("trace contains no events")
+	}
+
+	reader, err := index.SeekRecord(0)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replay{
+		server: s,
+		path:   path,
+		index:  index,
+		reader: reader,
+		nodes:  map[string]emu.Node{},
+		speed:  1,
+		stop:   make(chan struct{}),
+	}
+
+	s.Lock()
+	old := s.replay
+	s.replay = r
+	s.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	s.stats.reset()
+	r.Seek(index.Start())
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r, nil
+}
+
+// Replay returns the active replay or nil if no replay is loaded.
+func (s *Server) Replay() *Replay {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.replay
+}
+
+func (s *Server) stopReplay() {
+	s.Lock()
+	replay := s.replay
+	s.replay = nil
+	s.Unlock()
+
+	if replay != nil {
+		replay.close()
+	}
+}
+
+// Header returns the header of the trace or nil if the trace has no header record.
+func (r *Replay) Header() *trace.Header {
+	return r.index.Header()
+}
+
+// Status returns the state of the replay.
+func (r *Replay) Status() ReplayStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.statusLocked()
+}
+
+// Position returns the current time of the replay.
+func (r *Replay) Position() time.Time {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.position
+}
+
+// Play continues the replay at the current position. If the end was reached the replay starts again.
+func (r *Replay) Play() ReplayStatus {
+	r.emitting.Lock()
+	defer r.emitting.Unlock()
+
+	r.Lock()
+	var resync func()
+	if r.ended {
+		resync = r.seekLocked(r.index.Start())
+	}
+	r.playing = true
+	status := r.statusLocked()
+	r.Unlock()
+
+	if resync != nil {
+		resync()
+	}
+
+	return status
+}
+
+// Pause pauses the replay at the current position.
+func (r *Replay) Pause() ReplayStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	r.playing = false
+
+	return r.statusLocked()
+}
+
+// SetSpeed sets the factor of the trace time to the wall clock, e.g. 10 replays 10 seconds per second.
+func (r *Replay) SetSpeed(speed float64) (ReplayStatus, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if speed <= 0 {
+		return r.statusLocked(), errors.New("speed must be greater than 0")
+	}
+
+	r.speed = speed
+
+	return r.statusLocked(), nil
+}
+
+// Seek jumps to the given time of the trace. The nodes and stats are reconstructed from the closest
+// checkpoint without emitting the skipped events, afterwards all frontend sessions receive the new state.
+func (r *Replay) Seek(t time.Time) ReplayStatus {
+	r.emitting.Lock()
+	defer r.emitting.Unlock()
+
+	r.Lock()
+	resync := r.seekLocked(t)
+	status := r.statusLocked()
+	r.Unlock()
+
+	resync()
+
+	return status
+}
+
+// Step pauses the replay and emits the next count events. A negative count steps back by reconstructing
+// the state before the last count events.
+func (r *Replay) Step(count int) ReplayStatus {
+	r.emitting.Lock()
+	defer r.emitting.Unlock()
+
+	r.Lock()
+	r.playing = false
+
+	var emits []func()
+	if count < 0 {
+		target := r.played + count
+		if target < 0 {
+			target = 0
+		}
+
+		emits = append(emits, r.rebuildLocked(func(cp replayCheckpoint) bool {
+			return cp.played <= target
+		}, func(trace.Record) bool {
+			return r.played >= target
+		}))
+
+		r.position = r.maxTime
+		if r.played == 0 {
+			r.position = r.index.Start()
+		}
+	} else {
+		target := r.played + count
+		emits = r.playLocked(func(trace.Record) bool {
+			return r.played >= target
+		}, true)
+
+		if r.maxTime.After(r.position) {
+			r.position = r.maxTime
+		}
+	}
+
+	status := r.statusLocked()
+	r.Unlock()
+
+	for _, emit := range emits {
+		emit()
+	}
+
+	return status
+}
+
+// seekLocked rebuilds the state at the time and returns the function that syncs it.
+func (r *Replay) seekLocked(t time.Time) func() {
+	if t.Before(r.index.Start()) {
+		t = r.index.Start()
+	} else if t.After(r.index.End()) {
+		t = r.index.End()
+	}
+
+	// all events up to and including the time are applied
+	resync := r.rebuildLocked(func(cp replayCheckpoint) bool {
+		return !cp.maxTime.After(t)
+	}, func(record trace.Record) bool {
+		return record.Time.After(t)
+	})
+
+	r.position = t
+
+	return resync
+}
+
+func (r *Replay) statusLocked() ReplayStatus {
+	return ReplayStatus{
+		Path:     r.path,
+		Start:    r.index.Start().UnixMilli(),
+		End:      r.index.End().UnixMilli(),
+		Position: r.position.UnixMilli(),
+		Speed:    r.speed,
+		Playing:  r.playing,
+		Records:  r.index.Events(),
+		Played:   r.played,
+	}
+}
+
+func (r *Replay) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(ReplayTick)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.advance(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// advance moves the position by the elapsed wall clock time and emits the events that are due.
+func (r *Replay) advance(elapsed time.Duration) {
+	r.emitting.Lock()
+	defer r.emitting.Unlock()
+
+	r.Lock()
+	if !r.playing {
+		r.Unlock()
+		return
+	}
+
+	r.position = r.position.Add(time.Duration(float64(elapsed) * r.speed))
+
+	position := r.position
+	emits := r.playLocked(func(record trace.Record) bool {
+		return record.Time.After(position)
+	}, true)
+
+	if r.ended {
+		r.position = r.index.End()
+		r.playing = false
+	}
+	r.Unlock()
+
+	for _, emit := range emits {
+		emit()
+	}
+}
+
+func (r *Replay) close() {
+	close(r.stop)
+	r.wg.Wait()
+
+	r.Lock()
+	defer r.Unlock()
+
+	_ = r.reader.Close()
+}
+
+// checkpointLocked returns a snapshot of the state before the next record.
+func (r *Replay) checkpointLocked() replayCheckpoint {
+	return replayCheckpoint{
+		read:    r.read,
+		played:  r.played,
+		maxTime: r.maxTime,
+		nodes:   copyNodes(r.nodes),
+		stats:   r.server.stats.snapshot(),
+	}
+}
+
+// restoreLocked reopens the log at the checkpoint and restores its state.
+func (r *Replay) restoreLocked(cp replayCheckpoint) error {
+	reader, err := r.index.SeekRecord(cp.read)
+	if err != nil {
+		return err
+	}
+
+	_ = r.reader.Close()
+	r.reader = reader
+	r.read = cp.read
+	r.pending = nil
+	r.ended = false
+	r.played = cp.played
+	r.maxTime = cp.maxTime
+	r.nodes = copyNodes(cp.nodes)
+	r.server.stats.restore(cp.stats)
+
+	return nil
+}
+
+// peekLocked returns the next record of the log without applying it. It returns false at the end of the log.
+// Every ReplayCheckpointInterval records a checkpoint is taken the first time the state gets there.
+func (r *Replay) peekLocked() (trace.Record, bool) {
+	if r.pending != nil {
+		return *r.pending, true
+	}
+
+	if r.read%ReplayCheckpointInterval == 0 && r.read/ReplayCheckpointInterval == len(r.checkpoints) {
+		r.checkpoints = append(r.checkpoints, r.checkpointLocked())
+	}
+
+	record, err := r.reader.Next()
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			r.server.logger.Error(err, "can't read replay", "path", r.path)
+		}
+
+		r.ended = true
+		return trace.Record{}, false
+	}
+
+	r.read++
+	r.pending = &record
+
+	return record, true
+}
+
+// playLocked applies the records to the nodes and stats until done returns true for the next one or the
+// log ends. If emit is set the returned functions emit the events after the lock is released.
+func (r *Replay) playLocked(done func(record trace.Record) bool, emit bool) []func() {
+	var emits []func()
+
+	for {
+		record, ok := r.peekLocked()
+		if !ok || done(record) {
+			return emits
+		}
+		r.pending = nil
+
+		// the header describes the trace and isn't a event of the emulator
+		if record.Event == trace.EventHeader {
+			continue
+		}
+
+		changed := r.applyNode(record)
+
+		r.played++
+		if record.Time.After(r.maxTime) {
+			r.maxTime = record.Time
+		}
+
+		switch record.Event {
+		case emu.EventSending, emu.EventReceived, emu.EventCollision:
+			r.server.stats.observe(r.message(record))
+		}
+
+		if emit {
+			emits = append(emits, r.emitter(record, changed))
+		}
+	}
+}
+
+// applyNode updates the replayed node state by a node event or the position of a transmission. It returns
+// false if the event doesn't change any node.
+func (r *Replay) applyNode(record trace.Record) bool {
+	switch data := record.Data.(type) {
+	case emu.Node:
+		if record.Event == emu.EventNodeRemoved {
+			delete(r.nodes, record.NodeID)
+		} else {
+			r.nodes[record.NodeID] = data
+		}
+		return true
+	case emu.Transmission:
+		// traces before the schema have no node data, but the transmissions contain the position
+		node, ok := r.nodes[record.NodeID]
+		if !ok || (node.X == data.X && node.Y == data.Y && node.Z == data.Z) {
+			return false
+		}
+
+		node.X, node.Y, node.Z = data.X, data.Y, data.Z
+		r.nodes[record.NodeID] = node
+		return true
+	case nil:
+		switch record.Event {
+		case emu.EventNodeAdded:
+			if _, ok := r.nodes[record.NodeID]; !ok {
+				r.nodes[record.NodeID] = emu.Node{ID: record.NodeID, Online: true}
+				return true
+			}
+		case emu.EventNodeRemoved:
+			delete(r.nodes, record.NodeID)
+			return true
+		}
+	}
+
+	return false
+}
+
+// message returns the event message of the record with the replayed state of the node.
+func (r *Replay) message(record trace.Record) emu.EventMessage {
+	node, ok := r.nodes[record.NodeID]
+	if !ok {
+		node = emu.Node{ID: record.NodeID}
+	}
+
+	return emu.EventMessage{
+		Time:  record.Time,
+		Event: record.Event,
+		Node:  node,
+		Data:  record.Data,
+	}
+}
+
+// emitter returns the function that applies a node change to the emulator, which notifies the frontend
+// sessions itself, or sends the event to the frontend sessions. The other events aren't published on the
+// bus of the emulator, so the metrics, webhooks, trace sinks and node sessions don't take them for live
+// traffic. The replayed state is captured, so it can run after the lock is released.
+func (r *Replay) emitter(record trace.Record, changed bool) func() {
+	node, ok := r.nodes[record.NodeID]
+	msg := r.message(record)
+
+	return func() {
+		if changed {
+			r.syncNode(record.NodeID, node, ok)
+		}
+
+		switch record.Event {
+		case emu.EventNodeAdded, emu.EventNodeUpdated, emu.EventNodeRemoved:
+			return
+		}
+
+		r.server.onEvent(msg)
+	}
+}
+
+// syncNode sets the replayed state of the node in the emulator. If ok is false the node is removed.
+func (r *Replay) syncNode(id string, node emu.Node, ok bool) {
+	e := r.server.emu
+
+	if !ok {
+		if !e.HasNode(id) {
+			return
+		}
+
+		if err := e.RemoveNode(id); err != nil {
+			r.server.logger.Error(err, "can't remove replayed node", "id", id)
+		}
+		return
+	}
+
+	var err error
+	if e.HasNode(id) {
+		err = e.UpdateNode(id, func(n *emu.Node) error {
+			*n = node
+			return nil
+		})
+	} else {
+		err = e.AddNode(node)
+	}
+
+	if err != nil {
+		r.server.logger.Error(err, "can't replay node", "id", id)
+	}
+}
+
+// rebuildLocked reconstructs the nodes and stats up to the first record for which done returns true. It
+// continues from the current state if possible, otherwise the latest checkpoint that is usable is restored.
+// The returned function syncs the nodes to the emulator and sends the new state to the frontend sessions.
+func (r *Replay) rebuildLocked(usable func(cp replayCheckpoint) bool, done func(record trace.Record) bool) func() {
+	// the checkpoints are ordered, so the usable ones are at the start
+	k := sort.Search(len(r.checkpoints), func(i int) bool {
+		return !usable(r.checkpoints[i])
+	}) - 1
+
+	current := replayCheckpoint{read: r.read, played: r.played, maxTime: r.maxTime}
+	if k >= 0 && (!usable(current) || r.checkpoints[k].read > r.read) {
+		if err := r.restoreLocked(r.checkpoints[k]); err != nil {
+			r.server.logger.Error(err, "can't restore replay checkpoint", "path", r.path)
+		}
+	}
+
+	r.playLocked(done, false)
+
+	nodes := copyNodes(r.nodes)
+	return func() {
+		for _, id := range r.server.emu.NodeIDs() {
+			if _, ok := nodes[id]; !ok {
+				r.syncNode(id, emu.Node{}, false)
+			}
+		}
+
+		ids := make([]string, 0, len(nodes))
+		for id := range nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			r.syncNode(id, nodes[id], true)
+		}
+
+		r.server.broadcastState()
+	}
+}
+
+func copyNodes(nodes map[string]emu.Node) map[string]emu.Node {
+	c := make(map[string]emu.Node, len(nodes))
+	for id, node := range nodes {
+		c[id] = node
+	}
+
+	return c
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/BigJk/loraemu/api"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"github.com/BigJk/loraemu/trace"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeReplayTrace(t *testing.T, start time.Time) string {
+	path := filepath.Join(t.TempDir(), "logs.txt")
+
+	entries := []emu.LogEntry{
+		{Time: start, Event: trace.EventHeader, Data: trace.Header{Format: trace.FormatVersion}},
+		{Time: start, Event: emu.EventNodeAdded, NodeID: "1", Data: emu.Node{ID: "1", Online: true}},
+		{Time: start, Event: emu.EventNodeAdded, NodeID: "2", Data: emu.Node{ID: "2", Online: true, X: 1}},
+		{Time: start.Add(time.Second), Event: emu.EventSending, NodeID: "1", Data: emu.Transmission{Start: start.Add(time.Second).UnixMilli(), Airtime: 50}},
+		{Time: start.Add(time.Second), Event: emu.EventReceived, NodeID: "2", Data: emu.Reception{From: "1", Sent: start.Add(time.Second).UnixMilli()}},
+		{Time: start.Add(2 * time.Second), Event: emu.EventNodeUpdated, NodeID: "1", Data: emu.Node{ID: "1", Online: true, X: 5}},
+		{Time: start.Add(3 * time.Second), Event: emu.EventSending, NodeID: "2", Data: emu.Transmission{Start: start.Add(3 * time.Second).UnixMilli(), Airtime: 50, X: 1}},
+		{Time: start.Add(4 * time.Second), Event: emu.EventNodeRemoved, NodeID: "2", Data: emu.Node{ID: "2", Online: true, X: 1}},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		assert.NoError(t, err)
+		buf.Write(append(line, '\n'))
+	}
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0666))
+
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testEmu := emu.New(868, 2.5, 0.1, 10, lora.PacketConfigDefault)
+	s := New(testEmu)
+	s.subscribe()
+	defer s.Stop()
+
+	// nodes of a previous session are replaced
+	assert.NoError(t, testEmu.AddNode(emu.Node{ID: "live", Online: true}))
+
+	replay, err := s.LoadReplay(writeReplayTrace(t, start))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	status := replay.Status()
+	assert.Equal(t, ReplayStatus{
+		Path:     status.Path,
+		Start:    start.UnixMilli(),
+		End:      start.Add(4 * time.Second).UnixMilli(),
+		Position: start.UnixMilli(),
+		Speed:    1,
+		Records:  7,
+		Played:   2,
+	}, status)
+	assert.NotNil(t, replay.Header())
+	assert.ElementsMatch(t, []string{"1", "2"}, testEmu.NodeIDs())
+
+	// seeking reconstructs the positions and stats without the live emulator
+	status = replay.Seek(start.Add(2500 * time.Millisecond))
+	assert.Equal(t, 5, status.Played)
+	assert.Equal(t, 5.0, testEmu.GetNode("1").X)
+	assert.Equal(t, map[string]api.NodeStat{"1": {Sending: 1}, "2": {Received: 1}}, s.stats.getTotals())
+	assert.Equal(t, start.Add(2500*time.Millisecond), s.now())
+
+	// steps emit the events like the live emulator
+	status = replay.Step(1)
+	assert.Equal(t, 6, status.Played)
+	assert.Equal(t, start.Add(3*time.Second).UnixMilli(), status.Position)
+	assert.Equal(t, 1, s.stats.getTotals()["2"].Sending)
+
+	replay.Step(1)
+	assert.False(t, testEmu.HasNode("2"))
+
+	status = replay.Step(-2)
+	assert.Equal(t, 5, status.Played)
+	assert.True(t, testEmu.HasNode("2"))
+	assert.Equal(t, 0, s.stats.getTotals()["2"].Sending)
+
+	_, err = replay.SetSpeed(0)
+	assert.Error(t, err)
+	_, err = replay.SetSpeed(100)
+	assert.NoError(t, err)
+
+	assert.True(t, replay.Play().Playing)
+	assert.Eventually(t, func() bool {
+		return !replay.Status().Playing
+	}, time.Second, ReplayTick)
+
+	status = replay.Status()
+	assert.Equal(t, 7, status.Played)
+	assert.Equal(t, status.End, status.Position)
+	assert.Equal(t, []string{"1"}, testEmu.NodeIDs())
+}
+
+func TestReplay_Routes(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := New(emu.New(868, 2.5, 0.1, 10, lora.PacketConfigDefault))
+	defer s.Stop()
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, s.routeGetReplay(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/replay", nil), rec)))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	_, err := s.LoadReplay(writeReplayTrace(t, start))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, test := range []struct {
+		route  func(c echo.Context) error
+		body   string
+		code   int
+		played int
+	}{
+		{s.routePostReplaySeek, `{"offset": 1}`, http.StatusOK, 4},
+		{s.routePostReplaySeek, `{"time": 0}`, http.StatusOK, 2},
+		{s.routePostReplaySeek, `{}`, http.StatusBadRequest, 0},
+		{s.routePostReplayStep, `{}`, http.StatusOK, 3},
+		{s.routePostReplayStep, `{"count": -1}`, http.StatusOK, 2},
+		{s.routePostReplaySpeed, `{"speed": -1}`, http.StatusBadRequest, 0},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/replay", bytes.NewBufferString(test.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		assert.NoError(t, test.route(s.NewContext(req, rec)))
+		assert.Equal(t, test.code, rec.Code, test.body)
+
+		if test.code == http.StatusOK {
+			var status ReplayStatus
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+			assert.Equal(t, test.played, status.Played, test.body)
+		}
+	}
+}
+
+func TestReplay_Checkpoints(t *testing.T) {
+	interval := ReplayCheckpointInterval
+	ReplayCheckpointInterval = 2
+	defer func() { ReplayCheckpointInterval = interval }()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testEmu := emu.New(868, 2.5, 0.1, 10, lora.PacketConfigDefault)
+	s := New(testEmu)
+	s.subscribe()
+	defer s.Stop()
+
+	replay, err := s.LoadReplay(writeReplayTrace(t, start))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// node changes are emitted without holding the lock of the replay
+	sub := testEmu.SubscribeFunc(func(msg emu.EventMessage) {
+		replay.Status()
+	}, emu.EventNodeUpdated)
+	defer sub.Unsubscribe()
+
+	// playing to the end takes a checkpoint every 2 records of the log
+	assert.Equal(t, 7, replay.Step(10).Played)
+	assert.Len(t, replay.checkpoints, 5)
+	assert.Equal(t, map[string]api.NodeStat{"1": {Sending: 1}, "2": {Received: 1, Sending: 1}}, s.stats.getTotals())
+
+	// seeking back restores the checkpoint before the time and applies the records after it
+	status := replay.Seek(start.Add(2500 * time.Millisecond))
+	assert.Equal(t, 5, status.Played)
+	assert.Equal(t, 5.0, testEmu.GetNode("1").X)
+	assert.Equal(t, map[string]api.NodeStat{"1": {Sending: 1}, "2": {Received: 1}}, s.stats.getTotals())
+
+	status = replay.Step(-4)
+	assert.Equal(t, 1, status.Played)
+	assert.Equal(t, start.UnixMilli(), status.Position)
+	assert.Equal(t, []string{"1"}, testEmu.NodeIDs())
+	assert.Empty(t, s.stats.getTotals())
+
+	status = replay.Step(2)
+	assert.Equal(t, 3, status.Played)
+	assert.Equal(t, 1, s.stats.getTotals()["1"].Sending)
+	assert.Len(t, replay.checkpoints, 5)
+}
+
+// TestReplay_Frontend tests if the replayed packets are only sent to the frontend sessions and aren't
+// published as live traffic on the bus of the emulator.
+func TestReplay_Frontend(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testEmu := emu.New(868, 2.5, 0.1, 10, lora.PacketConfigDefault)
+	s := New(testEmu)
+	if !assert.NoError(t, s.Setup()) {
+		return
+	}
+	defer s.Stop()
+
+	httpServer := httptest.NewServer(s)
+	defer httpServer.Close()
+
+	replay, err := s.LoadReplay(writeReplayTrace(t, start))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/api/ws", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	published := 0
+	sub := testEmu.SubscribeFunc(func(msg emu.EventMessage) {
+		published++
+	}, emu.EventSending, emu.EventReceived)
+	defer sub.Unsubscribe()
+
+	// wait for the session to be registered before the events are emitted
+	assert.Eventually(t, func() bool { return s.websocket.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	replay.Step(2)
+
+	events := map[string]bool{}
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for !events[string(emu.EventReceived)] {
+		_, data, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			break
+		}
+
+		var msg struct {
+			Event string `json:"event"`
+		}
+		_ = json.Unmarshal(data, &msg)
+		events[msg.Event] = true
+	}
+
+	assert.True(t, events[string(emu.EventSending)], "frontend didn't get the replayed transmission")
+	assert.Equal(t, 0, published, "replayed packets were published on the bus")
+
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotContains(t, res.Body.String(), "loraemu_node_sent_total{")
+}
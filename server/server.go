@@ -4,31 +4,36 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/BigJk/loraemu/api"
 	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/enddevice"
+	"github.com/BigJk/loraemu/lorawan"
+	"github.com/BigJk/loraemu/netserver"
+	"github.com/BigJk/loraemu/pcap"
+	"github.com/BigJk/loraemu/traffic"
 	"image"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/olahol/melody"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	echopprof "github.com/sevenNt/echo-pprof"
 )
 
-type NodeStat struct {
-	Received  int `json:"received"`
-	Collision int `json:"collision"`
-	Sending   int `json:"sending"`
-}
-
 // Server represents the LoRa emu webserver that hosts the frontend and REST API.
 type Server struct {
 	sync.RWMutex
@@ -39,24 +44,45 @@ type Server struct {
 	logger          logr.Logger
 	emu             *emu.Emulator
 	mobility        *emu.Mobility
+	networkServer   *netserver.NetworkServer
+	endDevices      []*enddevice.Device
+	generators      []*traffic.Generator
 	websocket       *melody.Melody
-	emuSessions     map[string]*melody.Session
+	nodeSessions    map[string]nodeSession
+	deliveries      map[string]*emu.Subscription
+	kissListeners   map[string]net.Listener
+	listeners       []io.Closer
 	backgroundImage image.Image
 	originX         float64
 	originY         float64
-	stats           map[string]NodeStat
+	stats           *stats
+	statsSub        *emu.Subscription
+	subscription    *emu.Subscription
+	metrics         *metrics
+	metricsSub      *emu.Subscription
+	webhooks        map[string]*webhook
+	webhookNames    []string
+	webhookClient   *http.Client
+	replay          *Replay
 }
 
 // New creates a new Server instance that is bound to an emulator instance.
 func New(emulator *emu.Emulator) *Server {
-	return &Server{
-		Echo:        echo.New(),
-		logger:      logr.Discard(),
-		websocket:   melody.New(),
-		emu:         emulator,
-		emuSessions: map[string]*melody.Session{},
-		stats:       map[string]NodeStat{},
+	s := &Server{
+		Echo:          echo.New(),
+		logger:        logr.Discard(),
+		websocket:     melody.New(),
+		emu:           emulator,
+		nodeSessions:  map[string]nodeSession{},
+		deliveries:    map[string]*emu.Subscription{},
+		kissListeners: map[string]net.Listener{},
+		stats:         newStats(),
+		webhooks:      map[string]*webhook{},
+		webhookClient: &http.Client{Timeout: time.Second * 10},
 	}
+	s.metrics = newMetrics(s)
+
+	return s
 }
 
 // SetDebug sets the debug state of the server. If debug is enabled the server expects the
@@ -74,6 +100,31 @@ func (s *Server) SetMobility(mobility *emu.Mobility) {
 	s.mobility = mobility
 }
 
+// SetNetworkServer sets a target LoRaWAN network server. This will enable the server to expose the
+// device sessions.
+func (s *Server) SetNetworkServer(networkServer *netserver.NetworkServer) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.networkServer = networkServer
+}
+
+// SetEndDevices sets the virtual LoRaWAN end-devices. This will enable the server to expose their MAC state.
+func (s *Server) SetEndDevices(endDevices []*enddevice.Device) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.endDevices = endDevices
+}
+
+// SetTrafficGenerators sets the traffic generators. This will enable the server to start and stop them.
+func (s *Server) SetTrafficGenerators(generators []*traffic.Generator) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.generators = generators
+}
+
 // SetLogger sets the logger of the server. If no logger is present no logs will be printed.
 func (s *Server) SetLogger(logger logr.Logger) {
 	s.Lock()
@@ -102,19 +153,15 @@ func (s *Server) ConnectedNodes() int {
 	s.RLock()
 	defer s.RUnlock()
 
-	return len(s.emuSessions)
+	return len(s.nodeSessions)
 }
 
 func (s *Server) handleDisconnect(session *melody.Session) {
 	id := session.MustGet("id").(string)
 
 	if session.MustGet("isFrontend").(bool) {
-	} else {
-		s.logger.Info("node disconnected", "id", id)
-
-		s.Lock()
-		delete(s.emuSessions, id)
-		s.Unlock()
+	} else if ws, ok := session.Get("nodeSession"); ok {
+		s.unregisterSession(id, ws.(*websocketSession))
 	}
 }
 
@@ -122,58 +169,141 @@ func (s *Server) handleConnect(session *melody.Session) {
 	id := session.MustGet("id").(string)
 
 	if session.MustGet("isFrontend").(bool) {
-		if configBytes, err := json.Marshal(map[string]interface{}{
-			"event":     "Config",
-			"gamma":     s.emu.GetGamma(),
-			"refDist":   s.emu.GetRefDist(),
-			"freq":      s.emu.GetFreq(),
-			"kmRange":   s.emu.GetKMRange(),
-			"startTime": s.emu.GetStartTime(),
-			"origin": map[string]interface{}{
-				"x": s.originX,
-				"y": s.originY,
-			},
-			"curNodeStats": s.stats,
-		}); err == nil {
-			_ = session.Write(configBytes)
-		}
-
-		if nodeBytes, err := json.Marshal(map[string]interface{}{
-			"event": "Nodes",
-			"nodes": s.emu.Nodes(),
-		}); err == nil {
-			_ = session.Write(nodeBytes)
+		for _, msg := range s.frontendState() {
+			_ = session.Write(msg)
 		}
 	} else {
-		s.Lock()
+		ws := &websocketSession{session: session}
 
 		// check if the node already is connected to, if so close the new request
-		if _, ok := s.emuSessions[id]; ok {
-			s.logger.Error(nil, "node denied connection", "id", id)
+		if err := s.registerSession(id, ws); err != nil {
 			_ = session.Close()
 			return
 		}
 
-		s.emuSessions[session.MustGet("id").(string)] = session
+		session.Set("nodeSession", ws)
+
+		if sessionProtocol(session) == ProtocolV2 {
+			s.handleConnectV2(session, id)
+		}
+	}
+}
+
+// broadcastState sends the config with the current stats and all nodes to the frontend sessions, like
+// on connect.
+func (s *Server) broadcastState() {
+	for _, msg := range s.frontendState() {
+		_ = s.websocket.BroadcastFilter(msg, func(session *melody.Session) bool {
+			return session.MustGet("isFrontend").(bool)
+		})
+	}
+}
 
-		s.Unlock()
+// frontendState returns the messages a frontend session needs to show the current state.
+func (s *Server) frontendState() [][]byte {
+	var messages [][]byte
+
+	if configBytes, err := json.Marshal(map[string]interface{}{
+		"event":     "Config",
+		"gamma":     s.emu.GetGamma(),
+		"refDist":   s.emu.GetRefDist(),
+		"freq":      s.emu.GetFreq(),
+		"kmRange":   s.emu.GetKMRange(),
+		"startTime": s.emu.GetStartTime(),
+		"origin": map[string]interface{}{
+			"x": s.originX,
+			"y": s.originY,
+		},
+		"curNodeStats": s.stats.getTotals(),
+	}); err == nil {
+		messages = append(messages, configBytes)
+	}
 
-		s.logger.Info("node connected", "id", id)
+	if nodeBytes, err := json.Marshal(map[string]interface{}{
+		"event": "Nodes",
+		"nodes": s.emu.Nodes(),
+	}); err == nil {
+		messages = append(messages, nodeBytes)
 	}
+
+	return messages
 }
 
 func (s *Server) handleMessageBinary(session *melody.Session, bytes []byte) {
 	id := session.MustGet("id").(string)
+
+	if sessionProtocol(session) == ProtocolV2 {
+		s.handleMessageV2(session, id, bytes)
+		return
+	}
+
 	if err := s.emu.SendMessage(id, bytes); err != nil {
 		s.logger.Error(err, "node denied connection", "id", id)
 	}
 }
 
-func (s *Server) onEvent(event emu.Event, node emu.Node, data any) {
+func (s *Server) handleMessage(session *melody.Session, bytes []byte) {
+	// text messages are only used by the v2 protocol
+	if session.MustGet("isFrontend").(bool) || sessionProtocol(session) != ProtocolV2 {
+		return
+	}
+
+	s.handleMessageV2(session, session.MustGet("id").(string), bytes)
+}
+
+// subscribe subscribes the server to the event bus of the emulator. The events are handled in order by a
+// single goroutine. If the frontend sessions are too slow the oldest events are dropped, so they never
+// block the emulator.
+func (s *Server) subscribe() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.subscription != nil {
+		return
+	}
+
+	subscription := s.emu.Subscribe(emu.SubscribeOptions{Overflow: emu.OverflowDropOldest})
+	s.subscription = subscription
+	s.metricsSub = s.emu.SubscribeFunc(s.metrics.observe, emu.EventSending, emu.EventReceived, emu.EventCollision)
+	s.statsSub = s.emu.SubscribeFunc(s.observeStats, emu.EventSending, emu.EventReceived, emu.EventCollision)
+
+	go func() {
+		for msg := range subscription.Events() {
+			s.onEvent(msg)
+		}
+	}()
+}
+
+// observeStats counts the events of the emulator. A replay records its events itself, so that the stats
+// of its checkpoints are exact before the events are emitted.
+func (s *Server) observeStats(msg emu.EventMessage) {
+	if s.Replay() != nil {
+		return
+	}
+
+	s.stats.observe(msg)
+}
+
+func (s *Server) unsubscribe() {
+	s.Lock()
+	subscription, metricsSub, statsSub := s.subscription, s.metricsSub, s.statsSub
+	s.subscription, s.metricsSub, s.statsSub = nil, nil, nil
+	s.Unlock()
+
+	if subscription != nil {
+		subscription.Unsubscribe()
+		metricsSub.Unsubscribe()
+		statsSub.Unsubscribe()
+	}
+}
+
+func (s *Server) onEvent(msg emu.EventMessage) {
+	event, node := msg.Event, msg.Node
+
 	bytes, err := json.Marshal(&map[string]interface{}{
 		"event": string(event),
 		"node":  node,
-		"data":  data,
+		"data":  msg.Data,
 	})
 
 	if err != nil {
@@ -185,94 +315,31 @@ func (s *Server) onEvent(event emu.Event, node emu.Node, data any) {
 	_ = s.websocket.BroadcastFilter(bytes, func(session *melody.Session) bool {
 		return session.MustGet("isFrontend").(bool)
 	})
-
-	switch event {
-	case emu.EventCollision:
-		go func() {
-			s.Lock()
-			defer s.Unlock()
-
-			val, ok := s.stats[node.ID]
-			if ok {
-				val.Collision += 1
-				s.stats[node.ID] = val
-			} else {
-				s.stats[node.ID] = NodeStat{
-					Received:  0,
-					Collision: 1,
-					Sending:   0,
-				}
-			}
-		}()
-	case emu.EventReceived:
-		go func() {
-			s.Lock()
-			defer s.Unlock()
-
-			val, ok := s.stats[node.ID]
-			if ok {
-				val.Received += 1
-				s.stats[node.ID] = val
-			} else {
-				s.stats[node.ID] = NodeStat{
-					Received:  1,
-					Collision: 0,
-					Sending:   0,
-				}
-			}
-		}()
-	case emu.EventSending:
-		go func() {
-			s.Lock()
-			defer s.Unlock()
-
-			val, ok := s.stats[node.ID]
-			if ok {
-				val.Sending += 1
-				s.stats[node.ID] = val
-			} else {
-				s.stats[node.ID] = NodeStat{
-					Received:  0,
-					Collision: 0,
-					Sending:   1,
-				}
-			}
-		}()
-	}
 }
 
-func (s *Server) onReceived(node emu.Node, packet emu.RxPacket) {
+func (s *Server) onReceived(node emu.Node, session nodeSession, packet emu.RxPacket) {
 	s.logger.Info("node got message", "id", node.ID, "len", len(packet.Data), "rssi", packet.RSSI)
 
-	bytes, err := json.Marshal(packet)
-	if err != nil {
-		s.logger.Error(err, "error while marshaling RxPacket", "id", node.ID)
-		return
+	if err := session.Deliver(packet); err != nil {
+		s.logger.Error(err, "error while delivering RxPacket", "id", node.ID, "transport", session.Transport())
 	}
-
-	_ = s.websocket.BroadcastFilter(bytes, func(session *melody.Session) bool {
-		return !session.MustGet("isFrontend").(bool) && session.MustGet("id").(string) == node.ID
-	})
 }
 
 func (s *Server) routeNodeWebsocketUpgrade(c echo.Context) error {
 	id := c.Param("id")
 
-	s.RLock()
-
 	if !s.emu.HasNode(id) {
-		return c.String(http.StatusBadRequest, "node doesn't exist")
+		return c.String(http.StatusBadRequest, ErrNodeNotFound.Error())
 	}
 
-	if _, ok := s.emuSessions[id]; ok {
-		return c.String(http.StatusBadRequest, "already connected")
+	if s.isConnected(id) {
+		return c.String(http.StatusBadRequest, ErrNodeAlreadyAttached.Error())
 	}
 
-	s.RUnlock()
-
 	if err := s.websocket.HandleRequestWithKeys(c.Response().Writer, c.Request(), map[string]interface{}{
 		"id":         id,
 		"isFrontend": false,
+		"protocol":   requestedProtocol(c.Request()),
 	}); err != nil {
 		return c.String(http.StatusBadRequest, err.Error())
 	}
@@ -315,6 +382,15 @@ func (s *Server) routeGetNode(c echo.Context) error {
 	return c.JSON(http.StatusOK, node)
 }
 
+func (s *Server) routeGetGatewayUsage(c echo.Context) error {
+	usage, err := s.emu.GatewayUsage(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
+
 func (s *Server) routeDeleteNode(c echo.Context) error {
 	id := c.Param("id")
 
@@ -326,6 +402,39 @@ func (s *Server) routeDeleteNode(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+func (s *Server) routeGetNodeQueue(c echo.Context) error {
+	queue, err := s.emu.Queue(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, queue)
+}
+
+func (s *Server) routeDeleteNodeQueue(c echo.Context) error {
+	flushed, err := s.emu.FlushQueue(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"flushed": flushed,
+	})
+}
+
+func (s *Server) routeDeleteNodeQueueTx(c echo.Context) error {
+	txID, err := strconv.ParseUint(c.Param("tx"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if err := s.emu.CancelTx(c.Param("id"), txID); err != nil {
+		return c.JSON(http.StatusNotFound, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
 func (s *Server) routePutNode(c echo.Context) error {
 	var updated emu.Node
 
@@ -390,6 +499,78 @@ func (s *Server) routeGetNodeIDs(c echo.Context) error {
 	return c.JSON(http.StatusOK, s.emu.NodeIDs())
 }
 
+func (s *Server) routeGetStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.stats.getTotals())
+}
+
+// statsWindow parses the window of the stats routes. Either the last N seconds of emulator time via
+// "last" or unix timestamps in ms via "from" and "to" can be given.
+func (s *Server) statsWindow(c echo.Context) (api.StatsWindow, error) {
+	var window api.StatsWindow
+
+	if last := c.QueryParam("last"); len(last) > 0 {
+		seconds, err := strconv.ParseFloat(last, 64)
+		if err != nil {
+			return window, err
+		}
+
+		now := s.now()
+		window.From = now.Add(-time.Duration(seconds * float64(time.Second))).UnixMilli()
+		window.To = now.UnixMilli()
+		return window, nil
+	}
+
+	if from := c.QueryParam("from"); len(from) > 0 {
+		val, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return window, err
+		}
+		window.From = val
+	}
+
+	if to := c.QueryParam("to"); len(to) > 0 {
+		val, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return window, err
+		}
+		window.To = val
+	}
+
+	return window, nil
+}
+
+// now returns the current time of the emulator or the position of the replay if one is active.
+func (s *Server) now() time.Time {
+	if replay := s.Replay(); replay != nil {
+		return replay.Position()
+	}
+
+	return s.emu.Now()
+}
+
+func (s *Server) routeGetNodeStats(c echo.Context) error {
+	window, err := s.statsWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, s.NodeStats(window))
+}
+
+func (s *Server) routeGetLinkStats(c echo.Context) error {
+	window, err := s.statsWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, s.LinkStats(window))
+}
+
+func (s *Server) routePostStatsReset(c echo.Context) error {
+	s.ResetStats()
+	return c.NoContent(http.StatusOK)
+}
+
 func (s *Server) routeGetEmuPause(c echo.Context) error {
 	if s.mobility == nil {
 		return c.JSON(http.StatusNotFound, "no mobility file active")
@@ -416,6 +597,230 @@ func (s *Server) routePostEmuPause(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+func (s *Server) routeGetReplay(c echo.Context) error {
+	replay := s.Replay()
+	if replay == nil {
+		return c.JSON(http.StatusNotFound, "no replay active")
+	}
+
+	return c.JSON(http.StatusOK, replay.Status())
+}
+
+func (s *Server) routePostReplayPlay(c echo.Context) error {
+	replay := s.Replay()
+	if replay == nil {
+		return c.JSON(http.StatusNotFound, "no replay active")
+	}
+
+	return c.JSON(http.StatusOK, replay.Play())
+}
+
+func (s *Server) routePostReplayPause(c echo.Context) error {
+	replay := s.Replay()
+	if replay == nil {
+		return c.JSON(http.StatusNotFound, "no replay active")
+	}
+
+	return c.JSON(http.StatusOK, replay.Pause())
+}
+
+func (s *Server) routePostReplaySeek(c echo.Context) error {
+	val := struct {
+		Time   *int64   `json:"time"`
+		Offset *float64 `json:"offset"`
+	}{}
+
+	if err := c.Bind(&val); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	replay := s.Replay()
+	if replay == nil {
+		return c.JSON(http.StatusNotFound, "no replay active")
+	}
+
+	switch {
+	case val.Time != nil:
+		return c.JSON(http.StatusOK, replay.Seek(time.UnixMilli(*val.Time)))
+	case val.Offset != nil:
+		start := time.UnixMilli(replay.Status().Start)
+		return c.JSON(http.StatusOK, replay.Seek(start.Add(time.Duration(*val.Offset*float64(time.Second)))))
+	}
+
+	return c.JSON(http.StatusBadRequest, "time or offset required")
+}
+
+func (s *Server) routePostReplayStep(c echo.Context) error {
+	val := struct {
+		Count int `json:"count"`
+	}{Count: 1}
+
+	if err := c.Bind(&val); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	replay := s.Replay()
+	if replay == nil {
+		return c.JSON(http.StatusNotFound, "no replay active")
+	}
+
+	return c.JSON(http.StatusOK, replay.Step(val.Count))
+}
+
+func (s *Server) routePostReplaySpeed(c echo.Context) error {
+	val := struct {
+		Speed float64 `json:"speed"`
+	}{}
+
+	if err := c.Bind(&val); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	replay := s.Replay()
+	if replay == nil {
+		return c.JSON(http.StatusNotFound, "no replay active")
+	}
+
+	status, err := replay.SetSpeed(val.Speed)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) routeGetLoRaWANDevices(c echo.Context) error {
+	if s.networkServer == nil {
+		return c.JSON(http.StatusNotFound, "no network server active")
+	}
+
+	return c.JSON(http.StatusOK, s.networkServer.Sessions())
+}
+
+func (s *Server) routeGetLoRaWANDevice(c echo.Context) error {
+	if s.networkServer == nil {
+		return c.JSON(http.StatusNotFound, "no network server active")
+	}
+
+	var devEUI lorawan.EUI64
+	if err := devEUI.UnmarshalText([]byte(c.Param("devEui"))); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	session, ok := s.networkServer.Session(devEUI)
+	if !ok {
+		return c.JSON(http.StatusNotFound, "not found")
+	}
+
+	return c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) routeGetEndDevices(c echo.Context) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	states := make([]enddevice.State, 0, len(s.endDevices))
+	for _, d := range s.endDevices {
+		states = append(states, d.State())
+	}
+
+	return c.JSON(http.StatusOK, states)
+}
+
+func (s *Server) routeGetEndDevice(c echo.Context) error {
+	var devEUI lorawan.EUI64
+	if err := devEUI.UnmarshalText([]byte(c.Param("devEui"))); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, d := range s.endDevices {
+		if d.DevEUI() == devEUI {
+			return c.JSON(http.StatusOK, d.State())
+		}
+	}
+
+	return c.JSON(http.StatusNotFound, "not found")
+}
+
+func (s *Server) routeGetTraffic(c echo.Context) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	status := make([]traffic.Status, 0, len(s.generators))
+	for _, g := range s.generators {
+		status = append(status, g.Status())
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) trafficGenerator(name string) *traffic.Generator {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, g := range s.generators {
+		if g.Name() == name {
+			return g
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) routePostTrafficStart(c echo.Context) error {
+	g := s.trafficGenerator(c.Param("name"))
+	if g == nil {
+		return c.JSON(http.StatusNotFound, "not found")
+	}
+
+	if err := g.Start(); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) routePostTrafficStop(c echo.Context) error {
+	g := s.trafficGenerator(c.Param("name"))
+	if g == nil {
+		return c.JSON(http.StatusNotFound, "not found")
+	}
+
+	if err := g.Stop(); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) routeGetWebhooks(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Webhooks())
+}
+
+func (s *Server) routePostWebhook(c echo.Context) error {
+	var config WebhookConfig
+	if err := c.Bind(&config); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if err := s.AddWebhook(config); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) routeDeleteWebhook(c echo.Context) error {
+	if err := s.RemoveWebhook(c.Param("name")); err != nil {
+		return c.JSON(http.StatusNotFound, err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
 func (s *Server) routeGetBackgroundImage(c echo.Context) error {
 	s.RLock()
 	defer s.RUnlock()
@@ -431,19 +836,122 @@ func (s *Server) routeGetBackgroundImage(c echo.Context) error {
 	return c.Stream(http.StatusOK, "image/png", buf)
 }
 
-// Start the LoRa emu server that hosts the frontend of the emulator.
-func (s *Server) Start(bind string) error {
+func (s *Server) routeGetGraph(c echo.Context) error {
+	graph := s.emu.Graph()
+
+	buf := &bytes.Buffer{}
+	switch c.QueryParam("format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, graph)
+	case "dot":
+		if err := graph.WriteDOT(buf); err != nil {
+			return c.JSON(http.StatusInternalServerError, err.Error())
+		}
+		return c.Stream(http.StatusOK, "text/vnd.graphviz", buf)
+	case "graphml":
+		if err := graph.WriteGraphML(buf); err != nil {
+			return c.JSON(http.StatusInternalServerError, err.Error())
+		}
+		return c.Stream(http.StatusOK, "application/graphml+xml", buf)
+	}
+
+	return c.JSON(http.StatusBadRequest, "unknown format")
+}
+
+func (s *Server) routeGetCoverage(c echo.Context) error {
+	options := CoverageOptions{
+		Nodes: c.QueryParams()["node"],
+		Scale: c.QueryParam("scale"),
+	}
+
+	for name, target := range map[string]*float64{
+		"z":       &options.Z,
+		"min":     &options.Min,
+		"max":     &options.Max,
+		"opacity": &options.Opacity,
+	} {
+		if val := c.QueryParam(name); len(val) > 0 {
+			parsed, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, err.Error())
+			}
+			*target = parsed
+		}
+	}
+
+	if val := c.QueryParam("resolution"); len(val) > 0 {
+		resolution, err := strconv.Atoi(val)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+		options.Resolution = resolution
+	}
+
+	img, err := s.Coverage(options)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	return c.Stream(http.StatusOK, "image/png", buf)
+}
+
+// routeGetPcap streams the air traffic as pcap capture until the client disconnects. If the client is too
+// slow the oldest packets are dropped.
+func (s *Server) routeGetPcap(c echo.Context) error {
+	subscription := s.emu.Subscribe(emu.SubscribeOptions{
+		Events:   pcap.Events,
+		Nodes:    c.QueryParams()["node"],
+		Overflow: emu.OverflowDropOldest,
+	})
+	defer subscription.Unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/vnd.tcpdump.pcap")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="loraemu.pcap"`)
+	res.WriteHeader(http.StatusOK)
+
+	writer, err := pcap.NewWriter(res, s.emu.GetPacketConfig().SyncWord)
+	if err != nil {
+		return nil
+	}
+	res.Flush()
+
+	for {
+		select {
+		case msg, ok := <-subscription.Events():
+			if !ok {
+				return nil
+			}
+
+			if err := writer.WriteEvent(msg); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// Setup registers the emulator handlers and all routes without starting to listen. This is useful
+// to serve the server with a custom listener, otherwise use Start.
+func (s *Server) Setup() error {
 	s.HideBanner = true
 
-	// sets event for the LoRa emu
-	s.emu.SetOnEvent(s.onEvent)
-	s.emu.SetOnReceived(s.onReceived)
+	// subscribe to the events of the LoRa emu
+	s.subscribe()
 
 	// set handlers for the websocket
 	s.websocket.Upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	s.websocket.Upgrader.Subprotocols = []string{SubprotocolV2}
 	s.websocket.HandleDisconnect(s.handleDisconnect)
 	s.websocket.HandleConnect(s.handleConnect)
 	s.websocket.HandleMessageBinary(s.handleMessageBinary)
+	s.websocket.HandleMessage(s.handleMessage)
 
 	// set websocket upgrader
 	s.GET("/api/emu/:id", s.routeNodeWebsocketUpgrade).Name = "Node Websocket"
@@ -454,13 +962,41 @@ func (s *Server) Start(bind string) error {
 	s.GET("/api/node_ids", s.routeGetNodeIDs).Name = "Get Node IDs"
 	s.GET("/api/node/:id/latlng", s.routeGetNodeLatLng).Name = "Get Node LatLng"
 	s.GET("/api/node/:id", s.routeGetNode).Name = "Get Node"
+	s.GET("/api/node/:id/gateway", s.routeGetGatewayUsage).Name = "Get Gateway Usage"
+	s.GET("/api/node/:id/queue", s.routeGetNodeQueue).Name = "Get Node TX Queue"
+	s.DELETE("/api/node/:id/queue", s.routeDeleteNodeQueue).Name = "Flush Node TX Queue"
+	s.DELETE("/api/node/:id/queue/:tx", s.routeDeleteNodeQueueTx).Name = "Cancel Node TX"
 	s.PUT("/api/node/update", s.routePutNode).Name = "Update Node"
 	s.PUT("/api/node/:id/meta", s.routePutNodeMeta).Name = "Update Node Meta Info"
 	s.POST("/api/node/create", s.routePostNode).Name = "Create Node"
 	s.DELETE("/api/node/:id", s.routeDeleteNode).Name = "Delete Node"
+	s.GET("/api/stats", s.routeGetStats).Name = "Get Stats"
+	s.GET("/api/stats/nodes", s.routeGetNodeStats).Name = "Get Node Stats"
+	s.GET("/api/stats/links", s.routeGetLinkStats).Name = "Get Link Stats"
+	s.POST("/api/stats/reset", s.routePostStatsReset).Name = "Reset Stats"
 	s.GET("/api/emu/pause", s.routeGetEmuPause).Name = "Get Pause Emu"
 	s.POST("/api/emu/pause", s.routePostEmuPause).Name = "Pause Emu"
+	s.GET("/api/replay", s.routeGetReplay).Name = "Get Replay"
+	s.POST("/api/replay/play", s.routePostReplayPlay).Name = "Play Replay"
+	s.POST("/api/replay/pause", s.routePostReplayPause).Name = "Pause Replay"
+	s.POST("/api/replay/seek", s.routePostReplaySeek).Name = "Seek Replay"
+	s.POST("/api/replay/step", s.routePostReplayStep).Name = "Step Replay"
+	s.POST("/api/replay/speed", s.routePostReplaySpeed).Name = "Set Replay Speed"
+	s.GET("/api/webhooks", s.routeGetWebhooks).Name = "Get Webhooks"
+	s.POST("/api/webhooks", s.routePostWebhook).Name = "Create Webhook"
+	s.DELETE("/api/webhooks/:name", s.routeDeleteWebhook).Name = "Delete Webhook"
 	s.GET("/api/background", s.routeGetBackgroundImage).Name = "Get Background Image"
+	s.GET("/api/lorawan/devices", s.routeGetLoRaWANDevices).Name = "Get LoRaWAN Devices"
+	s.GET("/api/lorawan/device/:devEui", s.routeGetLoRaWANDevice).Name = "Get LoRaWAN Device"
+	s.GET("/api/lorawan/end_devices", s.routeGetEndDevices).Name = "Get LoRaWAN End-Devices"
+	s.GET("/api/lorawan/end_device/:devEui", s.routeGetEndDevice).Name = "Get LoRaWAN End-Device"
+	s.GET("/api/traffic", s.routeGetTraffic).Name = "Get Traffic Generators"
+	s.POST("/api/traffic/:name/start", s.routePostTrafficStart).Name = "Start Traffic Generator"
+	s.POST("/api/traffic/:name/stop", s.routePostTrafficStop).Name = "Stop Traffic Generator"
+	s.GET("/api/graph", s.routeGetGraph).Name = "Get Graph"
+	s.GET("/api/coverage", s.routeGetCoverage).Name = "Get Coverage"
+	s.GET("/api/pcap", s.routeGetPcap).Name = "Stream Pcap"
+	s.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))).Name = "Metrics"
 
 	// api route that shows all available routes
 	s.GET("/api/routes", func(c echo.Context) error {
@@ -492,10 +1028,24 @@ func (s *Server) Start(bind string) error {
 		}
 	}
 
+	return nil
+}
+
+// Start the LoRa emu server that hosts the frontend of the emulator.
+func (s *Server) Start(bind string) error {
+	if err := s.Setup(); err != nil {
+		return err
+	}
+
 	return s.Echo.Start(bind)
 }
 
 // Stop the server.
 func (s *Server) Stop() error {
+	s.stopWebhooks()
+	s.stopReplay()
+	s.unsubscribe()
+	s.closeListeners()
+	s.closeSessions()
 	return s.Echo.Close()
 }
@@ -4,9 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/enddevice"
 	"github.com/BigJk/loraemu/lora"
+	"github.com/BigJk/loraemu/lorawan"
+	"github.com/BigJk/loraemu/netserver"
+	"github.com/BigJk/loraemu/pcap"
+	"github.com/BigJk/loraemu/traffic"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/labstack/echo/v4"
@@ -161,4 +168,256 @@ func TestServer(t *testing.T) {
 			assert.Len(t, testEmu.Nodes(), 0)
 		}
 	})
+
+	t.Run("GetGatewayUsage", func(t *testing.T) {
+		testEmu.Clear()
+
+		gateway := testNodeOk
+		gateway.Kind = emu.NodeKindGateway
+		gateway.Gateway = &emu.GatewayConfig{Demodulators: 4}
+
+		if !assert.NoError(t, testEmu.AddNode(gateway)) || !assert.Len(t, testEmu.Nodes(), 1) {
+			return
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := s.NewContext(req, rec)
+		c.SetPath("/api/node/:id/gateway")
+		c.SetParamNames("id")
+		c.SetParamValues(gateway.ID)
+
+		if assert.NoError(t, s.routeGetGatewayUsage(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var usage emu.GatewayUsage
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage)) {
+				assert.Equal(t, 4, usage.Demodulators)
+				assert.Equal(t, 0, usage.InUse)
+				assert.Equal(t, []float64{800}, usage.Channels)
+			}
+		}
+	})
+
+	t.Run("NodeQueue", func(t *testing.T) {
+		testEmu.Clear()
+
+		if !assert.NoError(t, testEmu.AddNode(testNodeOk)) || !assert.Len(t, testEmu.Nodes(), 1) {
+			return
+		}
+
+		// the first packet is sent right away, the others wait for it
+		for _, data := range []string{"first", "second", "third"} {
+			assert.NoError(t, testEmu.SendMessage(testNodeOk.ID, []byte(data)))
+		}
+
+		newContext := func(method string, path string, values ...string) (echo.Context, *httptest.ResponseRecorder) {
+			req := httptest.NewRequest(method, "/", nil)
+			rec := httptest.NewRecorder()
+			c := s.NewContext(req, rec)
+			c.SetPath(path)
+			c.SetParamNames("id", "tx")
+			c.SetParamValues(values...)
+			return c, rec
+		}
+
+		c, rec := newContext(http.MethodGet, "/api/node/:id/queue", testNodeOk.ID)
+		var queue []emu.QueuedTx
+		if assert.NoError(t, s.routeGetNodeQueue(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queue)) && assert.Len(t, queue, 2) {
+				assert.Equal(t, []byte("second"), queue[0].Data)
+			}
+		}
+
+		if len(queue) == 2 {
+			c, rec = newContext(http.MethodDelete, "/api/node/:id/queue/:tx", testNodeOk.ID, strconv.FormatUint(queue[0].ID, 10))
+			if assert.NoError(t, s.routeDeleteNodeQueueTx(c)) {
+				assert.Equal(t, http.StatusOK, rec.Code)
+			}
+		}
+
+		c, rec = newContext(http.MethodDelete, "/api/node/:id/queue/:tx", testNodeOk.ID, "invalid")
+		if assert.NoError(t, s.routeDeleteNodeQueueTx(c)) {
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+
+		c, rec = newContext(http.MethodDelete, "/api/node/:id/queue", testNodeOk.ID)
+		if assert.NoError(t, s.routeDeleteNodeQueue(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, `{"flushed":1}`, rec.Body.String())
+		}
+
+		c, rec = newContext(http.MethodGet, "/api/node/:id/queue", "unknown")
+		if assert.NoError(t, s.routeGetNodeQueue(c)) {
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+
+		testEmu.Wait()
+	})
+
+	t.Run("GetGraph", func(t *testing.T) {
+		for format, contentType := range map[string]string{
+			"":        echo.MIMEApplicationJSON,
+			"dot":     "text/vnd.graphviz",
+			"graphml": "application/graphml+xml",
+		} {
+			rec := httptest.NewRecorder()
+			if assert.NoError(t, s.routeGetGraph(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/graph?format="+format, nil), rec))) {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Contains(t, rec.Header().Get(echo.HeaderContentType), contentType)
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		if assert.NoError(t, s.routeGetGraph(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/graph?format=png", nil), rec))) {
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("GetLoRaWANDevice", func(t *testing.T) {
+		devEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		s.SetNetworkServer(netserver.New(testEmu, netserver.Config{
+			Devices: []netserver.DeviceConfig{{DevEUI: devEUI}},
+		}))
+		defer s.SetNetworkServer(nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := s.NewContext(req, rec)
+		c.SetPath("/api/lorawan/device/:devEui")
+		c.SetParamNames("devEui")
+		c.SetParamValues(devEUI.String())
+
+		if assert.NoError(t, s.routeGetLoRaWANDevice(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var session netserver.DeviceSession
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &session)) {
+				assert.Equal(t, devEUI, session.DevEUI)
+				assert.False(t, session.Joined)
+			}
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		rec = httptest.NewRecorder()
+		c = s.NewContext(req, rec)
+		c.SetPath("/api/lorawan/device/:devEui")
+		c.SetParamNames("devEui")
+		c.SetParamValues("0000000000000001")
+
+		if assert.NoError(t, s.routeGetLoRaWANDevice(c)) {
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		}
+	})
+
+	t.Run("GetEndDevice", func(t *testing.T) {
+		devEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		d, err := enddevice.New(testEmu, enddevice.Config{Node: "Node1", DevEUI: devEUI, DataRate: 5})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		s.SetEndDevices([]*enddevice.Device{d})
+		defer s.SetEndDevices(nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := s.NewContext(req, rec)
+		c.SetPath("/api/lorawan/end_device/:devEui")
+		c.SetParamNames("devEui")
+		c.SetParamValues(devEUI.String())
+
+		if assert.NoError(t, s.routeGetEndDevice(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var state enddevice.State
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state)) {
+				assert.Equal(t, devEUI, state.DevEUI)
+				assert.Equal(t, "Node1", state.Node)
+				assert.Equal(t, 5, state.DataRate)
+				assert.False(t, state.Joined)
+			}
+		}
+	})
+
+	t.Run("TrafficGenerator", func(t *testing.T) {
+		g, err := traffic.New(testEmu, traffic.Config{Name: "load", Kind: traffic.KindPeriodic, Nodes: []string{"Node1"}, Interval: 3600})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		s.SetTrafficGenerators([]*traffic.Generator{g})
+		defer s.SetTrafficGenerators(nil)
+
+		for _, route := range []struct {
+			name   string
+			action func(c echo.Context) error
+			code   int
+		}{
+			{"load", s.routePostTrafficStart, http.StatusOK},
+			{"load", s.routePostTrafficStart, http.StatusBadRequest},
+			{"load", s.routePostTrafficStop, http.StatusOK},
+			{"missing", s.routePostTrafficStop, http.StatusNotFound},
+		} {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			rec := httptest.NewRecorder()
+			c := s.NewContext(req, rec)
+			c.SetParamNames("name")
+			c.SetParamValues(route.name)
+
+			if assert.NoError(t, route.action(c)) {
+				assert.Equal(t, route.code, rec.Code)
+			}
+		}
+		g.Done()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/traffic", nil)
+		rec := httptest.NewRecorder()
+
+		if assert.NoError(t, s.routeGetTraffic(s.NewContext(req, rec))) {
+			var status []traffic.Status
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status)) && assert.Len(t, status, 1) {
+				assert.Equal(t, "load", status[0].Name)
+				assert.False(t, status[0].Running)
+			}
+		}
+	})
+}
+
+func TestServer_Pcap(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+	assert.NoError(t, testEmu.AddNode(emu.Node{ID: "Node1", Online: true, X: 1, Y: 1, TXGain: 14, RXSens: -137}))
+	assert.NoError(t, testEmu.AddNode(emu.Node{ID: "Node2", Online: true, X: 1.5, Y: 1, TXGain: 14, RXSens: -137}))
+
+	s := New(testEmu)
+	assert.NoError(t, s.Setup())
+	defer s.Stop()
+
+	httpServer := httptest.NewServer(s)
+	defer httpServer.Close()
+
+	res, err := http.Get(httpServer.URL + "/api/pcap?node=Node2")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	assert.Equal(t, "application/vnd.tcpdump.pcap", res.Header.Get(echo.HeaderContentType))
+
+	// the file header is sent right away
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(res.Body, header); assert.NoError(t, err) {
+		assert.Equal(t, []byte{0xd4, 0xc3, 0xb2, 0xa1}, header[:4])
+	}
+
+	assert.NoError(t, testEmu.SendMessage("Node1", []byte("hello")))
+
+	// only the reception of Node2 is streamed
+	record := make([]byte, 16+pcap.HeaderLen+5)
+	if _, err := io.ReadFull(res.Body, record); assert.NoError(t, err) {
+		assert.Equal(t, []byte("hello"), record[16+pcap.HeaderLen:])
+		assert.NotZero(t, record[16+10], "reception without rssi")
+	}
 }
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+// Errors returned when a node session can't be registered.
+var (
+	ErrNodeNotFound        = errors.New("node doesn't exist")
+	ErrNodeAlreadyAttached = errors.New("already connected")
+)
+
+// SessionWriteTimeout is the time after which a write to a node that doesn't read its connection fails. The
+// session is closed afterwards, so a stuck node can't block the delivery to other nodes.
+var SessionWriteTimeout = time.Second * 5
+
+// nodeSession represents the connection of a node over any of the transports. Only one session per
+// node is allowed across all transports.
+type nodeSession interface {
+	// Transport returns the name of the transport (e.g. websocket, tcp).
+	Transport() string
+	// Deliver sends a received packet to the node.
+	Deliver(packet emu.RxPacket) error
+	// Close closes the connection.
+	Close() error
+}
+
+// registerSession adds the session of a node to the registry.
+func (s *Server) registerSession(id string, session nodeSession) error {
+	if !s.emu.HasNode(id) {
+		return ErrNodeNotFound
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.nodeSessions[id]; ok {
+		s.logger.Error(nil, "node denied connection", "id", id, "transport", session.Transport())
+		return ErrNodeAlreadyAttached
+	}
+
+	s.nodeSessions[id] = session
+	s.deliveries[id] = s.deliver(id, session)
+	s.logger.Info("node connected", "id", id, "transport", session.Transport())
+
+	return nil
+}
+
+// unregisterSession removes the session of a node from the registry if it is still the registered one.
+func (s *Server) unregisterSession(id string, session nodeSession) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.nodeSessions[id] != session {
+		return
+	}
+
+	delete(s.nodeSessions, id)
+	s.deliveries[id].Unsubscribe()
+	delete(s.deliveries, id)
+	s.logger.Info("node disconnected", "id", id, "transport", session.Transport())
+}
+
+// deliver forwards the received packets of the node to its session. Every session has its own buffered
+// subscription, so a slow node only loses its oldest packets and never blocks the emulator or other nodes.
+func (s *Server) deliver(id string, session nodeSession) *emu.Subscription {
+	subscription := s.emu.Subscribe(emu.SubscribeOptions{
+		Events:   []emu.Event{emu.EventReceived},
+		Nodes:    []string{id},
+		Overflow: emu.OverflowDropOldest,
+	})
+
+	go func() {
+		for msg := range subscription.Events() {
+			if packet, ok := msg.Packet(); ok {
+				s.onReceived(msg.Node, session, packet)
+			}
+		}
+	}()
+
+	return subscription
+}
+
+// isConnected checks if a node has a session.
+func (s *Server) isConnected(id string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.nodeSessions[id]
+	return ok
+}
+
+// closeSessions closes all node sessions.
+func (s *Server) closeSessions() {
+	s.RLock()
+	sessions := make([]nodeSession, 0, len(s.nodeSessions))
+	for _, session := range s.nodeSessions {
+		sessions = append(sessions, session)
+	}
+	s.RUnlock()
+
+	for _, session := range sessions {
+		_ = session.Close()
+	}
+}
+
+// websocketSession is a node connected via the /api/emu/:id websocket.
+type websocketSession struct {
+	session *melody.Session
+}
+
+func (w *websocketSession) Transport() string {
+	return "websocket"
+}
+
+func (w *websocketSession) Deliver(packet emu.RxPacket) error {
+	var bytes []byte
+	var err error
+
+	if sessionProtocol(w.session) == ProtocolV2 {
+		bytes, err = json.Marshal(Message{Type: MessageRx, Packet: &packet})
+	} else {
+		bytes, err = json.Marshal(packet)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return w.session.Write(bytes)
+}
+
+func (w *websocketSession) Close() error {
+	return w.session.Close()
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"github.com/BigJk/loraemu/api"
+	"github.com/BigJk/loraemu/emu"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type sentRecord struct {
+	node    string
+	start   int64
+	airtime float64
+}
+
+type receptionRecord struct {
+	from      string
+	to        string
+	sent      int64
+	rssi      int
+	snr       int
+	collision bool
+}
+
+// transmissionKey identifies a transmission, as a node can only send one packet at a time.
+type transmissionKey struct {
+	node  string
+	start int64
+}
+
+// summary accumulates values for a ValueSummary.
+type summary struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (s *summary) add(val float64) {
+	if s.count == 0 {
+		s.min = val
+		s.max = val
+	}
+
+	s.count++
+	s.sum += val
+	s.min = math.Min(s.min, val)
+	s.max = math.Max(s.max, val)
+}
+
+func (s *summary) merge(other summary) {
+	if other.count == 0 {
+		return
+	}
+
+	if s.count == 0 {
+		*s = other
+		return
+	}
+
+	s.count += other.count
+	s.sum += other.sum
+	s.min = math.Min(s.min, other.min)
+	s.max = math.Max(s.max, other.max)
+}
+
+func (s *summary) value() *api.ValueSummary {
+	if s.count == 0 {
+		return nil
+	}
+
+	return &api.ValueSummary{Min: s.min, Mean: s.sum / float64(s.count), Max: s.max}
+}
+
+func ratio(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+
+	return float64(a) / float64(b)
+}
+
+// DefaultStatsRetention is the emulator time for which the sent and received packets are kept for windowed
+// stats queries.
+const DefaultStatsRetention = time.Hour
+
+// deliveryKey identifies the reception of a transmission by one receiver.
+type deliveryKey struct {
+	from string
+	to   string
+	sent int64
+}
+
+type nodeAggregate struct {
+	stats api.NodeStats
+	rssi  summary
+	snr   summary
+}
+
+type linkAggregate struct {
+	stats     api.LinkStats
+	delivered int
+	rssi      summary
+	snr       summary
+}
+
+// aggregate accumulates the statistics of sent and received packets per node and link.
+type aggregate struct {
+	nodes map[string]*nodeAggregate
+	links map[[2]string]*linkAggregate
+}
+
+func newAggregate() *aggregate {
+	return &aggregate{nodes: map[string]*nodeAggregate{}, links: map[[2]string]*linkAggregate{}}
+}
+
+func (a *aggregate) node(id string) *nodeAggregate {
+	node, ok := a.nodes[id]
+	if !ok {
+		node = &nodeAggregate{}
+		a.nodes[id] = node
+	}
+
+	return node
+}
+
+func (a *aggregate) link(from string, to string) *linkAggregate {
+	key := [2]string{from, to}
+
+	link, ok := a.links[key]
+	if !ok {
+		link = &linkAggregate{stats: api.LinkStats{From: from, To: to}}
+		a.links[key] = link
+	}
+
+	return link
+}
+
+// add accumulates the records in the window. The receptions of a transmission have to be added in the same
+// call, as the delivered packets are only counted once per transmission.
+func (a *aggregate) add(sent []sentRecord, receptions []receptionRecord, window api.StatsWindow) {
+	for _, record := range sent {
+		if !window.Contains(record.start) {
+			continue
+		}
+
+		node := a.node(record.node)
+		node.stats.Sent++
+		node.stats.AirtimeMs += record.airtime
+	}
+
+	delivered := map[transmissionKey]bool{}
+	linkDelivered := map[deliveryKey]bool{}
+	for _, reception := range receptions {
+		if !window.Contains(reception.sent) {
+			continue
+		}
+
+		node := a.node(reception.to)
+		link := a.link(reception.from, reception.to)
+
+		if reception.collision {
+			node.stats.Collisions++
+			link.stats.Collisions++
+			continue
+		}
+
+		node.stats.Received++
+		node.rssi.add(float64(reception.rssi))
+		node.snr.add(float64(reception.snr))
+
+		link.stats.Received++
+		link.rssi.add(float64(reception.rssi))
+		link.snr.add(float64(reception.snr))
+
+		if key := (transmissionKey{node: reception.from, start: reception.sent}); !delivered[key] {
+			delivered[key] = true
+			a.node(reception.from).stats.Delivered++
+		}
+
+		if key := (deliveryKey{from: reception.from, to: reception.to, sent: reception.sent}); !linkDelivered[key] {
+			linkDelivered[key] = true
+			link.delivered++
+		}
+	}
+}
+
+// merge adds the statistics of the other aggregate.
+func (a *aggregate) merge(other *aggregate) {
+	for id, o := range other.nodes {
+		node := a.node(id)
+		node.stats.Sent += o.stats.Sent
+		node.stats.Delivered += o.stats.Delivered
+		node.stats.Received += o.stats.Received
+		node.stats.Collisions += o.stats.Collisions
+		node.stats.AirtimeMs += o.stats.AirtimeMs
+		node.rssi.merge(o.rssi)
+		node.snr.merge(o.snr)
+	}
+
+	for key, o := range other.links {
+		link := a.link(key[0], key[1])
+		link.stats.Received += o.stats.Received
+		link.stats.Collisions += o.stats.Collisions
+		link.delivered += o.delivered
+		link.rssi.merge(o.rssi)
+		link.snr.merge(o.snr)
+	}
+}
+
+func (a *aggregate) copy() *aggregate {
+	c := newAggregate()
+	c.merge(a)
+	return c
+}
+
+func (a *aggregate) nodeStats() map[string]api.NodeStats {
+	nodes := make(map[string]api.NodeStats, len(a.nodes))
+	for id, node := range a.nodes {
+		stats := node.stats
+		stats.DeliveryRatio = ratio(stats.Delivered, stats.Sent)
+		stats.RSSI = node.rssi.value()
+		stats.SNR = node.snr.value()
+		nodes[id] = stats
+	}
+
+	return nodes
+}
+
+func (a *aggregate) linkStats() []api.LinkStats {
+	links := make([]api.LinkStats, 0, len(a.links))
+	for _, link := range a.links {
+		stats := link.stats
+		if sender, ok := a.nodes[stats.From]; ok {
+			stats.Sent = sender.stats.Sent
+		}
+		stats.DeliveryRatio = ratio(link.delivered, stats.Sent)
+		stats.RSSI = link.rssi.value()
+		stats.SNR = link.snr.value()
+		links = append(links, stats)
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+
+	return links
+}
+
+// stats records the sent and received packets. The events are counted synchronously, so the numbers
+// are exact once the emulator is idle. Packets older than the retention are folded into the running
+// totals, so they only count towards queries without a window.
+type stats struct {
+	sync.Mutex
+
+	retention  int64
+	totals     map[string]api.NodeStat
+	archived   *aggregate
+	sent       []sentRecord
+	receptions []receptionRecord
+}
+
+func newStats() *stats {
+	return &stats{
+		retention: DefaultStatsRetention.Milliseconds(),
+		totals:    map[string]api.NodeStat{},
+		archived:  newAggregate(),
+	}
+}
+
+func (s *stats) setRetention(retention time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.retention = retention.Milliseconds()
+}
+
+func (s *stats) observe(msg emu.EventMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	total := s.totals[msg.Node.ID]
+
+	switch msg.Event {
+	case emu.EventSending:
+		total.Sending++
+
+		transmission, ok := msg.Data.(emu.Transmission)
+		if !ok {
+			break
+		}
+
+		s.sent = append(s.sent, sentRecord{node: msg.Node.ID, start: transmission.Start, airtime: transmission.Airtime})
+		s.pruneLocked(transmission.Start - s.retention)
+	case emu.EventReceived, emu.EventCollision:
+		if msg.Event == emu.EventReceived {
+			total.Received++
+		} else {
+			total.Collision++
+		}
+
+		reception, ok := msg.Data.(emu.Reception)
+		if !ok {
+			break
+		}
+
+		s.receptions = append(s.receptions, receptionRecord{
+			from:      reception.From,
+			to:        msg.Node.ID,
+			sent:      reception.Sent,
+			rssi:      reception.RSSI,
+			snr:       reception.SNR,
+			collision: msg.Event == emu.EventCollision,
+		})
+	}
+
+	s.totals[msg.Node.ID] = total
+}
+
+// pruneLocked moves the packets sent before the horizon into the running totals. The receptions are
+// received after their transmission, so they are pruned together with it.
+func (s *stats) pruneLocked(horizon int64) {
+	sent := 0
+	for sent < len(s.sent) && s.sent[sent].start < horizon {
+		sent++
+	}
+
+	receptions := 0
+	for receptions < len(s.receptions) && s.receptions[receptions].sent < horizon {
+		receptions++
+	}
+
+	if sent == 0 && receptions == 0 {
+		return
+	}
+
+	s.archived.add(s.sent[:sent], s.receptions[:receptions], api.StatsWindow{})
+	s.sent = s.sent[sent:]
+	s.receptions = s.receptions[receptions:]
+}
+
+func (s *stats) reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.totals = map[string]api.NodeStat{}
+	s.archived = newAggregate()
+	s.sent = nil
+	s.receptions = nil
+}
+
+// statsSnapshot is a copy of the recorded packets, e.g. for the checkpoints of a replay.
+type statsSnapshot struct {
+	totals     map[string]api.NodeStat
+	archived   *aggregate
+	sent       []sentRecord
+	receptions []receptionRecord
+}
+
+func copyTotals(totals map[string]api.NodeStat) map[string]api.NodeStat {
+	c := make(map[string]api.NodeStat, len(totals))
+	for id, total := range totals {
+		c[id] = total
+	}
+
+	return c
+}
+
+func (s *stats) snapshot() statsSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	// the records are only appended, so limiting the capacity keeps appends from changing the snapshot
+	return statsSnapshot{
+		totals:     copyTotals(s.totals),
+		archived:   s.archived.copy(),
+		sent:       s.sent[:len(s.sent):len(s.sent)],
+		receptions: s.receptions[:len(s.receptions):len(s.receptions)],
+	}
+}
+
+func (s *stats) restore(snapshot statsSnapshot) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.totals = copyTotals(snapshot.totals)
+	s.archived = snapshot.archived.copy()
+	s.sent = snapshot.sent
+	s.receptions = snapshot.receptions
+}
+
+func (s *stats) getTotals() map[string]api.NodeStat {
+	s.Lock()
+	defer s.Unlock()
+
+	return copyTotals(s.totals)
+}
+
+// aggregateLocked accumulates the packets in the window. Without a window the running totals of the
+// pruned packets are included.
+func (s *stats) aggregateLocked(window api.StatsWindow) *aggregate {
+	result := newAggregate()
+	if window == (api.StatsWindow{}) {
+		result.merge(s.archived)
+	}
+	result.add(s.sent, s.receptions, window)
+
+	return result
+}
+
+func (s *stats) nodes(window api.StatsWindow) map[string]api.NodeStats {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.aggregateLocked(window).nodeStats()
+}
+
+func (s *stats) links(window api.StatsWindow) []api.LinkStats {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.aggregateLocked(window).linkStats()
+}
+
+// NodeStats returns the statistics of all nodes that sent or received packets in the window.
+func (s *Server) NodeStats(window api.StatsWindow) map[string]api.NodeStats {
+	return s.stats.nodes(window)
+}
+
+// LinkStats returns the statistics of all sender and receiver pairs with at least one received or
+// collided packet in the window, sorted by sender and receiver.
+func (s *Server) LinkStats(window api.StatsWindow) []api.LinkStats {
+	return s.stats.links(window)
+}
+
+// SetStatsRetention sets the emulator time for which the packets are kept for windowed stats queries.
+// Older packets only count towards the stats without a window. Defaults to DefaultStatsRetention.
+func (s *Server) SetStatsRetention(retention time.Duration) {
+	s.stats.setRetention(retention)
+}
+
+// ResetStats forgets all recorded packets, e.g. between the phases of an experiment.
+func (s *Server) ResetStats() {
+	s.stats.reset()
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/BigJk/loraemu/api"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sendingMessage(id string, start int64) emu.EventMessage {
+	return emu.EventMessage{Event: emu.EventSending, Node: emu.Node{ID: id}, Data: emu.Transmission{
+		Start:   start,
+		Stop:    start + 50,
+		Airtime: 50,
+	}}
+}
+
+func receptionMessage(event emu.Event, from string, to string, sent int64, rssi int) emu.EventMessage {
+	return emu.EventMessage{Event: event, Node: emu.Node{ID: to}, Data: emu.Reception{
+		RxPacket: emu.RxPacket{RSSI: rssi, SNR: rssi + 130},
+		From:     from,
+		Sent:     sent,
+	}}
+}
+
+func TestStats(t *testing.T) {
+	s := newStats()
+
+	// first phase: both packets of 1 reach 2, only the first reaches 3
+	s.observe(sendingMessage("1", 1000))
+	s.observe(receptionMessage(emu.EventReceived, "1", "2", 1000, -100))
+	s.observe(receptionMessage(emu.EventReceived, "1", "3", 1000, -120))
+	s.observe(sendingMessage("1", 2000))
+	s.observe(receptionMessage(emu.EventReceived, "1", "2", 2000, -90))
+	s.observe(receptionMessage(emu.EventCollision, "1", "3", 2000, -121))
+
+	// second phase: 3 sends a packet that doesn't arrive anywhere
+	s.observe(sendingMessage("3", 5000))
+
+	nodes := s.nodes(api.StatsWindow{})
+	assert.Equal(t, api.NodeStats{Sent: 2, Delivered: 2, DeliveryRatio: 1, AirtimeMs: 100}, nodes["1"])
+	assert.Equal(t, 2, nodes["2"].Received)
+	assert.Equal(t, &api.ValueSummary{Min: -100, Mean: -95, Max: -90}, nodes["2"].RSSI)
+	assert.Equal(t, &api.ValueSummary{Min: 30, Mean: 35, Max: 40}, nodes["2"].SNR)
+	assert.Equal(t, 1, nodes["3"].Received)
+	assert.Equal(t, 1, nodes["3"].Collisions)
+	assert.Equal(t, 1, nodes["3"].Sent)
+	assert.Equal(t, 0.0, nodes["3"].DeliveryRatio)
+
+	links := s.links(api.StatsWindow{})
+	if assert.Len(t, links, 2) {
+		assert.Equal(t, "2", links[0].To)
+		assert.Equal(t, 2, links[0].Received)
+		assert.Equal(t, 1.0, links[0].DeliveryRatio)
+
+		assert.Equal(t, "3", links[1].To)
+		assert.Equal(t, 2, links[1].Sent)
+		assert.Equal(t, 1, links[1].Received)
+		assert.Equal(t, 1, links[1].Collisions)
+		assert.Equal(t, 0.5, links[1].DeliveryRatio)
+		assert.Equal(t, &api.ValueSummary{Min: -120, Mean: -120, Max: -120}, links[1].RSSI)
+	}
+
+	// the window only contains the second packet of 1
+	window := api.StatsWindow{From: 1500, To: 3000}
+	nodes = s.nodes(window)
+	assert.Len(t, nodes, 3)
+	assert.Equal(t, 1, nodes["1"].Sent)
+	assert.Equal(t, 1, nodes["2"].Received)
+	assert.Equal(t, 0, nodes["3"].Received)
+	assert.Equal(t, 1, nodes["3"].Collisions)
+	assert.Nil(t, nodes["3"].RSSI)
+
+	links = s.links(window)
+	if assert.Len(t, links, 2) {
+		assert.Equal(t, 0.0, links[1].DeliveryRatio)
+		assert.Nil(t, links[1].RSSI)
+	}
+
+	assert.Equal(t, map[string]api.NodeStat{
+		"1": {Sending: 2},
+		"2": {Received: 2},
+		"3": {Received: 1, Collision: 1, Sending: 1},
+	}, s.getTotals())
+
+	s.reset()
+	assert.Empty(t, s.nodes(api.StatsWindow{}))
+	assert.Empty(t, s.links(api.StatsWindow{}))
+	assert.Empty(t, s.getTotals())
+}
+
+func TestStats_Retention(t *testing.T) {
+	full := newStats()
+	pruned := newStats()
+	pruned.setRetention(2500 * time.Millisecond)
+
+	for _, msg := range []emu.EventMessage{
+		sendingMessage("1", 1000),
+		receptionMessage(emu.EventReceived, "1", "2", 1000, -100),
+		receptionMessage(emu.EventReceived, "1", "2", 1000, -100),
+		receptionMessage(emu.EventReceived, "1", "3", 1000, -120),
+		sendingMessage("1", 2000),
+		receptionMessage(emu.EventCollision, "1", "3", 2000, -121),
+		sendingMessage("3", 5000),
+		receptionMessage(emu.EventReceived, "3", "1", 5000, -90),
+	} {
+		full.observe(msg)
+		pruned.observe(msg)
+	}
+
+	// the packets of 1 are older than the retention and only kept in the running totals
+	assert.Len(t, pruned.sent, 1)
+	assert.Len(t, pruned.receptions, 1)
+	assert.Equal(t, full.nodes(api.StatsWindow{}), pruned.nodes(api.StatsWindow{}))
+	assert.Equal(t, full.links(api.StatsWindow{}), pruned.links(api.StatsWindow{}))
+
+	window := api.StatsWindow{From: 1500, To: 3000}
+	assert.NotEmpty(t, full.nodes(window))
+	assert.Empty(t, pruned.nodes(window))
+	assert.Empty(t, pruned.links(window))
+}
+
+func TestStats_Routes(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+
+	for i, id := range []string{"Node1", "Node2"} {
+		assert.NoError(t, testEmu.AddNode(emu.Node{ID: id, Online: true, X: 1 + float64(i)*0.5, Y: 1, TXGain: 14, RXSens: -137}))
+	}
+
+	s := New(testEmu)
+	assert.NoError(t, s.Setup())
+	defer s.Stop()
+
+	assert.NoError(t, testEmu.SendMessage("Node1", []byte("hello")))
+	testEmu.Wait()
+
+	// the events are counted synchronously, so the stats are complete as soon as the emulator is idle
+	rec := httptest.NewRecorder()
+	if assert.NoError(t, s.routeGetNodeStats(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/stats/nodes?last=60", nil), rec))) {
+		var nodes map[string]api.NodeStats
+		if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &nodes)) {
+			assert.Equal(t, 1, nodes["Node1"].Sent)
+			assert.Equal(t, 1.0, nodes["Node1"].DeliveryRatio)
+			assert.Equal(t, 1, nodes["Node2"].Received)
+			assert.NotNil(t, nodes["Node2"].RSSI)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	if assert.NoError(t, s.routeGetLinkStats(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/stats/links?from=1&to=2", nil), rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, "[]", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	if assert.NoError(t, s.routeGetLinkStats(s.NewContext(httptest.NewRequest(http.MethodGet, "/api/stats/links?last=abc", nil), rec))) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	if assert.NoError(t, s.routePostStatsReset(s.NewContext(httptest.NewRequest(http.MethodPost, "/api/stats/reset", nil), rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Empty(t, s.LinkStats(api.StatsWindow{}))
+}
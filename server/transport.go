@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MaxFrameSize is the maximum size of a length-prefixed frame on the stream transports.
+const MaxFrameSize = 64 * 1024
+
+// UDPSessionTimeout is the time after which a UDP node without any datagram is disconnected.
+var UDPSessionTimeout = time.Minute * 5
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// readFrame reads a frame that is prefixed by its length as big endian uint32.
+func readFrame(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// writeFrame writes a frame that is prefixed by its length as big endian uint32.
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// streamSession is a node connected via a TCP or Unix domain socket.
+type streamSession struct {
+	sync.Mutex
+
+	transport string
+	conn      net.Conn
+}
+
+func (s *streamSession) Transport() string {
+	return s.transport
+}
+
+func (s *streamSession) Deliver(packet emu.RxPacket) error {
+	bytes, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(SessionWriteTimeout)); err != nil {
+		return err
+	}
+
+	if err := writeFrame(s.conn, bytes); err != nil {
+		// the read loop of the session ends with the closed connection and unregisters it
+		_ = s.conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (s *streamSession) Close() error {
+	return s.conn.Close()
+}
+
+// ListenTCP starts a TCP listener for nodes. Every frame is prefixed by its length as big endian
+// uint32. The first frame sent by the client is the id of the node, every following frame is
+// transmitted by the node. Received packets are sent back as JSON encoded RxPacket frames.
+func (s *Server) ListenTCP(bind string) (net.Addr, error) {
+	return s.listenStream("tcp", bind)
+}
+
+// ListenUnix starts a Unix domain socket listener for nodes. It uses the same protocol as ListenTCP.
+// An existing file at the path is removed.
+func (s *Server) ListenUnix(path string) (net.Addr, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return s.listenStream("unix", path)
+}
+
+func (s *Server) listenStream(network string, address string) (net.Addr, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.Unlock()
+
+	go s.acceptStream(network, listener)
+
+	s.logger.Info("node transport listening", "transport", network, "addr", listener.Addr().String())
+
+	return listener.Addr(), nil
+}
+
+func (s *Server) acceptStream(network string, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handleStreamConn(&streamSession{transport: network, conn: conn})
+	}
+}
+
+func (s *Server) handleStreamConn(session *streamSession) {
+	defer func() {
+		_ = session.Close()
+	}()
+
+	id, err := readFrame(session.conn)
+	if err != nil {
+		return
+	}
+
+	// check if the node already is connected to, if so close the new connection
+	if err := s.registerSession(string(id), session); err != nil {
+		return
+	}
+	defer s.unregisterSession(string(id), session)
+
+	for {
+		data, err := readFrame(session.conn)
+		if err != nil {
+			return
+		}
+
+		if err := s.emu.SendMessage(string(id), data); err != nil {
+			s.logger.Error(err, "node couldn't send frame", "id", string(id), "transport", session.transport)
+		}
+	}
+}
+
+// udpSession is a node connected via its UDP port. The address of the node is learned from the
+// first datagram.
+type udpSession struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (u *udpSession) Transport() string {
+	return "udp"
+}
+
+func (u *udpSession) Deliver(packet emu.RxPacket) error {
+	bytes, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	_, err = u.conn.WriteToUDP(bytes, u.addr)
+	return err
+}
+
+func (u *udpSession) Close() error {
+	// the socket belongs to the listener, so only the session ends
+	return nil
+}
+
+// ListenUDP starts a UDP socket for a node. The first datagram attaches the sending client, every
+// datagram of it is transmitted by the node and received packets are sent back as JSON encoded
+// RxPacket datagrams. An empty datagram detaches the client, as does no datagram within UDPSessionTimeout.
+func (s *Server) ListenUDP(id string, bind string) (net.Addr, error) {
+	if !s.emu.HasNode(id) {
+		return nil, ErrNodeNotFound
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.listeners = append(s.listeners, conn)
+	s.Unlock()
+
+	go s.handleUDP(id, conn)
+
+	s.logger.Info("node transport listening", "transport", "udp", "id", id, "addr", conn.LocalAddr().String())
+
+	return conn.LocalAddr(), nil
+}
+
+func (s *Server) handleUDP(id string, conn *net.UDPConn) {
+	var session *udpSession
+
+	disconnect := func() {
+		if session != nil {
+			s.unregisterSession(id, session)
+			session = nil
+		}
+	}
+	defer disconnect()
+
+	buf := make([]byte, MaxFrameSize)
+
+	for {
+		if session != nil {
+			_ = conn.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+		} else {
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				disconnect()
+				continue
+			}
+			return
+		}
+
+		if session == nil {
+			if n == 0 {
+				continue
+			}
+
+			newSession := &udpSession{conn: conn, addr: addr}
+			if err := s.registerSession(id, newSession); err != nil {
+				continue
+			}
+			session = newSession
+		} else if addr.String() != session.addr.String() {
+			// only the attached client is allowed to transmit
+			continue
+		}
+
+		if n == 0 {
+			disconnect()
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		if err := s.emu.SendMessage(id, data); err != nil {
+			s.logger.Error(err, "node couldn't send datagram", "id", id, "transport", "udp")
+		}
+	}
+}
+
+// closeListeners closes all listeners of the node transports.
+func (s *Server) closeListeners() {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, listener := range s.kissListeners {
+		_ = listener.Close()
+		delete(s.kissListeners, id)
+	}
+
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.listeners = nil
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTransportTest(t *testing.T) (*emu.Emulator, *Server, chan emu.RxPacket) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.SetTimeScaling(10))
+
+	for i, id := range []string{"Node1", "Node2"} {
+		assert.NoError(t, testEmu.AddNode(emu.Node{
+			ID:     id,
+			Online: true,
+			X:      1 + float64(i)*0.5,
+			Y:      1,
+			TXGain: 14,
+			RXSens: -137,
+		}))
+	}
+
+	s := New(testEmu)
+	s.subscribe()
+
+	received := make(chan emu.RxPacket, 10)
+	assert.NoError(t, testEmu.AttachNode("Node2", func(node emu.Node, packet emu.RxPacket) {
+		received <- packet
+	}))
+
+	return testEmu, s, received
+}
+
+func waitPacket(t *testing.T, received chan emu.RxPacket, data []byte) {
+	select {
+	case packet := <-received:
+		assert.Equal(t, data, packet.Data)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "packet not received")
+	}
+}
+
+func waitConnected(t *testing.T, s *Server, count int) {
+	assert.Eventually(t, func() bool {
+		return s.ConnectedNodes() == count
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func testStreamTransport(t *testing.T, network string, listen func(s *Server) (net.Addr, error)) {
+	testEmu, s, received := newTransportTest(t)
+
+	addr, err := listen(s)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.closeListeners()
+
+	conn, err := net.Dial(network, addr.String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	assert.NoError(t, writeFrame(conn, []byte("Node1")))
+	waitConnected(t, s, 1)
+
+	// the second connection for the same node is closed
+	second, err := net.Dial(network, addr.String())
+	if assert.NoError(t, err) {
+		assert.NoError(t, writeFrame(second, []byte("Node1")))
+		_ = second.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = second.Read(make([]byte, 1))
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, 1, s.ConnectedNodes())
+
+	t.Run("Transmit", func(t *testing.T) {
+		assert.NoError(t, writeFrame(conn, []byte{0xc0, 0xff, 0xee}))
+		waitPacket(t, received, []byte{0xc0, 0xff, 0xee})
+	})
+
+	t.Run("Receive", func(t *testing.T) {
+		assert.NoError(t, testEmu.SendMessage("Node2", []byte("hello")))
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		frame, err := readFrame(conn)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		var packet emu.RxPacket
+		assert.NoError(t, json.Unmarshal(frame, &packet))
+		assert.Equal(t, []byte("hello"), packet.Data)
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		_ = conn.Close()
+		waitConnected(t, s, 0)
+	})
+}
+
+func TestTCPTransport(t *testing.T) {
+	testStreamTransport(t, "tcp", func(s *Server) (net.Addr, error) {
+		return s.ListenTCP("127.0.0.1:0")
+	})
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loraemu.sock")
+
+	testStreamTransport(t, "unix", func(s *Server) (net.Addr, error) {
+		return s.ListenUnix(path)
+	})
+}
+
+func TestUDPTransport(t *testing.T) {
+	testEmu, s, received := newTransportTest(t)
+
+	_, err := s.ListenUDP("Missing", "127.0.0.1:0")
+	assert.Error(t, err)
+
+	addr, err := s.ListenUDP("Node1", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.closeListeners()
+
+	conn, err := net.Dial("udp", addr.String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	t.Run("Transmit", func(t *testing.T) {
+		_, err := conn.Write([]byte{0xc0, 0xff, 0xee})
+		assert.NoError(t, err)
+
+		waitPacket(t, received, []byte{0xc0, 0xff, 0xee})
+		assert.Equal(t, 1, s.ConnectedNodes())
+	})
+
+	t.Run("Receive", func(t *testing.T) {
+		assert.NoError(t, testEmu.SendMessage("Node2", []byte("hello")))
+
+		buf := make([]byte, 1024)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, err := conn.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		var packet emu.RxPacket
+		assert.NoError(t, json.Unmarshal(buf[:n], &packet))
+		assert.Equal(t, []byte("hello"), packet.Data)
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		_, err := conn.Write(nil)
+		assert.NoError(t, err)
+		waitConnected(t, s, 0)
+	})
+}
+
+func TestStreamTransport_WriteTimeout(t *testing.T) {
+	timeout := SessionWriteTimeout
+	SessionWriteTimeout = time.Millisecond * 50
+	defer func() { SessionWriteTimeout = timeout }()
+
+	_, s, _ := newTransportTest(t)
+
+	// the node connects but never reads, so the session is closed on the first delivery
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	go s.handleStreamConn(&streamSession{transport: "tcp", conn: conn})
+	assert.NoError(t, writeFrame(other, []byte("Node1")))
+	waitConnected(t, s, 1)
+
+	s.RLock()
+	session := s.nodeSessions["Node1"]
+	s.RUnlock()
+
+	assert.Error(t, session.Deliver(emu.RxPacket{Data: []byte("hello")}))
+	waitConnected(t, s, 0)
+}
+
+// blockingSession is a node session that doesn't read its connection until it is released.
+type blockingSession struct {
+	release chan struct{}
+}
+
+func (b *blockingSession) Transport() string {
+	return "blocking"
+}
+
+func (b *blockingSession) Deliver(packet emu.RxPacket) error {
+	<-b.release
+	return nil
+}
+
+func (b *blockingSession) Close() error {
+	return nil
+}
+
+func TestSession_SlowNode(t *testing.T) {
+	testEmu, s, received := newTransportTest(t)
+	defer s.Stop()
+
+	slow := &blockingSession{release: make(chan struct{})}
+	defer close(slow.release)
+	assert.NoError(t, s.registerSession("Node1", slow))
+
+	// more packets than the buffer of the session fit, the oldest ones are dropped instead of blocking the bus
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < emu.DefaultSubscriberBuffer*2; i++ {
+			testEmu.Bus().Publish(emu.EventMessage{Event: emu.EventReceived, Node: emu.Node{ID: "Node1"}, Data: emu.RxPacket{Data: []byte("hello")}})
+		}
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "slow session blocked the bus")
+	}
+
+	assert.NoError(t, testEmu.SendMessage("Node1", []byte("hello")))
+	waitPacket(t, received, []byte("hello"))
+
+	s.unregisterSession("Node1", slow)
+	waitConnected(t, s, 0)
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// WebhookSignatureHeader contains the hex encoded HMAC-SHA256 of the request body prefixed with "sha256=" if
+// the webhook has a secret.
+const WebhookSignatureHeader = "X-LoRaEmu-Signature"
+
+var ErrWebhookExists = errors.New("webhook with this name already exists")
+
+// WebhookConfig represents the configuration of a webhook that receives the events as JSON batches of LogEntry.
+type WebhookConfig struct {
+	// Name identifies the webhook in the REST API.
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Events that are sent. If empty all events are sent.
+	Events []emu.Event `json:"events"`
+	// Nodes whose events are sent. If empty the events of all nodes are sent.
+	Nodes []string `json:"nodes"`
+	// BatchSize is the maximum number of events per request. Defaults to 100.
+	BatchSize int `json:"batchSize"`
+	// BatchIntervalMs is the maximum time an event waits for the batch to fill up. Defaults to 1000.
+	BatchIntervalMs int `json:"batchIntervalMs"`
+	// MaxRetries is the number of retries before a batch is dropped. Defaults to 5.
+	MaxRetries int `json:"maxRetries"`
+	// RetryBackoffMs is the wait before the first retry, which doubles with every retry. Defaults to 500.
+	RetryBackoffMs int `json:"retryBackoffMs"`
+	// Secret signs the requests with HMAC-SHA256 if set.
+	Secret string `json:"secret"`
+	// Buffer is the number of events that can wait while a batch is delivered. If it's full the oldest
+	// events are dropped. Defaults to 10000.
+	Buffer int `json:"buffer"`
+}
+
+// WebhookStatus represents the delivery health of a webhook.
+type WebhookStatus struct {
+	Name   string      `json:"name"`
+	URL    string      `json:"url"`
+	Events []emu.Event `json:"events"`
+	Nodes  []string    `json:"nodes"`
+	// Healthy is false if the last batch couldn't be delivered.
+	Healthy bool `json:"healthy"`
+	// Delivered is the number of delivered events.
+	Delivered int `json:"delivered"`
+	// Batches is the number of delivered batches.
+	Batches int `json:"batches"`
+	// Retries is the number of failed requests that were retried.
+	Retries int `json:"retries"`
+	// Dropped is the number of events that were dropped because the buffer was full or all retries failed.
+	Dropped       int       `json:"dropped"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	LastDelivery  time.Time `json:"lastDelivery,omitempty"`
+}
+
+// webhook sends the events of a subscription in batches to a URL.
+type webhook struct {
+	sync.Mutex
+
+	config       WebhookConfig
+	client       *http.Client
+	logger       logr.Logger
+	subscription *emu.Subscription
+	status       WebhookStatus
+	dropped      int
+	done         chan bool
+	wg           sync.WaitGroup
+}
+
+func newWebhook(config WebhookConfig, client *http.Client, logger logr.Logger) (*webhook, error) {
+	if len(config.Name) == 0 {
+		return nil, errors.New("name missing")
+	}
+
+	target, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme '%s'", target.Scheme)
+	}
+
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+
+	if config.BatchIntervalMs <= 0 {
+		config.BatchIntervalMs = 1000
+	}
+
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 5
+	}
+
+	if config.RetryBackoffMs <= 0 {
+		config.RetryBackoffMs = 500
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = 10000
+	}
+
+	return &webhook{
+		config: config,
+		client: client,
+		logger: logger,
+		status: WebhookStatus{
+			Name:    config.Name,
+			URL:     config.URL,
+			Events:  config.Events,
+			Nodes:   config.Nodes,
+			Healthy: true,
+		},
+		done: make(chan bool),
+	}, nil
+}
+
+func (w *webhook) getStatus() WebhookStatus {
+	w.Lock()
+	defer w.Unlock()
+
+	status := w.status
+	status.Dropped = w.dropped + int(w.subscription.Dropped())
+
+	return status
+}
+
+func (w *webhook) start(emulator *emu.Emulator) {
+	w.subscription = emulator.Subscribe(emu.SubscribeOptions{
+		Events:   w.config.Events,
+		Nodes:    w.config.Nodes,
+		Buffer:   w.config.Buffer,
+		Overflow: emu.OverflowDropOldest,
+	})
+
+	w.wg.Add(1)
+	go w.run()
+}
+
+// stop stops the webhook. Events that are still buffered are sent, but failed batches aren't retried.
+func (w *webhook) stop() {
+	close(w.done)
+	w.subscription.Unsubscribe()
+	w.wg.Wait()
+}
+
+func (w *webhook) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(w.config.BatchIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	batch := make([]emu.LogEntry, 0, w.config.BatchSize)
+	for {
+		select {
+		case msg, ok := <-w.subscription.Events():
+			if !ok {
+				w.deliver(batch)
+				return
+			}
+
+			batch = append(batch, msg.LogEntry())
+			if len(batch) >= w.config.BatchSize {
+				w.deliver(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.deliver(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// deliver sends the batch and retries with exponential backoff.
+func (w *webhook) deliver(batch []emu.LogEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		w.failed(len(batch), err)
+		return
+	}
+
+	backoff := time.Duration(w.config.RetryBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			w.Lock()
+			w.status.Healthy = true
+			w.status.Delivered += len(batch)
+			w.status.Batches++
+			w.status.LastDelivery = time.Now()
+			w.Unlock()
+			return
+		}
+
+		w.logger.Error(err, "webhook delivery failed", "webhook", w.config.Name, "attempt", attempt+1)
+
+		if attempt >= w.config.MaxRetries {
+			break
+		}
+
+		w.Lock()
+		w.status.Retries++
+		w.status.LastError = err.Error()
+		w.status.LastErrorTime = time.Now()
+		w.Unlock()
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-w.done:
+			w.failed(len(batch), err)
+			return
+		}
+	}
+
+	w.failed(len(batch), err)
+}
+
+func (w *webhook) failed(count int, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.status.Healthy = false
+	w.status.LastError = err.Error()
+	w.status.LastErrorTime = time.Now()
+	w.dropped += count
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.config.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(w.config.Secret, body))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of the body that is sent in the WebhookSignatureHeader.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AddWebhook adds a webhook that receives the events of the emulator.
+func (s *Server) AddWebhook(config WebhookConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.webhooks[config.Name]; ok {
+		return ErrWebhookExists
+	}
+
+	w, err := newWebhook(config, s.webhookClient, s.logger)
+	if err != nil {
+		return err
+	}
+
+	w.start(s.emu)
+	s.webhooks[config.Name] = w
+	s.webhookNames = append(s.webhookNames, config.Name)
+
+	return nil
+}
+
+// RemoveWebhook stops and removes a webhook by name.
+func (s *Server) RemoveWebhook(name string) error {
+	s.Lock()
+	w, ok := s.webhooks[name]
+	if ok {
+		delete(s.webhooks, name)
+		for i := range s.webhookNames {
+			if s.webhookNames[i] == name {
+				s.webhookNames = append(s.webhookNames[:i:i], s.webhookNames[i+1:]...)
+				break
+			}
+		}
+	}
+	s.Unlock()
+
+	if !ok {
+		return errors.New("not found")
+	}
+
+	w.stop()
+
+	return nil
+}
+
+// Webhooks returns the status of all webhooks.
+func (s *Server) Webhooks() []WebhookStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	status := make([]WebhookStatus, 0, len(s.webhookNames))
+	for _, name := range s.webhookNames {
+		status = append(status, s.webhooks[name].getStatus())
+	}
+
+	return status
+}
+
+// stopWebhooks stops all webhooks and sends the buffered events.
+func (s *Server) stopWebhooks() {
+	s.RLock()
+	names := append([]string{}, s.webhookNames...)
+	s.RUnlock()
+
+	for _, name := range names {
+		_ = s.RemoveWebhook(name)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookReceiver collects the batches of a webhook and fails the first requests.
+type webhookReceiver struct {
+	sync.Mutex
+
+	fail    int
+	batches [][]emu.LogEntry
+	signed  bool
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	body, _ := io.ReadAll(req.Body)
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var batch []emu.LogEntry
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.signed = req.Header.Get(WebhookSignatureHeader) == "sha256="+SignWebhook("secret", body)
+	r.batches = append(r.batches, batch)
+}
+
+func (r *webhookReceiver) entries() []emu.LogEntry {
+	r.Lock()
+	defer r.Unlock()
+
+	var entries []emu.LogEntry
+	for _, batch := range r.batches {
+		entries = append(entries, batch...)
+	}
+	return entries
+}
+
+func TestWebhook(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	for _, id := range []string{"Node1", "Node2"} {
+		assert.NoError(t, testEmu.AddNode(emu.Node{ID: id, Online: true}))
+	}
+
+	s := New(testEmu)
+
+	receiver := &webhookReceiver{fail: 2}
+	httpServer := httptest.NewServer(receiver)
+	defer httpServer.Close()
+
+	assert.Error(t, s.AddWebhook(WebhookConfig{Name: "invalid", URL: "ftp://localhost"}))
+	assert.NoError(t, s.AddWebhook(WebhookConfig{
+		Name:            "orchestrator",
+		URL:             httpServer.URL,
+		Events:          []emu.Event{emu.EventScriptError},
+		Nodes:           []string{"Node1"},
+		BatchSize:       3,
+		BatchIntervalMs: 50,
+		RetryBackoffMs:  10,
+		Secret:          "secret",
+	}))
+	assert.ErrorIs(t, s.AddWebhook(WebhookConfig{Name: "orchestrator", URL: httpServer.URL}), ErrWebhookExists)
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, testEmu.EmitEvent(emu.EventScriptError, "Node1", map[string]interface{}{"i": i}))
+	}
+	assert.NoError(t, testEmu.EmitEvent(emu.EventScriptError, "Node2", nil))
+	assert.NoError(t, testEmu.EmitEvent(emu.EventNodeUpdated, "Node1", nil))
+
+	// the status is updated after the receiver answered
+	assert.Eventually(t, func() bool {
+		status := s.Webhooks()
+		return len(receiver.entries()) == 4 && len(status) == 1 && status[0].Delivered == 4
+	}, time.Second*5, time.Millisecond*10)
+
+	entries := receiver.entries()
+	for _, entry := range entries {
+		assert.Equal(t, emu.EventScriptError, entry.Event)
+		assert.Equal(t, "Node1", entry.NodeID)
+	}
+
+	receiver.Lock()
+	batches := len(receiver.batches)
+	assert.True(t, receiver.signed)
+	for _, batch := range receiver.batches {
+		assert.LessOrEqual(t, len(batch), 3)
+	}
+	receiver.Unlock()
+
+	if status := s.Webhooks(); assert.Len(t, status, 1) {
+		assert.True(t, status[0].Healthy)
+		assert.Equal(t, 4, status[0].Delivered)
+		assert.Equal(t, batches, status[0].Batches)
+		assert.Equal(t, 2, status[0].Retries)
+		assert.Equal(t, 0, status[0].Dropped)
+	}
+
+	assert.NoError(t, s.Stop())
+	assert.Empty(t, s.Webhooks())
+	assert.Equal(t, 0, testEmu.Bus().Subscribers())
+}
+
+func TestWebhook_Failing(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, testEmu.AddNode(emu.Node{ID: "Node1", Online: true}))
+
+	s := New(testEmu)
+
+	receiver := &webhookReceiver{fail: 100}
+	httpServer := httptest.NewServer(receiver)
+	defer httpServer.Close()
+
+	assert.NoError(t, s.AddWebhook(WebhookConfig{Name: "down", URL: httpServer.URL, BatchIntervalMs: 10, MaxRetries: 1, RetryBackoffMs: 10}))
+	assert.NoError(t, testEmu.EmitEvent(emu.EventNodeUpdated, "Node1", nil))
+
+	assert.Eventually(t, func() bool {
+		status := s.Webhooks()
+		return len(status) == 1 && !status[0].Healthy && status[0].Dropped == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	assert.Contains(t, s.Webhooks()[0].LastError, "503")
+	assert.NoError(t, s.RemoveWebhook("down"))
+	assert.Error(t, s.RemoveWebhook("down"))
+}
+
+func TestWebhook_Routes(t *testing.T) {
+	testEmu := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	s := New(testEmu)
+	defer s.Stop()
+
+	body, _ := json.Marshal(WebhookConfig{Name: "hook", URL: "http://127.0.0.1:1/events", Events: []emu.Event{emu.EventCollision}})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks", bytes.NewBuffer(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if assert.NoError(t, s.routePostWebhook(s.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	if assert.NoError(t, s.routeGetWebhooks(s.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec))) {
+		var status []WebhookStatus
+		if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status)) && assert.Len(t, status, 1) {
+			assert.Equal(t, "hook", status[0].Name)
+			assert.Equal(t, []emu.Event{emu.EventCollision}, status[0].Events)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	c := s.NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+	c.SetPath("/api/webhooks/:name")
+	c.SetParamNames("name")
+	c.SetParamValues("hook")
+	if assert.NoError(t, s.routeDeleteWebhook(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	assert.Empty(t, s.Webhooks())
+}
@@ -0,0 +1,287 @@
+package trace
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression represents a compression format of the trace files.
+type Compression struct {
+	// Ext is appended to the path of the files.
+	Ext string
+	// NewWriter wraps the file. Closing the returned writer has to flush the compressed data but must not
+	// close the file.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Compressions are the available compression formats by name. Further formats can be registered before
+// the sinks are created.
+var Compressions = map[string]Compression{
+	"gzip": {
+		Ext: ".gz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+	"zstd": {
+		Ext: ".zst",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	},
+}
+
+// backupTimeFormat is the timestamp of rotated files. It sorts in the order of the rotations.
+const backupTimeFormat = "20060102T150405.000"
+
+// countingWriter counts the bytes that are written to the file.
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// File is a writer that writes to the file at its path and rotates it to a timestamped backup next to it.
+// Existing files aren't truncated but rotated when the file is opened.
+type File struct {
+	sync.Mutex
+
+	path        string
+	compression *Compression
+	maxBackups  int
+
+	file    *os.File
+	counter *countingWriter
+	writer  io.WriteCloser
+}
+
+// OpenFile opens the file at the path with the given compression, which is either empty or the name of a
+// format in Compressions. The extension of the compression is appended to the path if it's missing. If
+// maxBackups is greater than 0 only that many rotated files are kept.
+func OpenFile(path string, compression string, maxBackups int) (*File, error) {
+	f := &File{
+		maxBackups: maxBackups,
+	}
+
+	if len(compression) > 0 {
+		c, ok := Compressions[compression]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression '%s'", compression)
+		}
+
+		f.compression = &c
+		if !strings.HasSuffix(path, c.Ext) {
+			path += c.Ext
+		}
+	}
+
+	f.path = path
+
+	f.Lock()
+	defer f.Unlock()
+
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err := f.backupLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := f.openLocked(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Path returns the path of the current file.
+func (f *File) Path() string {
+	return f.path
+}
+
+// Size returns the number of bytes that were written to the current file. Compressed data is flushed in
+// blocks, so the size of compressed files lags behind the written data.
+func (f *File) Size() int64 {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.counter == nil {
+		return 0
+	}
+	return f.counter.n
+}
+
+// Write writes to the current file. If the file couldn't be opened on the last rotation it's opened again.
+func (f *File) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.writer == nil {
+		if err := f.openLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	return f.writer.Write(p)
+}
+
+// Rotate closes the current file, moves it to a backup and opens a new file.
+func (f *File) Rotate() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.closeLocked(); err != nil {
+		return err
+	}
+
+	if err := f.backupLocked(); err != nil {
+		return err
+	}
+
+	return f.openLocked()
+}
+
+// Close flushes and closes the current file.
+func (f *File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.closeLocked()
+}
+
+// Backups returns the paths of the rotated files from the oldest to the newest.
+func (f *File) Backups() ([]string, error) {
+	base, ext := f.splitPath()
+
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+
+	// only consider names that contain a rotation timestamp
+	backups := matches[:0]
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, base+"-"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, match)
+		}
+	}
+
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// splitPath splits the path into the part before and after the extensions, so that "logs.txt.gz" becomes
+// "logs" and ".txt.gz".
+func (f *File) splitPath() (string, string) {
+	path := f.path
+	ext := ""
+
+	if f.compression != nil {
+		path = strings.TrimSuffix(path, f.compression.Ext)
+		ext = f.compression.Ext
+	}
+
+	ext = filepath.Ext(path) + ext
+	return path[:len(path)-len(filepath.Ext(path))], ext
+}
+
+func (f *File) openLocked() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	counter := &countingWriter{writer: file}
+
+	var writer io.WriteCloser = nopCloser{counter}
+	if f.compression != nil {
+		writer, err = f.compression.NewWriter(counter)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+
+	f.file = file
+	f.counter = counter
+	f.writer = writer
+
+	return nil
+}
+
+func (f *File) closeLocked() error {
+	if f.writer == nil {
+		return nil
+	}
+
+	err := f.writer.Close()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	f.file = nil
+	f.counter = nil
+	f.writer = nil
+
+	return err
+}
+
+func (f *File) backupLocked() error {
+	base, ext := f.splitPath()
+
+	// rotations in the same millisecond are moved to the next free millisecond so that no backup is overwritten
+	stamp := time.Now()
+	backup := fmt.Sprintf("%s-%s%s", base, stamp.Format(backupTimeFormat), ext)
+	for {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		stamp = stamp.Add(time.Millisecond)
+		backup = fmt.Sprintf("%s-%s%s", base, stamp.Format(backupTimeFormat), ext)
+	}
+
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+
+	if f.maxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,309 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// IndexInterval is the number of records between two checkpoints of an Index.
+const IndexInterval = 1000
+
+// gzipMagic are the first bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// zstdMagic are the first bytes of a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Reader streams the records of a trace log. Gzip and zstd compressed logs are detected automatically.
+type Reader struct {
+	reader       *bufio.Reader
+	decompressor io.Closer
+	closer       io.Closer
+	offset       int64
+	line         int
+	from         time.Time
+}
+
+// NewReader creates a reader for the trace log.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := bufio.NewReader(r)
+
+	if magic, err := reader.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{reader: bufio.NewReader(gz), decompressor: gz}, nil
+	}
+
+	if magic, err := reader.Peek(len(zstdMagic)); err == nil && bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{reader: bufio.NewReader(zr), decompressor: zr.IOReadCloser()}, nil
+	}
+
+	return &Reader{reader: reader}, nil
+}
+
+// Open opens the trace log at the path. The reader needs to be closed.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	reader.closer = file
+
+	return reader, nil
+}
+
+// Next returns the next record or io.EOF at the end of the log.
+func (r *Reader) Next() (Record, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return Record{}, err
+		}
+
+		if len(line) == 0 && err == io.EOF {
+			return Record{}, io.EOF
+		}
+
+		r.offset += int64(len(line))
+		r.line++
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		record, decodeErr := Decode(line)
+		if decodeErr != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.line, decodeErr)
+		}
+
+		if record.Time.Before(r.from) {
+			continue
+		}
+
+		return record, nil
+	}
+}
+
+// Offset returns the offset of the next record in the uncompressed log.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Close releases the decompressor and closes the file of the reader if it was opened with Open.
+func (r *Reader) Close() error {
+	if r.decompressor != nil {
+		_ = r.decompressor.Close()
+	}
+
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// checkpoint is a position in the log. All records before it are older than maxTime.
+type checkpoint struct {
+	offset  int64
+	line    int
+	maxTime time.Time
+}
+
+// Index gives random access by time to a trace log. It's built by reading the log once and keeps a
+// checkpoint every IndexInterval records, so that seeking only has to decode the records after the
+// closest checkpoint. Plain logs are read from the byte offset of the checkpoint, compressed logs have
+// to be decompressed up to it, so seeking in them is linear in the position.
+type Index struct {
+	path        string
+	compressed  bool
+	checkpoints []checkpoint
+	header      *Header
+	start       time.Time
+	end         time.Time
+	records     int
+	events      int
+}
+
+// NewIndex reads the trace log at the path and creates the index.
+func NewIndex(path string) (*Index, error) {
+	reader, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	index := &Index{path: path, compressed: reader.decompressor != nil}
+
+	var maxTime time.Time
+	for {
+		if index.records%IndexInterval == 0 {
+			index.checkpoints = append(index.checkpoints, checkpoint{offset: reader.offset, line: reader.line, maxTime: maxTime})
+		}
+
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header, ok := record.Data.(Header); ok && index.header == nil {
+			index.header = &header
+		}
+
+		if record.Event != EventHeader {
+			index.events++
+		}
+
+		if index.records == 0 || record.Time.Before(index.start) {
+			index.start = record.Time
+		}
+
+		if record.Time.After(maxTime) {
+			maxTime = record.Time
+		}
+
+		index.records++
+	}
+
+	index.end = maxTime
+
+	return index, nil
+}
+
+// Header returns the first header record of the log or nil if it has none.
+func (i *Index) Header() *Header {
+	return i.header
+}
+
+// Start returns the time of the oldest record.
+func (i *Index) Start() time.Time {
+	return i.start
+}
+
+// End returns the time of the newest record.
+func (i *Index) End() time.Time {
+	return i.end
+}
+
+// Len returns the number of records.
+func (i *Index) Len() int {
+	return i.records
+}
+
+// Events returns the number of records that aren't headers.
+func (i *Index) Events() int {
+	return i.events
+}
+
+// Seek returns a reader that starts at the first record at or after t. Records that are older than t
+// are skipped, even if they were written after it. For compressed logs the time of a seek grows with the
+// position, as the data before the checkpoint has to be decompressed. The reader needs to be closed.
+func (i *Index) Seek(t time.Time) (*Reader, error) {
+	// the last checkpoint before which all records are older than t
+	n := sort.Search(len(i.checkpoints), func(n int) bool {
+		return !i.checkpoints[n].maxTime.Before(t)
+	})
+	if n > 0 {
+		n--
+	}
+
+	var cp checkpoint
+	if len(i.checkpoints) > 0 {
+		cp = i.checkpoints[n]
+	}
+
+	reader, err := i.open(cp)
+	if err != nil {
+		return nil, err
+	}
+	reader.from = t
+
+	return reader, nil
+}
+
+// SeekRecord returns a reader that starts at the n-th record of the log. Only the records after the
+// closest checkpoint are decoded. The reader needs to be closed.
+func (i *Index) SeekRecord(n int) (*Reader, error) {
+	var cp checkpoint
+	skip := n
+	if len(i.checkpoints) > 0 {
+		k := n / IndexInterval
+		if k >= len(i.checkpoints) {
+			k = len(i.checkpoints) - 1
+		}
+
+		cp = i.checkpoints[k]
+		skip = n - k*IndexInterval
+	}
+
+	reader, err := i.open(cp)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; skip > 0; skip-- {
+		if _, err := reader.Next(); err != nil {
+			_ = reader.Close()
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
+
+// open returns a reader at the checkpoint.
+func (i *Index) open(cp checkpoint) (*Reader, error) {
+	var reader *Reader
+	if i.compressed {
+		var err error
+		if reader, err = Open(i.path); err != nil {
+			return nil, err
+		}
+
+		// compressed streams can't be seeked, so the records before the checkpoint are decompressed
+		if _, err := io.CopyN(io.Discard, reader.reader, cp.offset); err != nil {
+			_ = reader.Close()
+			return nil, err
+		}
+	} else {
+		file, err := os.Open(i.path)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := file.Seek(cp.offset, io.SeekStart); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+
+		reader = &Reader{reader: bufio.NewReader(file), closer: file}
+	}
+
+	reader.offset = cp.offset
+	reader.line = cp.line
+
+	return reader, nil
+}
@@ -0,0 +1,241 @@
+package trace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader_Schema(t *testing.T) {
+	dir := t.TempDir()
+	e := newEmulator(t)
+	e.SetFaults(emu.NewFaults(e, emu.FaultConfig{Seed: 1, DuplicateProbability: 1}))
+	e.SetLinkEvents(true)
+
+	s, err := New(e, Config{Path: filepath.Join(dir, "logs.txt"), Compression: "gzip", Header: true})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+
+	assert.NoError(t, e.AddNode(emu.Node{ID: "1", Online: true, X: 1, Y: 1, TXGain: 14, RXSens: -137}))
+	assert.NoError(t, e.AddNode(emu.Node{ID: "2", Online: true, X: 1.5, Y: 1, TXGain: 14, RXSens: -137}))
+	assert.NoError(t, e.SendMessage("1", []byte("hello")))
+	e.Wait()
+	assert.NoError(t, e.SendMessage("1", make([]byte, 300)))
+	assert.NoError(t, e.RemoveNode("2"))
+
+	assert.NoError(t, s.Stop())
+	s.Done()
+
+	raw := rawData(t, filepath.Join(dir, "logs.txt.gz"))
+
+	reader, err := Open(filepath.Join(dir, "logs.txt.gz"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+
+	types := map[emu.Event]string{}
+	for i := 0; ; i++ {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			assert.Len(t, raw, i)
+			break
+		}
+		if !assert.NoError(t, err) || !assert.Less(t, i, len(raw)) {
+			return
+		}
+
+		types[record.Event] = fmt.Sprintf("%T", record.Data)
+
+		// the typed data contains every field that was written
+		typed, err := json.Marshal(record.Data)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(raw[i]), string(typed), string(record.Event))
+	}
+
+	assert.Equal(t, map[emu.Event]string{
+		EventHeader:                  "trace.Header",
+		emu.EventNodeAdded:           "emu.Node",
+		emu.EventNodeRemoved:         "emu.Node",
+		emu.EventLinkUp:              "emu.LinkChange",
+		emu.EventLinkDown:            "emu.LinkChange",
+		emu.EventSending:             "emu.Transmission",
+		emu.EventReceived:            "emu.Reception",
+		emu.EventFaultPacketDuped:    "emu.FaultPacket",
+		emu.EventPayloadSizeExceeded: "emu.PayloadSizeExceeded",
+	}, types)
+}
+
+// rawData returns the undecoded data of the records of the log.
+func rawData(t *testing.T, path string) []json.RawMessage {
+	reader, err := Open(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer reader.Close()
+
+	var raw []json.RawMessage
+	for {
+		line, err := reader.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry struct {
+				Data json.RawMessage `json:"data"`
+			}
+			assert.NoError(t, json.Unmarshal(line, &entry))
+			raw = append(raw, entry.Data)
+		}
+
+		if err != nil {
+			return raw
+		}
+	}
+}
+
+func TestReader_Zstd(t *testing.T) {
+	dir := t.TempDir()
+	e := newEmulator(t)
+
+	s, err := New(e, Config{Path: filepath.Join(dir, "logs.txt"), Compression: "zstd", Header: true})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+
+	assert.NoError(t, e.AddNode(emu.Node{ID: "1", Online: true}))
+	assert.NoError(t, e.RemoveNode("1"))
+
+	assert.NoError(t, s.Stop())
+	s.Done()
+
+	reader, err := Open(filepath.Join(dir, "logs.txt.zst"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+
+	var events []emu.Event
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		events = append(events, record.Event)
+	}
+
+	assert.Equal(t, []emu.Event{EventHeader, emu.EventNodeAdded, emu.EventNodeRemoved}, events)
+}
+
+func TestReader_Unknown(t *testing.T) {
+	reader, err := NewReader(bytes.NewBufferString(`{"time":"2024-01-01T00:00:00Z","event":"Custom","nodeId":"1","data":{"a":1}}
+
+{"time":"2024-01-01T00:00:01Z","event":"NodeAdded","nodeId":"1","data":null}
+{"broken`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	record, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`{"a":1}`), record.Data)
+
+	// older traces have no data for node events
+	record, err = reader.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, record.Data)
+
+	_, err = reader.Next()
+	assert.ErrorContains(t, err, "line 4")
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < 2500; i++ {
+		line, err := json.Marshal(emu.LogEntry{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Event:  emu.EventSending,
+			NodeID: fmt.Sprint(i),
+			Data:   emu.Transmission{Start: int64(i)},
+		})
+		assert.NoError(t, err)
+
+		buf.Write(append(line, '\n'))
+	}
+	plain := filepath.Join(dir, "logs.txt")
+	assert.NoError(t, os.WriteFile(plain, buf.Bytes(), 0666))
+
+	compressed := filepath.Join(dir, "logs.txt.gz")
+	gz := &bytes.Buffer{}
+	writer := gzip.NewWriter(gz)
+	_, err := writer.Write(buf.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, os.WriteFile(compressed, gz.Bytes(), 0666))
+
+	// plain logs are seeked by the byte offset, compressed ones are decompressed up to the checkpoint
+	for _, path := range []string{plain, compressed} {
+		testIndex(t, path, start)
+	}
+}
+
+func testIndex(t *testing.T, path string, start time.Time) {
+	index, err := NewIndex(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 2500, index.Len())
+	assert.Nil(t, index.Header())
+	assert.Equal(t, start, index.Start().UTC())
+	assert.Equal(t, start.Add(2499*time.Second), index.End().UTC())
+
+	for _, i := range []int{0, 999, 1000, 1001, 2499} {
+		reader, err := index.Seek(start.Add(time.Duration(i) * time.Second))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		record, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), record.NodeID)
+		assert.Equal(t, int64(i), record.Data.(emu.Transmission).Start)
+		assert.NoError(t, reader.Close())
+	}
+
+	reader, err := index.Seek(start.Add(time.Hour))
+	assert.NoError(t, err)
+	_, err = reader.Next()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NoError(t, reader.Close())
+
+	assert.Equal(t, 2500, index.Events())
+	for _, n := range []int{0, 1000, 1500, 2500} {
+		reader, err := index.SeekRecord(n)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		record, err := reader.Next()
+		if n == 2500 {
+			assert.ErrorIs(t, err, io.EOF)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprint(n), record.NodeID)
+		}
+		assert.NoError(t, reader.Close())
+	}
+}
@@ -0,0 +1,101 @@
+package trace
+
+import (
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"time"
+)
+
+// Record represents a decoded entry of the trace log.
+type Record struct {
+	Time   time.Time
+	Event  emu.Event
+	NodeID string
+	// Data has the type that is registered in Schema for the event, e.g. emu.Transmission for
+	// emu.EventSending. Events without a registered type keep the data as json.RawMessage.
+	Data any
+}
+
+// LogEntry returns the record as it is written to the trace log.
+func (r Record) LogEntry() emu.LogEntry {
+	return emu.LogEntry{
+		Time:   r.Time,
+		Event:  r.Event,
+		NodeID: r.NodeID,
+		Data:   r.Data,
+	}
+}
+
+// DecodeFn decodes the data of an event.
+type DecodeFn func(data json.RawMessage) (any, error)
+
+// DecodeAs returns a DecodeFn that decodes the data into T. Missing data, like in node events of traces
+// before the schema, stays nil.
+func DecodeAs[T any]() DecodeFn {
+	return func(data json.RawMessage) (any, error) {
+		if len(data) == 0 || string(data) == "null" {
+			return nil, nil
+		}
+
+		var val T
+		if err := json.Unmarshal(data, &val); err != nil {
+			return nil, err
+		}
+		return val, nil
+	}
+}
+
+// Schema maps the events to the types of their data in the trace format of FormatVersion. Components
+// that emit their own events can register them here.
+var Schema = map[emu.Event]DecodeFn{
+	EventHeader:                  DecodeAs[Header](),
+	emu.EventNodeAdded:           DecodeAs[emu.Node](),
+	emu.EventNodeUpdated:         DecodeAs[emu.Node](),
+	emu.EventNodeRemoved:         DecodeAs[emu.Node](),
+	emu.EventSending:             DecodeAs[emu.Transmission](),
+	emu.EventReceived:            DecodeAs[emu.Reception](),
+	emu.EventCollision:           DecodeAs[emu.Reception](),
+	emu.EventPayloadSizeExceeded: DecodeAs[emu.PayloadSizeExceeded](),
+	emu.EventFaultPacketDropped:  DecodeAs[emu.FaultPacket](),
+	emu.EventFaultPacketCorrupt:  DecodeAs[emu.FaultPacketCorrupted](),
+	emu.EventFaultPacketDuped:    DecodeAs[emu.FaultPacket](),
+	emu.EventFaultNodeCrashed:    DecodeAs[emu.FaultNode](),
+	emu.EventFaultNodeRecovered:  DecodeAs[emu.FaultNode](),
+	emu.EventDemodulatorsBusy:    DecodeAs[emu.DemodulatorsBusy](),
+	emu.EventScriptError:         DecodeAs[emu.ScriptError](),
+	emu.EventQueueOverflow:       DecodeAs[emu.QueueOverflow](),
+	emu.EventInterceptorDropped:  DecodeAs[emu.InterceptorDropped](),
+	emu.EventLinkUp:              DecodeAs[emu.LinkChange](),
+	emu.EventLinkDown:            DecodeAs[emu.LinkChange](),
+}
+
+// Decode decodes a line of the trace log.
+func Decode(line []byte) (Record, error) {
+	var entry struct {
+		Time   time.Time       `json:"time"`
+		Event  emu.Event       `json:"event"`
+		NodeID string          `json:"nodeId"`
+		Data   json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return Record{}, err
+	}
+
+	record := Record{
+		Time:   entry.Time,
+		Event:  entry.Event,
+		NodeID: entry.NodeID,
+		Data:   entry.Data,
+	}
+
+	if decode, ok := Schema[entry.Event]; ok {
+		data, err := decode(entry.Data)
+		if err != nil {
+			return Record{}, err
+		}
+		record.Data = data
+	}
+
+	return record, nil
+}
@@ -0,0 +1,362 @@
+// Package trace writes and reads the trace log of the emulator. Every sink has its own event and node
+// filter and rotates, compresses and prunes its files, so that long runs don't end up in a single huge file.
+// The reader decodes the data of the events into the types of the Schema.
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BigJk/loraemu/emu"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// EventHeader is the event of the header record at the start of every file.
+const EventHeader = emu.Event("TraceHeader")
+
+// FormatVersion is the version of the trace log format. It's increased on incompatible changes of the records.
+const FormatVersion = 1
+
+var (
+	ErrRunning    = errors.New("sink already running")
+	ErrNotRunning = errors.New("sink not running")
+)
+
+// Config represents the configuration of a trace sink.
+type Config struct {
+	// Name identifies the sink in the logs. Defaults to the path.
+	Name string `json:"name"`
+	// Path of the file. Existing files are rotated instead of overwritten.
+	Path string `json:"path"`
+	// Events that are written. If empty all events are written.
+	Events []emu.Event `json:"events"`
+	// Nodes whose events are written. If empty the events of all nodes are written.
+	Nodes []string `json:"nodes"`
+	// MaxBytes rotates the file once it reaches the size in bytes. 0 disables the size based rotation.
+	MaxBytes int64 `json:"maxBytes"`
+	// Interval rotates the file every interval seconds of emulator time. 0 disables the time based rotation.
+	Interval float64 `json:"interval"`
+	// MaxBackups is the number of rotated files that are kept. If 0 all files are kept.
+	MaxBackups int `json:"maxBackups"`
+	// Compression of the files. Either empty or the name of a format in Compressions, e.g. "gzip" or "zstd".
+	Compression string `json:"compression"`
+	// Header writes a header record with the version and the scenario config at the start of every file.
+	Header bool `json:"header"`
+}
+
+// Header is the data of the header record.
+type Header struct {
+	// Format is the FormatVersion of the records.
+	Format int `json:"format"`
+	// Version of the emulator.
+	Version string `json:"version"`
+	// StartTime of the emulator as unix timestamp in ms.
+	StartTime int64 `json:"startTime"`
+	// Config of the scenario, see Sink.SetScenario.
+	Config any `json:"config,omitempty"`
+}
+
+// Status represents the state of a sink.
+type Status struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Running bool   `json:"running"`
+	Written int    `json:"written"`
+	Rotated int    `json:"rotated"`
+	Errors  int    `json:"errors"`
+	// LastError is the last write or rotation error.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Version returns the version of the emulator module the binary was built with.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	if info.Main.Path == "github.com/BigJk/loraemu" {
+		return info.Main.Version
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/BigJk/loraemu" {
+			return dep.Version
+		}
+	}
+
+	return "unknown"
+}
+
+// Sink represents a file the trace log is written to.
+type Sink struct {
+	sync.Mutex
+
+	emu       *emu.Emulator
+	config    Config
+	scenario  any
+	logger    logr.Logger
+	startTime int64
+
+	sub     *emu.Subscription
+	file    *File
+	opened  time.Time
+	running bool
+	wg      sync.WaitGroup
+
+	written int
+	rotated int
+	errors  int
+	lastErr error
+}
+
+// New creates a new sink for the emulator. The file is opened on Start.
+func New(emulator *emu.Emulator, config Config) (*Sink, error) {
+	if len(config.Path) == 0 {
+		return nil, errors.New("no path given")
+	}
+
+	if len(config.Compression) > 0 {
+		if _, ok := Compressions[config.Compression]; !ok {
+			return nil, errors.New("unknown compression '" + config.Compression + "'")
+		}
+	}
+
+	if config.MaxBytes < 0 || config.Interval < 0 || config.MaxBackups < 0 {
+		return nil, errors.New("maxBytes, interval and maxBackups can't be negative")
+	}
+
+	if len(config.Name) == 0 {
+		config.Name = config.Path
+	}
+
+	return &Sink{
+		emu:    emulator,
+		config: config,
+		logger: logr.Discard(),
+	}, nil
+}
+
+// SetLogger sets the logger. Write errors are logged when they first occur and when the sink recovers.
+func (s *Sink) SetLogger(logger logr.Logger) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.logger = logger
+}
+
+// SetScenario sets the scenario config that is included in the header record.
+func (s *Sink) SetScenario(config any) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.scenario = config
+}
+
+// Config returns the config of the sink.
+func (s *Sink) Config() Config {
+	return s.config
+}
+
+// Status returns the state of the sink.
+func (s *Sink) Status() Status {
+	s.Lock()
+	defer s.Unlock()
+
+	status := Status{
+		Name:    s.config.Name,
+		Path:    s.config.Path,
+		Running: s.running,
+		Written: s.written,
+		Rotated: s.rotated,
+		Errors:  s.errors,
+	}
+
+	if s.file != nil {
+		status.Path = s.file.Path()
+	}
+
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+
+	return status
+}
+
+// Err returns the last write or rotation error or nil if the last write succeeded.
+func (s *Sink) Err() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lastErr
+}
+
+// Start opens the file and subscribes to the events of the emulator.
+func (s *Sink) Start() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.running {
+		return ErrRunning
+	}
+
+	file, err := OpenFile(s.config.Path, s.config.Compression, s.config.MaxBackups)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.opened = time.Time{}
+	s.running = true
+	s.startTime = s.emu.GetStartTime()
+
+	// the sink doesn't drop events, a slow disk blocks the emulator like the synchronous trace writer. This
+	// is only safe because writing the events never calls the emulator, which would deadlock it.
+	s.sub = s.emu.Subscribe(emu.SubscribeOptions{
+		Events:   s.config.Events,
+		Nodes:    s.config.Nodes,
+		Overflow: emu.OverflowBlock,
+	})
+
+	s.wg.Add(1)
+	go s.run(s.sub, file)
+
+	s.logger.Info("trace sink started", "sink", s.config.Name, "path", file.Path())
+
+	return nil
+}
+
+// Stop unsubscribes the sink. The buffered events are still written before the file is closed. You need
+// to .Done() after this to ensure all events are written.
+func (s *Sink) Stop() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.running {
+		return ErrNotRunning
+	}
+
+	s.running = false
+	s.sub.Unsubscribe()
+
+	return nil
+}
+
+// Done waits for the sink to write the remaining events and close the file.
+func (s *Sink) Done() {
+	s.wg.Wait()
+}
+
+func (s *Sink) run(sub *emu.Subscription, file *File) {
+	defer s.wg.Done()
+
+	for msg := range sub.Events() {
+		s.write(file, msg)
+	}
+
+	if err := file.Close(); err != nil {
+		s.Lock()
+		s.failLocked(err)
+		s.Unlock()
+	}
+
+	s.logger.Info("trace sink stopped", "sink", s.config.Name)
+}
+
+func (s *Sink) write(file *File, msg emu.EventMessage) {
+	line, err := json.Marshal(msg.LogEntry())
+	if err != nil {
+		s.Lock()
+		s.failLocked(err)
+		s.Unlock()
+		return
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shouldRotateLocked(file, msg.Time, len(line)) {
+		if err := file.Rotate(); err != nil {
+			s.failLocked(err)
+		} else {
+			s.rotated++
+		}
+		s.opened = time.Time{}
+	}
+
+	// the header is the first record of every file
+	if s.opened.IsZero() {
+		s.opened = msg.Time
+
+		if s.config.Header {
+			if err := s.writeHeaderLocked(file, msg.Time); err != nil {
+				s.failLocked(err)
+				return
+			}
+		}
+	}
+
+	if _, err := file.Write(line); err != nil {
+		s.failLocked(err)
+		return
+	}
+
+	s.written++
+	s.recoverLocked()
+}
+
+func (s *Sink) shouldRotateLocked(file *File, now time.Time, size int) bool {
+	if s.opened.IsZero() {
+		return false
+	}
+
+	if s.config.MaxBytes > 0 && file.Size()+int64(size) > s.config.MaxBytes {
+		return true
+	}
+
+	if s.config.Interval > 0 && now.Sub(s.opened) >= time.Duration(s.config.Interval*float64(time.Second)) {
+		return true
+	}
+
+	return false
+}
+
+func (s *Sink) writeHeaderLocked(file *File, now time.Time) error {
+	line, err := json.Marshal(emu.LogEntry{
+		Time:  now,
+		Event: EventHeader,
+		Data: Header{
+			Format:    FormatVersion,
+			Version:   Version(),
+			StartTime: s.startTime,
+			Config:    s.scenario,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *Sink) failLocked(err error) {
+	if s.lastErr == nil {
+		s.logger.Error(err, "can't write trace", "sink", s.config.Name)
+	}
+
+	s.errors++
+	s.lastErr = err
+}
+
+func (s *Sink) recoverLocked() {
+	if s.lastErr != nil {
+		s.logger.Info("trace sink recovered", "sink", s.config.Name, "errors", s.errors)
+	}
+
+	s.lastErr = nil
+}
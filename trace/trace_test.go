@@ -0,0 +1,193 @@
+package trace
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readEntries(t *testing.T, path string) []emu.LogEntry {
+	file, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if filepath.Ext(path) == ".gz" {
+		gz, err := gzip.NewReader(file)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		reader = gz
+	}
+
+	var entries []emu.LogEntry
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var entry emu.LogEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, scanner.Err())
+
+	return entries
+}
+
+func newEmulator(t *testing.T) *emu.Emulator {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(10))
+	return e
+}
+
+func TestSink_Filter(t *testing.T) {
+	dir := t.TempDir()
+	e := newEmulator(t)
+
+	all, err := New(e, Config{Path: filepath.Join(dir, "all.txt"), Header: true})
+	assert.NoError(t, err)
+	all.SetScenario(map[string]any{"freq": 868})
+
+	filtered, err := New(e, Config{Path: filepath.Join(dir, "filtered.txt"), Events: []emu.Event{emu.EventNodeAdded}, Nodes: []string{"2"}, Compression: "gzip"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, all.Start())
+	assert.NoError(t, filtered.Start())
+	assert.ErrorIs(t, all.Start(), ErrRunning)
+
+	assert.NoError(t, e.AddNode(emu.Node{ID: "1"}))
+	assert.NoError(t, e.AddNode(emu.Node{ID: "2"}))
+	assert.NoError(t, e.RemoveNode("2"))
+
+	for _, s := range []*Sink{all, filtered} {
+		assert.NoError(t, s.Stop())
+		s.Done()
+		assert.ErrorIs(t, s.Stop(), ErrNotRunning)
+		assert.NoError(t, s.Err())
+	}
+
+	entries := readEntries(t, filepath.Join(dir, "all.txt"))
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, EventHeader, entries[0].Event)
+
+		header := entries[0].Data.(map[string]any)
+		assert.Equal(t, float64(FormatVersion), header["format"])
+		assert.Equal(t, map[string]any{"freq": float64(868)}, header["config"])
+
+		assert.Equal(t, emu.EventNodeRemoved, entries[3].Event)
+	}
+
+	assert.Equal(t, filepath.Join(dir, "filtered.txt.gz"), filtered.Status().Path)
+
+	entries = readEntries(t, filepath.Join(dir, "filtered.txt.gz"))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, emu.EventNodeAdded, entries[0].Event)
+		assert.Equal(t, "2", entries[0].NodeID)
+	}
+}
+
+func TestSink_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs.txt")
+
+	// a log of a previous run isn't overwritten
+	assert.NoError(t, os.WriteFile(path, []byte("previous run\n"), 0666))
+
+	e := newEmulator(t)
+	s, err := New(e, Config{Path: path, MaxBytes: 800, MaxBackups: 3, Header: true})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		assert.NoError(t, e.AddNode(emu.Node{ID: id}))
+	}
+
+	assert.NoError(t, s.Stop())
+	s.Done()
+
+	status := s.Status()
+	assert.Equal(t, 8, status.Written)
+	assert.Greater(t, status.Rotated, 0)
+	assert.Zero(t, status.Errors)
+
+	backups, err := s.file.Backups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 3)
+
+	// every file starts with a header and stays below the size limit
+	for _, path := range append(backups, path) {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(800))
+
+		entries := readEntries(t, path)
+		if assert.NotEmpty(t, entries) {
+			assert.Equal(t, EventHeader, entries[0].Event)
+		}
+	}
+
+	entries := readEntries(t, path)
+	assert.Equal(t, "8", entries[len(entries)-1].NodeID)
+}
+
+func TestSink_Interval(t *testing.T) {
+	dir := t.TempDir()
+	e := newEmulator(t)
+
+	s, err := New(e, Config{Path: filepath.Join(dir, "logs.txt"), Interval: 60})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+
+	now := e.Now()
+	for _, offset := range []int{0, 30, 59, 60, 90, 130} {
+		s.write(s.file, emu.EventMessage{Time: now.Add(time.Duration(offset) * time.Second), Event: emu.EventNodeUpdated})
+	}
+
+	assert.NoError(t, s.Stop())
+	s.Done()
+
+	assert.Equal(t, 2, s.Status().Rotated)
+	assert.Len(t, readEntries(t, filepath.Join(dir, "logs.txt")), 1)
+}
+
+func TestSink_Errors(t *testing.T) {
+	dir := t.TempDir()
+	e := newEmulator(t)
+
+	_, err := New(e, Config{})
+	assert.Error(t, err)
+
+	_, err = New(e, Config{Path: "logs.txt", Compression: "lz4"})
+	assert.Error(t, err)
+
+	s, err := New(e, Config{Path: filepath.Join(dir, "missing", "logs.txt")})
+	assert.NoError(t, err)
+	assert.Error(t, s.Start())
+
+	// the rotation fails once the directory is gone
+	s, err = New(e, Config{Path: filepath.Join(dir, "sub", "logs.txt"), MaxBytes: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0777))
+	assert.NoError(t, s.Start())
+
+	assert.NoError(t, e.AddNode(emu.Node{ID: "1"}))
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "sub")))
+	assert.NoError(t, e.AddNode(emu.Node{ID: "2"}))
+
+	assert.NoError(t, s.Stop())
+	s.Done()
+
+	status := s.Status()
+	assert.Greater(t, status.Errors, 0)
+	assert.NotEmpty(t, status.LastError)
+	assert.Error(t, s.Err())
+}
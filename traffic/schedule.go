@@ -0,0 +1,73 @@
+package traffic
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ScheduleEntry represents a single transmission of a replayed schedule.
+type ScheduleEntry struct {
+	// Time is the offset in seconds from the start of the generator.
+	Time float64
+	// Node is the id of the sending node. If empty all selected nodes send.
+	Node string
+	// Payload overrides the payload template of the generator if set.
+	Payload *Template
+}
+
+// ParseSchedule parses a CSV schedule with the columns time, node and an optional payload template.
+// A header line is skipped. The entries are returned sorted by time.
+func ParseSchedule(reader io.Reader) ([]ScheduleEntry, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ScheduleEntry
+	for i, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least time and node", i+1)
+		}
+
+		offset, err := strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+		if err != nil {
+			// the first line can be a header
+			if i == 0 {
+				continue
+			}
+
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		entry := ScheduleEntry{
+			Time: offset,
+			Node: strings.TrimSpace(record[1]),
+		}
+
+		if len(record) > 2 && len(record[2]) > 0 {
+			payload, err := ParseTemplate(record[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+
+			entry.Payload = &payload
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time < entries[j].Time
+	})
+
+	return entries, nil
+}
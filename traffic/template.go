@@ -0,0 +1,90 @@
+package traffic
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// templatePart is either literal text or a placeholder of a payload template.
+type templatePart struct {
+	literal     []byte
+	placeholder string
+	size        int
+}
+
+// Template represents a parsed payload template. Placeholders are written in curly braces:
+//
+//   - {node} is replaced by the id of the sending node
+//   - {counter} is replaced by the decimal packet counter of the sending node, starting at 0
+//   - {random:N} is replaced by N random bytes
+//
+// All other text is sent as is.
+type Template struct {
+	parts []templatePart
+}
+
+// ParseTemplate parses a payload template.
+func ParseTemplate(template string) (Template, error) {
+	var parts []templatePart
+
+	for len(template) > 0 {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			parts = append(parts, templatePart{literal: []byte(template)})
+			break
+		}
+
+		if start > 0 {
+			parts = append(parts, templatePart{literal: []byte(template[:start])})
+		}
+
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return Template{}, errors.New("unclosed placeholder")
+		}
+
+		name := template[start+1 : start+end]
+		template = template[start+end+1:]
+
+		switch {
+		case name == "node" || name == "counter":
+			parts = append(parts, templatePart{placeholder: name})
+		case strings.HasPrefix(name, "random:"):
+			size, err := strconv.Atoi(strings.TrimPrefix(name, "random:"))
+			if err != nil || size < 0 {
+				return Template{}, fmt.Errorf("invalid random size in placeholder '%s'", name)
+			}
+
+			parts = append(parts, templatePart{placeholder: "random", size: size})
+		default:
+			return Template{}, fmt.Errorf("unknown placeholder '%s'", name)
+		}
+	}
+
+	return Template{parts: parts}, nil
+}
+
+// Render creates the payload for a node.
+func (t Template) Render(node string, counter int, rand *rand.Rand) []byte {
+	var payload []byte
+
+	for _, part := range t.parts {
+		switch part.placeholder {
+		case "":
+			payload = append(payload, part.literal...)
+		case "node":
+			payload = append(payload, node...)
+		case "counter":
+			payload = strconv.AppendInt(payload, int64(counter), 10)
+		case "random":
+			random := make([]byte, part.size)
+			_, _ = rand.Read(random)
+			payload = append(payload, random...)
+		}
+	}
+
+	return payload
+}
@@ -0,0 +1,430 @@
+// Package traffic implements declarative traffic generators that let emulator nodes send load without
+// any external process. Generators send periodically, with Poisson arrivals, in bursts or replay a
+// CSV schedule.
+package traffic
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BigJk/loraemu/emu"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Kind represents the arrival pattern of a generator.
+type Kind string
+
+const (
+	// KindPeriodic sends every Interval ± Jitter seconds.
+	KindPeriodic = Kind("periodic")
+	// KindPoisson sends with exponentially distributed inter-arrival times with Rate packets per second.
+	KindPoisson = Kind("poisson")
+	// KindBurst sends BurstSize packets spaced by BurstSpacing seconds every Interval ± Jitter seconds.
+	KindBurst = Kind("burst")
+	// KindSchedule replays the transmissions of a CSV schedule.
+	KindSchedule = Kind("schedule")
+)
+
+var (
+	ErrRunning    = errors.New("generator already running")
+	ErrNotRunning = errors.New("generator not running")
+)
+
+// Config represents the configuration of a traffic generator.
+type Config struct {
+	// Name identifies the generator in the REST API.
+	Name string `json:"name"`
+	Kind Kind   `json:"kind"`
+	// Nodes are the ids of the sending nodes.
+	Nodes []string `json:"nodes"`
+	// Tags selects all nodes that have any of the tags. If neither nodes nor tags are given all
+	// nodes that aren't gateways send.
+	Tags []string `json:"tags"`
+	// Interval is the time between packets or bursts in seconds. Defaults to 60.
+	Interval float64 `json:"interval"`
+	// Jitter is the maximum time in seconds the interval is randomly shortened or extended.
+	Jitter float64 `json:"jitter"`
+	// Rate is the mean number of packets per second and node of the Poisson arrivals.
+	Rate float64 `json:"rate"`
+	// BurstSize is the number of packets per burst. Defaults to 5.
+	BurstSize int `json:"burstSize"`
+	// BurstSpacing is the time between the packets of a burst in seconds. Defaults to 1.
+	BurstSpacing float64 `json:"burstSpacing"`
+	// Schedule is the path of the CSV schedule with the columns time, node and payload.
+	Schedule string `json:"schedule"`
+	// Loop restarts the schedule after the last entry.
+	Loop bool `json:"loop"`
+	// LoopPeriod is the time in seconds from the start of a pass of a looped schedule to the start of the next
+	// pass. It has to be greater than the time of the last entry.
+	LoopPeriod float64 `json:"loopPeriod"`
+	// Payload is the payload template. Defaults to 8 random bytes.
+	Payload string `json:"payload"`
+	// Seed for the random source. If 0 a time based seed will be used.
+	Seed int64 `json:"seed"`
+	// Stopped generators aren't started with the emulator but can be started via the REST API.
+	Stopped bool `json:"stopped"`
+}
+
+// Status represents the state of a generator.
+type Status struct {
+	Name    string   `json:"name"`
+	Kind    Kind     `json:"kind"`
+	Running bool     `json:"running"`
+	Nodes   []string `json:"nodes"`
+	Sent    int      `json:"sent"`
+	Errors  int      `json:"errors"`
+}
+
+// Generator represents a traffic generator.
+type Generator struct {
+	sync.Mutex
+
+	emu      *emu.Emulator
+	config   Config
+	logger   logr.Logger
+	payload  Template
+	schedule []ScheduleEntry
+	rand     *rand.Rand
+	counters map[string]int
+	nodes    []string
+	sent     int
+	errors   int
+	running  bool
+	done     chan bool
+	wg       sync.WaitGroup
+}
+
+// New creates a new traffic generator.
+func New(emulator *emu.Emulator, config Config) (*Generator, error) {
+	if len(config.Name) == 0 {
+		return nil, errors.New("name missing")
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = 60
+	}
+
+	if config.BurstSize <= 0 {
+		config.BurstSize = 5
+	}
+
+	if config.BurstSpacing <= 0 {
+		config.BurstSpacing = 1
+	}
+
+	if len(config.Payload) == 0 {
+		config.Payload = "{random:8}"
+	}
+
+	payload, err := ParseTemplate(config.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule []ScheduleEntry
+	switch config.Kind {
+	case KindPeriodic, KindBurst:
+	case KindPoisson:
+		if config.Rate <= 0 {
+			return nil, errors.New("rate missing")
+		}
+	case KindSchedule:
+		file, err := os.Open(config.Schedule)
+		if err != nil {
+			return nil, err
+		}
+
+		schedule, err = ParseSchedule(file)
+		_ = file.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Loop {
+			if len(schedule) == 0 {
+				return nil, errors.New("looped schedule has no entries")
+			}
+
+			if last := schedule[len(schedule)-1].Time; config.LoopPeriod <= last {
+				return nil, fmt.Errorf("loop period must be greater than the time of the last entry (%g s)", last)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown generator kind '%s'", config.Kind)
+	}
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Generator{
+		emu:      emulator,
+		config:   config,
+		logger:   logr.Discard(),
+		payload:  payload,
+		schedule: schedule,
+		rand:     rand.New(rand.NewSource(seed)),
+		counters: map[string]int{},
+	}, nil
+}
+
+// SetLogger sets the logger of the generator.
+func (g *Generator) SetLogger(logger logr.Logger) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.logger = logger
+}
+
+// Name returns the name of the generator.
+func (g *Generator) Name() string {
+	return g.config.Name
+}
+
+// Config returns the config of the generator.
+func (g *Generator) Config() Config {
+	return g.config
+}
+
+// Status returns the current state of the generator.
+func (g *Generator) Status() Status {
+	g.Lock()
+	defer g.Unlock()
+
+	return Status{
+		Name:    g.config.Name,
+		Kind:    g.config.Kind,
+		Running: g.running,
+		Nodes:   g.nodes,
+		Sent:    g.sent,
+		Errors:  g.errors,
+	}
+}
+
+// selectNodes returns the ids of the nodes that are selected by the config.
+func (g *Generator) selectNodes() []string {
+	if len(g.config.Nodes) == 0 && len(g.config.Tags) == 0 {
+		var ids []string
+		for _, node := range g.emu.Nodes() {
+			if !node.IsGateway() {
+				ids = append(ids, node.ID)
+			}
+		}
+		return ids
+	}
+
+	selected := map[string]bool{}
+	for _, id := range g.config.Nodes {
+		selected[id] = true
+	}
+
+	for _, node := range g.emu.Nodes() {
+		for _, tag := range g.config.Tags {
+			if node.HasTag(tag) {
+				selected[node.ID] = true
+			}
+		}
+	}
+
+	var ids []string
+	for _, node := range g.emu.NodeIDs() {
+		if selected[node] {
+			ids = append(ids, node)
+		}
+	}
+
+	return ids
+}
+
+func (g *Generator) float64() float64 {
+	g.Lock()
+	defer g.Unlock()
+
+	return g.rand.Float64()
+}
+
+// wait waits the given seconds of emulator time. It returns false if the generator is stopped.
+func (g *Generator) wait(seconds float64, done chan bool) bool {
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second) / float64(g.emu.GetTimeScaling()))):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// jittered returns the interval randomly shortened or extended by up to the jitter.
+func (g *Generator) jittered() float64 {
+	return g.config.Interval + (g.float64()*2-1)*g.config.Jitter
+}
+
+func (g *Generator) send(id string, template Template) {
+	g.Lock()
+	payload := template.Render(id, g.counters[id], g.rand)
+	g.counters[id]++
+	logger := g.logger
+	g.Unlock()
+
+	err := g.emu.SendMessage(id, payload)
+
+	g.Lock()
+	if err != nil {
+		g.errors++
+	} else {
+		g.sent++
+	}
+	g.Unlock()
+
+	if err != nil {
+		logger.Error(err, "traffic generator couldn't send", "generator", g.config.Name, "id", id)
+	}
+}
+
+func (g *Generator) runNode(id string, done chan bool) {
+	defer g.wg.Done()
+
+	switch g.config.Kind {
+	case KindPeriodic, KindBurst:
+		// start at a random phase so that not all nodes send at the same time
+		if !g.wait(g.float64()*g.config.Interval, done) {
+			return
+		}
+
+		for {
+			count := 1
+			if g.config.Kind == KindBurst {
+				count = g.config.BurstSize
+			}
+
+			for i := 0; i < count; i++ {
+				if i > 0 && !g.wait(g.config.BurstSpacing, done) {
+					return
+				}
+
+				g.send(id, g.payload)
+			}
+
+			if !g.wait(g.jittered(), done) {
+				return
+			}
+		}
+	case KindPoisson:
+		for {
+			g.Lock()
+			next := g.rand.ExpFloat64() / g.config.Rate
+			g.Unlock()
+
+			if !g.wait(next, done) {
+				return
+			}
+
+			g.send(id, g.payload)
+		}
+	}
+}
+
+func (g *Generator) runSchedule(nodes []string, done chan bool) {
+	defer g.wg.Done()
+
+	for {
+		last := 0.0
+		for _, entry := range g.schedule {
+			if !g.wait(entry.Time-last, done) {
+				return
+			}
+			last = entry.Time
+
+			template := g.payload
+			if entry.Payload != nil {
+				template = *entry.Payload
+			}
+
+			if len(entry.Node) > 0 {
+				g.send(entry.Node, template)
+				continue
+			}
+
+			for _, id := range nodes {
+				g.send(id, template)
+			}
+		}
+
+		if !g.config.Loop || len(g.schedule) == 0 {
+			break
+		}
+
+		// the next pass starts a full loop period after the start of this one
+		if !g.wait(g.config.LoopPeriod-last, done) {
+			return
+		}
+	}
+
+	// the schedule is finished, so the generator can be started again
+	g.Lock()
+	if g.done == done {
+		g.running = false
+	}
+	g.Unlock()
+}
+
+// Start starts the generator for the selected nodes.
+func (g *Generator) Start() error {
+	nodes := g.selectNodes()
+
+	g.Lock()
+	defer g.Unlock()
+
+	if g.running {
+		return ErrRunning
+	}
+
+	g.running = true
+	g.nodes = nodes
+	g.done = make(chan bool)
+
+	if g.config.Kind == KindSchedule {
+		g.wg.Add(1)
+		go g.runSchedule(nodes, g.done)
+	} else {
+		for _, id := range nodes {
+			g.wg.Add(1)
+			go g.runNode(id, g.done)
+		}
+	}
+
+	g.logger.Info("traffic generator started", "generator", g.config.Name, "kind", g.config.Kind, "nodes", len(nodes))
+
+	return nil
+}
+
+// Stop requests the stop of the generator. You need to .Done() after this to ensure graceful shutdown.
+func (g *Generator) Stop() error {
+	g.Lock()
+	defer g.Unlock()
+
+	if !g.running {
+		return ErrNotRunning
+	}
+
+	g.running = false
+	close(g.done)
+
+	g.logger.Info("traffic generator stopped", "generator", g.config.Name)
+
+	return nil
+}
+
+// Done waits for the generator to stop.
+func (g *Generator) Done() {
+	g.wg.Wait()
+}
@@ -0,0 +1,212 @@
+package traffic
+
+import (
+	"github.com/BigJk/loraemu/emu"
+	"github.com/BigJk/loraemu/lora"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplate(t *testing.T) {
+	template, err := ParseTemplate("{node}:{counter}:{random:4}!")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	payload := template.Render("Node1", 12, rand.New(rand.NewSource(1)))
+	assert.True(t, strings.HasPrefix(string(payload), "Node1:12:"))
+	assert.Len(t, payload, len("Node1:12:")+4+1)
+
+	_, err = ParseTemplate("{unknown}")
+	assert.Error(t, err)
+
+	_, err = ParseTemplate("{random:x}")
+	assert.Error(t, err)
+
+	_, err = ParseTemplate("{node")
+	assert.Error(t, err)
+}
+
+func TestParseSchedule(t *testing.T) {
+	entries, err := ParseSchedule(strings.NewReader("time,node,payload\n2.5,Node2,\n1,Node1,hello {counter}\n3,,\n"))
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 3) {
+		return
+	}
+
+	assert.Equal(t, 1.0, entries[0].Time)
+	assert.Equal(t, "Node1", entries[0].Node)
+	if assert.NotNil(t, entries[0].Payload) {
+		assert.Equal(t, []byte("hello 0"), entries[0].Payload.Render("Node1", 0, nil))
+	}
+
+	assert.Equal(t, "Node2", entries[1].Node)
+	assert.Nil(t, entries[1].Payload)
+	assert.Equal(t, "", entries[2].Node)
+
+	_, err = ParseSchedule(strings.NewReader("1,Node1\nx,Node2\n"))
+	assert.Error(t, err)
+}
+
+func newTestEmu(t *testing.T) (*emu.Emulator, *sync.Map) {
+	e := emu.New(868, 2, 1, 10, lora.PacketConfigDefault)
+	assert.NoError(t, e.SetTimeScaling(100))
+	e.SetIgnoreCollision(true)
+
+	nodes := []emu.Node{
+		{ID: "Node1", Tags: []string{"sensor"}},
+		{ID: "Node2", Tags: []string{"sensor"}},
+		{ID: "Node3"},
+		{ID: "Gateway1", Kind: emu.NodeKindGateway},
+	}
+
+	for i, node := range nodes {
+		node.Online = true
+		node.X = 1 + float64(i)*0.1
+		node.Y = 1
+		node.TXGain = 14
+		node.RXSens = -137
+		assert.NoError(t, e.AddNode(node))
+	}
+
+	sent := &sync.Map{}
+	e.SubscribeFunc(func(msg emu.EventMessage) {
+		count, _ := sent.LoadOrStore(msg.Node.ID, new(int))
+		*count.(*int)++
+	}, emu.EventSending)
+
+	return e, sent
+}
+
+func TestGenerator_Periodic(t *testing.T) {
+	e, sent := newTestEmu(t)
+
+	g, err := New(e, Config{Name: "periodic", Kind: KindPeriodic, Tags: []string{"sensor"}, Interval: 10, Jitter: 1, Payload: "{counter}"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, g.Start())
+	assert.ErrorIs(t, g.Start(), ErrRunning)
+	assert.ElementsMatch(t, []string{"Node1", "Node2"}, g.Status().Nodes)
+
+	// 10s interval with time scaling 100 is one packet every 100ms
+	time.Sleep(time.Millisecond * 550)
+
+	assert.NoError(t, g.Stop())
+	g.Done()
+	e.Wait()
+
+	assert.ErrorIs(t, g.Stop(), ErrNotRunning)
+
+	status := g.Status()
+	assert.False(t, status.Running)
+	assert.InDelta(t, 10, status.Sent, 4)
+
+	_, ok := sent.Load("Node3")
+	assert.False(t, ok, "node without tag sent")
+
+	// generators can be restarted
+	assert.NoError(t, g.Start())
+	assert.NoError(t, g.Stop())
+	g.Done()
+}
+
+func TestGenerator_Burst(t *testing.T) {
+	e, _ := newTestEmu(t)
+
+	g, err := New(e, Config{Name: "burst", Kind: KindBurst, Nodes: []string{"Node3"}, Interval: 10, BurstSize: 3, BurstSpacing: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the first burst starts within the first interval and takes 2s
+	assert.NoError(t, g.Start())
+	time.Sleep(time.Millisecond * 150)
+	assert.NoError(t, g.Stop())
+	g.Done()
+
+	assert.GreaterOrEqual(t, g.Status().Sent, 3)
+}
+
+func TestGenerator_Poisson(t *testing.T) {
+	e, _ := newTestEmu(t)
+
+	_, err := New(e, Config{Name: "poisson", Kind: KindPoisson})
+	assert.Error(t, err, "rate is required")
+
+	g, err := New(e, Config{Name: "poisson", Kind: KindPoisson, Nodes: []string{"Node1"}, Rate: 0.5, Seed: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, g.Start())
+	time.Sleep(time.Millisecond * 500)
+	assert.NoError(t, g.Stop())
+	g.Done()
+
+	// 50s of emulator time with 0.5 packets per second
+	assert.InDelta(t, 25, g.Status().Sent, 15)
+}
+
+func TestGenerator_Schedule(t *testing.T) {
+	e, sent := newTestEmu(t)
+
+	path := filepath.Join(t.TempDir(), "schedule.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("time,node,payload\n0,Node1,a\n1,Node2,b\n2,,c\n"), 0666))
+
+	g, err := New(e, Config{Name: "schedule", Kind: KindSchedule, Schedule: path, Tags: []string{"sensor"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, g.Start())
+	g.Done()
+
+	status := g.Status()
+	assert.False(t, status.Running, "finished schedule stops the generator")
+	assert.Equal(t, 4, status.Sent)
+
+	count, _ := sent.Load("Node1")
+	if assert.NotNil(t, count) {
+		assert.Equal(t, 2, *count.(*int))
+	}
+}
+
+func TestGenerator_ScheduleLoop(t *testing.T) {
+	e, sent := newTestEmu(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "schedule.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("0,Node1,a\n"), 0666))
+
+	empty := filepath.Join(dir, "empty.csv")
+	assert.NoError(t, os.WriteFile(empty, []byte("time,node,payload\n"), 0666))
+
+	// a looped schedule without a period or entries would send in a tight loop
+	_, err := New(e, Config{Name: "schedule", Kind: KindSchedule, Schedule: path, Loop: true})
+	assert.Error(t, err)
+	_, err = New(e, Config{Name: "schedule", Kind: KindSchedule, Schedule: empty, Loop: true, LoopPeriod: 1})
+	assert.Error(t, err)
+
+	g, err := New(e, Config{Name: "schedule", Kind: KindSchedule, Schedule: path, Loop: true, LoopPeriod: 20})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// a pass every 200ms at 100x
+	assert.NoError(t, g.Start())
+	time.Sleep(500 * time.Millisecond)
+	assert.NoError(t, g.Stop())
+
+	count, _ := sent.Load("Node1")
+	if assert.NotNil(t, count) {
+		assert.Equal(t, 3, *count.(*int))
+	}
+}